@@ -0,0 +1,138 @@
+package golsm
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+var ErrNotResumable = errors.New("background error is not recoverable, reopen the lsm tree")
+
+// 后台错误的来源
+type BackgroundErrorReason int
+
+const (
+	BackgroundErrorFlush      BackgroundErrorReason = iota + 1 // memtable 溢写
+	BackgroundErrorCompaction                                  // level 层之间的 compact
+	BackgroundErrorRemoveFile                                  // 删除已经失效的 sst 文件或者预写日志
+	BackgroundErrorWAL                                         // 切换 memtable 时创建或者持久化预写日志
+	BackgroundErrorVersion                                     // 记录文件版本
+	BackgroundErrorMemTable                                    // 将已经写入预写日志的数据应用到 memtable
+)
+
+func (r BackgroundErrorReason) String() string {
+	switch r {
+	case BackgroundErrorFlush:
+		return "flush"
+	case BackgroundErrorCompaction:
+		return "compaction"
+	case BackgroundErrorRemoveFile:
+		return "remove file"
+	case BackgroundErrorWAL:
+		return "wal"
+	case BackgroundErrorVersion:
+		return "version"
+	case BackgroundErrorMemTable:
+		return "memtable"
+	default:
+		return "unknown"
+	}
+}
+
+// 后台流程中出现的错误. 出现后台错误后 lsm tree 进入只读状态，写入均返回该错误，溢写以及 compact 流程暂停
+type BackgroundError struct {
+	Reason BackgroundErrorReason
+	Err    error
+}
+
+func (e *BackgroundError) Error() string {
+	return fmt.Sprintf("background %s error: %v", e.Reason, e.Err)
+}
+
+func (e *BackgroundError) Unwrap() error {
+	return e.Err
+}
+
+// 能否通过 Resume 恢复. 溢写以及 compact 失败时不会留下不一致的状态，磁盘空间不足等错误在释放出空间之后重试即可；
+// 其余流程失败时，内存状态与磁盘文件已经无法衔接，只能处理后重新打开 lsm tree
+func (e *BackgroundError) Recoverable() bool {
+	if e.Reason != BackgroundErrorFlush && e.Reason != BackgroundErrorCompaction {
+		return false
+	}
+	return errors.Is(e.Err, syscall.ENOSPC) || errors.Is(e.Err, syscall.EDQUOT)
+}
+
+// lsm tree 的事件监听器. 回调在后台协程中同步执行，不能阻塞
+type EventListener interface {
+	// 后台流程出现错误，lsm tree 进入只读状态
+	OnBackgroundError(err *BackgroundError)
+	// 通过 Resume 从后台错误中恢复
+	OnErrorRecovered(err *BackgroundError)
+}
+
+// 记录后台错误并通知监听器. 已经存在后台错误时保留最早的错误，返回当前的后台错误
+func (t *Tree) setBackgroundError(reason BackgroundErrorReason, err error) error {
+	t.bgErrLock.Lock()
+	if t.bgErr != nil {
+		bgErr := t.bgErr
+		t.bgErrLock.Unlock()
+		return bgErr
+	}
+	bgErr := &BackgroundError{Reason: reason, Err: err}
+	t.bgErr = bgErr
+	t.bgErrLock.Unlock()
+
+	if listener := t.conf.EventListener; listener != nil {
+		listener.OnBackgroundError(bgErr)
+	}
+	return bgErr
+}
+
+// 获取后台错误. 不存在后台错误时返回 nil
+func (t *Tree) BackgroundError() error {
+	t.bgErrLock.Lock()
+	defer t.bgErrLock.Unlock()
+	if t.bgErr == nil {
+		return nil
+	}
+	return t.bgErr
+}
+
+// 从可以恢复的后台错误中恢复: 清除后台错误，重新溢写积压的只读 memtable，并重新检查各层是否需要 compact.
+// 不存在后台错误时直接返回 nil；错误无法恢复时返回 ErrNotResumable，此时需要重新打开 lsm tree
+func (t *Tree) Resume() error {
+	// 在 dataLock 的保护下检查关闭状态，保证 lsm tree 关闭之前 compact 协程仍在运行
+	t.dataLock.RLock()
+	defer t.dataLock.RUnlock()
+	if err := t.checkOpen(); err != nil {
+		return err
+	}
+
+	t.bgErrLock.Lock()
+	bgErr := t.bgErr
+	if bgErr == nil {
+		t.bgErrLock.Unlock()
+		return nil
+	}
+	if !bgErr.Recoverable() {
+		t.bgErrLock.Unlock()
+		return ErrNotResumable
+	}
+	t.bgErr = nil
+	t.bgErrLock.Unlock()
+
+	if listener := t.conf.EventListener; listener != nil {
+		listener.OnErrorRecovered(bgErr)
+	}
+
+	// 暂停期间积压的只读 memtable 重新交由 compact 协程溢写. compact 协程总是溢写最早的只读 memtable
+	for _, item := range t.rOnlyMemTable {
+		t.notifyMemCompact(item)
+	}
+	for _, cf := range t.cfs {
+		for level := 0; level < len(cf.nodes); level++ {
+			cf.tryTriggerCompact(level)
+		}
+	}
+	return nil
+}
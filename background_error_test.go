@@ -0,0 +1,313 @@
+package golsm
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xiaoxuxiansheng/golsm/vfs"
+)
+
+type testEventListener struct {
+	sync.Mutex
+	errs      []*BackgroundError
+	recovered []*BackgroundError
+}
+
+func (l *testEventListener) OnBackgroundError(err *BackgroundError) {
+	l.Lock()
+	defer l.Unlock()
+	l.errs = append(l.errs, err)
+}
+
+func (l *testEventListener) OnErrorRecovered(err *BackgroundError) {
+	l.Lock()
+	defer l.Unlock()
+	l.recovered = append(l.recovered, err)
+}
+
+func Test_Tree_BackgroundError(t *testing.T) {
+	listener := &testEventListener{}
+	conf, err := NewConfig(t.TempDir(),
+		WithSSTSize(4*1024),
+		WithSSTDataBlockSize(512),
+		WithEventListener(listener),
+	)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	lsmTree, err := NewTree(conf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer lsmTree.Close()
+
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, lsmTree.Put([]byte(fmt.Sprintf("key_%d", i)), []byte("value")))
+	}
+
+	// 1 在溢写的目标路径上放置一个目录，使得 memtable 溢写失败
+	blocker := path.Join(conf.Dir, "0_1.sst")
+	if err = os.Mkdir(blocker, 0755); err != nil {
+		t.Error(err)
+		return
+	}
+	lsmTree.dataLock.Lock()
+	lsmTree.refreshMemTableLocked()
+	lsmTree.dataLock.Unlock()
+	for lsmTree.BackgroundError() == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var bgErr *BackgroundError
+	assert.True(t, errors.As(lsmTree.BackgroundError(), &bgErr))
+	assert.Equal(t, BackgroundErrorFlush, bgErr.Reason)
+	listener.Lock()
+	assert.Equal(t, []*BackgroundError{bgErr}, listener.errs)
+	listener.Unlock()
+
+	// 2 出现后台错误后拒绝写入，只读 memtable 中的数据仍然可读
+	assert.Equal(t, bgErr, lsmTree.Put([]byte("key_new"), []byte("value")))
+	value, ok, err := lsmTree.Get([]byte("key_0"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "value", string(value))
+
+	// 3 无法恢复的错误需要重新打开 lsm tree
+	assert.Equal(t, ErrNotResumable, lsmTree.Resume())
+
+	// 4 磁盘空间不足的错误在释放空间后可以恢复，积压的只读 memtable 重新溢写
+	assert.Nil(t, os.Remove(blocker))
+	lsmTree.bgErrLock.Lock()
+	lsmTree.bgErr = &BackgroundError{Reason: BackgroundErrorFlush, Err: &os.PathError{Op: "write", Path: blocker, Err: syscall.ENOSPC}}
+	lsmTree.bgErrLock.Unlock()
+	assert.Nil(t, lsmTree.Resume())
+	assert.Nil(t, lsmTree.BackgroundError())
+	waitMemTableFlushed(lsmTree)
+	_, err = os.Stat(blocker)
+	assert.Nil(t, err)
+	listener.Lock()
+	assert.Len(t, listener.recovered, 1)
+	listener.Unlock()
+
+	assert.Nil(t, lsmTree.Put([]byte("key_new"), []byte("value")))
+	assert.Nil(t, lsmTree.Resume())
+}
+
+// 在文件系统操作上挂载钩子的文件系统. hook 返回非 nil 的错误时，对应的操作直接返回该错误
+type hookFS struct {
+	vfs.FS
+	hook func(op, name string) error
+}
+
+func (fs *hookFS) wrap(name string, f vfs.File, err error) (vfs.File, error) {
+	if err != nil {
+		return nil, err
+	}
+	return &hookFile{File: f, fs: fs, name: name}, nil
+}
+
+func (fs *hookFS) Create(name string) (vfs.File, error) {
+	if err := fs.hook("create", name); err != nil {
+		return nil, err
+	}
+	f, err := fs.FS.Create(name)
+	return fs.wrap(name, f, err)
+}
+
+func (fs *hookFS) OpenAppend(name string) (vfs.File, error) {
+	if err := fs.hook("create", name); err != nil {
+		return nil, err
+	}
+	f, err := fs.FS.OpenAppend(name)
+	return fs.wrap(name, f, err)
+}
+
+func (fs *hookFS) Rename(oldname, newname string) error {
+	if err := fs.hook("rename", newname); err != nil {
+		return err
+	}
+	return fs.FS.Rename(oldname, newname)
+}
+
+func (fs *hookFS) Remove(name string) error {
+	if err := fs.hook("remove", name); err != nil {
+		return err
+	}
+	return fs.FS.Remove(name)
+}
+
+func (fs *hookFS) SyncDir(dir string) error {
+	if err := fs.hook("syncdir", dir); err != nil {
+		return err
+	}
+	return vfs.SyncDir(fs.FS, dir)
+}
+
+type hookFile struct {
+	vfs.File
+	fs   *hookFS
+	name string
+}
+
+func (f *hookFile) Write(p []byte) (int, error) {
+	if err := f.fs.hook("write", f.name); err != nil {
+		return 0, err
+	}
+	return f.File.Write(p)
+}
+
+func (f *hookFile) Sync() error {
+	if err := f.fs.hook("sync", f.name); err != nil {
+		return err
+	}
+	return f.File.Sync()
+}
+
+func Test_Tree_BackgroundError_WAL(t *testing.T) {
+	var failWAL atomic.Bool
+	fs := &hookFS{FS: vfs.NewMem(), hook: func(op, name string) error {
+		if op == "write" && path.Ext(name) == ".wal" && failWAL.Load() {
+			return &os.PathError{Op: op, Path: name, Err: syscall.EIO}
+		}
+		return nil
+	}}
+	conf, err := NewConfig("db", WithFS(fs))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	lsmTree, err := NewTree(conf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer lsmTree.Close()
+	assert.Nil(t, lsmTree.Put([]byte("key_0"), []byte("value")))
+
+	// 1 预写日志写入失败时，末尾可能残留不完整的记录，记录为无法恢复的后台错误
+	failWAL.Store(true)
+	err = lsmTree.Put([]byte("key_1"), []byte("value"))
+	var bgErr *BackgroundError
+	assert.True(t, errors.As(err, &bgErr))
+	assert.Equal(t, BackgroundErrorWAL, bgErr.Reason)
+	assert.True(t, errors.Is(err, syscall.EIO))
+	assert.False(t, bgErr.Recoverable())
+
+	// 2 此后即使磁盘恢复正常，写入仍然被拒绝
+	failWAL.Store(false)
+	assert.Equal(t, bgErr, lsmTree.Put([]byte("key_2"), []byte("value")))
+	assert.Equal(t, ErrNotResumable, lsmTree.Resume())
+	value, ok, err := lsmTree.Get([]byte("key_0"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "value", string(value))
+}
+
+func Test_Tree_BackgroundError_Version(t *testing.T) {
+	var failVersion atomic.Bool
+	fs := &hookFS{FS: vfs.NewMem(), hook: func(op, name string) error {
+		if op == "rename" && path.Base(name) == versionFileName && failVersion.Load() {
+			return &os.PathError{Op: op, Path: name, Err: syscall.EIO}
+		}
+		return nil
+	}}
+	conf, err := NewConfig("db", WithFS(fs))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	lsmTree, err := NewTree(conf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, lsmTree.Put([]byte(fmt.Sprintf("key_%d", i)), []byte("value")))
+	}
+
+	// 1 溢写之后文件版本记录失败，记录为无法恢复的后台错误
+	failVersion.Store(true)
+	walFile := lsmTree.walFile()
+	lsmTree.dataLock.Lock()
+	lsmTree.refreshMemTableLocked()
+	lsmTree.dataLock.Unlock()
+	for lsmTree.BackgroundError() == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+	var bgErr *BackgroundError
+	assert.True(t, errors.As(lsmTree.BackgroundError(), &bgErr))
+	assert.Equal(t, BackgroundErrorVersion, bgErr.Reason)
+	assert.False(t, bgErr.Recoverable())
+
+	// 2 溢写的数据没有记录在文件版本中，对应的预写日志需要保留
+	_, err = fs.Stat(walFile)
+	assert.Nil(t, err)
+	failVersion.Store(false)
+	_ = lsmTree.Close()
+
+	// 3 重启后回放保留的预写日志，数据完整
+	if lsmTree, err = NewTree(conf); err != nil {
+		t.Error(err)
+		return
+	}
+	defer lsmTree.Close()
+	for i := 0; i < 10; i++ {
+		value, ok, err := lsmTree.Get([]byte(fmt.Sprintf("key_%d", i)))
+		assert.Nil(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, "value", string(value))
+	}
+}
+
+func Test_Tree_BackgroundError_MemTable(t *testing.T) {
+	listener := &testEventListener{}
+	conf, err := NewConfig(t.TempDir(),
+		WithSSTSize(4*1024),
+		WithSSTDataBlockSize(512),
+		WithEventListener(listener),
+		WithMergeOperator(NewStringAppendOperator([]byte(","))),
+	)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	lsmTree, err := NewTree(conf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer lsmTree.Close()
+
+	// memtable 中的记录已经损坏，merge 操作数写入预写日志之后无法与其叠加
+	lsmTree.dataLock.Lock()
+	lsmTree.DefaultColumnFamily().memTable.Put([]byte("key_0"), nil)
+	lsmTree.dataLock.Unlock()
+	cf := lsmTree.DefaultColumnFamily()
+	batch := NewWriteBatch()
+	batch.Put(cf, []byte("key_1"), []byte("value"))
+	batch.Merge(cf, []byte("key_0"), []byte("operand"))
+	err = lsmTree.Write(batch)
+
+	// 批量写入只应用了一部分，记录为无法恢复的后台错误，此后拒绝写入
+	var bgErr *BackgroundError
+	assert.True(t, errors.As(err, &bgErr))
+	assert.Equal(t, BackgroundErrorMemTable, bgErr.Reason)
+	assert.Equal(t, bgErr, lsmTree.BackgroundError())
+	listener.Lock()
+	assert.Equal(t, []*BackgroundError{bgErr}, listener.errs)
+	listener.Unlock()
+	assert.Equal(t, bgErr, lsmTree.Put([]byte("key_2"), []byte("value")))
+	assert.Equal(t, ErrNotResumable, lsmTree.Resume())
+}
@@ -0,0 +1,432 @@
+package backup
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xiaoxuxiansheng/golsm"
+	"github.com/xiaoxuxiansheng/golsm/vfs"
+)
+
+var (
+	ErrBackupNotFound   = errors.New("backup not found")
+	ErrBackupCorrupted  = errors.New("backup corrupted")
+	ErrTargetDirExists  = errors.New("restore target directory already exists")
+	ErrInvalidKeepCount = errors.New("keep count must be positive")
+)
+
+// 备份目录下的子目录
+const (
+	sharedDir  = "shared"  // 多个备份共享的 sst 文件以及 blob 文件
+	privateDir = "private" // 各备份独有的文件，例如预写日志
+	metaDir    = "meta"    // 各备份的元信息
+	tmpDir     = "tmp"     // 生成备份过程中使用的临时目录
+)
+
+// crc32 校验和使用的多项式
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// 备份的元信息
+type BackupInfo struct {
+	ID        uint64       `json:"id"`        // 备份编号，单调递增
+	Timestamp time.Time    `json:"timestamp"` // 备份生成的时间
+	Seq       uint64       `json:"seq"`       // 备份对应的 lsm tree 最新序列号
+	Size      int64        `json:"size"`      // 备份中全部文件的大小之和，单位 byte. 共享的文件也计算在内
+	Files     []BackupFile `json:"files"`     // 备份中的全部文件
+}
+
+// 备份中的一个文件
+type BackupFile struct {
+	Name     string `json:"name"`     // 相对于 lsm tree 目录的路径，以 / 分隔
+	Path     string `json:"path"`     // 相对于备份目录的存放路径，以 / 分隔
+	Size     int64  `json:"size"`     // 文件大小，单位 byte
+	Checksum uint32 `json:"checksum"` // 文件内容的 crc32 校验和
+}
+
+// 以 lsm tree 检查点为基础的增量备份. sst 文件以及 blob 文件写入后不再修改，在多个备份之间共享，
+// 生成新备份时只复制此前的备份中没有的文件. 共享文件被引用的次数由全部备份的元信息得出，不再被任何备份引用时删除
+type Engine struct {
+	dir  string
+	fs   vfs.FS
+	lock sync.Mutex
+}
+
+// 备份引擎配置项
+type EngineOption func(*Engine)
+
+// 备份目录所在的文件系统. 生成备份时检查点会写入 lsm tree 所在的文件系统，因此需要与 lsm tree 使用同一个文件系统.
+// 默认使用操作系统的文件系统
+func WithFS(fs vfs.FS) EngineOption {
+	return func(e *Engine) {
+		e.fs = fs
+	}
+}
+
+// 基于备份目录构造备份引擎，目录不存在时创建
+func NewEngine(dir string, opts ...EngineOption) (*Engine, error) {
+	e := Engine{dir: dir}
+	for _, opt := range opts {
+		opt(&e)
+	}
+	if e.fs == nil {
+		e.fs = vfs.Default
+	}
+	for _, sub := range []string{sharedDir, privateDir, metaDir} {
+		if err := e.fs.MkdirAll(path.Join(dir, sub)); err != nil {
+			return nil, err
+		}
+	}
+	return &e, nil
+}
+
+// 为 lsm tree 生成一个新的备份，存放在 backupDir 目录下
+func CreateBackup(tree *golsm.Tree, backupDir string, opts ...EngineOption) (*BackupInfo, error) {
+	engine, err := NewEngine(backupDir, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return engine.CreateBackup(tree)
+}
+
+// 为 lsm tree 生成一个新的备份
+func (e *Engine) CreateBackup(tree *golsm.Tree) (*BackupInfo, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	// 元信息损坏的备份同样占用编号，避免新备份复用其独有目录下残留的文件
+	_, lastID, err := e.listBackups()
+	if err != nil {
+		return nil, err
+	}
+	info := BackupInfo{ID: lastID + 1, Timestamp: time.Now()}
+
+	// 1 生成检查点. 检查点中的文件与 lsm tree 共享硬链接，代价很小
+	checkpointDir := path.Join(e.dir, tmpDir, strconv.FormatUint(info.ID, 10))
+	if err = e.fs.RemoveAll(checkpointDir); err != nil {
+		return nil, err
+	}
+	if err = e.fs.MkdirAll(path.Dir(checkpointDir)); err != nil {
+		return nil, err
+	}
+	if err = tree.Checkpoint(checkpointDir); err != nil {
+		return nil, err
+	}
+	defer e.fs.RemoveAll(checkpointDir)
+	manifest, err := golsm.ReadManifest(e.fs, checkpointDir)
+	if err != nil {
+		return nil, err
+	}
+	info.Seq = manifest.Seq
+
+	// 2 sst 文件以及 blob 文件按照校验和存放在共享目录下，此前的备份中已经存在时无需复制. 预写日志存放在备份独有的目录下.
+	// 检查点中的文件与 lsm tree 共享硬链接，需要复制一份，避免备份受到 lsm tree 所在磁盘的影响
+	for _, f := range manifest.Files {
+		src := path.Join(checkpointDir, f.Name)
+		checksum, err := checksumFile(e.fs, src)
+		if err != nil {
+			return nil, err
+		}
+		file := BackupFile{Name: f.Name, Size: f.Size, Checksum: checksum}
+		if shareable(f.Name) {
+			file.Path = path.Join(sharedDir, fmt.Sprintf("%08x_%d_%s", checksum, f.Size, strings.ReplaceAll(f.Name, "/", "_")))
+		} else {
+			file.Path = path.Join(privateDir, strconv.FormatUint(info.ID, 10), f.Name)
+		}
+		if err = e.storeFile(src, &file); err != nil {
+			return nil, err
+		}
+		info.Files = append(info.Files, file)
+		info.Size += f.Size
+	}
+
+	// 3 元信息写入完成后，备份才算生成
+	if err = e.writeInfo(&info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// 将文件复制到备份目录下，已经存在时跳过. 先复制到临时文件，校验和一致后再重命名
+func (e *Engine) storeFile(src string, file *BackupFile) error {
+	dest := path.Join(e.dir, file.Path)
+	if _, err := e.fs.Stat(dest); err == nil || !os.IsNotExist(err) {
+		return err
+	}
+	if err := e.fs.MkdirAll(path.Dir(dest)); err != nil {
+		return err
+	}
+	checksum, err := copyFile(e.fs, src, dest+".tmp")
+	if err != nil {
+		_ = e.fs.Remove(dest + ".tmp")
+		return err
+	}
+	if checksum != file.Checksum {
+		_ = e.fs.Remove(dest + ".tmp")
+		return fmt.Errorf("%w: %s: checksum mismatch", ErrBackupCorrupted, file.Name)
+	}
+	return renameDurable(e.fs, dest+".tmp", dest)
+}
+
+// 列出全部备份，按照编号由小到大排列. 元信息损坏的备份不在其中，可以通过 VerifyBackup 得知
+func (e *Engine) ListBackups() ([]*BackupInfo, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	backups, _, err := e.listBackups()
+	return backups, err
+}
+
+// 只保留最新的 keep 个备份，删除其余的备份以及不再被任何备份引用的共享文件
+func (e *Engine) PurgeOldBackups(keep int) error {
+	if keep <= 0 {
+		return ErrInvalidKeepCount
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	backups, _, err := e.listBackups()
+	if err != nil {
+		return err
+	}
+	if len(backups) <= keep {
+		return nil
+	}
+
+	// 先删除元信息，保证中途退出时不会留下不完整的备份
+	for _, info := range backups[:len(backups)-keep] {
+		if err = e.fs.Remove(e.infoFile(info.ID)); err != nil {
+			return err
+		}
+		if err = e.fs.RemoveAll(path.Join(e.dir, privateDir, strconv.FormatUint(info.ID, 10))); err != nil {
+			return err
+		}
+	}
+	return e.removeUnreferenced(backups[len(backups)-keep:])
+}
+
+// 删除共享目录下没有被 backups 引用的文件
+func (e *Engine) removeUnreferenced(backups []*BackupInfo) error {
+	refs := make(map[string]int)
+	for _, info := range backups {
+		for _, f := range info.Files {
+			refs[f.Path]++
+		}
+	}
+
+	names, err := e.fs.List(path.Join(e.dir, sharedDir))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		p := path.Join(sharedDir, name)
+		if refs[p] > 0 {
+			continue
+		}
+		if err = e.fs.Remove(path.Join(e.dir, p)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 校验备份中的全部文件是否存在，并且校验和与生成备份时一致
+func (e *Engine) VerifyBackup(id uint64) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	info, err := e.readInfo(id)
+	if err != nil {
+		return err
+	}
+	for _, f := range info.Files {
+		checksum, err := checksumFile(e.fs, path.Join(e.dir, f.Path))
+		if err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrBackupCorrupted, f.Name, err)
+		}
+		if checksum != f.Checksum {
+			return fmt.Errorf("%w: %s: checksum mismatch", ErrBackupCorrupted, f.Name)
+		}
+	}
+	return nil
+}
+
+// 将备份恢复到 targetDir 目录下，恢复后可以直接通过 golsm.NewTree 打开. targetDir 不能已经存在
+func (e *Engine) RestoreBackup(id uint64, targetDir string) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if _, err := e.fs.Stat(targetDir); err == nil {
+		return ErrTargetDirExists
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	info, err := e.readInfo(id)
+	if err != nil {
+		return err
+	}
+
+	// 先恢复到临时目录，复制的同时校验文件内容，全部完成后再重命名
+	restoreDir := targetDir + ".tmp"
+	if err = e.fs.RemoveAll(restoreDir); err != nil {
+		return err
+	}
+	if err = e.restoreFiles(info, restoreDir); err != nil {
+		_ = e.fs.RemoveAll(restoreDir)
+		return err
+	}
+	if err = renameDurable(e.fs, restoreDir, targetDir); err != nil {
+		_ = e.fs.RemoveAll(restoreDir)
+		return err
+	}
+	return nil
+}
+
+func (e *Engine) restoreFiles(info *BackupInfo, restoreDir string) error {
+	// lsm tree 目录下的预写日志目录需要存在
+	dirs := map[string]bool{restoreDir: true, path.Join(restoreDir, "walfile"): true}
+	if err := e.fs.MkdirAll(path.Join(restoreDir, "walfile")); err != nil {
+		return err
+	}
+	for _, f := range info.Files {
+		dest := path.Join(restoreDir, f.Name)
+		if err := e.fs.MkdirAll(path.Dir(dest)); err != nil {
+			return err
+		}
+		dirs[path.Dir(dest)] = true
+		checksum, err := copyFile(e.fs, path.Join(e.dir, f.Path), dest)
+		if err != nil {
+			return err
+		}
+		if checksum != f.Checksum {
+			return fmt.Errorf("%w: %s: checksum mismatch", ErrBackupCorrupted, f.Name)
+		}
+	}
+
+	// 文件均已持久化，再持久化其所在的目录
+	for dir := range dirs {
+		if err := vfs.SyncDir(e.fs, dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 读取全部元信息完好的备份，按照编号由小到大排列，同时返回包括元信息损坏的备份在内的最大编号
+func (e *Engine) listBackups() ([]*BackupInfo, uint64, error) {
+	names, err := e.fs.List(path.Join(e.dir, metaDir))
+	if err != nil {
+		return nil, 0, err
+	}
+	var lastID uint64
+	backups := make([]*BackupInfo, 0, len(names))
+	for _, name := range names {
+		id, err := strconv.ParseUint(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		if id > lastID {
+			lastID = id
+		}
+		info, err := e.readInfo(id)
+		if errors.Is(err, ErrBackupCorrupted) {
+			continue
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		backups = append(backups, info)
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].ID < backups[j].ID
+	})
+	return backups, lastID, nil
+}
+
+func (e *Engine) infoFile(id uint64) string {
+	return path.Join(e.dir, metaDir, strconv.FormatUint(id, 10))
+}
+
+func (e *Engine) readInfo(id uint64) (*BackupInfo, error) {
+	raw, err := vfs.ReadFile(e.fs, e.infoFile(id))
+	if os.IsNotExist(err) {
+		return nil, ErrBackupNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var info BackupInfo
+	if err = json.Unmarshal(raw, &info); err != nil {
+		return nil, fmt.Errorf("%w: meta %d: %v", ErrBackupCorrupted, id, err)
+	}
+	return &info, nil
+}
+
+// 先写入临时文件并持久化，再重命名，保证元信息要么完整存在，要么不存在
+func (e *Engine) writeInfo(info *BackupInfo) error {
+	raw, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	file := e.infoFile(info.ID)
+	if err = vfs.WriteFile(e.fs, file+".tmp", raw); err != nil {
+		return err
+	}
+	return renameDurable(e.fs, file+".tmp", file)
+}
+
+// 重命名已经持久化的临时文件，并持久化所在的目录，保证崩溃后重命名不会丢失
+func renameDurable(fs vfs.FS, tmp, file string) error {
+	if err := fs.Rename(tmp, file); err != nil {
+		return err
+	}
+	return vfs.SyncDir(fs, path.Dir(file))
+}
+
+// sst 文件以及 blob 文件写入后不再修改，可以在备份之间共享
+func shareable(name string) bool {
+	return strings.HasSuffix(name, ".sst") || strings.HasSuffix(name, ".blob")
+}
+
+func checksumFile(fs vfs.FS, file string) (uint32, error) {
+	f, err := fs.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	h := crc32.New(crcTable)
+	if _, err = io.Copy(h, f); err != nil {
+		return 0, err
+	}
+	return h.Sum32(), nil
+}
+
+// 复制文件并持久化，返回文件内容的校验和
+func copyFile(fs vfs.FS, src, dest string) (uint32, error) {
+	in, err := fs.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	out, err := fs.Create(dest)
+	if err != nil {
+		return 0, err
+	}
+	h := crc32.New(crcTable)
+	if _, err = io.Copy(io.MultiWriter(out, h), in); err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return h.Sum32(), err
+}
@@ -0,0 +1,309 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xiaoxuxiansheng/golsm"
+	"github.com/xiaoxuxiansheng/golsm/vfs"
+)
+
+func newTestConfig(t *testing.T, dir string) *golsm.Config {
+	conf, err := golsm.NewConfig(dir,
+		golsm.WithSSTSize(4*1024),
+		golsm.WithSSTDataBlockSize(512),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conf
+}
+
+func putRange(t *testing.T, tree *golsm.Tree, start, end int, value string) {
+	for i := start; i < end; i++ {
+		if err := tree.Put([]byte(fmt.Sprintf("key_%04d", i)), []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// 等待只读 memtable 全部溢写落盘. 溢写完成后对应的预写日志会被删除，只剩下读写 memtable 的预写日志
+func waitFlushed(t *testing.T, dir string) {
+	for {
+		entries, err := os.ReadDir(path.Join(dir, "walfile"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) <= 1 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// 校验 dir 下的 lsm tree 中恰好包含 expect 中的数据
+func checkTree(t *testing.T, dir string, expect map[string]string) {
+	tree, err := golsm.NewTree(newTestConfig(t, dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	iter, err := tree.NewIterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer iter.Close()
+	var cnt int
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+		assert.Equal(t, expect[string(iter.Key())], string(iter.Value()), string(iter.Key()))
+		cnt++
+	}
+	assert.Equal(t, len(expect), cnt)
+}
+
+func sharedFiles(t *testing.T, backupDir string) map[string]bool {
+	entries, err := os.ReadDir(path.Join(backupDir, sharedDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]bool)
+	for _, entry := range entries {
+		files[entry.Name()] = true
+	}
+	return files
+}
+
+func Test_Backup(t *testing.T) {
+	treeDir := t.TempDir()
+	tree, err := golsm.NewTree(newTestConfig(t, treeDir))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer tree.Close()
+
+	backupDir := t.TempDir()
+	engine, err := NewEngine(backupDir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// 1 生成首个备份
+	expect1 := make(map[string]string)
+	putRange(t, tree, 0, 500, "v1")
+	for i := 0; i < 500; i++ {
+		expect1[fmt.Sprintf("key_%04d", i)] = "v1"
+	}
+	waitFlushed(t, treeDir)
+	info1, err := CreateBackup(tree, backupDir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	assert.Equal(t, uint64(1), info1.ID)
+	shared1 := sharedFiles(t, backupDir)
+	assert.NotEmpty(t, shared1)
+
+	// 2 追加写入后生成第二个备份. 未发生变化的 sst 文件在两个备份之间共享
+	expect2 := make(map[string]string)
+	for key, value := range expect1 {
+		expect2[key] = value
+	}
+	putRange(t, tree, 500, 600, "v2")
+	for i := 500; i < 600; i++ {
+		expect2[fmt.Sprintf("key_%04d", i)] = "v2"
+	}
+	waitFlushed(t, treeDir)
+	info2, err := engine.CreateBackup(tree)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	assert.Equal(t, uint64(2), info2.ID)
+	assert.Greater(t, info2.Seq, info1.Seq)
+	shared2 := sharedFiles(t, backupDir)
+	var reused int
+	for _, f := range info2.Files {
+		if shared1[path.Base(f.Path)] {
+			reused++
+		}
+	}
+	assert.Greater(t, reused, 0)
+	assert.Less(t, len(shared2), len(info1.Files)+len(info2.Files))
+
+	backups, err := engine.ListBackups()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	assert.Equal(t, 2, len(backups))
+	assert.Nil(t, engine.VerifyBackup(1))
+	assert.Nil(t, engine.VerifyBackup(2))
+	assert.Equal(t, ErrBackupNotFound, engine.VerifyBackup(3))
+
+	// 3 恢复出的 lsm tree 与生成备份时的数据一致
+	restoreDir := path.Join(t.TempDir(), "restore1")
+	if err = engine.RestoreBackup(1, restoreDir); err != nil {
+		t.Error(err)
+		return
+	}
+	checkTree(t, restoreDir, expect1)
+	assert.Equal(t, ErrTargetDirExists, engine.RestoreBackup(1, restoreDir))
+
+	// 4 只保留最新的备份. 只被首个备份引用的共享文件随之删除，第二个备份依然完整
+	assert.Equal(t, ErrInvalidKeepCount, engine.PurgeOldBackups(0))
+	if err = engine.PurgeOldBackups(1); err != nil {
+		t.Error(err)
+		return
+	}
+	backups, err = engine.ListBackups()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	assert.Equal(t, 1, len(backups))
+	assert.Equal(t, uint64(2), backups[0].ID)
+	assert.Equal(t, len(info2.Files)-countPrivate(info2), len(sharedFiles(t, backupDir)))
+	assert.Nil(t, engine.VerifyBackup(2))
+
+	restoreDir = path.Join(t.TempDir(), "restore2")
+	if err = engine.RestoreBackup(2, restoreDir); err != nil {
+		t.Error(err)
+		return
+	}
+	checkTree(t, restoreDir, expect2)
+
+	// 5 篡改共享文件后，校验失败，也无法恢复
+	for _, f := range info2.Files {
+		if !shareable(f.Name) {
+			continue
+		}
+		if err = os.WriteFile(path.Join(backupDir, f.Path), []byte("corrupted"), 0644); err != nil {
+			t.Error(err)
+			return
+		}
+		break
+	}
+	assert.True(t, errors.Is(engine.VerifyBackup(2), ErrBackupCorrupted))
+	assert.True(t, errors.Is(engine.RestoreBackup(2, path.Join(t.TempDir(), "restore3")), ErrBackupCorrupted))
+}
+
+func countPrivate(info *BackupInfo) int {
+	var cnt int
+	for _, f := range info.Files {
+		if !shareable(f.Name) {
+			cnt++
+		}
+	}
+	return cnt
+}
+
+func Test_Backup_FS(t *testing.T) {
+	// lsm tree、备份以及恢复出的目录均位于内存文件系统中，不会访问操作系统的文件系统
+	fs := vfs.NewMem()
+	newConf := func(dir string) *golsm.Config {
+		conf, err := golsm.NewConfig(dir, golsm.WithFS(fs), golsm.WithSSTSize(4*1024), golsm.WithSSTDataBlockSize(512))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conf
+	}
+	tree, err := golsm.NewTree(newConf("db"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer tree.Close()
+
+	putRange(t, tree, 0, 300, "v1")
+	info, err := CreateBackup(tree, "backup", WithFS(fs))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	engine, err := NewEngine("backup", WithFS(fs))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	assert.Nil(t, engine.VerifyBackup(info.ID))
+	if err = engine.RestoreBackup(info.ID, "restore"); err != nil {
+		t.Error(err)
+		return
+	}
+
+	restored, err := golsm.NewTree(newConf("restore"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer restored.Close()
+	for i := 0; i < 300; i++ {
+		v, ok, err := restored.Get([]byte(fmt.Sprintf("key_%04d", i)))
+		assert.Nil(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, "v1", string(v))
+	}
+	for _, dir := range []string{"db", "backup", "restore"} {
+		_, err = os.Stat(dir)
+		assert.True(t, os.IsNotExist(err), dir)
+	}
+}
+
+func Test_Backup_CorruptedMeta(t *testing.T) {
+	treeDir := t.TempDir()
+	tree, err := golsm.NewTree(newTestConfig(t, treeDir))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer tree.Close()
+
+	backupDir := t.TempDir()
+	engine, err := NewEngine(backupDir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	putRange(t, tree, 0, 100, "v1")
+	if _, err = engine.CreateBackup(tree); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// 元信息损坏的备份被跳过，不影响其他备份，新备份也不会复用其编号
+	if err = os.WriteFile(path.Join(backupDir, metaDir, "2"), []byte("{"), 0644); err != nil {
+		t.Error(err)
+		return
+	}
+	backups, err := engine.ListBackups()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	assert.Equal(t, 1, len(backups))
+	assert.True(t, errors.Is(engine.VerifyBackup(2), ErrBackupCorrupted))
+
+	info, err := engine.CreateBackup(tree)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	assert.Equal(t, uint64(3), info.ID)
+	assert.Nil(t, engine.VerifyBackup(3))
+	assert.Nil(t, engine.PurgeOldBackups(1))
+	backups, err = engine.ListBackups()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	assert.Equal(t, 1, len(backups))
+	assert.Equal(t, uint64(3), backups[0].ID)
+}
@@ -0,0 +1,368 @@
+package golsm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/xiaoxuxiansheng/golsm/memtable"
+	"github.com/xiaoxuxiansheng/golsm/vfs"
+)
+
+var (
+	errInvalidBlobRef    = errors.New("invalid blob reference")
+	errBlobFileNotExists = errors.New("blob file not exists")
+)
+
+// value 存放在 blob 文件中时，sstable 中保留的引用
+type blobRef struct {
+	file   uint64 // blob 文件编号. 对应为文件名中 file.blob 的 file
+	offset uint64 // value 在 blob 文件中的偏移量
+	size   uint64 // value 的大小，单位 byte
+}
+
+// 将 blob 引用编码追加到 buf 中: 文件编号 | 偏移量 | 大小，均为 uvarint
+func appendBlobRef(buf []byte, ref *blobRef) []byte {
+	var scratch [binary.MaxVarintLen64]byte
+	for _, v := range []uint64{ref.file, ref.offset, ref.size} {
+		n := binary.PutUvarint(scratch[0:], v)
+		buf = append(buf, scratch[:n]...)
+	}
+	return buf
+}
+
+// 解析 blob 引用
+func decodeBlobRef(raw []byte) (*blobRef, error) {
+	var (
+		ref    blobRef
+		fields = []*uint64{&ref.file, &ref.offset, &ref.size}
+	)
+	for _, field := range fields {
+		v, n := binary.Uvarint(raw)
+		if n <= 0 {
+			return nil, errInvalidBlobRef
+		}
+		*field = v
+		raw = raw[n:]
+	}
+	if len(raw) > 0 {
+		return nil, errInvalidBlobRef
+	}
+	return &ref, nil
+}
+
+// 列族目录下的一个 blob 文件
+type blobFile struct {
+	size   uint64   // 文件大小，单位 byte
+	refs   int      // 引用该文件的节点个数
+	reader vfs.File // 读取 value 使用的文件句柄，首次读取时打开
+}
+
+// 列族下的全部 blob 文件. 超过 Config.MinBlobSize 的 value 会被分离到只追加写入的 blob 文件中，sstable 中只保留 blob 引用.
+// blob 文件的生命周期由引用它的节点决定，不再被任何节点引用时删除
+type blobSet struct {
+	fs       vfs.FS
+	dir      string
+	readOnly bool // 只读模式下不再被引用的 blob 文件只关闭读句柄，不删除文件
+	lock     sync.Mutex
+	seq      uint64 // 已分配的最大 blob 文件编号
+	files    map[uint64]*blobFile
+}
+
+func newBlobSet(fs vfs.FS, dir string, readOnly bool) *blobSet {
+	return &blobSet{
+		fs:       fs,
+		dir:      dir,
+		readOnly: readOnly,
+		files:    make(map[uint64]*blobFile),
+	}
+}
+
+func blobFileName(file uint64) string {
+	return fmt.Sprintf("%d.blob", file)
+}
+
+// 解析 file.blob 格式的文件名
+func parseBlobFile(name string) (uint64, bool) {
+	if !strings.HasSuffix(name, ".blob") {
+		return 0, false
+	}
+	file, err := strconv.ParseUint(strings.TrimSuffix(name, ".blob"), 10, 64)
+	return file, err == nil
+}
+
+// 扫描列族目录，加载已有的 blob 文件. 需要在加载节点之前执行. 已经加载过的 blob 文件保持不变
+func (b *blobSet) load() error {
+	entries, err := b.fs.List(b.dir)
+	if err != nil {
+		return err
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, entry := range entries {
+		file, ok := parseBlobFile(entry)
+		if !ok {
+			continue
+		}
+		if _, ok = b.files[file]; ok {
+			continue
+		}
+		info, err := b.fs.Stat(path.Join(b.dir, entry))
+		if err != nil {
+			return err
+		}
+		b.files[file] = &blobFile{size: uint64(info.Size())}
+		if file > b.seq {
+			b.seq = file
+		}
+	}
+	return nil
+}
+
+// 删除没有被任何节点引用的 blob 文件. 这部分文件来自溢写或 compact 流程中途退出，在全部节点加载完成后执行
+func (b *blobSet) removeUnreferenced() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for file, f := range b.files {
+		if f.refs > 0 {
+			continue
+		}
+		b.removeLocked(file, f)
+	}
+}
+
+// 登记节点对一组 blob 文件的引用
+func (b *blobSet) ref(refs map[uint64]uint64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for file := range refs {
+		if f, ok := b.files[file]; ok {
+			f.refs++
+		}
+	}
+}
+
+// 释放节点对一组 blob 文件的引用. 引用归零的 blob 文件已经没有存活的 value，直接删除
+func (b *blobSet) unref(refs map[uint64]uint64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for file := range refs {
+		f, ok := b.files[file]
+		if !ok {
+			continue
+		}
+		if f.refs--; f.refs <= 0 {
+			b.removeLocked(file, f)
+		}
+	}
+}
+
+func (b *blobSet) removeLocked(file uint64, f *blobFile) {
+	if f.reader != nil {
+		_ = f.reader.Close()
+	}
+	if !b.readOnly {
+		_ = b.fs.Remove(path.Join(b.dir, blobFileName(file)))
+	}
+	delete(b.files, file)
+}
+
+// 读取 blob 引用对应的 value
+func (b *blobSet) get(ref *blobRef) ([]byte, error) {
+	b.lock.Lock()
+	f, ok := b.files[ref.file]
+	if !ok {
+		b.lock.Unlock()
+		return nil, errBlobFileNotExists
+	}
+	if f.reader == nil {
+		reader, err := b.fs.Open(path.Join(b.dir, blobFileName(ref.file)))
+		if err != nil {
+			b.lock.Unlock()
+			return nil, err
+		}
+		f.reader = reader
+	}
+	reader := f.reader
+	b.lock.Unlock()
+
+	value := make([]byte, ref.size)
+	if _, err := reader.ReadAt(value, int64(ref.offset)); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// 垃圾占比不低于 ratio 的 blob 文件. live 为各 blob 文件中仍被节点引用的字节数，其余部分均为垃圾
+func (b *blobSet) garbageFiles(live map[uint64]uint64, ratio float64) map[uint64]bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	files := make(map[uint64]bool)
+	for file, f := range b.files {
+		if f.size == 0 || live[file] >= f.size {
+			continue
+		}
+		if float64(f.size-live[file])/float64(f.size) >= ratio {
+			files[file] = true
+		}
+	}
+	return files
+}
+
+// 创建一个新的 blob 文件用于写入
+func (b *blobSet) newWriter() (*blobWriter, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	file := b.seq + 1
+	dest, err := b.fs.OpenAppend(path.Join(b.dir, blobFileName(file)))
+	if err != nil {
+		return nil, err
+	}
+	b.seq = file
+	b.files[file] = &blobFile{}
+	return &blobWriter{set: b, file: file, dest: dest}, nil
+}
+
+// 关闭全部 blob 文件的读句柄
+func (b *blobSet) close() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, f := range b.files {
+		if f.reader != nil {
+			_ = f.reader.Close()
+			f.reader = nil
+		}
+	}
+}
+
+// blob 文件的写入入口. value 依次追加到文件末尾
+type blobWriter struct {
+	set  *blobSet
+	file uint64
+	dest vfs.File
+	size uint64
+}
+
+// 追加一个 value，返回其 blob 引用
+func (w *blobWriter) add(value []byte) (*blobRef, error) {
+	// 写入失败时文件中可能残留部分数据，同样需要计入偏移量，保证后续 value 的引用正确
+	n, err := w.dest.Write(value)
+	ref := blobRef{file: w.file, offset: w.size, size: uint64(len(value))}
+	w.size += uint64(n)
+
+	w.set.lock.Lock()
+	if f, ok := w.set.files[w.file]; ok {
+		f.size = w.size
+	}
+	w.set.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return &ref, nil
+}
+
+func (w *blobWriter) close() {
+	_ = w.dest.Close()
+}
+
+// 溢写以及 compact 流程中，将 value 较大的记录分离到 blob 文件中.
+// 引用了待回收 blob 文件的记录会被读出，按照相同的规则重新写入
+type blobSeparator struct {
+	cf      *ColumnFamily
+	gcFiles map[uint64]bool // 待回收的 blob 文件
+	writer  *blobWriter     // 首次分离 value 时创建
+}
+
+func (cf *ColumnFamily) newBlobSeparator(gcFiles map[uint64]bool) *blobSeparator {
+	return &blobSeparator{cf: cf, gcFiles: gcFiles}
+}
+
+// 返回写入 sstable 的记录. 读写 blob 文件失败时保留原记录，不影响数据的正确性
+func (s *blobSeparator) separate(raw []byte) []byte {
+	minSize := s.cf.conf.MinBlobSize
+	if len(raw) == 0 || entryKind(raw[0]&entryKindMask) != entryKindValue {
+		return raw
+	}
+	if raw[0]&entryFlagBlob == 0 && (minSize <= 0 || len(raw) < minSize) {
+		return raw
+	}
+
+	e, err := decodeEntry(raw)
+	if err != nil {
+		return raw
+	}
+	if e.blob != nil {
+		if !s.gcFiles[e.blob.file] {
+			return raw
+		}
+		if e.value, err = s.cf.blobs.get(e.blob); err != nil {
+			return raw
+		}
+		e.blob = nil
+	}
+
+	if minSize <= 0 || len(e.value) < minSize {
+		return encodeEntry(e)
+	}
+	if s.writer == nil {
+		if s.writer, err = s.cf.blobs.newWriter(); err != nil {
+			return encodeEntry(e)
+		}
+	}
+	ref, err := s.writer.add(e.value)
+	if err != nil {
+		return encodeEntry(e)
+	}
+	e.value, e.blob = nil, ref
+	return encodeEntry(e)
+}
+
+// 将写入的 blob 文件持久化. 需要在引用它的 sstable 生效之前执行
+func (s *blobSeparator) sync() error {
+	if s.writer == nil {
+		return nil
+	}
+	return s.writer.dest.Sync()
+}
+
+func (s *blobSeparator) close() {
+	if s.writer != nil {
+		s.writer.close()
+	}
+}
+
+// 各节点仍在引用的 blob 文件字节数之和. 节点的增删只会在 compact 协程中执行，因此 compact 协程内读取 nodes 无需加锁
+func (cf *ColumnFamily) liveBlobBytes() map[uint64]uint64 {
+	live := make(map[uint64]uint64)
+	for _, nodes := range cf.nodes {
+		for _, node := range nodes {
+			for file, size := range node.blobRefs {
+				live[file] += size
+			}
+		}
+	}
+	return live
+}
+
+// merge 操作数需要叠加到更早写入的 value 之上. value 存放在 blob 文件中时，先将其读回 memtable
+func (cf *ColumnFamily) inlineBlob(memTable memtable.MemTable, key []byte) error {
+	raw, ok := memTable.Get(key)
+	if !ok || len(raw) == 0 || raw[0]&entryFlagBlob == 0 {
+		return nil
+	}
+	e, err := decodeEntry(raw)
+	if err != nil {
+		return err
+	}
+	if e.value, err = cf.blobs.get(e.blob); err != nil {
+		return err
+	}
+	e.blob = nil
+	memTable.Put(key, encodeEntry(e))
+	return nil
+}
@@ -0,0 +1,254 @@
+package golsm
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 将读写 memtable 切换为只读 memtable，并等待其溢写完成
+func flushMemTable(t *Tree) {
+	t.dataLock.Lock()
+	t.refreshMemTableLocked()
+	t.dataLock.Unlock()
+	waitMemTableFlushed(t)
+}
+
+// 列族目录下的 blob 文件编号，由小到大排列
+func listBlobFiles(t *testing.T, dir string) []uint64 {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []uint64
+	for _, entry := range entries {
+		if file, ok := parseBlobFile(entry.Name()); ok {
+			files = append(files, file)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i] < files[j] })
+	return files
+}
+
+func blobTestValue(key string, version int) []byte {
+	return bytes.Repeat([]byte(fmt.Sprintf("%s_v%d|", key, version)), 4096/len(key))
+}
+
+func Test_BlobRef_Encode(t *testing.T) {
+	e := &entry{
+		kind:     entryKindValue,
+		expireAt: 100,
+		blob:     &blobRef{file: 3, offset: 1 << 20, size: 65536},
+	}
+	raw := encodeEntry(e)
+	assert.NotEqual(t, byte(0), raw[0]&entryFlagBlob)
+
+	got, err := decodeEntry(raw)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	assert.Equal(t, e.blob, got.blob)
+	assert.Equal(t, e.expireAt, got.expireAt)
+	assert.Equal(t, 0, len(got.value))
+
+	// blob 标识只允许出现在 value 类型的记录中
+	raw[0] = byte(entryKindDelete) | entryFlagBlob
+	_, err = decodeEntry(raw)
+	assert.Equal(t, errInvalidEntry, err)
+}
+
+func Test_Tree_BlobValues(t *testing.T) {
+	conf, err := NewConfig(t.TempDir(),
+		WithSSTSize(64*1024),
+		WithSSTDataBlockSize(512),
+		WithSSTNumPerLevel(1000), // 避免后台自动触发 compact
+		WithMinBlobSize(1024),
+	)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	lsmTree, err := NewTree(conf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// 偶数 key 的 value 超过阈值，存放在 blob 文件中；奇数 key 的 value 内联在 sstable 中
+	expect := make(map[string][]byte)
+	var keys [][]byte
+	for i := 0; i < 60; i++ {
+		key := fmt.Sprintf("key_%03d", i)
+		value := []byte(key)
+		if i%2 == 0 {
+			value = blobTestValue(key, 0)
+		}
+		if err = lsmTree.Put([]byte(key), value); err != nil {
+			t.Error(err)
+			return
+		}
+		expect[key] = value
+		keys = append(keys, []byte(key))
+	}
+	flushMemTable(lsmTree)
+	lsmTree.DefaultColumnFamily().compactLevel(0)
+
+	check := func(lsmTree *Tree) {
+		cf := lsmTree.DefaultColumnFamily()
+		// sstable 中只保留 blob 引用
+		var sstSize uint64
+		for _, nodes := range cf.nodes {
+			for _, node := range nodes {
+				sstSize += node.size
+			}
+		}
+		assert.Less(t, sstSize, uint64(30*1024))
+		assert.NotEmpty(t, listBlobFiles(t, conf.Dir))
+
+		for key, value := range expect {
+			got, ok, err := lsmTree.Get([]byte(key))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			assert.Equal(t, true, ok)
+			assert.Equal(t, value, got, key)
+		}
+
+		values, oks, err := lsmTree.MultiGet(keys)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		for i, key := range keys {
+			assert.Equal(t, true, oks[i])
+			assert.Equal(t, expect[string(key)], values[i])
+		}
+
+		iter, err := lsmTree.NewIterator()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer iter.Close()
+		var cnt int
+		for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+			assert.Equal(t, expect[string(iter.Key())], iter.Value())
+			cnt++
+		}
+		assert.Equal(t, len(expect), cnt)
+	}
+	check(lsmTree)
+
+	// 重启后 blob 文件依然可以正常读取
+	lsmTree.Close()
+	if lsmTree, err = NewTree(conf); err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		waitMemTableFlushed(lsmTree)
+		lsmTree.Close()
+	}()
+	check(lsmTree)
+}
+
+func Test_Tree_BlobGC(t *testing.T) {
+	conf, err := NewConfig(t.TempDir(),
+		WithSSTSize(256*1024),
+		WithSSTDataBlockSize(512),
+		WithSSTNumPerLevel(1000), // 避免后台自动触发 compact
+		WithMinBlobSize(1024),
+		WithBlobGCRatio(0.5),
+		WithMergeOperator(NewStringAppendOperator([]byte(","))),
+	)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	lsmTree, err := NewTree(conf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		waitMemTableFlushed(lsmTree)
+		lsmTree.Close()
+	}()
+	cf := lsmTree.DefaultColumnFamily()
+
+	expect := make(map[string][]byte)
+	put := func(i, version int) {
+		key := fmt.Sprintf("key_%02d", i)
+		value := blobTestValue(key, version)
+		if err := lsmTree.Put([]byte(key), value); err != nil {
+			t.Fatal(err)
+		}
+		expect[key] = value
+	}
+	check := func() {
+		for key, value := range expect {
+			got, ok, err := lsmTree.Get([]byte(key))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			assert.Equal(t, true, ok)
+			assert.Equal(t, value, got, key)
+		}
+	}
+
+	// 1 首批 value 写入 1 号 blob 文件
+	for i := 0; i < 20; i++ {
+		put(i, 0)
+	}
+	flushMemTable(lsmTree)
+	cf.compactLevel(0)
+	assert.Equal(t, []uint64{1}, listBlobFiles(t, conf.Dir))
+
+	// 2 覆盖写其中的 15 个 key，写入 2 号 blob 文件. 归并完成后 1 号 blob 文件中 75% 的数据成为垃圾
+	for i := 0; i < 15; i++ {
+		put(i, 1)
+	}
+	flushMemTable(lsmTree)
+	cf.compactLevel(0)
+	assert.Equal(t, []uint64{1, 2}, listBlobFiles(t, conf.Dir))
+	check()
+
+	// 3 对存放在 blob 文件中的 value 追加 merge 操作数
+	if err = lsmTree.Merge([]byte("key_19"), []byte("tail")); err != nil {
+		t.Error(err)
+		return
+	}
+	expect["key_19"] = append(append(append([]byte{}, expect["key_19"]...), ','), []byte("tail")...)
+	flushMemTable(lsmTree)
+	check()
+
+	// 4 再次归并时，1 号 blob 文件中仍然有效的 value 被迁移到 3 号 blob 文件，1 号 blob 文件随之删除.
+	// 2 号 blob 文件中没有垃圾，保持不变
+	cf.compactLevel(0)
+	assert.Equal(t, []uint64{2, 3}, listBlobFiles(t, conf.Dir))
+	check()
+
+	// 5 全部 key 被删除后，blob 文件不再被任何节点引用，随之删除
+	for key := range expect {
+		if err = lsmTree.Delete([]byte(key)); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	expect = map[string][]byte{}
+	flushMemTable(lsmTree)
+	cf.compactLevel(0)
+	assert.Empty(t, listBlobFiles(t, conf.Dir))
+	_, err = os.Stat(path.Join(conf.Dir, blobFileName(2)))
+	assert.True(t, os.IsNotExist(err))
+}
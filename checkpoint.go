@@ -0,0 +1,258 @@
+package golsm
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/xiaoxuxiansheng/golsm/vfs"
+)
+
+var ErrCheckpointExists = errors.New("checkpoint directory already exists")
+
+// 检查点以及备份中记录文件清单的文件名. 重启 lsm tree 时不会读取该文件
+const ManifestFileName = "MANIFEST"
+
+// 检查点中的文件清单
+type Manifest struct {
+	Seq   uint64         `json:"seq"`   // 检查点对应的最新序列号
+	Files []ManifestFile `json:"files"` // 检查点中的全部文件，文件清单本身除外
+}
+
+// 文件清单中的一个文件
+type ManifestFile struct {
+	Name string `json:"name"` // 相对于检查点目录的路径，以 / 分隔
+	Size int64  `json:"size"` // 文件大小，单位 byte
+}
+
+// 读取文件系统 fs 中目录下的文件清单. fs 为 nil 时使用操作系统的文件系统
+func ReadManifest(fs vfs.FS, dir string) (*Manifest, error) {
+	if fs == nil {
+		fs = vfs.Default
+	}
+	raw, err := vfs.ReadFile(fs, path.Join(dir, ManifestFileName))
+	if err != nil {
+		return nil, err
+	}
+	var manifest Manifest
+	if err = json.Unmarshal(raw, &manifest); err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+// 在 dir 目录下生成 lsm tree 当前时刻的一致性快照，可以直接通过 NewTree 打开. 存在其他列族时，打开时需要声明相同的列族.
+// 快照期间各列族当前的节点被持有引用，对应的 sst 文件以及 blob 文件不会被删除. sst 文件以及 blob 文件写入后不再修改，
+// 优先通过硬链接的方式加入快照，失败时退化为复制；预写日志仍在追加写入，先持久化再复制. 快照中同样记录文件版本. dir 不能已经存在.
+// 只读模式下预写日志可能已经被其他进程删除，无法保证快照完整，返回 ErrReadOnly. 存在后台错误时预写日志无法持久化，返回该错误. 快照写入 lsm tree 所在的文件系统
+func (t *Tree) Checkpoint(dir string) error {
+	if err := t.checkOpen(); err != nil {
+		return err
+	}
+	if t.readOnly {
+		return ErrReadOnly
+	}
+	fs := t.conf.FS
+	if _, err := fs.Stat(dir); err == nil {
+		return ErrCheckpointExists
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	// 先写入临时目录，全部完成后再重命名，避免留下不完整的快照
+	tmpDir := dir + ".tmp"
+	if err := fs.RemoveAll(tmpDir); err != nil {
+		return err
+	}
+	if err := t.writeCheckpoint(tmpDir); err != nil {
+		_ = fs.RemoveAll(tmpDir)
+		return err
+	}
+	if err := fs.Rename(tmpDir, dir); err != nil {
+		_ = fs.RemoveAll(tmpDir)
+		return err
+	}
+	return vfs.SyncDir(fs, path.Dir(dir))
+}
+
+func (t *Tree) writeCheckpoint(dir string) error {
+	fs := t.conf.FS
+	walDir := path.Join(dir, "walfile")
+	if err := fs.MkdirAll(walDir); err != nil {
+		return err
+	}
+
+	// 1 在 dataLock 写锁的保护下获取各列族的节点快照以及预写日志. 写入、memtable 的溢写都需要 dataLock，
+	// 因此节点快照与预写日志恰好衔接，不会遗漏也不会重复
+	t.dataLock.Lock()
+	seq := t.seq
+	versions := make([]*version, 0, len(t.cfs))
+	for _, cf := range t.cfs {
+		versions = append(versions, cf.refVersion())
+	}
+	defer func() {
+		for _, v := range versions {
+			v.unref()
+		}
+	}()
+	liveVersion := t.newLiveVersion(versions)
+	// 只读 memtable 对应的预写日志不再追加写入，可以直接链接. 读写 memtable 对应的预写日志先持久化，再复制当前的内容，
+	// 避免快照中包含尚未持久化、崩溃后会丢失的写入
+	err := t.checkWritable()
+	if err == nil {
+		if err = t.walWriter.Sync(); err != nil {
+			err = t.setBackgroundError(BackgroundErrorWAL, err)
+		}
+	}
+	for _, item := range t.rOnlyMemTable {
+		if err != nil {
+			break
+		}
+		err = linkOrCopyFile(fs, item.walFile, path.Join(walDir, path.Base(item.walFile)))
+	}
+	if err == nil {
+		err = copyFile(fs, t.walFile(), path.Join(walDir, path.Base(t.walFile())))
+	}
+	t.dataLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// 2 加入各列族节点对应的 sst 文件以及引用的 blob 文件
+	for i, cf := range t.cfs {
+		cfDir := dir
+		if cf.index > 0 {
+			cfDir = path.Join(dir, cf.name)
+			if err := fs.MkdirAll(cfDir); err != nil {
+				return err
+			}
+		}
+		if err := cf.checkpointNodes(versions[i], cfDir); err != nil {
+			return err
+		}
+		if err := vfs.SyncDir(fs, cfDir); err != nil {
+			return err
+		}
+	}
+	if err := vfs.SyncDir(fs, walDir); err != nil {
+		return err
+	}
+
+	// 3 写入文件版本，打开快照时只加载其中记录的 sst 文件，并按照当前格式回放预写日志
+	if err := writeVersionFile(fs, dir, liveVersion); err != nil {
+		return err
+	}
+
+	// 4 写入文件清单
+	if err := writeManifest(fs, dir, seq); err != nil {
+		return err
+	}
+	return vfs.SyncDir(fs, dir)
+}
+
+// 将快照中的节点对应的文件加入检查点目录
+func (cf *ColumnFamily) checkpointNodes(v *version, dir string) error {
+	blobFiles := make(map[uint64]struct{})
+	for _, nodes := range v.nodes {
+		for _, node := range nodes {
+			dest := path.Join(dir, cf.sstFile(node.level, node.seq))
+			// 节点可能已经被平移到下一层，对应的文件被重命名. 此时通过节点仍然打开的文件句柄复制
+			if err := cf.conf.FS.Link(path.Join(cf.conf.Dir, node.file), dest); err != nil {
+				size, err := node.sstReader.Size()
+				if err != nil {
+					return err
+				}
+				if err = copyReader(cf.conf.FS, io.NewSectionReader(node.sstReader.src, 0, int64(size)), dest); err != nil {
+					return err
+				}
+			}
+			for file := range node.blobRefs {
+				blobFiles[file] = struct{}{}
+			}
+		}
+	}
+
+	for file := range blobFiles {
+		name := blobFileName(file)
+		if err := linkOrCopyFile(cf.conf.FS, path.Join(cf.conf.Dir, name), path.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 记录目录下的全部文件，写入文件清单
+func writeManifest(fs vfs.FS, dir string, seq uint64) error {
+	manifest := Manifest{Seq: seq}
+	var walk func(rel string) error
+	walk = func(rel string) error {
+		names, err := fs.List(path.Join(dir, rel))
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			name = path.Join(rel, name)
+			info, err := fs.Stat(path.Join(dir, name))
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				if err = walk(name); err != nil {
+					return err
+				}
+				continue
+			}
+			if name != ManifestFileName {
+				manifest.Files = append(manifest.Files, ManifestFile{Name: name, Size: info.Size()})
+			}
+		}
+		return nil
+	}
+	if err := walk(""); err != nil {
+		return err
+	}
+	sort.Slice(manifest.Files, func(i, j int) bool {
+		return manifest.Files[i].Name < manifest.Files[j].Name
+	})
+
+	raw, err := json.MarshalIndent(&manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return vfs.WriteFile(fs, path.Join(dir, ManifestFileName), raw)
+}
+
+// 通过硬链接的方式复用文件，失败时退化为复制
+func linkOrCopyFile(fs vfs.FS, src, dest string) error {
+	if err := fs.Link(src, dest); err == nil {
+		return nil
+	}
+	return copyFile(fs, src, dest)
+}
+
+func copyFile(fs vfs.FS, src, dest string) error {
+	f, err := fs.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return copyReader(fs, f, dest)
+}
+
+func copyReader(fs vfs.FS, src io.Reader, dest string) error {
+	f, err := fs.Create(dest)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, src); err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
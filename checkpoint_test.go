@@ -0,0 +1,186 @@
+package golsm
+
+import (
+	"fmt"
+	"math/rand"
+	"path"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Tree_Checkpoint(t *testing.T) {
+	conf, err := NewConfig(t.TempDir(),
+		WithSSTSize(4*1024),
+		WithSSTDataBlockSize(512),
+		WithSSTNumPerLevel(1000), // 避免后台自动触发 compact
+		WithMinBlobSize(64),
+	)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	cfDesc := ColumnFamilyDescriptor{Name: "meta"}
+
+	lsmTree, err := NewTree(conf, cfDesc)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		waitMemTableFlushed(lsmTree)
+		lsmTree.Close()
+	}()
+	meta, _ := lsmTree.ColumnFamily("meta")
+
+	// 1 一部分数据落盘到 sstable 中，value 较大的部分存放在 blob 文件中；其余数据保留在 memtable 以及预写日志中
+	value := func(i int) []byte {
+		if i%2 == 0 {
+			return []byte(fmt.Sprintf("%0128d", i))
+		}
+		return []byte(strconv.Itoa(i))
+	}
+	for i := 0; i < 300; i++ {
+		if err = lsmTree.Put([]byte(fmt.Sprintf("key_%04d", i)), value(i)); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	if err = lsmTree.PutCF(meta, []byte("version"), []byte("1")); err != nil {
+		t.Error(err)
+		return
+	}
+	waitMemTableFlushed(lsmTree)
+	lsmTree.DefaultColumnFamily().compactLevel(0)
+	for i := 300; i < 310; i++ {
+		if err = lsmTree.Put([]byte(fmt.Sprintf("key_%04d", i)), value(i)); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	checkpointDir := path.Join(t.TempDir(), "checkpoint")
+	if err = lsmTree.Checkpoint(checkpointDir); err != nil {
+		t.Error(err)
+		return
+	}
+	assert.Equal(t, ErrCheckpointExists, lsmTree.Checkpoint(checkpointDir))
+
+	manifest, err := ReadManifest(conf.FS, checkpointDir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	assert.NotZero(t, manifest.Seq)
+	assert.NotEmpty(t, manifest.Files)
+
+	// 2 检查点之后的修改以及 compact 不影响检查点
+	for i := 0; i < 310; i += 3 {
+		if err = lsmTree.Delete([]byte(fmt.Sprintf("key_%04d", i))); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	if err = lsmTree.PutCF(meta, []byte("version"), []byte("2")); err != nil {
+		t.Error(err)
+		return
+	}
+	waitMemTableFlushed(lsmTree)
+	lsmTree.DefaultColumnFamily().compactLevel(0)
+	lsmTree.DefaultColumnFamily().compactLevel(1)
+
+	// 3 检查点可以直接打开，数据与生成检查点时完全一致
+	checkpointConf, err := NewConfig(checkpointDir, WithSSTSize(4*1024), WithSSTDataBlockSize(512), WithSSTNumPerLevel(1000))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	checkpoint, err := NewTree(checkpointConf, cfDesc)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		waitMemTableFlushed(checkpoint)
+		checkpoint.Close()
+	}()
+
+	iter, err := checkpoint.NewIterator()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer iter.Close()
+	var cnt int
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+		assert.Equal(t, fmt.Sprintf("key_%04d", cnt), string(iter.Key()))
+		assert.Equal(t, value(cnt), iter.Value())
+		cnt++
+	}
+	assert.Equal(t, 310, cnt)
+
+	checkpointMeta, _ := checkpoint.ColumnFamily("meta")
+	got, ok, err := checkpoint.GetCF(checkpointMeta, []byte("version"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "1", string(got))
+}
+
+func Test_Tree_Checkpoint_Crash(t *testing.T) {
+	disk := newFaultDisk(rand.New(rand.NewSource(time.Now().UnixNano())), true)
+	conf, err := NewConfig("db", WithFS(disk.fs()), WithSSTSize(4*1024), WithSSTDataBlockSize(512), WithSSTNumPerLevel(1000))
+	if !assert.Nil(t, err) {
+		return
+	}
+	lsmTree, err := NewTree(conf)
+	if !assert.Nil(t, err) {
+		return
+	}
+	for i := 0; i < 200; i++ {
+		assert.Nil(t, lsmTree.Put([]byte(fmt.Sprintf("key_%04d", i)), []byte(strconv.Itoa(i))))
+	}
+	waitMemTableFlushed(lsmTree)
+	// 检查点之前的写入没有调用 SyncWAL
+	for i := 200; i < 220; i++ {
+		assert.Nil(t, lsmTree.Put([]byte(fmt.Sprintf("key_%04d", i)), []byte(strconv.Itoa(i))))
+	}
+	if !assert.Nil(t, lsmTree.Checkpoint("checkpoint")) {
+		return
+	}
+
+	// 崩溃之后检查点仍然完整，包含文件版本以及生成检查点之前的全部写入. 原目录中同样保留了这些写入，检查点不会领先于原目录
+	fs := disk.crash()
+	_ = lsmTree.Close()
+	check := func(dir string) {
+		conf, err := NewConfig(dir, WithFS(fs), WithSSTSize(4*1024), WithSSTDataBlockSize(512), WithSSTNumPerLevel(1000))
+		if !assert.Nil(t, err) {
+			return
+		}
+		lsmTree, err := NewTree(conf)
+		if !assert.Nil(t, err) {
+			return
+		}
+		defer lsmTree.Close()
+		for i := 0; i < 220; i++ {
+			key := fmt.Sprintf("key_%04d", i)
+			v, ok, err := lsmTree.Get([]byte(key))
+			assert.Nil(t, err)
+			assert.True(t, ok, key)
+			assert.Equal(t, strconv.Itoa(i), string(v), key)
+		}
+	}
+	check("db")
+	check("checkpoint")
+
+	manifest, err := ReadManifest(fs, "checkpoint")
+	if !assert.Nil(t, err) {
+		return
+	}
+	names := make([]string, 0, len(manifest.Files))
+	for _, file := range manifest.Files {
+		names = append(names, file.Name)
+	}
+	assert.Contains(t, names, versionFileName)
+}
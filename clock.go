@@ -0,0 +1,15 @@
+package golsm
+
+import "time"
+
+// 时钟. 用于获取当前时间，判断带有 ttl 的数据是否过期
+type Clock interface {
+	Now() time.Time
+}
+
+// 系统时钟
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
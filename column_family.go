@@ -0,0 +1,116 @@
+package golsm
+
+import (
+	"errors"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/xiaoxuxiansheng/golsm/memtable"
+)
+
+// 默认列族的名称. 默认列族的 sst 文件直接存放在 lsm tree 的根目录下
+const DefaultColumnFamilyName = "default"
+
+var (
+	ErrInvalidColumnFamilyName = errors.New("invalid column family name")
+	ErrUnknownColumnFamily     = errors.New("unknown column family")
+)
+
+// 列族描述. 除默认列族外，每个列族的 sst 文件存放在根目录下以列族名称命名的子目录中
+type ColumnFamilyDescriptor struct {
+	Name string         // 列族名称
+	Opts []ConfigOption // 列族独立的配置项，例如过滤器、block 大小、每层 sstable 数量、compact 策略等
+}
+
+// 列族. 同一棵 lsm tree 中的各个列族拥有独立的 memtable、level 层结构以及配置，共享同一份预写日志
+type ColumnFamily struct {
+	tree  *Tree
+	index int    // 列族在 lsm tree 中的下标
+	name  string // 列族名称
+	conf  *Config
+
+	// 每层 node 节点使用的读写锁
+	levelLocks []sync.RWMutex
+
+	// 读写 memtable. 与 lsm tree 的只读 memtable 一样，受 lsm tree 的 dataLock 保护
+	memTable memtable.MemTable
+
+	// 读写 memtable 对应的范围删除标记
+	memRangeDels rangeTombstones
+
+	// lsm树状数据结构
+	nodes [][]*Node
+
+	// 各层 sstable 文件 seq. sstable 文件命名为 level_seq.sst
+	levelToSeq []atomic.Int32
+
+	// 列族下各节点的过滤器统计
+	filterStats filterStats
+
+	// 列族下存放大 value 的 blob 文件
+	blobs *blobSet
+}
+
+func newColumnFamily(tree *Tree, index int, name string, conf *Config) *ColumnFamily {
+	return &ColumnFamily{
+		tree:       tree,
+		index:      index,
+		name:       name,
+		conf:       conf,
+		levelLocks: make([]sync.RWMutex, conf.MaxLevel),
+		nodes:      make([][]*Node, conf.MaxLevel),
+		levelToSeq: make([]atomic.Int32, conf.MaxLevel),
+		blobs:      newBlobSet(conf.FS, conf.Dir, tree.readOnly),
+	}
+}
+
+// 列族名称
+func (cf *ColumnFamily) Name() string {
+	return cf.name
+}
+
+// 根据名称获取列族
+func (t *Tree) ColumnFamily(name string) (*ColumnFamily, bool) {
+	for _, cf := range t.cfs {
+		if cf.name == name {
+			return cf, true
+		}
+	}
+	return nil, false
+}
+
+// 获取默认列族
+func (t *Tree) DefaultColumnFamily() *ColumnFamily {
+	return t.cfs[0]
+}
+
+// 校验列族属于当前 lsm tree
+func (t *Tree) checkColumnFamily(cf *ColumnFamily) error {
+	if cf == nil || cf.tree != t {
+		return ErrUnknownColumnFamily
+	}
+	return nil
+}
+
+// 基于 lsm tree 的配置构造列族的配置. 列族目录为根目录下以列族名称命名的子目录，时钟默认与 lsm tree 保持一致
+func newColumnFamilyConfig(conf *Config, desc ColumnFamilyDescriptor) (*Config, error) {
+	name := desc.Name
+	if name == "" || name == DefaultColumnFamilyName || name == "walfile" || strings.ContainsAny(name, `/\.`) {
+		return nil, ErrInvalidColumnFamilyName
+	}
+
+	c := Config{
+		Dir:           path.Join(conf.Dir, name),
+		SSTFooterSize: conf.SSTFooterSize,
+		Clock:         conf.Clock,
+	}
+	for _, opt := range desc.Opts {
+		opt(&c)
+	}
+	// 列族共用 lsm tree 的预写日志以及目录锁，只能使用同一个文件系统
+	c.FS = conf.FS
+	repaire(&c)
+	return &c, nil
+}
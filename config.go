@@ -1,13 +1,13 @@
 package golsm
 
 import (
-	"io/fs"
 	"os"
 	"path"
-	"strings"
+	"time"
 
 	"github.com/xiaoxuxiansheng/golsm/filter"
 	"github.com/xiaoxuxiansheng/golsm/memtable"
+	"github.com/xiaoxuxiansheng/golsm/vfs"
 )
 
 // lsm tree 配置项聚合
@@ -21,15 +21,39 @@ type Config struct {
 	SSTDataBlockSize int    // sst table 中 block 大小 默认 16KB
 	SSTFooterSize    int    // sst table 中 footer 部分大小. 固定为 32B
 
+	CompactionStyle CompactionStyle // compact 策略. 默认为分层归并
+
 	Filter              filter.Filter                // 过滤器. 默认使用布隆过滤器
+	BloomBitsPerKey     int                          // 布隆过滤器中每个 key 占用的 bit 数. 默认不设置，此时每个过滤器固定为 1024 bit
+	FullFilter          bool                         // 是否每个 sstable 只生成一个全文件过滤器. 默认为每个 block 各生成一个过滤器
 	MemTableConstructor memtable.MemTableConstructor // memtable 构造器，默认为跳表
+	MergeOperator       MergeOperator                // merge 操作符. 默认不设置，此时不支持 merge 操作
+	Clock               Clock                        // 时钟，用于判断数据是否过期. 默认使用系统时钟
+	PrefixExtractor     PrefixExtractor              // 前缀提取器. 默认不设置，此时过滤器中只包含完整的 key
+	MinBlobSize         int                          // value 分离到 blob 文件的大小阈值，单位 byte. 默认为 0，此时 value 均存放在 sstable 中
+	BlobGCRatio         float64                      // blob 文件的垃圾占比达到该阈值时，compact 流程会将其中仍然有效的 value 迁移到新的 blob 文件. 默认为 0.5
+	FlushOnClose        bool                         // 关闭时是否将全部 memtable 溢写落盘. 默认不溢写，此时数据保留在预写日志中，重启时回放
+	CloseTimeout        time.Duration                // 关闭时等待后台溢写以及 compact 流程结束的超时时间. 默认为 10s
+	EventListener       EventListener                // 事件监听器. 默认不设置
+	FS                  vfs.FS                       // 文件系统. 默认使用操作系统的文件系统
 }
 
+// compact 策略
+type CompactionStyle int
+
+const (
+	// 分层归并. level 层的数据量超过阈值时，与 level + 1 层中重叠的节点归并
+	CompactionStyleLevel CompactionStyle = iota
+	// 先进先出. 数据只保留在 level0 层，不做归并；level0 层的数据量超过阈值时，直接删除最早写入的 sstable.
+	// 适用于日志、缓存等允许丢弃老数据的场景
+	CompactionStyleFIFO
+)
+
 // 配置文件构造器.
 func NewConfig(dir string, opts ...ConfigOption) (*Config, error) {
 	c := Config{
 		Dir:           dir, // sstable 文件所在的目录路径
-		SSTFooterSize: 32,  // 对应 4 个 uint64，共 32 byte
+		SSTFooterSize: 32,  // 依次存放 6 个 uvarint，不足部分补零，最后一个 byte 为格式版本，共 32 byte
 	}
 
 	// 加载配置项
@@ -43,32 +67,24 @@ func NewConfig(dir string, opts ...ConfigOption) (*Config, error) {
 	return &c, c.check() // 校验一下配置是否合法，主要是 check 存放 sst 文件和 wal 文件的目录，如果有缺失则进行目录创建
 }
 
-// 校验一下配置是否合法，主要是 check 存放 sst 文件和 wal 文件的目录，如果有缺失则进行目录创建
+// 校验一下配置是否合法. 目录不存在时视为新建 lsm tree，创建存放 sst 文件和 wal 文件的目录.
+// 已经存在的目录可能会以只读模式或者从实例的方式打开，此时不做任何修改，缺失的 wal 文件目录由 NewTree 创建
 func (c *Config) check() error {
-	// sstable 文件目录确保存在
-	if _, err := os.ReadDir(c.Dir); err != nil {
-		_, ok := err.(*fs.PathError)
-		if !ok || !strings.HasSuffix(err.Error(), "no such file or directory") {
-			return err
-		}
-		if err = os.Mkdir(c.Dir, os.ModePerm); err != nil {
-			return err
-		}
+	if _, err := c.FS.Stat(c.Dir); !os.IsNotExist(err) {
+		return err
 	}
+	return c.mkdirs()
+}
 
-	// wal 文件目录确保存在
-	walDir := path.Join(c.Dir, "walfile")
-	if _, err := os.ReadDir(walDir); err != nil {
-		_, ok := err.(*fs.PathError)
-		if !ok || !strings.HasSuffix(err.Error(), "no such file or directory") {
-			return err
-		}
-		if err = os.Mkdir(walDir, os.ModePerm); err != nil {
-			return err
-		}
+// 存放 sst 文件和 wal 文件的目录确保存在，如果有缺失则进行目录创建. 新建的目录项需要持久化，否则崩溃后其中的文件会一并丢失
+func (c *Config) mkdirs() error {
+	if err := c.FS.MkdirAll(path.Join(c.Dir, "walfile")); err != nil {
+		return err
 	}
-
-	return nil
+	if err := vfs.SyncDir(c.FS, c.Dir); err != nil {
+		return err
+	}
+	return vfs.SyncDir(c.FS, path.Dir(c.Dir))
 }
 
 // 配置项
@@ -103,6 +119,14 @@ func WithSSTNumPerLevel(sstNumPerLevel int) ConfigOption {
 	}
 }
 
+// compact 策略. 默认为 CompactionStyleLevel. 使用 CompactionStyleFIFO 时，level0 层的数据量阈值同样为 SSTSize * SSTNumPerLevel.
+// 作为列族的配置项时，各列族可以使用不同的策略.
+func WithCompactionStyle(style CompactionStyle) ConfigOption {
+	return func(c *Config) {
+		c.CompactionStyle = style
+	}
+}
+
 // 注入过滤器的具体实现. 默认使用本项目下实现的布隆过滤器 bloom filter.
 func WithFilter(filter filter.Filter) ConfigOption {
 	return func(c *Config) {
@@ -110,6 +134,22 @@ func WithFilter(filter filter.Filter) ConfigOption {
 	}
 }
 
+// 布隆过滤器中每个 key 占用的 bit 数，过滤器的大小随实际 key 的个数变化. 通过 WithFilter 注入过滤器时不生效.
+// 默认每个过滤器固定为 1024 bit，block 中 key 的个数差异较大时，假阳性率也会随之大幅波动.
+func WithBloomBitsPerKey(bitsPerKey int) ConfigOption {
+	return func(c *Config) {
+		c.BloomBitsPerKey = bitsPerKey
+	}
+}
+
+// 每个 sstable 只生成一个涵盖全部 key 的过滤器，代替每个 block 各自的过滤器.
+// 全文件过滤器的假阳性率不受 block 大小影响，但点查命中过滤器时仍需二分索引定位 block.
+func WithFullFilter() ConfigOption {
+	return func(c *Config) {
+		c.FullFilter = true
+	}
+}
+
 // 注入有序表构造器. 默认使用本项目下实现的跳表 skiplist.
 func WithMemtableConstructor(memtableConstructor memtable.MemTableConstructor) ConfigOption {
 	return func(c *Config) {
@@ -117,6 +157,71 @@ func WithMemtableConstructor(memtableConstructor memtable.MemTableConstructor) C
 	}
 }
 
+// 注入 merge 操作符. 设置后才能使用 Tree.Merge 方法.
+func WithMergeOperator(mergeOperator MergeOperator) ConfigOption {
+	return func(c *Config) {
+		c.MergeOperator = mergeOperator
+	}
+}
+
+// 注入时钟的具体实现. 默认使用系统时钟，测试时可以注入可控的时钟.
+func WithClock(clock Clock) ConfigOption {
+	return func(c *Config) {
+		c.Clock = clock
+	}
+}
+
+// 注入前缀提取器. 设置后 key 的前缀也会添加到过滤器中，前缀迭代时可以跳过不包含该前缀的 block.
+func WithPrefixExtractor(prefixExtractor PrefixExtractor) ConfigOption {
+	return func(c *Config) {
+		c.PrefixExtractor = prefixExtractor
+	}
+}
+
+// 不小于 minBlobSize 的 value 在溢写以及 compact 时分离到只追加写入的 blob 文件中，sstable 中只保留指向 value 的引用.
+// 适用于 value 较大的场景，避免 compact 流程反复读写 value. 默认为 0，不进行分离.
+func WithMinBlobSize(minBlobSize int) ConfigOption {
+	return func(c *Config) {
+		c.MinBlobSize = minBlobSize
+	}
+}
+
+// blob 文件中不再被引用的部分占比达到 ratio 时，compact 流程会将其中仍然有效的 value 迁移到新的 blob 文件，
+// 全部 value 迁移完成后删除老文件. 默认为 0.5.
+func WithBlobGCRatio(ratio float64) ConfigOption {
+	return func(c *Config) {
+		c.BlobGCRatio = ratio
+	}
+}
+
+// 关闭 lsm tree 时将全部 memtable 溢写落盘，重启时无需回放预写日志.
+func WithFlushOnClose() ConfigOption {
+	return func(c *Config) {
+		c.FlushOnClose = true
+	}
+}
+
+// 关闭 lsm tree 时等待后台溢写以及 compact 流程结束的超时时间. 默认为 10s.
+func WithCloseTimeout(timeout time.Duration) ConfigOption {
+	return func(c *Config) {
+		c.CloseTimeout = timeout
+	}
+}
+
+// 注入事件监听器，在后台流程出现错误以及从错误中恢复时回调.
+func WithEventListener(listener EventListener) ConfigOption {
+	return func(c *Config) {
+		c.EventListener = listener
+	}
+}
+
+// 注入文件系统的具体实现. 默认使用操作系统的文件系统，可以替换为 vfs.NewMem() 等实现.
+func WithFS(fs vfs.FS) ConfigOption {
+	return func(c *Config) {
+		c.FS = fs
+	}
+}
+
 func repaire(c *Config) {
 	// lsm tree 默认为 7 层.
 	if c.MaxLevel <= 1 {
@@ -140,6 +245,10 @@ func repaire(c *Config) {
 	}
 
 	// 注入过滤器的具体实现. 默认使用本项目下实现的布隆过滤器 bloom filter.
+	// 设置了每个 key 占用的 bit 数时，过滤器的大小随 key 的个数变化.
+	if c.Filter == nil && c.BloomBitsPerKey > 0 {
+		c.Filter, _ = filter.NewBloomFilterWithBitsPerKey(c.BloomBitsPerKey)
+	}
 	if c.Filter == nil {
 		c.Filter, _ = filter.NewBloomFilter(1024)
 	}
@@ -148,4 +257,24 @@ func repaire(c *Config) {
 	if c.MemTableConstructor == nil {
 		c.MemTableConstructor = memtable.NewSkiplist
 	}
+
+	// 注入时钟. 默认使用系统时钟.
+	if c.Clock == nil {
+		c.Clock = SystemClock{}
+	}
+
+	// blob 文件的垃圾占比阈值. 默认为 0.5.
+	if c.BlobGCRatio <= 0 {
+		c.BlobGCRatio = 0.5
+	}
+
+	// 注入文件系统. 默认使用操作系统的文件系统.
+	if c.FS == nil {
+		c.FS = vfs.Default
+	}
+
+	// 关闭时等待后台流程结束的超时时间. 默认为 10s.
+	if c.CloseTimeout <= 0 {
+		c.CloseTimeout = 10 * time.Second
+	}
 }
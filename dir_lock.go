@@ -0,0 +1,65 @@
+package golsm
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/xiaoxuxiansheng/golsm/vfs"
+)
+
+var ErrLocked = errors.New("lsm tree directory is locked by another process")
+
+// 目录锁文件名，位于 lsm tree 根目录下
+const lockFileName = "LOCK"
+
+// lsm tree 目录的排他锁. 以读写模式打开 lsm tree 时通过文件系统锁定 LOCK 文件，并在其中记录持有者的进程号，
+// 避免两个进程同时读写同一个目录、删除对方的文件. 操作系统的文件系统基于 flock 加锁，进程退出时会自动释放，不会残留失效的锁
+type dirLock struct {
+	l io.Closer
+}
+
+// 锁定目录. 目录已经被锁定时返回 ErrLocked，并附带持有者的进程号
+func lockDir(fs vfs.FS, dir string) (*dirLock, error) {
+	file := path.Join(dir, lockFileName)
+	l, err := fs.Lock(file)
+	if errors.Is(err, vfs.ErrLocked) {
+		raw, _ := vfs.ReadFile(fs, file)
+		if pid, err := strconv.Atoi(strings.TrimSpace(string(raw))); err == nil {
+			return nil, fmt.Errorf("%w, held by pid %d", ErrLocked, pid)
+		}
+		return nil, ErrLocked
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// 记录持有者的进程号
+	if err = writePid(fs, file); err != nil {
+		_ = l.Close()
+		return nil, err
+	}
+	return &dirLock{l: l}, nil
+}
+
+func writePid(fs vfs.FS, file string) error {
+	f, err := fs.OpenReadWrite(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err = f.Truncate(0); err != nil {
+		return err
+	}
+	_, err = f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	return err
+}
+
+// 释放目录锁. LOCK 文件本身保留，删除文件会与其他进程的加锁流程产生竞争
+func (l *dirLock) release() {
+	_ = l.l.Close()
+}
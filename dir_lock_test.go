@@ -0,0 +1,60 @@
+package golsm
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Tree_DirLock(t *testing.T) {
+	conf, err := NewConfig(t.TempDir())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	lsmTree, err := NewTree(conf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if err = lsmTree.Put([]byte("a"), []byte("1")); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// 1 目录已经被锁定时无法再以读写模式打开，错误信息中包含持有者的进程号
+	_, err = NewTree(conf)
+	assert.True(t, errors.Is(err, ErrLocked))
+	assert.True(t, strings.Contains(err.Error(), strconv.Itoa(os.Getpid())), err.Error())
+
+	// 2 只读模式以及从实例不需要加锁
+	readOnly, err := OpenReadOnly(conf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	readOnly.Close()
+	secondary, err := OpenAsSecondary(conf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	secondary.Close()
+
+	// 3 关闭后释放目录锁，可以再次打开
+	lsmTree.Close()
+	if lsmTree, err = NewTree(conf); err != nil {
+		t.Error(err)
+		return
+	}
+	defer lsmTree.Close()
+	value, ok, err := lsmTree.Get([]byte("a"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "1", string(value))
+}
@@ -0,0 +1,429 @@
+package golsm
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/xiaoxuxiansheng/golsm/memtable"
+)
+
+// 数据记录的类型. 写入 memtable、wal 以及 sstable 的 value 首个 byte 均为类型标识.
+// 早期版本写入的 sstable 与 wal 中的 value 为原始值，分别通过 sstable footer 中的格式版本以及文件版本中的 LegacyWALs 识别
+type entryKind uint8
+
+const (
+	entryKindValue       entryKind = 1 // 普通的 kv 数据
+	entryKindMerge       entryKind = 2 // merge 操作数
+	entryKindDelete      entryKind = 3 // 删除标记
+	entryKindRangeDelete entryKind = 4 // 范围删除标记. 仅出现在 wal 中，key 为范围起点，value 为范围终点
+	entryKindBatch       entryKind = 5 // 批量写入. 仅出现在 wal 中，value 为编码后的一组跨列族操作
+)
+
+const (
+	entryKindMask   byte = 0x0f // 类型标识 byte 的低 4 位为记录类型
+	entryFlagExpire byte = 0x80 // 类型标识 byte 的最高位标识记录是否带有过期时间
+	entryFlagSeq    byte = 0x40 // 类型标识 byte 的次高位标识记录是否带有序列号
+	entryFlagBlob   byte = 0x20 // 类型标识 byte 的第 3 高位标识 value 是否存放在 blob 文件中. 仅出现在 sstable 中
+)
+
+var errInvalidEntry = errors.New("invalid entry")
+
+// lsm tree 内部的一笔数据记录
+type entry struct {
+	kind        entryKind
+	value       []byte   // entryKindValue 对应的值. entryKindMerge 时为 base 值，仅当 hasBase 为 true 时有效
+	hasBase     bool     // entryKindMerge 时，是否已经包含了更早写入的 base 值
+	baseDeleted bool     // entryKindMerge 时，更早写入的 base 是否为删除标记
+	operands    [][]byte // entryKindMerge 时的操作数，按照写入顺序由旧到新排列
+	expireAt    int64    // value（entryKindMerge 时为 base 值）的过期时间，unix 纳秒时间戳. 0 表示永不过期
+	seq         uint64   // 写入时分配的序列号，用于事务的冲突检测. 仅保留在 wal 与 memtable 中，溢写为 sstable 时清除
+	blob        *blobRef // entryKindValue 的 value 存放在 blob 文件中时，指向 value 的引用. 此时 value 为空
+}
+
+func newValueEntry(value []byte) *entry {
+	return &entry{
+		kind:  entryKindValue,
+		value: value,
+	}
+}
+
+func newDeleteEntry() *entry {
+	return &entry{
+		kind: entryKindDelete,
+	}
+}
+
+func newRangeDeleteEntry(end []byte) *entry {
+	return &entry{
+		kind:  entryKindRangeDelete,
+		value: end,
+	}
+}
+
+func newMergeEntry(operand []byte) *entry {
+	return &entry{
+		kind:     entryKindMerge,
+		operands: [][]byte{operand},
+	}
+}
+
+// 数据记录是否完整. 完整的记录无需再结合更早写入的数据即可得出结果
+func (e *entry) complete() bool {
+	return e.kind != entryKindMerge || e.hasBase
+}
+
+// value（entryKindMerge 时为 base 值）在 now 时刻是否已经过期
+func (e *entry) expired(now time.Time) bool {
+	return e.expireAt > 0 && now.UnixNano() >= e.expireAt
+}
+
+// 数据记录完整时，其 value（entryKindMerge 时为 base 值）在 now 时刻是否存在
+func (e *entry) baseExist(now time.Time) bool {
+	switch e.kind {
+	case entryKindValue:
+		return !e.expired(now)
+	case entryKindMerge:
+		return e.hasBase && !e.baseDeleted && !e.expired(now)
+	default:
+		return false
+	}
+}
+
+// 将数据记录编码为字节数组
+// value: kind | [过期时间] | [序列号] | value 或 blob 引用
+// delete: kind | [序列号]
+// range delete: kind | [序列号] | 范围终点
+// merge: kind | [过期时间] | [序列号] | base 标识 | base 长度 | base | 操作数个数 | 操作数1长度 | 操作数1 | ...
+// base 标识为 0 表示不含 base，为 1 表示包含 base，为 2 表示 base 为删除标记
+// 仅当 kind 中设置了 entryFlagExpire 标识时，才会存在过期时间字段；仅当设置了 entryFlagSeq 标识时，才会存在序列号字段.
+// 设置了 entryFlagBlob 标识时，value 部分为 blob 引用
+func encodeEntry(e *entry) []byte {
+	var scratch [binary.MaxVarintLen64]byte
+	buf := []byte{byte(e.kind)}
+	if e.expireAt > 0 {
+		buf[0] |= entryFlagExpire
+		n := binary.PutUvarint(scratch[0:], uint64(e.expireAt))
+		buf = append(buf, scratch[:n]...)
+	}
+	if e.seq > 0 {
+		buf[0] |= entryFlagSeq
+		n := binary.PutUvarint(scratch[0:], e.seq)
+		buf = append(buf, scratch[:n]...)
+	}
+
+	if e.kind == entryKindValue && e.blob != nil {
+		buf[0] |= entryFlagBlob
+		return appendBlobRef(buf, e.blob)
+	}
+	if e.kind != entryKindMerge {
+		return append(buf, e.value...)
+	}
+
+	switch {
+	case e.hasBase && e.baseDeleted:
+		buf = append(buf, 2)
+	case e.hasBase:
+		buf = append(buf, 1)
+	default:
+		buf = append(buf, 0)
+	}
+	n := binary.PutUvarint(scratch[0:], uint64(len(e.value)))
+	buf = append(buf, scratch[:n]...)
+	buf = append(buf, e.value...)
+	n = binary.PutUvarint(scratch[0:], uint64(len(e.operands)))
+	buf = append(buf, scratch[:n]...)
+	for _, operand := range e.operands {
+		n = binary.PutUvarint(scratch[0:], uint64(len(operand)))
+		buf = append(buf, scratch[:n]...)
+		buf = append(buf, operand...)
+	}
+	return buf
+}
+
+// 将字节数组解析为数据记录
+func decodeEntry(raw []byte) (*entry, error) {
+	if len(raw) == 0 {
+		return nil, errInvalidEntry
+	}
+
+	e := entry{kind: entryKind(raw[0] & entryKindMask)}
+	flags := raw[0]
+	raw = raw[1:]
+	if flags&entryFlagExpire != 0 {
+		expireAt, n := binary.Uvarint(raw)
+		if n <= 0 {
+			return nil, errInvalidEntry
+		}
+		e.expireAt = int64(expireAt)
+		raw = raw[n:]
+	}
+	if flags&entryFlagSeq != 0 {
+		seq, n := binary.Uvarint(raw)
+		if n <= 0 {
+			return nil, errInvalidEntry
+		}
+		e.seq = seq
+		raw = raw[n:]
+	}
+
+	if flags&entryFlagBlob != 0 {
+		if e.kind != entryKindValue {
+			return nil, errInvalidEntry
+		}
+		blob, err := decodeBlobRef(raw)
+		if err != nil {
+			return nil, err
+		}
+		e.blob = blob
+		return &e, nil
+	}
+
+	switch e.kind {
+	case entryKindValue, entryKindDelete, entryKindRangeDelete:
+		// 保证存在的 value 不为 nil
+		e.value = append([]byte{}, raw...)
+		return &e, nil
+	case entryKindMerge:
+	default:
+		return nil, errInvalidEntry
+	}
+
+	if len(raw) < 1 {
+		return nil, errInvalidEntry
+	}
+	e.hasBase, e.baseDeleted = raw[0] != 0, raw[0] == 2
+	raw = raw[1:]
+
+	base, raw, err := readLengthPrefixed(raw)
+	if err != nil {
+		return nil, err
+	}
+	if e.hasBase {
+		e.value = base
+	}
+
+	cnt, n := binary.Uvarint(raw)
+	if n <= 0 {
+		return nil, errInvalidEntry
+	}
+	raw = raw[n:]
+	e.operands = make([][]byte, 0, cnt)
+	for i := uint64(0); i < cnt; i++ {
+		var operand []byte
+		if operand, raw, err = readLengthPrefixed(raw); err != nil {
+			return nil, err
+		}
+		e.operands = append(e.operands, operand)
+	}
+	return &e, nil
+}
+
+// 清除编码后的数据记录中的序列号. 序列号只在内存中用于冲突检测，无需落盘到 sstable
+func stripEntrySeq(raw []byte) []byte {
+	if len(raw) == 0 || raw[0]&entryFlagSeq == 0 {
+		return raw
+	}
+	e, err := decodeEntry(raw)
+	if err != nil {
+		return raw
+	}
+	e.seq = 0
+	return encodeEntry(e)
+}
+
+// 读取编码后的数据记录中的序列号. 不含序列号时返回 0
+func entrySeq(raw []byte) uint64 {
+	if len(raw) == 0 || raw[0]&entryFlagSeq == 0 {
+		return 0
+	}
+	flags := raw[0]
+	raw = raw[1:]
+	if flags&entryFlagExpire != 0 {
+		_, n := binary.Uvarint(raw)
+		if n <= 0 {
+			return 0
+		}
+		raw = raw[n:]
+	}
+	seq, n := binary.Uvarint(raw)
+	if n <= 0 {
+		return 0
+	}
+	return seq
+}
+
+// 读取一段 长度 | 内容 格式的数据，返回内容以及剩余部分
+func readLengthPrefixed(raw []byte) ([]byte, []byte, error) {
+	length, n := binary.Uvarint(raw)
+	if n <= 0 || uint64(len(raw)-n) < length {
+		return nil, nil, errInvalidEntry
+	}
+	content := append([]byte{}, raw[n:n+int(length)]...)
+	return content, raw[n+int(length):], nil
+}
+
+// 将同一个 key 的一笔较新的数据记录叠加到较老的记录之上，得到新的记录
+func combineEntries(older, newer *entry) *entry {
+	// 新记录本身是完整的，直接覆盖老记录
+	if older == nil || newer.complete() {
+		return newer
+	}
+
+	// 新记录为不带 base 的 merge 操作数，需要继承老记录的 base 和操作数
+	combined := entry{
+		kind:     entryKindMerge,
+		operands: make([][]byte, 0, len(older.operands)+len(newer.operands)),
+		seq:      newer.seq,
+	}
+	// 老记录的 value 成为新记录的 base，base 的过期时间随之继承
+	combined.expireAt = older.expireAt
+	switch older.kind {
+	case entryKindValue:
+		combined.hasBase = true
+		combined.value = older.value
+	case entryKindDelete:
+		combined.hasBase, combined.baseDeleted = true, true
+	case entryKindMerge:
+		combined.hasBase, combined.baseDeleted = older.hasBase, older.baseDeleted
+		combined.value = older.value
+		combined.operands = append(combined.operands, older.operands...)
+	}
+	combined.operands = append(combined.operands, newer.operands...)
+	return &combined
+}
+
+// 将 memtable 中已有的记录与新记录叠加后写入 memtable
+func applyToMemTable(memTable memtable.MemTable, key []byte, e *entry) error {
+	if !e.complete() {
+		if raw, ok := memTable.Get(key); ok {
+			older, err := decodeEntry(raw)
+			if err != nil {
+				return err
+			}
+			e = combineEntries(older, e)
+		}
+	}
+	memTable.Put(key, encodeEntry(e))
+	return nil
+}
+
+// 将一笔写入记录应用到 memtable. 范围删除记录会覆盖 memtable 中已有的数据，并追加到 memtable 对应的范围删除标记中
+func applyRecord(memTable memtable.MemTable, rangeDels *rangeTombstones, key []byte, e *entry) error {
+	if e.kind != entryKindRangeDelete {
+		return applyToMemTable(memTable, key, e)
+	}
+	r := RangeTombstone{Start: key, End: e.value, seq: e.seq}
+	deleteRangeInMemTable(memTable, &r)
+	*rangeDels = append(*rangeDels, &r)
+	return nil
+}
+
+// 基于同一个 key 由新到旧排列的一系列数据记录，得出 key 在 now 时刻对应的最终结果
+// 删除标记以及已过期的 value 视为不存在，并且会遮蔽更早写入的数据
+func (cf *ColumnFamily) resolveEntries(key []byte, entries []*entry, now time.Time) ([]byte, bool, error) {
+	var (
+		base     []byte
+		exist    bool
+		operands [][]byte
+	)
+
+	for _, e := range entries {
+		if e.kind == entryKindMerge {
+			// 越往后的记录越老，其操作数需要排在前面
+			operands = append(append([][]byte{}, e.operands...), operands...)
+		}
+		if e.complete() {
+			base, exist = e.value, e.baseExist(now)
+			// value 存放在 blob 文件中时，只有确定需要时才读取
+			if exist && e.blob != nil {
+				var err error
+				if base, err = cf.blobs.get(e.blob); err != nil {
+					return nil, false, err
+				}
+			}
+			break
+		}
+	}
+
+	if !exist {
+		base = nil
+	}
+
+	if len(operands) == 0 {
+		return base, exist, nil
+	}
+
+	if cf.conf.MergeOperator == nil {
+		return nil, false, ErrMergeOperatorNotSet
+	}
+
+	value, err := cf.conf.MergeOperator.FullMerge(key, base, operands)
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+// compact 流程中对记录进行收敛. 若 baseLevel 为 true，说明更深的 level 层中不存在该 key，可以直接得出最终结果
+// 返回 nil 表示该记录可以被物理删除
+func (cf *ColumnFamily) collapseEntry(key []byte, e *entry, baseLevel bool, now time.Time) (*entry, error) {
+	switch e.kind {
+	case entryKindDelete:
+		// 更深的 level 层中没有需要遮蔽的老数据，删除标记可以直接清理
+		if baseLevel {
+			return nil, nil
+		}
+		return e, nil
+	case entryKindValue:
+		if !e.expired(now) {
+			return e, nil
+		}
+		// 已过期的 value 在最深一层可以直接删除. 否则需要保留一个不含数据的记录，用于遮蔽更深 level 层中的老数据
+		if baseLevel {
+			return nil, nil
+		}
+		return &entry{
+			kind:     entryKindValue,
+			expireAt: e.expireAt,
+		}, nil
+	}
+
+	if cf.conf.MergeOperator == nil {
+		return e, nil
+	}
+
+	// base 带有过期时间且尚未过期时，过期之后需要将操作数作用于空的 base，因此保留 base 及其过期时间，只合并相邻的操作数
+	ttlBase := e.hasBase && e.expireAt > 0 && e.baseExist(now)
+	if (e.hasBase || baseLevel) && !ttlBase {
+		var base []byte
+		if e.baseExist(now) {
+			base = e.value
+		}
+		value, err := cf.conf.MergeOperator.FullMerge(key, base, e.operands)
+		if err != nil {
+			return nil, err
+		}
+		return newValueEntry(value), nil
+	}
+
+	// 更深的 level 层中可能存在 base 值，只能将相邻的操作数两两合并
+	operands := make([][]byte, 0, len(e.operands))
+	for _, operand := range e.operands {
+		if len(operands) > 0 {
+			if merged, ok := cf.conf.MergeOperator.PartialMerge(key, operands[len(operands)-1], operand); ok {
+				operands[len(operands)-1] = merged
+				continue
+			}
+		}
+		operands = append(operands, operand)
+	}
+	collapsed := entry{
+		kind:     entryKindMerge,
+		operands: operands,
+	}
+	if ttlBase {
+		collapsed.hasBase, collapsed.value, collapsed.expireAt = true, e.value, e.expireAt
+	}
+	return &collapsed, nil
+}
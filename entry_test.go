@@ -0,0 +1,89 @@
+package golsm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Entry_EncodeDecode(t *testing.T) {
+	tests := []*entry{
+		newValueEntry([]byte("v")),
+		newValueEntry([]byte{}),
+		newMergeEntry([]byte("op")),
+		newDeleteEntry(),
+		newRangeDeleteEntry([]byte("end")),
+		{
+			kind:        entryKindMerge,
+			hasBase:     true,
+			baseDeleted: true,
+			operands:    [][]byte{[]byte("a")},
+		},
+		{
+			kind:     entryKindMerge,
+			hasBase:  true,
+			value:    []byte("base"),
+			operands: [][]byte{[]byte("a"), []byte("b")},
+		},
+		{
+			kind:     entryKindValue,
+			value:    []byte("v"),
+			expireAt: 100,
+			seq:      300,
+		},
+		{
+			kind:     entryKindMerge,
+			operands: [][]byte{[]byte("a")},
+			seq:      1,
+		},
+	}
+
+	for _, expect := range tests {
+		got, err := decodeEntry(encodeEntry(expect))
+		assert.Nil(t, err)
+		assert.Equal(t, expect.kind, got.kind)
+		assert.Equal(t, expect.hasBase, got.hasBase)
+		assert.Equal(t, expect.baseDeleted, got.baseDeleted)
+		assert.Equal(t, expect.operands, got.operands)
+		assert.Equal(t, expect.expireAt, got.expireAt)
+		assert.Equal(t, expect.seq, got.seq)
+		if expect.complete() && !expect.baseDeleted && expect.kind != entryKindDelete {
+			assert.Equal(t, expect.value, got.value)
+			assert.NotNil(t, got.value)
+		}
+	}
+
+	_, err := decodeEntry(nil)
+	assert.Equal(t, errInvalidEntry, err)
+
+	// 溢写为 sstable 时清除序列号
+	stripped, err := decodeEntry(stripEntrySeq(encodeEntry(&entry{kind: entryKindValue, value: []byte("v"), seq: 7})))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), stripped.seq)
+	assert.Equal(t, []byte("v"), stripped.value)
+}
+
+func Test_combineEntries(t *testing.T) {
+	// 完整的新记录直接覆盖老记录
+	combined := combineEntries(newMergeEntry([]byte("a")), newValueEntry([]byte("v")))
+	assert.Equal(t, entryKindValue, combined.kind)
+	assert.Equal(t, []byte("v"), combined.value)
+
+	// merge 操作数叠加在 value 之上，value 成为 base
+	combined = combineEntries(newValueEntry([]byte("v")), newMergeEntry([]byte("a")))
+	assert.True(t, combined.hasBase)
+	assert.Equal(t, []byte("v"), combined.value)
+	assert.Equal(t, [][]byte{[]byte("a")}, combined.operands)
+
+	// merge 操作数之间叠加，保持由旧到新的顺序
+	combined = combineEntries(combined, newMergeEntry([]byte("b")))
+	assert.True(t, combined.hasBase)
+	assert.Equal(t, [][]byte{[]byte("a"), []byte("b")}, combined.operands)
+
+	// merge 操作数叠加在删除标记之上，base 视为不存在
+	combined = combineEntries(newDeleteEntry(), newMergeEntry([]byte("a")))
+	assert.True(t, combined.hasBase)
+	assert.True(t, combined.baseDeleted)
+	assert.False(t, combined.baseExist(time.Now()))
+}
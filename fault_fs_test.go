@@ -0,0 +1,528 @@
+package golsm
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/xiaoxuxiansheng/golsm/vfs"
+)
+
+// 模拟崩溃之后，崩溃之前打开的文件系统实例上的操作均返回该错误
+var errCrashed = errors.New("fault fs: crashed")
+
+// 用于测试的故障注入磁盘. 数据存放在内存文件系统中，同时记录每个文件最近一次持久化时的内容，以及最近一次持久化目录时的目录项:
+// 1 通过 faultFS.failAt 指定第 n 次操作返回 EIO、ENOSPC 等错误. 开启撕裂写时，出错的写操作会先写入随机长度的前缀
+// 2 通过 crash 模拟崩溃，丢弃全部文件自上次持久化以来的写入. 开启撕裂写时，末尾追加的部分会随机保留一段前缀.
+// 文件以及目录的创建、重命名、删除只有在所在目录被持久化之后才会保留，否则崩溃后回退到目录上一次持久化时的状态
+type faultDisk struct {
+	mu          sync.Mutex
+	base        vfs.FS
+	rand        *rand.Rand
+	torn        bool                   // 是否开启撕裂写
+	files       map[string]*syncedFile // 当前的文件路径 -> 文件. 硬链接的多个路径指向同一个 syncedFile
+	dirs        map[string]bool        // 当前的全部目录
+	durable     map[string]*syncedFile // 目录项已经持久化的文件路径 -> 文件
+	durableDirs map[string]bool        // 目录项已经持久化的目录
+	cur         *faultFS               // 当前的文件系统实例
+}
+
+// 一个文件，以及它最近一次持久化时的内容
+type syncedFile struct {
+	data []byte
+}
+
+func newFaultDisk(r *rand.Rand, torn bool) *faultDisk {
+	d := faultDisk{
+		base:        vfs.NewMem(),
+		rand:        r,
+		torn:        torn,
+		files:       make(map[string]*syncedFile),
+		dirs:        make(map[string]bool),
+		durable:     make(map[string]*syncedFile),
+		durableDirs: make(map[string]bool),
+	}
+	d.cur = &faultFS{disk: &d}
+	return &d
+}
+
+// 获取当前的文件系统实例
+func (d *faultDisk) fs() *faultFS {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cur
+}
+
+// 模拟崩溃: 此前的文件系统实例不再可用，持有的文件锁全部释放，目录项回退到最近一次持久化目录时的状态，
+// 各文件回退到最近一次持久化时的内容. 返回崩溃重启后的文件系统实例
+func (d *faultDisk) crash() *faultFS {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.cur.dead = true
+	for _, l := range d.cur.locks {
+		_ = l.Close()
+	}
+
+	// 上级目录没有保留下来的目录项同样丢失
+	var exists func(dir string) bool
+	exists = func(dir string) bool {
+		return dir == "." || dir == "/" || d.durableDirs[dir] && exists(path.Dir(dir))
+	}
+	base := vfs.NewMem()
+	dirs := make(map[string]bool)
+	for dir := range d.durableDirs {
+		if exists(dir) {
+			if err := base.MkdirAll(dir); err != nil {
+				panic(err)
+			}
+			dirs[dir] = true
+		}
+	}
+
+	// 按照文件名依次还原，硬链接的多个路径还原为同一个文件
+	names := make([]string, 0, len(d.durable))
+	for name := range d.durable {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	files := make(map[string]*syncedFile)
+	restored := make(map[*syncedFile]string)
+	for _, name := range names {
+		sf := d.durable[name]
+		if !exists(path.Dir(name)) {
+			continue
+		}
+		files[name] = sf
+		if first, ok := restored[sf]; ok {
+			if err := base.Link(first, name); err != nil {
+				panic(err)
+			}
+			continue
+		}
+		restored[sf] = name
+
+		keep := sf.data
+		if cur, ok := d.pathOf(sf); ok && d.torn {
+			data, err := vfs.ReadFile(d.base, cur)
+			if err != nil {
+				panic(err)
+			}
+			if len(data) > len(sf.data) && bytes.HasPrefix(data, sf.data) {
+				keep = data[:len(sf.data)+d.rand.Intn(len(data)-len(sf.data)+1)]
+			}
+		}
+		f, err := base.Create(name)
+		if err != nil {
+			panic(err)
+		}
+		_, _ = f.Write(keep)
+		_ = f.Close()
+		sf.data = append([]byte(nil), keep...)
+	}
+
+	d.base, d.files, d.dirs = base, files, dirs
+	d.durable, d.durableDirs = make(map[string]*syncedFile, len(files)), make(map[string]bool, len(dirs))
+	for name, sf := range files {
+		d.durable[name] = sf
+	}
+	for dir := range dirs {
+		d.durableDirs[dir] = true
+	}
+	d.cur = &faultFS{disk: d}
+	return d.cur
+}
+
+// 当前路径指向 sf 的任意一个文件名. 调用方需要持有 mu
+func (d *faultDisk) pathOf(sf *syncedFile) (string, bool) {
+	for name, f := range d.files {
+		if f == sf {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// 故障注入磁盘上的一个文件系统实例，对应一次进程的生命周期
+type faultFS struct {
+	disk    *faultDisk
+	dead    bool
+	ops     int // 已经执行的操作次数
+	failAt  int // 第 failAt 次操作返回 failErr. 为 0 表示不注入错误
+	failErr error
+	locks   []io.Closer
+}
+
+// 从现在起的第 n 次操作返回 err，只生效一次
+func (fs *faultFS) injectAfter(n int, err error) {
+	fs.disk.mu.Lock()
+	defer fs.disk.mu.Unlock()
+	fs.failAt, fs.failErr = fs.ops+n, err
+}
+
+// 计入一次操作，返回需要注入的错误. 调用方需要持有 disk.mu
+func (fs *faultFS) op(name string) error {
+	if fs.dead {
+		return errCrashed
+	}
+	fs.ops++
+	if fs.ops == fs.failAt {
+		return &os.PathError{Op: "inject", Path: name, Err: fs.failErr}
+	}
+	return nil
+}
+
+func (fs *faultFS) open(name string, open func(vfs.FS, string) (vfs.File, error)) (vfs.File, error) {
+	d := fs.disk
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	name = path.Clean(name)
+	if err := fs.op(name); err != nil {
+		return nil, err
+	}
+	f, err := open(d.base, name)
+	if err != nil {
+		return nil, err
+	}
+	sf, ok := d.files[name]
+	if !ok {
+		sf = &syncedFile{}
+		d.files[name] = sf
+	}
+	return &faultFile{fs: fs, name: name, synced: sf, f: f}, nil
+}
+
+func (fs *faultFS) Create(name string) (vfs.File, error) {
+	return fs.open(name, vfs.FS.Create)
+}
+
+func (fs *faultFS) Open(name string) (vfs.File, error) {
+	return fs.open(name, vfs.FS.Open)
+}
+
+func (fs *faultFS) OpenReadWrite(name string) (vfs.File, error) {
+	return fs.open(name, vfs.FS.OpenReadWrite)
+}
+
+func (fs *faultFS) OpenAppend(name string) (vfs.File, error) {
+	return fs.open(name, vfs.FS.OpenAppend)
+}
+
+// 路径是否为 name 或者位于 name 目录下
+func under(file, name string) bool {
+	return file == name || strings.HasPrefix(file, name+"/")
+}
+
+func (fs *faultFS) Rename(oldname, newname string) error {
+	d := fs.disk
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	oldname, newname = path.Clean(oldname), path.Clean(newname)
+	if err := fs.op(oldname); err != nil {
+		return err
+	}
+	isDir := d.dirs[oldname]
+	if err := d.base.Rename(oldname, newname); err != nil {
+		return err
+	}
+	// 重命名目录时，其中已经持久化的目录项属于目录本身，随之移动. 目录自身的目录项仍需持久化上级目录
+	if isDir {
+		durable := make(map[string]*syncedFile, len(d.durable))
+		for file, sf := range d.durable {
+			if under(file, oldname) {
+				file = newname + strings.TrimPrefix(file, oldname)
+			}
+			durable[file] = sf
+		}
+		durableDirs := make(map[string]bool, len(d.durableDirs))
+		for dir := range d.durableDirs {
+			if dir != oldname && under(dir, oldname) {
+				dir = newname + strings.TrimPrefix(dir, oldname)
+			}
+			durableDirs[dir] = true
+		}
+		d.durable, d.durableDirs = durable, durableDirs
+	}
+	// 重命名目录时，其中的文件以及子目录随之移动
+	moved := make(map[string]*syncedFile)
+	for file, sf := range d.files {
+		if under(file, oldname) {
+			delete(d.files, file)
+			moved[newname+strings.TrimPrefix(file, oldname)] = sf
+		}
+	}
+	for file, sf := range moved {
+		d.files[file] = sf
+	}
+	movedDirs := make(map[string]bool)
+	for dir := range d.dirs {
+		if under(dir, oldname) {
+			delete(d.dirs, dir)
+			movedDirs[newname+strings.TrimPrefix(dir, oldname)] = true
+		}
+	}
+	for dir := range movedDirs {
+		d.dirs[dir] = true
+	}
+	return nil
+}
+
+func (fs *faultFS) Link(oldname, newname string) error {
+	d := fs.disk
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	oldname, newname = path.Clean(oldname), path.Clean(newname)
+	if err := fs.op(oldname); err != nil {
+		return err
+	}
+	if err := d.base.Link(oldname, newname); err != nil {
+		return err
+	}
+	d.files[newname] = d.files[oldname]
+	return nil
+}
+
+func (fs *faultFS) Remove(name string) error {
+	d := fs.disk
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	name = path.Clean(name)
+	if err := fs.op(name); err != nil {
+		return err
+	}
+	if err := d.base.Remove(name); err != nil {
+		return err
+	}
+	delete(d.files, name)
+	delete(d.dirs, name)
+	return nil
+}
+
+func (fs *faultFS) RemoveAll(name string) error {
+	d := fs.disk
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	name = path.Clean(name)
+	if err := fs.op(name); err != nil {
+		return err
+	}
+	if err := d.base.RemoveAll(name); err != nil {
+		return err
+	}
+	for file := range d.files {
+		if under(file, name) {
+			delete(d.files, file)
+		}
+	}
+	for dir := range d.dirs {
+		if under(dir, name) {
+			delete(d.dirs, dir)
+		}
+	}
+	return nil
+}
+
+func (fs *faultFS) Stat(name string) (os.FileInfo, error) {
+	fs.disk.mu.Lock()
+	defer fs.disk.mu.Unlock()
+	if err := fs.op(name); err != nil {
+		return nil, err
+	}
+	return fs.disk.base.Stat(name)
+}
+
+func (fs *faultFS) List(dir string) ([]string, error) {
+	fs.disk.mu.Lock()
+	defer fs.disk.mu.Unlock()
+	if err := fs.op(dir); err != nil {
+		return nil, err
+	}
+	return fs.disk.base.List(dir)
+}
+
+func (fs *faultFS) MkdirAll(dir string) error {
+	d := fs.disk
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	dir = path.Clean(dir)
+	if err := fs.op(dir); err != nil {
+		return err
+	}
+	if err := d.base.MkdirAll(dir); err != nil {
+		return err
+	}
+	for ; dir != "." && dir != "/"; dir = path.Dir(dir) {
+		d.dirs[dir] = true
+	}
+	return nil
+}
+
+// 持久化目录: 目录下当前的文件以及子目录在崩溃后保留，此前已经被删除或者重命名的目录项在崩溃后不再出现
+func (fs *faultFS) SyncDir(dir string) error {
+	d := fs.disk
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	dir = path.Clean(dir)
+	if err := fs.op(dir); err != nil {
+		return err
+	}
+	for file := range d.durable {
+		if path.Dir(file) == dir {
+			delete(d.durable, file)
+		}
+	}
+	for file, sf := range d.files {
+		if path.Dir(file) == dir {
+			d.durable[file] = sf
+		}
+	}
+	for sub := range d.durableDirs {
+		if path.Dir(sub) == dir {
+			delete(d.durableDirs, sub)
+		}
+	}
+	for sub := range d.dirs {
+		if path.Dir(sub) == dir {
+			d.durableDirs[sub] = true
+		}
+	}
+	return nil
+}
+
+func (fs *faultFS) Lock(name string) (io.Closer, error) {
+	d := fs.disk
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	name = path.Clean(name)
+	if err := fs.op(name); err != nil {
+		return nil, err
+	}
+	l, err := d.base.Lock(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := d.files[name]; !ok {
+		d.files[name] = &syncedFile{}
+	}
+	fl := &faultLock{l: l}
+	fs.locks = append(fs.locks, fl)
+	return fl, nil
+}
+
+func (fs *faultFS) SameFile(a, b os.FileInfo) bool {
+	return fs.disk.base.SameFile(a, b)
+}
+
+// 崩溃时文件锁已经被释放，之后的释放操作直接忽略
+type faultLock struct {
+	once sync.Once
+	l    io.Closer
+}
+
+func (l *faultLock) Close() error {
+	var err error
+	l.once.Do(func() {
+		err = l.l.Close()
+	})
+	return err
+}
+
+// 故障注入文件系统上打开的文件
+type faultFile struct {
+	fs     *faultFS
+	name   string
+	synced *syncedFile
+	f      vfs.File
+}
+
+func (f *faultFile) do(fn func() (int, error)) (int, error) {
+	f.fs.disk.mu.Lock()
+	defer f.fs.disk.mu.Unlock()
+	if err := f.fs.op(f.name); err != nil {
+		return 0, err
+	}
+	return fn()
+}
+
+// 写操作出错时，开启撕裂写的情况下先写入随机长度的前缀
+func (f *faultFile) write(p []byte, write func([]byte) (int, error)) (int, error) {
+	d := f.fs.disk
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := f.fs.op(f.name); err != nil {
+		if d.torn && !f.fs.dead && len(p) > 0 {
+			n, _ := write(p[:d.rand.Intn(len(p))])
+			return n, err
+		}
+		return 0, err
+	}
+	return write(p)
+}
+
+func (f *faultFile) Read(p []byte) (int, error) {
+	return f.do(func() (int, error) { return f.f.Read(p) })
+}
+
+func (f *faultFile) ReadAt(p []byte, off int64) (int, error) {
+	return f.do(func() (int, error) { return f.f.ReadAt(p, off) })
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	return f.write(p, f.f.Write)
+}
+
+func (f *faultFile) WriteAt(p []byte, off int64) (int, error) {
+	return f.write(p, func(p []byte) (int, error) { return f.f.WriteAt(p, off) })
+}
+
+func (f *faultFile) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	_, err := f.do(func() (n int, err error) {
+		pos, err = f.f.Seek(offset, whence)
+		return
+	})
+	return pos, err
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	_, err := f.do(func() (int, error) { return 0, f.f.Truncate(size) })
+	return err
+}
+
+// 记录文件当前的内容作为持久化的内容
+func (f *faultFile) Sync() error {
+	_, err := f.do(func() (int, error) {
+		name, ok := f.fs.disk.pathOf(f.synced)
+		if !ok {
+			// 文件已经被删除
+			return 0, nil
+		}
+		data, err := vfs.ReadFile(f.fs.disk.base, name)
+		if err != nil {
+			return 0, err
+		}
+		f.synced.data = data
+		return 0, nil
+	})
+	return err
+}
+
+func (f *faultFile) Stat() (os.FileInfo, error) {
+	var info os.FileInfo
+	_, err := f.do(func() (n int, err error) {
+		info, err = f.f.Stat()
+		return
+	})
+	return info, err
+}
+
+// 关闭操作不会失败，保证文件句柄总是能够被释放
+func (f *faultFile) Close() error {
+	return f.f.Close()
+}
@@ -0,0 +1,119 @@
+package filter
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/spaolacci/murmur3"
+)
+
+// 分块布隆过滤器在注册表中的名称
+const blockedBloomFilterName = "blocked_bloom"
+
+// 每个分块的大小，与 cache line 对齐，单位 byte
+const cacheLineSize = 64
+
+// 按 cache line 分块的布隆过滤器. 每个 key 的 k 个 bit 位都落在同一个分块中，判定时只需访问一个 cache line.
+// 代价是同样 bit 数下假阳性率略高于普通的布隆过滤器
+type BlockedBloomFilter struct {
+	bitsPerKey int      // 每个 key 占用的 bit 数
+	hashedKeys []uint64 // 添加到过滤器的一系列 key 的 hash 值
+}
+
+// 分块布隆过滤器构造器. 分块个数根据实际 key 的个数确定
+func NewBlockedBloomFilter(bitsPerKey int) (*BlockedBloomFilter, error) {
+	if bitsPerKey <= 0 {
+		return nil, errors.New("bits per key must be postive")
+	}
+	return &BlockedBloomFilter{
+		bitsPerKey: bitsPerKey,
+	}, nil
+}
+
+// 添加一个 key 到过滤器
+func (bf *BlockedBloomFilter) Add(key []byte) {
+	bf.hashedKeys = append(bf.hashedKeys, murmur3.Sum64(key))
+}
+
+// 判断过滤器中是否存在 key（注意，可能存在假阳性误判问题）
+func (bf *BlockedBloomFilter) Exist(bitmap, key []byte) bool {
+	if bitmap == nil {
+		bitmap = bf.Hash()
+	}
+	// 最后一个 byte 存放哈希函数个数 k，其余部分由若干个分块组成
+	k := bitmap[len(bitmap)-1]
+	numBlocks := uint32((len(bitmap) - 1) / cacheLineSize)
+	if numBlocks == 0 {
+		return true
+	}
+
+	block, h, delta := blockedBloomLocate(murmur3.Sum64(key), numBlocks)
+	probes := bitmap[block*cacheLineSize : (block+1)*cacheLineSize]
+	for i := uint8(0); i < k; i++ {
+		// 在分块内的 512 个 bit 中定位
+		targetBit := h & (cacheLineSize<<3 - 1)
+		if probes[targetBit>>3]&(1<<(targetBit&7)) == 0 {
+			return false
+		}
+		h += delta
+	}
+	return true
+}
+
+// 生成过滤器对应的 bitmap. 最后一个 byte 标识 k 的数值
+func (bf *BlockedBloomFilter) Hash() []byte {
+	// 分块个数 = key 个数 * 每个 key 占用的 bit 数 / 每个分块的 bit 数（向上取整）
+	numBlocks := (len(bf.hashedKeys)*bf.bitsPerKey + cacheLineSize<<3 - 1) / (cacheLineSize << 3)
+	if numBlocks == 0 {
+		numBlocks = 1
+	}
+	k := bestK(bf.bitsPerKey)
+
+	bitmap := make([]byte, numBlocks*cacheLineSize+1)
+	bitmap[len(bitmap)-1] = k
+	for _, hashedKey := range bf.hashedKeys {
+		block, h, delta := blockedBloomLocate(hashedKey, uint32(numBlocks))
+		probes := bitmap[block*cacheLineSize : (block+1)*cacheLineSize]
+		for i := uint8(0); i < k; i++ {
+			targetBit := h & (cacheLineSize<<3 - 1)
+			probes[targetBit>>3] |= 1 << (targetBit & 7)
+			h += delta
+		}
+	}
+	return bitmap
+}
+
+// 重置过滤器
+func (bf *BlockedBloomFilter) Reset() {
+	bf.hashedKeys = bf.hashedKeys[:0]
+}
+
+// 获取过滤器中存在的 key 个数
+func (bf *BlockedBloomFilter) KeyLen() int {
+	return len(bf.hashedKeys)
+}
+
+// 过滤器策略. 参数为每个 key 占用的 bit 数
+func (bf *BlockedBloomFilter) Policy() Policy {
+	return Policy{Name: blockedBloomFilterName, Params: "bits_per_key=" + strconv.Itoa(bf.bitsPerKey)}
+}
+
+// 64 位 hash 值的高 32 位用于选择分块，低 32 位作为分块内的基准 hash 函数，并由其派生出步长
+func blockedBloomLocate(hashedKey uint64, numBlocks uint32) (block, h, delta uint32) {
+	block = uint32((hashedKey >> 32) * uint64(numBlocks) >> 32)
+	h = uint32(hashedKey)
+	delta = (h >> 17) | (h << 15)
+	return
+}
+
+// 根据每个 key 占用的 bit 数推算出最佳的 k. k = ln2 * bitsPerKey，k ∈ [1,30]
+func bestK(bitsPerKey int) uint8 {
+	k := 69 * bitsPerKey / 100
+	if k < 1 {
+		k = 1
+	}
+	if k > 30 {
+		k = 30
+	}
+	return uint8(k)
+}
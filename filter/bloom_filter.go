@@ -2,14 +2,23 @@ package filter
 
 import (
 	"errors"
+	"strconv"
 
 	"github.com/spaolacci/murmur3"
 )
 
+// 布隆过滤器在注册表中的名称
+const (
+	bloomFilterName       = "bloom"
+	legacyBloomFilterName = "legacy_bloom" // 早期版本的布隆过滤器
+)
+
 // 布隆过滤器
 type BloomFilter struct {
-	m          int      // bitmap 的长度，单位 bit
+	m          int      // bitmap 的长度，单位 bit. bitsPerKey 大于 0 时不生效
+	bitsPerKey int      // 每个 key 占用的 bit 数. 大于 0 时，bitmap 的长度根据实际 key 的个数确定
 	hashedKeys []uint32 // 添加到布隆过滤器的一系列 key 的 hash 值
+	legacy     bool     // 是否使用早期版本的 bit 位映射. 早期版本的映射范围包含了末尾存放 k 的 byte
 }
 
 // 布隆过滤器构造器
@@ -22,6 +31,28 @@ func NewBloomFilter(m int) (*BloomFilter, error) {
 	}, nil
 }
 
+// 构造早期版本的布隆过滤器，用于解析未记录过滤器策略的 sstable 中的 bitmap. 早期版本的 bit 位映射范围包含了末尾存放 k 的 byte，
+// 与当前版本的 bitmap 互不兼容
+func NewLegacyBloomFilter(m int) (*BloomFilter, error) {
+	bf, err := NewBloomFilter(m)
+	if err != nil {
+		return nil, err
+	}
+	bf.legacy = true
+	return bf, nil
+}
+
+// 按照每个 key 占用的 bit 数构造布隆过滤器. bitmap 长度随实际 key 的个数变化，假阳性率因此保持稳定.
+// 每个 key 占用 10 bit 时，假阳性率约为 1%
+func NewBloomFilterWithBitsPerKey(bitsPerKey int) (*BloomFilter, error) {
+	if bitsPerKey <= 0 {
+		return nil, errors.New("bits per key must be postive")
+	}
+	return &BloomFilter{
+		bitsPerKey: bitsPerKey,
+	}, nil
+}
+
 // 添加一个 key 到布隆过滤器
 func (bf *BloomFilter) Add(key []byte) {
 	bf.hashedKeys = append(bf.hashedKeys, murmur3.Sum32(key))
@@ -35,6 +66,11 @@ func (bf *BloomFilter) Exist(bitmap, key []byte) bool {
 	}
 	// 获取hash 函数的个数 k
 	k := bitmap[len(bitmap)-1]
+	// 早期版本的 bit 位映射可能落在存放 k 的 byte 上，k 的数值因此被改写变大. 真实的 k 由改写后数值中的部分 bit 位组成，
+	// 不小于其中最低位的 1，只检查这么多个 hash 函数，避免出现假阴性
+	if bf.legacy {
+		k &= -k
+	}
 
 	// 第一个基准 hash 函数 h1 = murmur3.Sum32
 	// 第二个基准 hash 函数 h2 = h1 >> 17 | h2 << 15
@@ -47,7 +83,7 @@ func (bf *BloomFilter) Exist(bitmap, key []byte) bool {
 	delta := (hashedKey >> 17) | (hashedKey << 15)
 	for i := uint32(0); i < uint32(k); i++ {
 		// gi = h1 + i * h2
-		targetBit := (hashedKey + i*delta) % uint32(len(bitmap)<<3)
+		targetBit := (hashedKey + i*delta) % bf.mappedBits(bitmap)
 		// 找到对应的 bit 位，如果值为 1，则继续判断；如果值为 0，则 key 肯定不存在
 		if bitmap[targetBit>>3]&(1<<(targetBit&7)) == 0 {
 			return false
@@ -76,7 +112,7 @@ func (bf *BloomFilter) Hash() []byte {
 		for i := uint32(0); i < uint32(k); i++ {
 			// 第 i 个 hash 函数 gi = h1 + i * h2
 			// 需要标记为 1 的 bit 位
-			targetBit := (hashedKey + i*delta) % uint32(len(bitmap)<<3)
+			targetBit := (hashedKey + i*delta) % bf.mappedBits(bitmap)
 			bitmap[targetBit>>3] |= (1 << (targetBit & 7))
 		}
 	}
@@ -97,17 +133,25 @@ func (bf *BloomFilter) KeyLen() int {
 // 生成一个空的 bitmap
 func (bf *BloomFilter) bitmap(k uint8) []byte {
 	// bytes = bits / 8 (向上取整)
-	bitmapLen := (bf.m + 7) >> 3
+	bitmapLen := (bf.bits() + 7) >> 3
 	bitmap := make([]byte, bitmapLen+1)
 	// 最后一位标识 k 的信息
 	bitmap[bitmapLen] = k
 	return bitmap
 }
 
+// bitmap 中参与 bit 位映射的 bit 数. 最后一个 byte 存放的是 k，不参与 bit 位映射；早期版本的 bitmap 除外
+func (bf *BloomFilter) mappedBits(bitmap []byte) uint32 {
+	if bf.legacy {
+		return uint32(len(bitmap) << 3)
+	}
+	return uint32((len(bitmap) - 1) << 3)
+}
+
 // 根据 m 和 n 推算出最佳的 k
 func (bf *BloomFilter) bestK() uint8 {
 	// k 最佳计算公式：k = ln2 * m / n  m——bitmap 长度 n——key个数
-	k := uint8(69 * bf.m / 100 / len(bf.hashedKeys))
+	k := uint8(69 * bf.bits() / 100 / len(bf.hashedKeys))
 	// k ∈ [1,30]
 	if k < 1 {
 		k = 1
@@ -117,3 +161,25 @@ func (bf *BloomFilter) bestK() uint8 {
 	}
 	return k
 }
+
+// bitmap 的长度，单位 bit. 按照 key 个数确定长度时，至少为 64 bit，避免 key 很少时假阳性率过高
+func (bf *BloomFilter) bits() int {
+	if bf.bitsPerKey <= 0 {
+		return bf.m
+	}
+	if bits := bf.bitsPerKey * len(bf.hashedKeys); bits > 64 {
+		return bits
+	}
+	return 64
+}
+
+// 过滤器策略. 参数为每个 key 占用的 bit 数或者固定的 bitmap 长度
+func (bf *BloomFilter) Policy() Policy {
+	if bf.legacy {
+		return Policy{Name: legacyBloomFilterName, Params: "m=" + strconv.Itoa(bf.m)}
+	}
+	if bf.bitsPerKey > 0 {
+		return Policy{Name: bloomFilterName, Params: "bits_per_key=" + strconv.Itoa(bf.bitsPerKey)}
+	}
+	return Policy{Name: bloomFilterName, Params: "m=" + strconv.Itoa(bf.m)}
+}
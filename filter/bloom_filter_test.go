@@ -2,6 +2,7 @@ package filter
 
 import (
 	"bytes"
+	"fmt"
 	"testing"
 
 	"github.com/spaolacci/murmur3"
@@ -81,3 +82,96 @@ func Test_bitOperation(t *testing.T) {
 	t.Log(hashedKey2_2)
 	t.Log(hashedKey2_2 & 7)
 }
+
+func Test_BloomFilter_BitsPerKey(t *testing.T) {
+	bf, err := NewBloomFilterWithBitsPerKey(10)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// bitmap 的长度随 key 的个数变化，假阳性率保持稳定
+	for _, n := range []int{100, 10000} {
+		for i := 0; i < n; i++ {
+			bf.Add([]byte(fmt.Sprintf("key_%d", i)))
+		}
+		bitmap := bf.Hash()
+		bf.Reset()
+		if expect := (n*10+7)/8 + 1; len(bitmap) != expect {
+			t.Errorf("keys: %d, expect bitmap len: %d, got: %d", n, expect, len(bitmap))
+		}
+
+		for i := 0; i < n; i++ {
+			if !bf.Exist(bitmap, []byte(fmt.Sprintf("key_%d", i))) {
+				t.Errorf("keys: %d, key: key_%d, expect: true, got: false", n, i)
+				return
+			}
+		}
+		var falsePositives int
+		for i := 0; i < 10000; i++ {
+			if bf.Exist(bitmap, []byte(fmt.Sprintf("absent_%d", i))) {
+				falsePositives++
+			}
+		}
+		if rate := float64(falsePositives) / 10000; rate > 0.03 {
+			t.Errorf("keys: %d, false positive rate: %v", n, rate)
+		}
+	}
+
+	if _, err = NewBloomFilterWithBitsPerKey(0); err == nil {
+		t.Error("expect error for non-positive bits per key")
+	}
+}
+
+func Test_BloomFilter_Legacy(t *testing.T) {
+	legacy, err := NewLegacyBloomFilter(256)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for i := 0; i < 50; i++ {
+		legacy.Add([]byte(fmt.Sprintf("key_%d", i)))
+	}
+	bitmap := legacy.Hash()
+
+	// 通过策略从注册表中获取的早期版本过滤器能够解析 bitmap
+	decoder, ok := Lookup(ParsePolicy(legacy.Policy().String()))
+	if !ok {
+		t.Errorf("unknown policy: %s", legacy.Policy())
+		return
+	}
+	for i := 0; i < 50; i++ {
+		if !decoder.Exist(bitmap, []byte(fmt.Sprintf("key_%d", i))) {
+			t.Errorf("key: key_%d, expect: true, got: false", i)
+			return
+		}
+	}
+
+	// bitmap 很短时，早期版本的 bit 位映射很可能落在存放 k 的 byte 上并改写 k，此时同样不能产生假阴性
+	small, _ := NewLegacyBloomFilter(8)
+	for n := 0; n < 100; n++ {
+		small.Reset()
+		for i := 0; i < 3; i++ {
+			small.Add([]byte(fmt.Sprintf("key_%d_%d", n, i)))
+		}
+		bitmap := small.Hash()
+		for i := 0; i < 3; i++ {
+			if !small.Exist(bitmap, []byte(fmt.Sprintf("key_%d_%d", n, i))) {
+				t.Errorf("key: key_%d_%d, bitmap: %v, expect: true, got: false", n, i, bitmap)
+				return
+			}
+		}
+	}
+
+	// 当前版本的 bit 位映射与早期版本不同，按照当前版本解析会产生假阴性
+	bf, _ := NewBloomFilter(256)
+	var misses int
+	for i := 0; i < 50; i++ {
+		if !bf.Exist(bitmap, []byte(fmt.Sprintf("key_%d", i))) {
+			misses++
+		}
+	}
+	if misses == 0 {
+		t.Error("expect legacy bitmap to be incompatible with current bloom filter")
+	}
+}
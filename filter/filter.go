@@ -1,5 +1,13 @@
 package filter
 
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
 // 过滤器. 用于辅助 sstable 快速判定一个 key 是否存在于某个 block 中
 type Filter interface {
 	Add(key []byte)                // 添加 key 到过滤器
@@ -7,4 +15,113 @@ type Filter interface {
 	Hash() []byte                  // 生成过滤器对应的 bitmap
 	Reset()                        // 重置过滤器
 	KeyLen() int                   // 存在多少个 key
+	Policy() Policy                // 过滤器策略
+}
+
+// 过滤器策略，由过滤器名称以及构造参数组成. 随 bitmap 一同写入 sstable，读取时据此从注册表中选择解析 bitmap 的实现
+type Policy struct {
+	Name   string // 过滤器名称，在注册表中唯一
+	Params string // 构造参数
+}
+
+// 策略的字符串形式. 有参数时为 name:params，否则为 name
+func (p Policy) String() string {
+	if p.Params == "" {
+		return p.Name
+	}
+	return p.Name + ":" + p.Params
+}
+
+// 解析策略的字符串形式
+func ParsePolicy(s string) Policy {
+	name, params, _ := strings.Cut(s, ":")
+	return Policy{Name: name, Params: params}
+}
+
+// 根据策略参数构造能够解析 bitmap 的过滤器
+type Decoder func(params string) (Filter, error)
+
+var (
+	registryLock sync.RWMutex
+	registry     = make(map[string]Decoder)
+)
+
+// 注册过滤器的解析器. 使用自定义过滤器的 sstable 在配置的过滤器变更后，需要注册解析器才能继续借助过滤器. 重复注册同一个名称会 panic
+func Register(name string, decoder Decoder) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	if _, ok := registry[name]; ok {
+		panic("filter: register decoder twice for " + name)
+	}
+	registry[name] = decoder
+}
+
+// 根据策略从注册表中获取解析 bitmap 的过滤器. 未注册或者参数无法解析时返回 false
+func Lookup(policy Policy) (Filter, bool) {
+	registryLock.RLock()
+	decoder, ok := registry[policy.Name]
+	registryLock.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	f, err := decoder(policy.Params)
+	if err != nil {
+		return nil, false
+	}
+	return f, true
+}
+
+func init() {
+	Register(bloomFilterName, func(params string) (Filter, error) {
+		if strings.HasPrefix(params, "bits_per_key=") {
+			bitsPerKey, err := intParam(params, "bits_per_key")
+			if err != nil {
+				return nil, err
+			}
+			return NewBloomFilterWithBitsPerKey(bitsPerKey)
+		}
+		m, err := intParam(params, "m")
+		if err != nil {
+			return nil, err
+		}
+		return NewBloomFilter(m)
+	})
+	Register(legacyBloomFilterName, func(params string) (Filter, error) {
+		m, err := intParam(params, "m")
+		if err != nil {
+			return nil, err
+		}
+		return NewLegacyBloomFilter(m)
+	})
+	Register(blockedBloomFilterName, func(params string) (Filter, error) {
+		bitsPerKey, err := intParam(params, "bits_per_key")
+		if err != nil {
+			return nil, err
+		}
+		return NewBlockedBloomFilter(bitsPerKey)
+	})
+	Register(xorFilterName, func(params string) (Filter, error) {
+		if params != "" {
+			return nil, errors.New("xor filter takes no params")
+		}
+		return NewXorFilter(), nil
+	})
+}
+
+// 是否为本项目内置的过滤器策略
+func IsBuiltin(policy Policy) bool {
+	switch policy.Name {
+	case bloomFilterName, legacyBloomFilterName, blockedBloomFilterName, xorFilterName:
+		return true
+	default:
+		return false
+	}
+}
+
+// 解析形如 key=value 的整数参数
+func intParam(params, key string) (int, error) {
+	if !strings.HasPrefix(params, key+"=") {
+		return 0, fmt.Errorf("invalid filter params: %q, expect %s", params, key)
+	}
+	return strconv.Atoi(strings.TrimPrefix(params, key+"="))
 }
@@ -0,0 +1,132 @@
+package filter
+
+import (
+	"fmt"
+	"testing"
+)
+
+// 各过滤器实现，每个 key 均占用约 10 bit
+func newTestFilters(t testing.TB) map[string]Filter {
+	bloom, err := NewBloomFilterWithBitsPerKey(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blockedBloom, err := NewBlockedBloomFilter(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]Filter{
+		"bloom":         bloom,
+		"blocked_bloom": blockedBloom,
+		"xor":           NewXorFilter(),
+	}
+}
+
+// 统计 n 个 key 构造的过滤器的 bitmap 以及在不存在的 key 上的假阳性率
+func measureFilter(f Filter, n int) (bitmap []byte, fpr float64) {
+	f.Reset()
+	for i := 0; i < n; i++ {
+		f.Add([]byte(fmt.Sprintf("key_%d", i)))
+	}
+	bitmap = f.Hash()
+
+	const probes = 100000
+	var falsePositives int
+	for i := 0; i < probes; i++ {
+		if f.Exist(bitmap, []byte(fmt.Sprintf("absent_%d", i))) {
+			falsePositives++
+		}
+	}
+	return bitmap, float64(falsePositives) / probes
+}
+
+func Test_Filter_Implementations(t *testing.T) {
+	for name, f := range newTestFilters(t) {
+		for _, n := range []int{1, 10, 1000, 20000} {
+			bitmap, fpr := measureFilter(f, n)
+			// 不允许假阴性
+			for i := 0; i < n; i++ {
+				if !f.Exist(bitmap, []byte(fmt.Sprintf("key_%d", i))) {
+					t.Errorf("filter: %s, keys: %d, key: key_%d, expect: true, got: false", name, n, i)
+					break
+				}
+			}
+			if fpr > 0.03 {
+				t.Errorf("filter: %s, keys: %d, false positive rate: %v", name, n, fpr)
+			}
+
+			// 通过策略从注册表中获取的过滤器能够解析 bitmap
+			decoder, ok := Lookup(ParsePolicy(f.Policy().String()))
+			if !ok {
+				t.Errorf("filter: %s, unknown policy: %s", name, f.Policy())
+				continue
+			}
+			for i := 0; i < n; i++ {
+				if !decoder.Exist(bitmap, []byte(fmt.Sprintf("key_%d", i))) {
+					t.Errorf("filter: %s, keys: %d, decoder miss key_%d", name, n, i)
+					break
+				}
+			}
+		}
+	}
+
+	for _, policy := range []string{"unknown", "bloom:k=3", "blocked_bloom", "xor:m=8"} {
+		if _, ok := Lookup(ParsePolicy(policy)); ok {
+			t.Errorf("policy: %s, expect unknown", policy)
+		}
+	}
+}
+
+func Test_XorFilter_DuplicateKeys(t *testing.T) {
+	xf := NewXorFilter()
+	for i := 0; i < 100; i++ {
+		xf.Add([]byte("dup"))
+		xf.Add([]byte(fmt.Sprintf("key_%d", i%10)))
+	}
+	bitmap := xf.Hash()
+	if !xf.Exist(bitmap, []byte("dup")) {
+		t.Error("key: dup, expect: true, got: false")
+	}
+	for i := 0; i < 10; i++ {
+		if !xf.Exist(bitmap, []byte(fmt.Sprintf("key_%d", i))) {
+			t.Errorf("key: key_%d, expect: true, got: false", i)
+		}
+	}
+}
+
+func Benchmark_Filter_Exist(b *testing.B) {
+	const n = 100000
+	for name, f := range newTestFilters(b) {
+		b.Run(name, func(b *testing.B) {
+			bitmap, fpr := measureFilter(f, n)
+			keys := make([][]byte, 1024)
+			for i := range keys {
+				keys[i] = []byte(fmt.Sprintf("key_%d", i*(n/len(keys))))
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				f.Exist(bitmap, keys[i&(len(keys)-1)])
+			}
+			// 假阳性率以及每个 key 实际占用的内存
+			b.ReportMetric(fpr*100, "fpr%")
+			b.ReportMetric(float64(len(bitmap)*8)/n, "bits/key")
+		})
+	}
+}
+
+func Benchmark_Filter_Hash(b *testing.B) {
+	const n = 10000
+	for name, f := range newTestFilters(b) {
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < n; i++ {
+				f.Add([]byte(fmt.Sprintf("key_%d", i)))
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				f.Hash()
+			}
+		})
+	}
+}
@@ -0,0 +1,486 @@
+package golsm
+
+import (
+	"bytes"
+	"sort"
+	"time"
+
+	"github.com/xiaoxuxiansheng/golsm/memtable"
+)
+
+// 内部迭代器. 按照 key 由小到大的顺序遍历某个数据源中的原始数据记录
+type internalIterator interface {
+	SeekToFirst()    // 定位到首笔数据
+	Seek(key []byte) // 定位到首个 >= key 的数据
+	Next()           // 移动到下一笔数据
+	Valid() bool     // 当前是否指向一笔有效的数据
+	Key() []byte     // 当前数据的 key
+	Value() []byte   // 当前数据的原始记录
+	Error() error    // 迭代过程中遇到的错误
+	// key 是否被数据源中的范围删除标记覆盖. 范围删除标记只对更老的数据源生效
+	Covered(key []byte) bool
+}
+
+// memtable 迭代器. 基于 memtable 某一时刻的全量数据快照进行遍历
+type memIterator struct {
+	kvs       []*memtable.KV
+	rangeDels rangeTombstones
+	pos       int
+}
+
+func newMemIterator(kvs []*memtable.KV, rangeDels rangeTombstones) *memIterator {
+	return &memIterator{
+		kvs:       kvs,
+		rangeDels: rangeDels,
+		pos:       len(kvs),
+	}
+}
+
+func (m *memIterator) SeekToFirst() {
+	m.pos = 0
+}
+
+func (m *memIterator) Seek(key []byte) {
+	m.pos = sort.Search(len(m.kvs), func(i int) bool {
+		return bytes.Compare(m.kvs[i].Key, key) >= 0
+	})
+}
+
+func (m *memIterator) Next() {
+	m.pos++
+}
+
+func (m *memIterator) Valid() bool {
+	return m.pos < len(m.kvs)
+}
+
+func (m *memIterator) Key() []byte {
+	return m.kvs[m.pos].Key
+}
+
+func (m *memIterator) Value() []byte {
+	return m.kvs[m.pos].Value
+}
+
+func (m *memIterator) Error() error {
+	return nil
+}
+
+func (m *memIterator) Covered(key []byte) bool {
+	return m.rangeDels.covers(key)
+}
+
+// sstable 迭代器. 按需逐个读取 block 块，避免一次性加载整个文件
+type nodeIterator struct {
+	node     *Node
+	indexPos int   // 当前 block 对应的索引下标. index[i] 记录的是其前一个 block 的位置
+	kvs      []*KV // 当前 block 中的 kv 数据
+	pos      int   // 当前 kv 在 block 中的下标
+	err      error
+
+	// 前缀迭代模式下的前缀. 不会读取越过前缀范围的 block
+	prefix []byte
+	// 是否可以借助过滤器跳过不包含前缀的 block
+	prefixFilter bool
+}
+
+func newNodeIterator(node *Node, prefix []byte, prefixFilter bool) *nodeIterator {
+	return &nodeIterator{
+		node:         node,
+		indexPos:     len(node.index),
+		prefix:       prefix,
+		prefixFilter: prefixFilter && node.filter.PrefixExtractor == node.conf.PrefixExtractor.Name(),
+	}
+}
+
+func (n *nodeIterator) SeekToFirst() {
+	// 整个 sstable 中都不存在前缀时，无需读取任何 block
+	if n.prefix != nil && !n.node.mayContainPrefix(n.prefix, n.prefixFilter) {
+		n.loadBlock(len(n.node.index))
+		return
+	}
+	// index[0] 之前不存在 block，首个 block 由 index[1] 记录
+	n.loadBlock(1)
+	n.skipEmptyBlocks()
+}
+
+func (n *nodeIterator) Seek(key []byte) {
+	if n.prefix != nil && !n.node.mayContainPrefix(n.prefix, n.prefixFilter) {
+		n.loadBlock(len(n.node.index))
+		return
+	}
+	// 找到首个 index key >= key 的索引，key 只可能存在于其前一个 block 中
+	i := sort.Search(len(n.node.index), func(i int) bool {
+		return bytes.Compare(n.node.index[i].Key, key) >= 0
+	})
+	if i == 0 {
+		i = 1
+	}
+	n.loadBlock(i)
+	n.pos = sort.Search(len(n.kvs), func(i int) bool {
+		return bytes.Compare(n.kvs[i].Key, key) >= 0
+	})
+	n.skipEmptyBlocks()
+}
+
+func (n *nodeIterator) Next() {
+	n.pos++
+	n.skipEmptyBlocks()
+}
+
+func (n *nodeIterator) Valid() bool {
+	return n.err == nil && n.pos < len(n.kvs)
+}
+
+func (n *nodeIterator) Key() []byte {
+	return n.kvs[n.pos].Key
+}
+
+func (n *nodeIterator) Value() []byte {
+	return n.kvs[n.pos].Value
+}
+
+func (n *nodeIterator) Error() error {
+	return n.err
+}
+
+func (n *nodeIterator) Covered(key []byte) bool {
+	return n.node.rangeDeleted(key)
+}
+
+// 倘若当前 block 已经遍历完毕，则持续加载下一个 block
+func (n *nodeIterator) skipEmptyBlocks() {
+	for n.err == nil && n.pos >= len(n.kvs) && n.indexPos < len(n.node.index) {
+		n.loadBlock(n.indexPos + 1)
+	}
+}
+
+// 加载 index[i] 记录的 block
+func (n *nodeIterator) loadBlock(i int) {
+	n.indexPos, n.kvs, n.pos = i, nil, 0
+	if i >= len(n.node.index) {
+		return
+	}
+
+	index := n.node.index[i]
+	if n.prefix != nil {
+		// block 中的 key 均不小于 index[i-1].Key. 倘若其已经越过前缀范围，之后的 block 都无需读取
+		if pastPrefix(n.node.index[i-1].Key, n.prefix) {
+			n.indexPos = len(n.node.index)
+			return
+		}
+		// 过滤器表明 block 中不存在前缀时，跳过该 block
+		if n.prefixFilter && !n.node.prefixMayExist(index, n.prefix) {
+			return
+		}
+	}
+	n.kvs, n.err = n.node.readBlock(index)
+}
+
+// level 层迭代器. level1~levelk 层的节点有序且互不重叠，可以依次串联遍历
+type levelIterator struct {
+	nodes []*Node
+	pos   int
+	cur   *nodeIterator
+
+	prefix       []byte // 前缀迭代模式下的前缀
+	prefixFilter bool   // 是否可以借助过滤器跳过不包含前缀的 block
+}
+
+func newLevelIterator(nodes []*Node, prefix []byte, prefixFilter bool) *levelIterator {
+	return &levelIterator{
+		nodes:        nodes,
+		pos:          len(nodes),
+		prefix:       prefix,
+		prefixFilter: prefixFilter,
+	}
+}
+
+func (l *levelIterator) SeekToFirst() {
+	l.loadNode(0)
+	if l.cur != nil {
+		l.cur.SeekToFirst()
+	}
+	l.skipEmptyNodes()
+}
+
+func (l *levelIterator) Seek(key []byte) {
+	// 找到首个最大 key >= key 的节点
+	i := sort.Search(len(l.nodes), func(i int) bool {
+		return bytes.Compare(l.nodes[i].End(), key) >= 0
+	})
+	l.loadNode(i)
+	if l.cur != nil {
+		l.cur.Seek(key)
+	}
+	l.skipEmptyNodes()
+}
+
+func (l *levelIterator) Next() {
+	l.cur.Next()
+	l.skipEmptyNodes()
+}
+
+func (l *levelIterator) Valid() bool {
+	return l.cur != nil && l.cur.Valid()
+}
+
+func (l *levelIterator) Key() []byte {
+	return l.cur.Key()
+}
+
+func (l *levelIterator) Value() []byte {
+	return l.cur.Value()
+}
+
+func (l *levelIterator) Error() error {
+	if l.cur == nil {
+		return nil
+	}
+	return l.cur.Error()
+}
+
+func (l *levelIterator) Covered(key []byte) bool {
+	for _, node := range levelBinarySearch(l.nodes, key) {
+		if node.rangeDeleted(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// 倘若当前节点已经遍历完毕，则持续切换到下一个节点
+func (l *levelIterator) skipEmptyNodes() {
+	for l.cur != nil && !l.cur.Valid() && l.cur.Error() == nil {
+		l.loadNode(l.pos + 1)
+		if l.cur != nil {
+			l.cur.SeekToFirst()
+		}
+	}
+}
+
+func (l *levelIterator) loadNode(i int) {
+	l.pos, l.cur = i, nil
+	// 节点之间有序，节点的最小 key 越过前缀范围时，之后的节点都无需遍历
+	if i < len(l.nodes) && l.prefix != nil && pastPrefix(l.nodes[i].Start(), l.prefix) {
+		l.pos = len(l.nodes)
+	}
+	if l.pos < len(l.nodes) {
+		l.cur = newNodeIterator(l.nodes[i], l.prefix, l.prefixFilter)
+	}
+}
+
+// lsm tree 迭代器. 创建时获取 memtable 与各层节点的快照，之后按照 key 由小到大的顺序遍历，
+// 对于同一个 key 只返回基于其最新数据得出的结果. 使用完毕后需要调用 Close 释放快照
+type Iterator struct {
+	cf      *ColumnFamily
+	version *version
+	sources []internalIterator // 由新到旧排列的数据源
+	now     time.Time          // 创建迭代器的时间，用于判断数据是否过期
+	key     []byte
+	value   []byte
+	valid   bool
+	err     error
+	observe func(key []byte) // 每遍历到一个 key 时回调，事务借此记录读取过的 key
+	prefix  []byte           // 前缀迭代模式下的前缀. 只会遍历到包含该前缀的 key
+}
+
+// 创建默认列族的迭代器. 需要调用 SeekToFirst 或者 Seek 完成定位后才能使用
+func (t *Tree) NewIterator() (*Iterator, error) {
+	return t.NewIteratorCF(t.DefaultColumnFamily())
+}
+
+// 创建指定列族的迭代器. 需要调用 SeekToFirst 或者 Seek 完成定位后才能使用
+func (t *Tree) NewIteratorCF(cf *ColumnFamily) (*Iterator, error) {
+	if err := t.checkOpen(); err != nil {
+		return nil, err
+	}
+	if err := t.checkColumnFamily(cf); err != nil {
+		return nil, err
+	}
+	return t.newIterator(cf, nil, nil), nil
+}
+
+// 创建默认列族的前缀迭代器，只遍历包含前缀 prefix 的 key.
+// prefix 恰好为前缀提取器提取出的前缀时，会借助过滤器跳过不包含该前缀的 sstable 以及 block
+func (t *Tree) NewPrefixIterator(prefix []byte) (*Iterator, error) {
+	return t.NewPrefixIteratorCF(t.DefaultColumnFamily(), prefix)
+}
+
+// 创建指定列族的前缀迭代器
+func (t *Tree) NewPrefixIteratorCF(cf *ColumnFamily, prefix []byte) (*Iterator, error) {
+	if err := t.checkOpen(); err != nil {
+		return nil, err
+	}
+	if err := t.checkColumnFamily(cf); err != nil {
+		return nil, err
+	}
+	return t.newIterator(cf, nil, append([]byte{}, prefix...)), nil
+}
+
+// 读取默认列族中包含前缀 prefix 的全部数据，按照 key 由小到大排列
+func (t *Tree) ScanPrefix(prefix []byte) ([]*KV, error) {
+	return t.ScanPrefixCF(t.DefaultColumnFamily(), prefix)
+}
+
+// 读取指定列族中包含前缀 prefix 的全部数据，按照 key 由小到大排列
+func (t *Tree) ScanPrefixCF(cf *ColumnFamily, prefix []byte) ([]*KV, error) {
+	it, err := t.NewPrefixIteratorCF(cf, prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	var kvs []*KV
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		kvs = append(kvs, &KV{Key: it.Key(), Value: it.Value()})
+	}
+	return kvs, it.Error()
+}
+
+// 创建迭代器. sources 为比 lsm tree 中的数据更新的数据源，例如事务中尚未提交的写入；prefix 不为 nil 时为前缀迭代模式
+func (t *Tree) newIterator(cf *ColumnFamily, sources []internalIterator, prefix []byte) *Iterator {
+	it := Iterator{
+		cf:      cf,
+		now:     cf.conf.Clock.Now(),
+		sources: sources,
+		prefix:  prefix,
+	}
+	prefixFilter := prefix != nil && isExtractedPrefix(cf.conf.PrefixExtractor, prefix)
+
+	t.dataLock.RLock()
+	// 1 active memtable 以及 readOnly memtable，由新到旧排列
+	// 范围删除标记只会追加，记录当前的 slice 即可得到快照
+	it.sources = append(it.sources, newMemIterator(cf.memTable.All(), cf.memRangeDels))
+	for i := len(t.rOnlyMemTable) - 1; i >= 0; i-- {
+		item := t.rOnlyMemTable[i].memTables[cf.index]
+		it.sources = append(it.sources, newMemIterator(item.memTable.All(), item.rangeDels))
+	}
+	// 2 各层节点的快照
+	it.version = cf.refVersion()
+	t.dataLock.RUnlock()
+
+	// 3 level0 层节点之间可能存在重叠，每个节点作为一个独立的数据源，按照 index 倒序排列
+	for i := len(it.version.nodes[0]) - 1; i >= 0; i-- {
+		it.sources = append(it.sources, newNodeIterator(it.version.nodes[0][i], prefix, prefixFilter))
+	}
+	// 4 level1~levelk 层，每层作为一个数据源
+	for level := 1; level < len(it.version.nodes); level++ {
+		it.sources = append(it.sources, newLevelIterator(it.version.nodes[level], prefix, prefixFilter))
+	}
+
+	return &it
+}
+
+// 定位到首笔数据. 前缀迭代模式下定位到首个包含前缀的数据
+func (it *Iterator) SeekToFirst() {
+	if it.prefix != nil {
+		it.Seek(it.prefix)
+		return
+	}
+	for _, source := range it.sources {
+		source.SeekToFirst()
+	}
+	it.findNext()
+}
+
+// 定位到首个 >= key 的数据
+func (it *Iterator) Seek(key []byte) {
+	if it.prefix != nil && bytes.Compare(key, it.prefix) < 0 {
+		key = it.prefix
+	}
+	for _, source := range it.sources {
+		source.Seek(key)
+	}
+	it.findNext()
+}
+
+// 移动到下一笔数据
+func (it *Iterator) Next() {
+	it.findNext()
+}
+
+// 当前是否指向一笔有效的数据
+func (it *Iterator) Valid() bool {
+	return it.valid
+}
+
+func (it *Iterator) Key() []byte {
+	return it.key
+}
+
+func (it *Iterator) Value() []byte {
+	return it.value
+}
+
+// 迭代过程中遇到的错误
+func (it *Iterator) Error() error {
+	return it.err
+}
+
+// 释放迭代器持有的快照
+func (it *Iterator) Close() {
+	if it.version != nil {
+		it.version.unref()
+		it.version = nil
+	}
+	it.valid = false
+}
+
+// 在各个数据源中找到最小的 key，收集该 key 由新到旧的全部数据记录并得出结果
+func (it *Iterator) findNext() {
+	it.valid = false
+	for it.err == nil {
+		// 1 找到所有数据源中最小的 key
+		var (
+			minKey []byte
+			found  bool
+		)
+		for _, source := range it.sources {
+			if err := source.Error(); err != nil {
+				it.err = err
+				return
+			}
+			if source.Valid() && (!found || bytes.Compare(source.Key(), minKey) < 0) {
+				minKey, found = source.Key(), true
+			}
+		}
+		// 前缀迭代模式下，遇到首个不包含前缀的 key 即说明遍历结束
+		if !found || (it.prefix != nil && !bytes.HasPrefix(minKey, it.prefix)) {
+			return
+		}
+		key := append([]byte{}, minKey...)
+
+		// 2 由新到旧收集该 key 的数据记录，并推进对应的数据源. key 被某个数据源的范围删除标记覆盖时，视为读到一笔删除标记
+		var entries []*entry
+		for _, source := range it.sources {
+			if source.Valid() && bytes.Equal(source.Key(), key) {
+				e, err := decodeEntry(source.Value())
+				if err != nil {
+					it.err = err
+					return
+				}
+				entries = append(entries, e)
+				source.Next()
+			}
+			if source.Covered(key) {
+				entries = append(entries, newDeleteEntry())
+			}
+		}
+
+		if it.observe != nil {
+			it.observe(key)
+		}
+
+		// 3 得出 key 对应的结果
+		value, ok, err := it.cf.resolveEntries(key, entries, it.now)
+		if err != nil {
+			it.err = err
+			return
+		}
+		if ok {
+			it.key, it.value, it.valid = key, value, true
+			return
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package golsm
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func Test_Iterator(t *testing.T) {
+	conf, err := NewConfig(t.TempDir(),
+		WithSSTSize(4*1024),
+		WithSSTDataBlockSize(512),
+		WithSSTNumPerLevel(1000), // 避免后台自动触发 compact
+	)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	lsmTree, err := NewTree(conf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		waitMemTableFlushed(lsmTree)
+		lsmTree.Close()
+	}()
+
+	// 写入两轮数据，第二轮覆盖偶数 key，使得新老数据分布在 memtable 和不同 level 层中
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key_%05d", i))
+		if err = lsmTree.Put(key, []byte("old")); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	waitMemTableFlushed(lsmTree)
+	lsmTree.DefaultColumnFamily().compactLevel(0)
+	for i := 0; i < 1000; i += 2 {
+		key := []byte(fmt.Sprintf("key_%05d", i))
+		if err = lsmTree.Put(key, []byte("new")); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	iter, err := lsmTree.NewIterator()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer iter.Close()
+
+	var cnt int
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+		expectKey := []byte(fmt.Sprintf("key_%05d", cnt))
+		expectValue := []byte("old")
+		if cnt%2 == 0 {
+			expectValue = []byte("new")
+		}
+		if !bytes.Equal(iter.Key(), expectKey) || !bytes.Equal(iter.Value(), expectValue) {
+			t.Errorf("index: %d, expect: %s -> %s, got: %s -> %s", cnt, expectKey, expectValue, iter.Key(), iter.Value())
+			return
+		}
+		cnt++
+	}
+	if err = iter.Error(); err != nil {
+		t.Error(err)
+		return
+	}
+	if cnt != 1000 {
+		t.Errorf("expect cnt: 1000, got: %d", cnt)
+	}
+
+	iter.Seek([]byte("key_00500"))
+	if !iter.Valid() || !bytes.Equal(iter.Key(), []byte("key_00500")) {
+		t.Errorf("seek key_00500 failed, got: %s", iter.Key())
+	}
+	iter.Seek([]byte("key_004995"))
+	if !iter.Valid() || !bytes.Equal(iter.Key(), []byte("key_00500")) {
+		t.Errorf("seek key_004995 failed, got: %s", iter.Key())
+	}
+	iter.Seek([]byte("key_99999"))
+	if iter.Valid() {
+		t.Errorf("seek key_99999 expect invalid, got: %s", iter.Key())
+	}
+}
+
+func Test_Iterator_Prefix(t *testing.T) {
+	conf, err := NewConfig(t.TempDir(),
+		WithSSTSize(4*1024),
+		WithSSTDataBlockSize(256),
+		WithSSTNumPerLevel(1000), // 避免后台自动触发 compact
+		WithPrefixExtractor(NewDelimiterPrefixExtractor('/')),
+	)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	lsmTree, err := NewTree(conf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		waitMemTableFlushed(lsmTree)
+		lsmTree.Close()
+	}()
+
+	// 各租户的数据分布在 memtable 以及不同 level 层中. 其中 tenant_3 的部分数据被删除
+	expect := make(map[string][]*KV)
+	for _, tenant := range []int{1, 3, 5, 7} {
+		for i := 0; i < 100; i++ {
+			key := []byte(fmt.Sprintf("tenant_%d/entity/%03d", tenant, i))
+			value := []byte(fmt.Sprintf("v%d", i))
+			if err = lsmTree.Put(key, value); err != nil {
+				t.Error(err)
+				return
+			}
+			if tenant == 3 && i%10 == 0 {
+				continue
+			}
+			prefix := fmt.Sprintf("tenant_%d/", tenant)
+			expect[prefix] = append(expect[prefix], &KV{Key: key, Value: value})
+		}
+		if tenant == 3 {
+			waitMemTableFlushed(lsmTree)
+			lsmTree.DefaultColumnFamily().compactLevel(0)
+		}
+	}
+	for i := 0; i < 100; i += 10 {
+		if err = lsmTree.Delete([]byte(fmt.Sprintf("tenant_3/entity/%03d", i))); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	// 不包含分隔符的 key 不存在前缀
+	if err = lsmTree.Put([]byte("tenant_3"), []byte("v")); err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, prefix := range []string{"tenant_1/", "tenant_3/", "tenant_4/", "tenant_7/", "tenant_5/entity/01"} {
+		kvs, err := lsmTree.ScanPrefix([]byte(prefix))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		want := expect[prefix]
+		if prefix == "tenant_5/entity/01" {
+			want = expect["tenant_5/"][10:20]
+		}
+		if err = assertDataEqual(want, kvs); err != nil {
+			t.Errorf("prefix: %s, %v", prefix, err)
+			return
+		}
+	}
+
+	// 前缀迭代器同样支持 Seek，且不会越过前缀范围
+	iter, err := lsmTree.NewPrefixIterator([]byte("tenant_5/"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer iter.Close()
+	var cnt int
+	for iter.Seek([]byte("tenant_5/entity/090")); iter.Valid(); iter.Next() {
+		cnt++
+	}
+	if cnt != 10 {
+		t.Errorf("expect 10 keys, got: %d", cnt)
+	}
+
+	// 过滤器中包含前缀，不包含前缀的 sstable 可以直接跳过
+	var skipped int
+	for _, node := range lsmTree.DefaultColumnFamily().nodes[1] {
+		if node.filter.PrefixExtractor != conf.PrefixExtractor.Name() {
+			t.Errorf("expect prefix extractor: %s, got: %s", conf.PrefixExtractor.Name(), node.filter.PrefixExtractor)
+			return
+		}
+		if !node.mayContainPrefix([]byte("tenant_2/"), true) {
+			skipped++
+		}
+	}
+	if skipped == 0 {
+		t.Error("expect sstables skipped by prefix filter")
+	}
+}
@@ -0,0 +1,171 @@
+package golsm
+
+import (
+	"errors"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+var (
+	ErrLockTimeout = errors.New("lock wait timeout")
+	ErrDeadlock    = errors.New("deadlock detected")
+)
+
+// 行锁对应的 key
+type lockKey struct {
+	cf  *ColumnFamily
+	key string
+}
+
+// 行锁管理器. 行锁按照 key 的哈希值分散到多个分片中，降低锁竞争.
+// 行锁为排他锁，同一个事务可以重复加锁
+type lockManager struct {
+	stripes []*lockStripe
+
+	// 等待图. 事务 -> 其正在等待的行锁以及持有者. 每个事务同一时刻至多等待一把行锁
+	waitLock sync.Mutex
+	waitFor  map[uint64]waitEdge
+}
+
+// 等待图中的一条边: waiter 正在等待 owner 持有的行锁 key
+type waitEdge struct {
+	waiter uint64
+	owner  uint64
+	key    lockKey
+}
+
+// 行锁分片
+type lockStripe struct {
+	mu sync.Mutex
+	// 行锁 -> 持有者事务 id
+	owners map[lockKey]uint64
+	// 分片中有行锁被释放时关闭该 chan，以唤醒等待者，随后替换为新的 chan
+	released chan struct{}
+}
+
+func newLockManager(stripes int) *lockManager {
+	l := lockManager{
+		stripes: make([]*lockStripe, stripes),
+		waitFor: make(map[uint64]waitEdge),
+	}
+	for i := range l.stripes {
+		l.stripes[i] = &lockStripe{
+			owners:   make(map[lockKey]uint64),
+			released: make(chan struct{}),
+		}
+	}
+	return &l
+}
+
+func (l *lockManager) stripe(key lockKey) *lockStripe {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key.cf.name))
+	_, _ = h.Write([]byte(key.key))
+	return l.stripes[h.Sum32()%uint32(len(l.stripes))]
+}
+
+// 事务 txID 获取行锁. 行锁被其他事务持有时等待其释放，等待超过 timeout 返回 ErrLockTimeout.
+// 开启死锁检测时，倘若等待形成了环路，则直接返回 ErrDeadlock
+func (l *lockManager) lock(txID uint64, key lockKey, timeout time.Duration, deadlockDetect bool) error {
+	stripe := l.stripe(key)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	defer l.stopWaiting(txID)
+
+	for {
+		stripe.mu.Lock()
+		owner, ok := stripe.owners[key]
+		if !ok || owner == txID {
+			stripe.owners[key] = txID
+			stripe.mu.Unlock()
+			return nil
+		}
+		released := stripe.released
+		// 在持有分片锁时记录等待关系，保证记录的持有者在此之前没有释放行锁
+		l.startWaiting(waitEdge{waiter: txID, owner: owner, key: key})
+		stripe.mu.Unlock()
+
+		if deadlockDetect && l.detectDeadlock(txID) {
+			return ErrDeadlock
+		}
+
+		select {
+		case <-released:
+		case <-timer.C:
+			return ErrLockTimeout
+		}
+	}
+}
+
+// 释放事务持有的行锁
+func (l *lockManager) unlock(txID uint64, keys []lockKey) {
+	for _, key := range keys {
+		stripe := l.stripe(key)
+		stripe.mu.Lock()
+		if owner, ok := stripe.owners[key]; ok && owner == txID {
+			delete(stripe.owners, key)
+			close(stripe.released)
+			stripe.released = make(chan struct{})
+		}
+		stripe.mu.Unlock()
+	}
+}
+
+func (l *lockManager) startWaiting(edge waitEdge) {
+	l.waitLock.Lock()
+	l.waitFor[edge.waiter] = edge
+	l.waitLock.Unlock()
+}
+
+// 事务 txID 的等待是否形成了死锁
+func (l *lockManager) detectDeadlock(txID uint64) bool {
+	cycle := l.findCycle(txID)
+	if len(cycle) == 0 {
+		return false
+	}
+
+	// 持有者释放行锁之后，等待者被唤醒之前仍然保留着等待关系，因此环路中的边可能已经过时.
+	// 逐一确认环路中的行锁仍然被对应的事务持有，并且等待者仍在等待
+	for _, edge := range cycle {
+		stripe := l.stripe(edge.key)
+		stripe.mu.Lock()
+		owner, ok := stripe.owners[edge.key]
+		stripe.mu.Unlock()
+		if !ok || owner != edge.owner {
+			return false
+		}
+	}
+	l.waitLock.Lock()
+	defer l.waitLock.Unlock()
+	for _, edge := range cycle {
+		if l.waitFor[edge.waiter] != edge {
+			return false
+		}
+	}
+	return true
+}
+
+// 沿着等待图从事务 txID 出发，倘若最终回到了事务自身，返回途经的边.
+// 其他事务之间可能已经存在未开启死锁检测的环路，因此至多走过等待图中的全部边
+func (l *lockManager) findCycle(txID uint64) []waitEdge {
+	l.waitLock.Lock()
+	defer l.waitLock.Unlock()
+
+	var cycle []waitEdge
+	edge, ok := l.waitFor[txID]
+	for i := 0; ok && i < len(l.waitFor); i++ {
+		cycle = append(cycle, edge)
+		if edge.owner == txID {
+			return cycle
+		}
+		edge, ok = l.waitFor[edge.owner]
+	}
+	return nil
+}
+
+func (l *lockManager) stopWaiting(txID uint64) {
+	l.waitLock.Lock()
+	delete(l.waitFor, txID)
+	l.waitLock.Unlock()
+}
@@ -1,5 +1,7 @@
 package memtable
 
+import "bytes"
+
 // memtable 构造器
 type MemTableConstructor func() MemTable
 
@@ -12,6 +14,28 @@ type MemTable interface {
 	EntriesCnt() int               // kv 对数量
 }
 
+// 支持范围读取的有序表. MemTable 的实现可以选择实现该 interface，避免范围读取时遍历全量数据
+type RangeReader interface {
+	Range(start, end []byte) []*KV // 返回 key 位于 [start, end) 范围内的 kv 对数据
+}
+
 type KV struct {
 	Key, Value []byte
 }
+
+// 读取有序表中 key 位于 [start, end) 范围内的 kv 对数据. 有序表没有实现 RangeReader 时，遍历全量数据进行过滤
+func Range(m MemTable, start, end []byte) []*KV {
+	if r, ok := m.(RangeReader); ok {
+		return r.Range(start, end)
+	}
+	var kvs []*KV
+	for _, kv := range m.All() {
+		if bytes.Compare(kv.Key, end) >= 0 {
+			break
+		}
+		if bytes.Compare(kv.Key, start) >= 0 {
+			kvs = append(kvs, kv)
+		}
+	}
+	return kvs
+}
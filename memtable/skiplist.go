@@ -98,6 +98,27 @@ func (s *Skiplist) All() []*KV {
 	return kvs
 }
 
+// 获取跳表中 key 位于 [start, end) 范围内的 kv 对数据
+func (s *Skiplist) Range(start, end []byte) []*KV {
+	// 层数自高向低，找到 key 小于 start 的最后一个节点
+	move := s.head
+	for level := len(s.head.nexts) - 1; level >= 0; level-- {
+		for move.nexts[level] != nil && bytes.Compare(move.nexts[level].key, start) < 0 {
+			move = move.nexts[level]
+		}
+	}
+
+	// 从第 0 层开始自左向右依次遍历读取，直到越过 end
+	var kvs []*KV
+	for ; len(move.nexts) > 0 && move.nexts[0] != nil && bytes.Compare(move.nexts[0].key, end) < 0; move = move.nexts[0] {
+		kvs = append(kvs, &KV{
+			Key:   move.nexts[0].key,
+			Value: move.nexts[0].value,
+		})
+	}
+	return kvs
+}
+
 // 跳表数据量大小，单位 byte
 func (s *Skiplist) Size() int {
 	return s.size
@@ -42,3 +42,32 @@ func Test_Skiplist(t *testing.T) {
 	assert.Equal(t, kvs[3].Key, []byte("bc"))
 	assert.Equal(t, kvs[3].Value, []byte("bbb"))
 }
+
+func Test_Skiplist_Range(t *testing.T) {
+	skiplist := NewSkiplist()
+	assert.Empty(t, skiplist.(RangeReader).Range([]byte("a"), []byte("z")))
+
+	for _, key := range []string{"d", "b", "f", "a", "e", "c"} {
+		skiplist.Put([]byte(key), []byte(key+key))
+	}
+
+	keys := func(kvs []*KV) []string {
+		var res []string
+		for _, kv := range kvs {
+			res = append(res, string(kv.Key))
+		}
+		return res
+	}
+	assert.Equal(t, []string{"b", "c", "d"}, keys(skiplist.(RangeReader).Range([]byte("b"), []byte("e"))))
+	assert.Equal(t, []string{"a", "b"}, keys(skiplist.(RangeReader).Range([]byte("0"), []byte("bb"))))
+	assert.Equal(t, []string{"e", "f"}, keys(skiplist.(RangeReader).Range([]byte("dd"), []byte("z"))))
+	assert.Empty(t, skiplist.(RangeReader).Range([]byte("g"), []byte("z")))
+	assert.Empty(t, skiplist.(RangeReader).Range([]byte("c"), []byte("c")))
+
+	kvs := skiplist.(RangeReader).Range([]byte("c"), []byte("d"))
+	assert.Equal(t, 1, len(kvs))
+	assert.Equal(t, []byte("cc"), kvs[0].Value)
+
+	// 没有实现 RangeReader 的有序表遍历全量数据进行过滤
+	assert.Equal(t, []string{"b", "c", "d"}, keys(Range(struct{ MemTable }{skiplist}, []byte("b"), []byte("e"))))
+}
@@ -0,0 +1,119 @@
+package golsm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+var (
+	ErrMergeOperatorNotSet   = errors.New("merge operator not set")
+	ErrInvalidMergeOperand   = errors.New("invalid merge operand")
+	ErrMergeOperatorMismatch = errors.New("merge operator mismatch")
+)
+
+// merge 操作符. 用于实现读-改-写语义的数据更新，如计数器累加、字符串追加等
+// 写入时只记录操作数，在读取或者 compact 时才将操作数与原值进行合并
+type MergeOperator interface {
+	// 操作符名称
+	Name() string
+	// 将 key 的原值与一系列操作数合并为最终结果. existing 为 nil 表示 key 原本不存在；operands 按照写入顺序由旧到新排列
+	FullMerge(key, existing []byte, operands [][]byte) ([]byte, error)
+	// 将两个相邻的操作数合并为一个. 第二个返回值为 false 表示无法合并
+	PartialMerge(key, left, right []byte) ([]byte, bool)
+}
+
+// 校验各列族的 merge 操作符名称与文件版本中的记录一致，并记录当前使用的名称. 已经写入的操作数只能由同一个操作符合并，
+// 更换操作符会得出错误的结果，返回 ErrMergeOperatorMismatch. 未设置操作符的列族沿用文件版本中的记录
+func (t *Tree) checkMergeOperators(v *liveVersion) error {
+	names := make(map[string]string)
+	if v != nil {
+		for cfName, name := range v.MergeOperators {
+			names[cfName] = name
+		}
+	}
+	for _, cf := range t.cfs {
+		op := cf.conf.MergeOperator
+		if op == nil {
+			continue
+		}
+		if name, ok := names[cf.name]; ok && name != op.Name() {
+			return ErrMergeOperatorMismatch
+		}
+		names[cf.name] = op.Name()
+	}
+	t.mergeOperators = names
+	return nil
+}
+
+// uint64 累加操作符. 值与操作数均为 8 byte 小端编码的 uint64
+type UInt64AddOperator struct{}
+
+func NewUInt64AddOperator() MergeOperator {
+	return UInt64AddOperator{}
+}
+
+func (UInt64AddOperator) Name() string {
+	return "uint64add"
+}
+
+func (UInt64AddOperator) FullMerge(key, existing []byte, operands [][]byte) ([]byte, error) {
+	var sum uint64
+	if existing != nil {
+		if len(existing) != 8 {
+			return nil, ErrInvalidMergeOperand
+		}
+		sum = binary.LittleEndian.Uint64(existing)
+	}
+
+	for _, operand := range operands {
+		if len(operand) != 8 {
+			return nil, ErrInvalidMergeOperand
+		}
+		sum += binary.LittleEndian.Uint64(operand)
+	}
+
+	return EncodeUInt64(sum), nil
+}
+
+func (UInt64AddOperator) PartialMerge(key, left, right []byte) ([]byte, bool) {
+	if len(left) != 8 || len(right) != 8 {
+		return nil, false
+	}
+	return EncodeUInt64(binary.LittleEndian.Uint64(left) + binary.LittleEndian.Uint64(right)), true
+}
+
+// 将 uint64 编码为 UInt64AddOperator 使用的 8 byte 小端格式
+func EncodeUInt64(v uint64) []byte {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, v)
+	return buf
+}
+
+// 字符串追加操作符. 各个操作数之间通过分隔符拼接
+type StringAppendOperator struct {
+	delimiter []byte
+}
+
+func NewStringAppendOperator(delimiter []byte) MergeOperator {
+	return &StringAppendOperator{
+		delimiter: delimiter,
+	}
+}
+
+func (s *StringAppendOperator) Name() string {
+	return "stringappend"
+}
+
+func (s *StringAppendOperator) FullMerge(key, existing []byte, operands [][]byte) ([]byte, error) {
+	parts := make([][]byte, 0, len(operands)+1)
+	if existing != nil {
+		parts = append(parts, existing)
+	}
+	parts = append(parts, operands...)
+	return bytes.Join(parts, s.delimiter), nil
+}
+
+func (s *StringAppendOperator) PartialMerge(key, left, right []byte) ([]byte, bool) {
+	return bytes.Join([][]byte{left, right}, s.delimiter), true
+}
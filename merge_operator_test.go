@@ -0,0 +1,93 @@
+package golsm
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_UInt64AddOperator(t *testing.T) {
+	op := NewUInt64AddOperator()
+
+	v, err := op.FullMerge([]byte("k"), nil, [][]byte{EncodeUInt64(1), EncodeUInt64(2)})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3), binary.LittleEndian.Uint64(v))
+
+	v, err = op.FullMerge([]byte("k"), EncodeUInt64(10), [][]byte{EncodeUInt64(5)})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(15), binary.LittleEndian.Uint64(v))
+
+	_, err = op.FullMerge([]byte("k"), nil, [][]byte{[]byte("a")})
+	assert.Equal(t, ErrInvalidMergeOperand, err)
+
+	v, ok := op.PartialMerge([]byte("k"), EncodeUInt64(7), EncodeUInt64(8))
+	assert.True(t, ok)
+	assert.Equal(t, uint64(15), binary.LittleEndian.Uint64(v))
+}
+
+func Test_StringAppendOperator(t *testing.T) {
+	op := NewStringAppendOperator([]byte(","))
+
+	v, err := op.FullMerge([]byte("k"), nil, [][]byte{[]byte("a"), []byte("b")})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("a,b"), v)
+
+	v, err = op.FullMerge([]byte("k"), []byte{}, [][]byte{[]byte("a")})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte(",a"), v)
+
+	v, ok := op.PartialMerge([]byte("k"), []byte("a"), []byte("b"))
+	assert.True(t, ok)
+	assert.Equal(t, []byte("a,b"), v)
+}
+
+func Test_Tree_MergeOperatorMismatch(t *testing.T) {
+	dir := t.TempDir()
+	cfDesc := func(op MergeOperator) ColumnFamilyDescriptor {
+		return ColumnFamilyDescriptor{Name: "counters", Opts: []ConfigOption{WithMergeOperator(op)}}
+	}
+	open := func(op, cfOp MergeOperator) (*Tree, error) {
+		var opts []ConfigOption
+		if op != nil {
+			opts = append(opts, WithMergeOperator(op))
+		}
+		conf, err := NewConfig(dir, opts...)
+		if err != nil {
+			return nil, err
+		}
+		return NewTree(conf, cfDesc(cfOp))
+	}
+
+	lsmTree, err := open(NewStringAppendOperator([]byte(",")), NewUInt64AddOperator())
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Nil(t, lsmTree.Merge([]byte("a"), []byte("1")))
+	assert.Nil(t, lsmTree.Close())
+
+	// 默认列族或者其他列族更换了 merge 操作符，拒绝打开
+	_, err = open(NewUInt64AddOperator(), NewUInt64AddOperator())
+	assert.Equal(t, ErrMergeOperatorMismatch, err)
+	_, err = open(NewStringAppendOperator([]byte(",")), NewStringAppendOperator([]byte(",")))
+	assert.Equal(t, ErrMergeOperatorMismatch, err)
+
+	// 未设置操作符时可以打开，文件版本中的记录保留下来
+	lsmTree, err = open(nil, NewUInt64AddOperator())
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Nil(t, lsmTree.Close())
+	_, err = open(NewUInt64AddOperator(), NewUInt64AddOperator())
+	assert.Equal(t, ErrMergeOperatorMismatch, err)
+
+	lsmTree, err = open(NewStringAppendOperator([]byte(",")), NewUInt64AddOperator())
+	if !assert.Nil(t, err) {
+		return
+	}
+	v, ok, err := lsmTree.Get([]byte("a"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("1"), v)
+	assert.Nil(t, lsmTree.Close())
+}
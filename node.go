@@ -4,63 +4,148 @@ import (
 	"bytes"
 	"os"
 	"path"
+	"sync"
+	"sync/atomic"
+
+	"github.com/xiaoxuxiansheng/golsm/filter"
 )
 
 // lsm tree 中的一个节点. 对应一个 sstables
 type Node struct {
-	conf          *Config           // 配置文件
-	file          string            // sstable 对应的文件名，不含目录路径
-	level         int               // sstable 所在 level 层级
-	seq           int32             // sstable 的 seq 序列号. 对应为文件名中的 level_seq.sst 中的 seq
-	size          uint64            // sstable 的大小，单位 byte
-	blockToFilter map[uint64][]byte // 各 block 对应的 filter bitmap
-	index         []*Index          // 各 block 对应的索引
-	startKey      []byte            // sstable 中最小的 key
-	endKey        []byte            // sstable 中最大的 key
-	sstReader     *SSTReader        // 读取 sst 文件的 reader 入口
-}
-
-func NewNode(conf *Config, file string, sstReader *SSTReader, level int, seq int32, size uint64, blockToFilter map[uint64][]byte, index []*Index) *Node {
-	return &Node{
-		conf:          conf,
-		file:          file,
-		sstReader:     sstReader,
-		level:         level,
-		seq:           seq,
-		size:          size,
-		blockToFilter: blockToFilter,
-		index:         index,
-		startKey:      index[0].Key,
-		endKey:        index[len(index)-1].Key,
+	conf      *Config           // 配置文件
+	file      string            // sstable 对应的文件名，不含目录路径
+	level     int               // sstable 所在 level 层级
+	seq       int32             // sstable 的 seq 序列号. 对应为文件名中的 level_seq.sst 中的 seq
+	size      uint64            // sstable 的大小，单位 byte
+	filter    *SSTFilter        // sstable 中的过滤器信息
+	decoder   filter.Filter     // 解析过滤器 bitmap 的实现. 为 nil 时不借助过滤器
+	index     []*Index          // 各 block 对应的索引
+	rangeDels rangeTombstones   // sstable 中的范围删除标记
+	startKey  []byte            // sstable 中真实的最小 key，范围删除标记的起点也计算在内
+	endKey    []byte            // sstable 中真实的最大 key，范围删除标记的终点也计算在内. 来自范围删除标记时，endKey 本身不在范围内
+	sstReader *SSTReader        // 读取 sst 文件的 reader 入口
+	stats     *filterStats      // 所属列族的过滤器统计. 为 nil 时不统计
+	blobs     *blobSet          // 所属列族的 blob 文件. 为 nil 时说明节点没有引用 blob 文件
+	blobRefs  map[uint64]uint64 // 节点引用的各个 blob 文件，以及引用的 value 大小之和
+	refs      atomic.Int32      // 引用计数. lsm tree 本身以及读流程获取的快照都会持有引用，归零时销毁节点
+	keepFile  bool              // 销毁节点时只关闭 sst reader，不删除 sst 文件. 用于只读模式，以及新的文件版本记录失败时
+	legacy    bool              // 是否为早期版本的 sstable. 其中的 value 为原始值，读取时需要转换为数据记录
+
+	// 删除 sst 文件失败时的回调. 为 nil 时忽略错误
+	onRemoveError func(err error)
+
+	// sstable 的属性信息，首次访问时从属性块中读取
+	propsOnce sync.Once
+	props     *Properties
+	propsErr  error
+}
+
+func NewNode(conf *Config, file string, sstReader *SSTReader, level int, seq int32, size uint64, filter *SSTFilter, index []*Index, rangeDels []*RangeTombstone) *Node {
+	node := Node{
+		conf:      conf,
+		file:      file,
+		sstReader: sstReader,
+		level:     level,
+		seq:       seq,
+		size:      size,
+		filter:    filter,
+		decoder:   filterDecoder(conf, filter),
+		index:     index,
+		rangeDels: rangeDels,
+	}
+	// 格式版本记录在 footer 中. 调用方通常已经加载了 footer，否则在此加载，加载失败时按照当前版本处理
+	if sstReader.indexOffset == 0 {
+		_ = sstReader.ReadFooter()
+	}
+	node.legacy = sstReader.indexOffset > 0 && sstReader.formatVersion == sstFormatLegacy
+	// 节点中数据的真实 key 范围
+	if len(index) > 0 {
+		node.startKey, node.endKey = node.dataBounds()
+	}
+	// key 范围需要涵盖范围删除标记，保证 compact 流程能够将其与更深 level 层中被覆盖的数据一同归并
+	if len(node.rangeDels) > 0 {
+		start, end := node.rangeDels.bounds()
+		if len(index) == 0 || bytes.Compare(start, node.startKey) < 0 {
+			node.startKey = start
+		}
+		if len(index) == 0 || bytes.Compare(end, node.endKey) > 0 {
+			node.endKey = end
+		}
+	}
+	// 初始引用由 lsm tree 持有
+	node.refs.Store(1)
+	return &node
+}
+
+// sstable 中数据的最小 key 和最大 key，优先取自属性. 早期版本的 sstable 没有属性，首个索引的 key 只是小于最小 key 的分隔符，
+// 需要读取首个 block 得到最小的 key；最后一个索引的 key 即为最后一笔数据的 key. 读取失败时退化为索引中的 key，范围只会偏大
+func (n *Node) dataBounds() ([]byte, []byte) {
+	if props, err := n.Properties(); err == nil && props != nil && props.NumEntries > 0 {
+		return props.SmallestKey, props.LargestKey
+	}
+	start, end := n.index[0].Key, n.index[len(n.index)-1].Key
+	if len(n.index) > 1 {
+		if kvs, err := n.readBlock(n.index[1]); err == nil && len(kvs) > 0 {
+			start = kvs[0].Key
+		}
 	}
+	return start, end
 }
 
 func (n *Node) GetAll() ([]*KV, error) {
-	return n.sstReader.ReadData()
+	kvs, err := n.sstReader.ReadData()
+	if err != nil {
+		return nil, err
+	}
+	n.upgradeLegacy(kvs)
+	return kvs, nil
+}
+
+// 读取并解析 index 记录的 block
+func (n *Node) readBlock(index *Index) ([]*KV, error) {
+	block, err := n.sstReader.ReadBlock(index.PrevBlockOffset, index.PrevBlockSize)
+	if err != nil {
+		return nil, err
+	}
+	kvs, err := n.sstReader.ReadBlockData(block)
+	if err != nil {
+		return nil, err
+	}
+	n.upgradeLegacy(kvs)
+	return kvs, nil
+}
+
+// 早期版本的 sstable 中 value 为原始值，将其转换为普通 kv 数据的记录
+func (n *Node) upgradeLegacy(kvs []*KV) {
+	if !n.legacy {
+		return
+	}
+	for _, kv := range kvs {
+		kv.Value = encodeEntry(newValueEntry(kv.Value))
+	}
 }
 
 // 查看是否在节点中
 func (n *Node) Get(key []byte) ([]byte, bool, error) {
-	// 通过索引定位到具体的块
-	index, ok := n.binarySearchIndex(key, 0, len(n.index)-1)
-	if !ok {
+	// 只包含范围删除标记的节点中没有数据
+	if len(n.index) == 0 {
 		return nil, false, nil
 	}
 
-	// 布隆过滤器辅助判断 key 是否存在
-	bitmap := n.blockToFilter[index.PrevBlockOffset]
-	if ok = n.conf.Filter.Exist(bitmap, key); !ok {
+	// 通过索引定位到具体的块. index[0] 之前不存在 block，首个 block 由 index[1] 记录
+	index, ok := n.binarySearchIndex(key, 1, len(n.index)-1)
+	if !ok {
 		return nil, false, nil
 	}
 
-	// 读取对应的块
-	block, err := n.sstReader.ReadBlock(index.PrevBlockOffset, index.PrevBlockSize)
-	if err != nil {
-		return nil, false, err
+	// 布隆过滤器辅助判断 key 是否存在
+	mayExist, filtered := n.keyMayExist(index, key)
+	if !mayExist {
+		return nil, false, nil
 	}
 
-	// 将块数据转为对应的 kv 对
-	kvs, err := n.sstReader.ReadBlockData(block)
+	// 读取对应的块，将块数据转为对应的 kv 对
+	kvs, err := n.readBlock(index)
 	if err != nil {
 		return nil, false, err
 	}
@@ -71,9 +156,152 @@ func (n *Node) Get(key []byte) ([]byte, bool, error) {
 		}
 	}
 
+	// 过滤器判定存在，实际却不存在
+	if filtered {
+		n.stats.recordFalsePositive()
+	}
 	return nil, false, nil
 }
 
+// 批量查找一组由小到大排列的 key，返回与 keys 一一对应的原始记录.
+// 落在同一个 block 中的 key 共享一次 block 的读取与解析
+func (n *Node) MultiGet(keys [][]byte) ([][]byte, []bool, error) {
+	values, oks := make([][]byte, len(keys)), make([]bool, len(keys))
+	// 只包含范围删除标记的节点中没有数据
+	if len(n.index) == 0 {
+		return values, oks, nil
+	}
+
+	for i := 0; i < len(keys); {
+		// 1 通过索引定位到具体的块. 超出节点最大 key 的 key 都不在节点中
+		index, ok := n.binarySearchIndex(keys[i], 1, len(n.index)-1)
+		if !ok {
+			break
+		}
+
+		// 2 key 有序，因此落在同一个块中的 key 是连续的. 借助布隆过滤器筛选出可能存在的 key，并记录各自是否经过了过滤器的判定
+		var candidates []int
+		var filtered []bool
+		j := i
+		for ; j < len(keys) && bytes.Compare(keys[j], index.Key) <= 0; j++ {
+			if mayExist, f := n.keyMayExist(index, keys[j]); mayExist {
+				candidates, filtered = append(candidates, j), append(filtered, f)
+			}
+		}
+		i = j
+		if len(candidates) == 0 {
+			continue
+		}
+
+		// 3 读取并解析对应的块
+		kvs, err := n.readBlock(index)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// 4 块中的 kv 对同样有序，双指针进行匹配
+		k := 0
+		for x, c := range candidates {
+			for k < len(kvs) && bytes.Compare(kvs[k].Key, keys[c]) < 0 {
+				k++
+			}
+			if k < len(kvs) && bytes.Equal(kvs[k].Key, keys[c]) {
+				values[c], oks[c] = kvs[k].Value, true
+				continue
+			}
+			if filtered[x] {
+				n.stats.recordFalsePositive()
+			}
+		}
+	}
+
+	return values, oks, nil
+}
+
+// 过滤器是否表明 index 记录的 block 中可能存在 key. 存在全文件过滤器时以其为准.
+// filtered 标识是否确实经过了过滤器的判定
+func (n *Node) keyMayExist(index *Index, key []byte) (mayExist, filtered bool) {
+	bitmap := n.filter.BlockToFilter[index.PrevBlockOffset]
+	if n.filter.Full != nil {
+		bitmap = n.filter.Full
+	}
+	if n.decoder == nil || len(bitmap) == 0 {
+		return true, false
+	}
+	mayExist = n.decoder.Exist(bitmap, key)
+	n.stats.recordCheck(mayExist)
+	return mayExist, true
+}
+
+// 整个节点中是否可能存在前缀为 prefix 的 key. prefixFilter 为 true 时借助各个 block 的过滤器进行判断
+func (n *Node) mayContainPrefix(prefix []byte, prefixFilter bool) bool {
+	if len(n.index) == 0 || bytes.Compare(n.End(), prefix) < 0 || pastPrefix(n.Start(), prefix) {
+		return false
+	}
+	if !prefixFilter {
+		return true
+	}
+	if n.filter.Full != nil {
+		return n.filterMayContain(n.filter.Full, prefix)
+	}
+	for _, index := range n.index[1:] {
+		if n.prefixMayExist(index, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// 过滤器是否表明 index 记录的 block 中可能存在前缀为 prefix 的 key
+func (n *Node) prefixMayExist(index *Index, prefix []byte) bool {
+	if n.filter.Full != nil {
+		return n.filterMayContain(n.filter.Full, prefix)
+	}
+	return n.filterMayContain(n.filter.BlockToFilter[index.PrevBlockOffset], prefix)
+}
+
+// 过滤器 bitmap 中是否可能存在 key. 缺少 bitmap 或者无法解析时视为可能存在
+func (n *Node) filterMayContain(bitmap, key []byte) bool {
+	if n.decoder == nil || len(bitmap) == 0 {
+		return true
+	}
+	return n.decoder.Exist(bitmap, key)
+}
+
+// 未记录过滤器策略的 sstable 由早期版本写入，早期版本内置的过滤器只有布隆过滤器
+var legacyBloomFilter, _ = filter.NewLegacyBloomFilter(1024)
+
+// 根据 sstable 写入时的过滤器策略选择解析 bitmap 的实现，保证配置的过滤器变更后不会因误判而漏读数据.
+// 未记录策略的 sstable 由早期版本写入: 配置的是内置过滤器时，按照早期版本布隆过滤器的 bit 位映射解析，否则沿用配置的自定义过滤器.
+// 策略与配置的过滤器一致时直接使用配置的过滤器，否则从注册表中查找，未注册的策略不借助过滤器，宁可多读 block 也不返回错误的结果
+func filterDecoder(conf *Config, sstFilter *SSTFilter) filter.Filter {
+	if sstFilter == nil {
+		return nil
+	}
+	if sstFilter.Policy.Name == "" {
+		if conf.Filter == nil || filter.IsBuiltin(conf.Filter.Policy()) {
+			return legacyBloomFilter
+		}
+		return conf.Filter
+	}
+	if conf.Filter != nil && sstFilter.Policy == conf.Filter.Policy() {
+		return conf.Filter
+	}
+	decoder, ok := filter.Lookup(sstFilter.Policy)
+	if !ok {
+		return nil
+	}
+	return decoder
+}
+
+// sstable 的属性信息. 早期版本的 sstable 没有属性块，此时返回 nil
+func (n *Node) Properties() (*Properties, error) {
+	n.propsOnce.Do(func() {
+		n.props, n.propsErr = n.sstReader.ReadProperties()
+	})
+	return n.props, n.propsErr
+}
+
 func (n *Node) Size() uint64 {
 	return n.size
 }
@@ -86,14 +314,45 @@ func (n *Node) End() []byte {
 	return n.endKey
 }
 
+// 节点中的范围删除标记
+func (n *Node) RangeTombstones() []*RangeTombstone {
+	return n.rangeDels
+}
+
+// key 是否被节点中的范围删除标记覆盖
+func (n *Node) rangeDeleted(key []byte) bool {
+	return n.rangeDels.covers(key)
+}
+
 func (n *Node) Index() (level int, seq int32) {
 	level, seq = n.level, n.seq
 	return
 }
 
+// 添加一次引用
+func (n *Node) Ref() {
+	n.refs.Add(1)
+}
+
+// 释放一次引用. 引用计数归零时销毁节点
+func (n *Node) Unref() {
+	if n.refs.Add(-1) == 0 {
+		n.Destroy()
+	}
+}
+
 func (n *Node) Destroy() {
 	n.sstReader.Close()
-	_ = os.Remove(path.Join(n.conf.Dir, n.file))
+	// 平移到下一层的节点对应的文件可能已经被重命名，文件不存在属于正常情况
+	if !n.keepFile {
+		if err := n.conf.FS.Remove(path.Join(n.conf.Dir, n.file)); err != nil && !os.IsNotExist(err) && n.onRemoveError != nil {
+			n.onRemoveError(err)
+		}
+	}
+	// 释放对 blob 文件的引用，不再被任何节点引用的 blob 文件随之删除
+	if n.blobs != nil {
+		n.blobs.unref(n.blobRefs)
+	}
 }
 
 func (n *Node) Close() {
@@ -2,6 +2,9 @@ package golsm
 
 import (
 	"bytes"
+	"fmt"
+	"os"
+	"path"
 	"testing"
 )
 
@@ -40,7 +43,7 @@ func Test_Node_Get(t *testing.T) {
 		sstWriter.Append(kv.Key, kv.Value)
 	}
 
-	size, blockToFilter, index := sstWriter.Finish()
+	size, filter, index, _ := sstWriter.Finish()
 	sstReader, err := NewSSTReader("test_node_get.sst", conf)
 	if err != nil {
 		t.Error(err)
@@ -48,7 +51,7 @@ func Test_Node_Get(t *testing.T) {
 	}
 	defer sstReader.Close()
 
-	node := NewNode(conf, "test_node_get.sst", sstReader, 0, 0, size, blockToFilter, index)
+	node := NewNode(conf, "test_node_get.sst", sstReader, 0, 0, size, filter, index, nil)
 	for _, kv := range kvs {
 		v, ok, err := node.Get(kv.Key)
 		if err != nil {
@@ -75,6 +78,120 @@ func Test_Node_Get(t *testing.T) {
 	}
 }
 
+func Test_Node_MultiGet(t *testing.T) {
+	conf, err := NewConfig(t.TempDir(), WithSSTDataBlockSize(64))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	sstWriter, err := NewSSTWriter("test_node_multi_get.sst", conf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer sstWriter.Close()
+
+	// 数据分散在多个 block 中
+	for i := 0; i < 100; i += 2 {
+		sstWriter.Append([]byte(fmt.Sprintf("key_%03d", i)), []byte(fmt.Sprintf("value_%03d", i)))
+	}
+	size, filter, index, _ := sstWriter.Finish()
+	if len(index) < 2 {
+		t.Errorf("expect multiple blocks, got: %d", len(index))
+		return
+	}
+	sstReader, err := NewSSTReader("test_node_multi_get.sst", conf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer sstReader.Close()
+
+	node := NewNode(conf, "test_node_multi_get.sst", sstReader, 0, 0, size, filter, index, nil)
+	var keys [][]byte
+	for i := 0; i < 110; i++ {
+		keys = append(keys, []byte(fmt.Sprintf("key_%03d", i)))
+	}
+	values, oks, err := node.MultiGet(keys)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for i, key := range keys {
+		expectOK := i < 100 && i%2 == 0
+		if oks[i] != expectOK {
+			t.Errorf("key: %s, expect ok: %t, got: %t", key, expectOK, oks[i])
+			continue
+		}
+		if expectOK && !bytes.Equal(values[i], []byte(fmt.Sprintf("value_%03d", i))) {
+			t.Errorf("key: %s, got: %s", key, values[i])
+		}
+	}
+}
+
+func Test_Node_Bounds(t *testing.T) {
+	conf, err := NewConfig(t.TempDir(), WithSSTDataBlockSize(64))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	sstWriter, err := NewSSTWriter("test_node_bounds.sst", conf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer sstWriter.Close()
+	for i := 0; i < 100; i++ {
+		sstWriter.Append([]byte(fmt.Sprintf("key_%03d", i)), []byte(fmt.Sprintf("value_%03d", i)))
+	}
+	size, filter, index, err := sstWriter.Finish()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	check := func() {
+		sstReader, err := NewSSTReader("test_node_bounds.sst", conf)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer sstReader.Close()
+		node := NewNode(conf, "test_node_bounds.sst", sstReader, 0, 0, size, filter, index, nil)
+		if !bytes.Equal(node.Start(), []byte("key_000")) || !bytes.Equal(node.End(), []byte("key_099")) {
+			t.Errorf("expect range: [key_000, key_099], got: [%s, %s]", node.Start(), node.End())
+		}
+	}
+
+	// 1 key 范围取自属性
+	check()
+
+	// 2 去掉属性块模拟早期版本的 sstable，最小 key 取自首个 block
+	file := path.Join(conf.Dir, "test_node_bounds.sst")
+	sstReader, err := NewSSTReader("test_node_bounds.sst", conf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if err = sstReader.ReadFooter(); err != nil {
+		t.Error(err)
+		return
+	}
+	propsOffset := sstReader.propsOffset
+	sstReader.Close()
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	raw = append(raw[:propsOffset:propsOffset], raw[len(raw)-conf.SSTFooterSize:]...)
+	if err = os.WriteFile(file, raw, 0644); err != nil {
+		t.Error(err)
+		return
+	}
+	check()
+}
+
 func Test_Node_binarySearchIndex(t *testing.T) {
 	tests := []struct {
 		name             string
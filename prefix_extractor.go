@@ -0,0 +1,68 @@
+package golsm
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// 前缀提取器. 设置后，sstable 的过滤器中会同时添加 key 的前缀，前缀迭代时可以借此跳过不包含该前缀的 block
+type PrefixExtractor interface {
+	// 提取器名称. 会记录在 sstable 中，名称不一致的 sstable 不会使用前缀过滤
+	Name() string
+	// key 是否存在前缀. 不存在前缀的 key 只会以完整的 key 添加到过滤器中
+	InDomain(key []byte) bool
+	// 提取 key 的前缀. 调用方需要保证 key 存在前缀
+	Transform(key []byte) []byte
+}
+
+// 固定长度前缀提取器. 取 key 的前 n 个 byte 作为前缀
+type FixedPrefixExtractor struct {
+	n int
+}
+
+func NewFixedPrefixExtractor(n int) PrefixExtractor {
+	return FixedPrefixExtractor{n: n}
+}
+
+func (f FixedPrefixExtractor) Name() string {
+	return fmt.Sprintf("fixed:%d", f.n)
+}
+
+func (f FixedPrefixExtractor) InDomain(key []byte) bool {
+	return len(key) >= f.n
+}
+
+func (f FixedPrefixExtractor) Transform(key []byte) []byte {
+	return key[:f.n]
+}
+
+// 分隔符前缀提取器. 取 key 中首个分隔符及其之前的部分作为前缀，例如 tenant/entity/id 的前缀为 tenant/
+type DelimiterPrefixExtractor struct {
+	delim byte
+}
+
+func NewDelimiterPrefixExtractor(delim byte) PrefixExtractor {
+	return DelimiterPrefixExtractor{delim: delim}
+}
+
+func (d DelimiterPrefixExtractor) Name() string {
+	return fmt.Sprintf("delimiter:%q", d.delim)
+}
+
+func (d DelimiterPrefixExtractor) InDomain(key []byte) bool {
+	return bytes.IndexByte(key, d.delim) >= 0
+}
+
+func (d DelimiterPrefixExtractor) Transform(key []byte) []byte {
+	return key[:bytes.IndexByte(key, d.delim)+1]
+}
+
+// prefix 是否恰好为提取器提取出的前缀. 只有这样的 prefix 才能借助过滤器进行过滤
+func isExtractedPrefix(extractor PrefixExtractor, prefix []byte) bool {
+	return extractor != nil && extractor.InDomain(prefix) && bytes.Equal(extractor.Transform(prefix), prefix)
+}
+
+// key 是否越过了前缀 prefix 的范围，即 key 以及大于 key 的数据都不可能包含该前缀
+func pastPrefix(key, prefix []byte) bool {
+	return bytes.Compare(key, prefix) > 0 && !bytes.HasPrefix(key, prefix)
+}
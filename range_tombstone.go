@@ -0,0 +1,115 @@
+package golsm
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+
+	"github.com/xiaoxuxiansheng/golsm/memtable"
+)
+
+var ErrInvalidRange = errors.New("range start must be less than end")
+
+// 范围删除标记. 删除 [Start, End) 范围内早于该标记写入的数据
+type RangeTombstone struct {
+	Start []byte // 范围起点，包含在范围内
+	End   []byte // 范围终点，不包含在范围内
+	seq   uint64 // 写入时分配的序列号. 仅 memtable 中的范围删除标记带有序列号
+}
+
+// key 是否在范围删除标记的范围内
+func (r *RangeTombstone) Covers(key []byte) bool {
+	return bytes.Compare(r.Start, key) <= 0 && bytes.Compare(key, r.End) < 0
+}
+
+// 同一个数据源中的一组范围删除标记
+// 约定：数据源中的数据总是晚于其范围删除标记写入，因此范围删除标记只对更老的数据源生效
+type rangeTombstones []*RangeTombstone
+
+// key 是否被其中任意一个范围删除标记覆盖
+func (rs rangeTombstones) covers(key []byte) bool {
+	for _, r := range rs {
+		if r.Covers(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// 覆盖了 key 的范围删除标记中最大的序列号
+func (rs rangeTombstones) coveredSeq(key []byte) (uint64, bool) {
+	var (
+		seq     uint64
+		covered bool
+	)
+	for _, r := range rs {
+		if !r.Covers(key) {
+			continue
+		}
+		if covered = true; r.seq > seq {
+			seq = r.seq
+		}
+	}
+	return seq, covered
+}
+
+// [start, end] 范围是否被其中某一个范围删除标记完整覆盖
+func (rs rangeTombstones) coversRange(start, end []byte) bool {
+	for _, r := range rs {
+		if bytes.Compare(r.Start, start) <= 0 && bytes.Compare(end, r.End) < 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// 所有范围删除标记覆盖的最小起点和最大终点
+func (rs rangeTombstones) bounds() (start, end []byte) {
+	for i, r := range rs {
+		if i == 0 || bytes.Compare(r.Start, start) < 0 {
+			start = r.Start
+		}
+		if i == 0 || bytes.Compare(r.End, end) > 0 {
+			end = r.End
+		}
+	}
+	return
+}
+
+// 按照 key 将范围删除标记切分为两部分. 前一部分位于 key 之前，后一部分位于 key 及之后
+func (rs rangeTombstones) split(key []byte) (before, after rangeTombstones) {
+	for _, r := range rs {
+		if bytes.Compare(r.Start, key) < 0 {
+			end := r.End
+			if bytes.Compare(end, key) > 0 {
+				end = key
+			}
+			before = append(before, &RangeTombstone{Start: r.Start, End: end})
+		}
+		if bytes.Compare(r.End, key) > 0 {
+			start := r.Start
+			if bytes.Compare(start, key) < 0 {
+				start = key
+			}
+			after = append(after, &RangeTombstone{Start: start, End: r.End})
+		}
+	}
+	return
+}
+
+// 按照范围起点由小到大排序
+func (rs rangeTombstones) sort() {
+	sort.Slice(rs, func(i, j int) bool {
+		return bytes.Compare(rs[i].Start, rs[j].Start) < 0
+	})
+}
+
+// 将范围删除标记作用于 memtable. memtable 中已有的数据早于范围删除标记写入，使用删除标记将其覆盖
+func deleteRangeInMemTable(memTable memtable.MemTable, r *RangeTombstone) {
+	deleted := newDeleteEntry()
+	deleted.seq = r.seq
+	raw := encodeEntry(deleted)
+	for _, kv := range memtable.Range(memTable, r.Start, r.End) {
+		memTable.Put(kv.Key, raw)
+	}
+}
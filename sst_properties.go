@@ -0,0 +1,237 @@
+package golsm
+
+import (
+	"encoding/binary"
+	"errors"
+	"path"
+	"sort"
+	"time"
+)
+
+var errInvalidProperties = errors.New("invalid sstable properties")
+
+const (
+	bytewiseComparatorName = "bytewise" // key 按照字节序比较
+	noCompressionName      = "none"     // block 不压缩
+)
+
+// sstable 的属性信息. 由 SSTWriter.Finish 写入属性块，供 compact 策略以及容量统计使用
+type Properties struct {
+	NumEntries        uint64            // kv 数据的条数，删除标记也计算在内
+	NumDeletions      uint64            // 删除标记的条数
+	NumRangeDeletions uint64            // 范围删除标记的条数
+	RawKeySize        uint64            // 全部 key 的原始大小之和，单位 byte
+	RawValueSize      uint64            // 全部 value 的原始大小之和，单位 byte
+	DataSize          uint64            // 数据块的大小，单位 byte
+	IndexSize         uint64            // 索引块的大小，单位 byte
+	FilterSize        uint64            // 过滤器块的大小，单位 byte
+	SmallestKey       []byte            // 最小的 key. 只包含范围删除标记时为空
+	LargestKey        []byte            // 最大的 key. 只包含范围删除标记时为空
+	CreationTime      time.Time         // sstable 的生成时间
+	Comparator        string            // key 的比较器名称
+	FilterPolicy      string            // 过滤器策略
+	Compression       string            // block 的压缩算法名称
+	SmallestSeq       uint64            // 数据中最小的序列号. 为 0 表示未知
+	LargestSeq        uint64            // 数据中最大的序列号. 为 0 表示未知
+	BlobFiles         map[uint64]uint64 // 引用的各个 blob 文件编号，以及引用的 value 大小之和. 不引用 blob 文件时为空
+}
+
+// 属性块中各个属性对应的 key
+const (
+	propNumEntries        = "num_entries"
+	propNumDeletions      = "num_deletions"
+	propNumRangeDeletions = "num_range_deletions"
+	propRawKeySize        = "raw_key_size"
+	propRawValueSize      = "raw_value_size"
+	propDataSize          = "data_size"
+	propIndexSize         = "index_size"
+	propFilterSize        = "filter_size"
+	propSmallestKey       = "smallest_key"
+	propLargestKey        = "largest_key"
+	propCreationTime      = "creation_time"
+	propComparator        = "comparator"
+	propFilterPolicy      = "filter_policy"
+	propCompression       = "compression"
+	propSmallestSeq       = "smallest_seq"
+	propLargestSeq        = "largest_seq"
+	propBlobFiles         = "blob_files"
+)
+
+// 将属性信息编码写入属性块. 每个属性一条记录，key 为属性名，数值类型的属性以 uvarint 编码
+func (p *Properties) appendTo(block *Block) {
+	var scratch [binary.MaxVarintLen64]byte
+	appendUint := func(name string, v uint64) {
+		n := binary.PutUvarint(scratch[0:], v)
+		block.Append([]byte(name), scratch[:n])
+	}
+	appendUint(propNumEntries, p.NumEntries)
+	appendUint(propNumDeletions, p.NumDeletions)
+	appendUint(propNumRangeDeletions, p.NumRangeDeletions)
+	appendUint(propRawKeySize, p.RawKeySize)
+	appendUint(propRawValueSize, p.RawValueSize)
+	appendUint(propDataSize, p.DataSize)
+	appendUint(propIndexSize, p.IndexSize)
+	appendUint(propFilterSize, p.FilterSize)
+	block.Append([]byte(propSmallestKey), p.SmallestKey)
+	block.Append([]byte(propLargestKey), p.LargestKey)
+	appendUint(propCreationTime, uint64(p.CreationTime.UnixNano()))
+	block.Append([]byte(propComparator), []byte(p.Comparator))
+	block.Append([]byte(propFilterPolicy), []byte(p.FilterPolicy))
+	block.Append([]byte(propCompression), []byte(p.Compression))
+	appendUint(propSmallestSeq, p.SmallestSeq)
+	appendUint(propLargestSeq, p.LargestSeq)
+	// 引用的 blob 文件依次编码为 文件编号 | 引用大小，均为 uvarint
+	if len(p.BlobFiles) > 0 {
+		files := make([]uint64, 0, len(p.BlobFiles))
+		for file := range p.BlobFiles {
+			files = append(files, file)
+		}
+		sort.Slice(files, func(i, j int) bool { return files[i] < files[j] })
+		var blobFiles []byte
+		for _, file := range files {
+			n := binary.PutUvarint(scratch[0:], file)
+			blobFiles = append(blobFiles, scratch[:n]...)
+			n = binary.PutUvarint(scratch[0:], p.BlobFiles[file])
+			blobFiles = append(blobFiles, scratch[:n]...)
+		}
+		block.Append([]byte(propBlobFiles), blobFiles)
+	}
+}
+
+// 解析属性块中的记录. 未知的属性直接忽略
+func decodeProperties(kvs []*KV) (*Properties, error) {
+	var p Properties
+	for _, kv := range kvs {
+		var target *uint64
+		switch string(kv.Key) {
+		case propNumEntries:
+			target = &p.NumEntries
+		case propNumDeletions:
+			target = &p.NumDeletions
+		case propNumRangeDeletions:
+			target = &p.NumRangeDeletions
+		case propRawKeySize:
+			target = &p.RawKeySize
+		case propRawValueSize:
+			target = &p.RawValueSize
+		case propDataSize:
+			target = &p.DataSize
+		case propIndexSize:
+			target = &p.IndexSize
+		case propFilterSize:
+			target = &p.FilterSize
+		case propSmallestSeq:
+			target = &p.SmallestSeq
+		case propLargestSeq:
+			target = &p.LargestSeq
+		case propCreationTime:
+			nanos, n := binary.Uvarint(kv.Value)
+			if n <= 0 {
+				return nil, errInvalidProperties
+			}
+			p.CreationTime = time.Unix(0, int64(nanos))
+		case propSmallestKey:
+			p.SmallestKey = kv.Value
+		case propLargestKey:
+			p.LargestKey = kv.Value
+		case propComparator:
+			p.Comparator = string(kv.Value)
+		case propFilterPolicy:
+			p.FilterPolicy = string(kv.Value)
+		case propCompression:
+			p.Compression = string(kv.Value)
+		case propBlobFiles:
+			blobFiles, err := decodeBlobFiles(kv.Value)
+			if err != nil {
+				return nil, err
+			}
+			p.BlobFiles = blobFiles
+		}
+		if target == nil {
+			continue
+		}
+		v, n := binary.Uvarint(kv.Value)
+		if n <= 0 {
+			return nil, errInvalidProperties
+		}
+		*target = v
+	}
+	return &p, nil
+}
+
+func decodeBlobFiles(raw []byte) (map[uint64]uint64, error) {
+	blobFiles := make(map[uint64]uint64)
+	for len(raw) > 0 {
+		file, n := binary.Uvarint(raw)
+		if n <= 0 {
+			return nil, errInvalidProperties
+		}
+		raw = raw[n:]
+		size, n := binary.Uvarint(raw)
+		if n <= 0 {
+			return nil, errInvalidProperties
+		}
+		raw = raw[n:]
+		blobFiles[file] = size
+	}
+	return blobFiles, nil
+}
+
+// 一组节点中数据的序列号范围. 属性缺失或者序列号未知的节点不计算在内
+func seqRangeOf(nodes []*Node) (smallest, largest uint64) {
+	for _, node := range nodes {
+		props, err := node.Properties()
+		if err != nil || props == nil || props.LargestSeq == 0 {
+			continue
+		}
+		if smallest == 0 || props.SmallestSeq < smallest {
+			smallest = props.SmallestSeq
+		}
+		if props.LargestSeq > largest {
+			largest = props.LargestSeq
+		}
+	}
+	return
+}
+
+// 更新 sstable 文件的属性信息. 属性块紧邻 footer 之前，只需截断属性块并重新写入属性块与 footer，无需改写其余部分.
+// 返回更新后的 sstable 大小
+func rewriteProperties(file string, conf *Config, update func(p *Properties)) (uint64, error) {
+	sstReader, err := NewSSTReader(file, conf)
+	if err != nil {
+		return 0, err
+	}
+	props, err := sstReader.ReadProperties()
+	if err != nil {
+		sstReader.Close()
+		return 0, err
+	}
+	footer, err := sstReader.ReadBlock(sstReader.propsOffset+sstReader.propsSize, uint64(conf.SSTFooterSize))
+	propsOffset := sstReader.propsOffset
+	sstReader.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	// 早期版本的 sstable 没有属性块，此时写入一个新的属性块
+	if props == nil {
+		props = &Properties{}
+	}
+	update(props)
+	propsBlock := NewBlock(conf)
+	props.appendTo(propsBlock)
+	buf := propsBlock.ToBytes()
+
+	dest, err := conf.FS.OpenReadWrite(path.Join(conf.Dir, file))
+	if err != nil {
+		return 0, err
+	}
+	defer dest.Close()
+	if err = dest.Truncate(int64(propsOffset)); err != nil {
+		return 0, err
+	}
+	if _, err = dest.WriteAt(append(buf, footer...), int64(propsOffset)); err != nil {
+		return 0, err
+	}
+	return propsOffset + uint64(len(buf)), nil
+}
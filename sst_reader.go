@@ -6,8 +6,10 @@ import (
 	"encoding/binary"
 	"errors"
 	"io"
-	"os"
 	"path"
+
+	"github.com/xiaoxuxiansheng/golsm/filter"
+	"github.com/xiaoxuxiansheng/golsm/vfs"
 )
 
 // kv 对
@@ -18,18 +20,29 @@ type KV struct {
 
 // 对应于 lsm tree 中的一个 sstable. 这是读取流程的视角
 type SSTReader struct {
-	conf         *Config       // 配置文件
-	src          *os.File      // 对应的文件
-	reader       *bufio.Reader // 读取文件的 reader
-	filterOffset uint64        // 过滤器块起始位置在 sstable 的 offset
-	filterSize   uint64        // 过滤器块的大小，单位 byte
-	indexOffset  uint64        // 索引块起始位置在 sstable 的 offset
-	indexSize    uint64        // 索引块的大小，单位 byte
+	conf           *Config       // 配置文件
+	src            vfs.File      // 对应的文件
+	reader         *bufio.Reader // 读取文件的 reader
+	filterOffset   uint64        // 过滤器块起始位置在 sstable 的 offset
+	filterSize     uint64        // 过滤器块的大小，单位 byte
+	indexOffset    uint64        // 索引块起始位置在 sstable 的 offset
+	indexSize      uint64        // 索引块的大小，单位 byte
+	rangeDelOffset uint64        // 范围删除块起始位置在 sstable 的 offset
+	rangeDelSize   uint64        // 范围删除块的大小，单位 byte. 为 0 表示不存在范围删除块
+	propsOffset    uint64        // 属性块起始位置在 sstable 的 offset
+	propsSize      uint64        // 属性块的大小，单位 byte. 为 0 表示不存在属性块
+	formatVersion  byte          // sstable 的格式版本
 }
 
+// sstable 的格式版本，记录在 footer 的最后一个 byte 中
+const (
+	sstFormatLegacy  byte = 0 // 早期版本. 数据块中的 value 为原始值，没有类型标识
+	sstFormatVersion byte = 1 // 当前版本. 数据块中的 value 为编码后的数据记录
+)
+
 // sstReader 构造器
 func NewSSTReader(file string, conf *Config) (*SSTReader, error) {
-	src, err := os.OpenFile(path.Join(conf.Dir, file), os.O_RDONLY, 0644)
+	src, err := conf.FS.Open(path.Join(conf.Dir, file))
 	if err != nil {
 		return nil, err
 	}
@@ -48,7 +61,7 @@ func (s *SSTReader) Size() (uint64, error) {
 			return 0, err
 		}
 	}
-	return s.indexOffset + s.indexSize, nil
+	return s.propsOffset + s.propsSize, nil
 }
 
 func (s *SSTReader) Close() {
@@ -82,11 +95,40 @@ func (s *SSTReader) ReadFooter() error {
 		return err
 	}
 
+	// 早期版本的 sstable 没有范围删除块，footer 中对应的部分为 0
+	if s.rangeDelOffset, err = binary.ReadUvarint(s.reader); err != nil {
+		return err
+	}
+
+	if s.rangeDelSize, err = binary.ReadUvarint(s.reader); err != nil {
+		return err
+	}
+
+	// 属性块紧随范围删除块之后，一直延续到 footer 之前. 早期版本的 sstable 没有属性块
+	s.propsOffset = s.indexOffset + s.indexSize
+	if s.rangeDelOffset > 0 {
+		s.propsOffset = s.rangeDelOffset + s.rangeDelSize
+	}
+	info, err := s.src.Stat()
+	if err != nil {
+		return err
+	}
+	if end := uint64(info.Size()) - uint64(s.conf.SSTFooterSize); end > s.propsOffset {
+		s.propsSize = end - s.propsOffset
+	}
+
+	// footer 的最后一个 byte 为格式版本. 早期版本的 footer 中对应的部分为 0
+	version := make([]byte, 1)
+	if _, err = s.src.ReadAt(version, info.Size()-1); err != nil {
+		return err
+	}
+	s.formatVersion = version[0]
+
 	return nil
 }
 
 // 读取过滤器
-func (s *SSTReader) ReadFilter() (map[uint64][]byte, error) {
+func (s *SSTReader) ReadFilter() (*SSTFilter, error) {
 	// 如果 footer 信息还没读取，则先完成 footer 信息加载
 	if s.filterOffset == 0 || s.filterSize == 0 {
 		if err := s.ReadFooter(); err != nil {
@@ -123,6 +165,62 @@ func (s *SSTReader) ReadIndex() ([]*Index, error) {
 	return s.readIndex(indexBlock)
 }
 
+// 读取范围删除块
+func (s *SSTReader) ReadRangeTombstones() ([]*RangeTombstone, error) {
+	// 如果 footer 信息还没读取，则先完成 footer 信息加载
+	if s.indexOffset == 0 {
+		if err := s.ReadFooter(); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.rangeDelSize == 0 {
+		return nil, nil
+	}
+
+	// 读取范围删除块的内容
+	rangeDelBlock, err := s.ReadBlock(s.rangeDelOffset, s.rangeDelSize)
+	if err != nil {
+		return nil, err
+	}
+
+	// 对范围删除块的内容进行解析，key 为范围起点，value 为范围终点
+	kvs, err := s.ReadBlockData(rangeDelBlock)
+	if err != nil {
+		return nil, err
+	}
+	rangeDels := make([]*RangeTombstone, 0, len(kvs))
+	for _, kv := range kvs {
+		rangeDels = append(rangeDels, &RangeTombstone{Start: kv.Key, End: kv.Value})
+	}
+	return rangeDels, nil
+}
+
+// 读取属性块. 早期版本的 sstable 没有属性块，此时返回 nil
+func (s *SSTReader) ReadProperties() (*Properties, error) {
+	// 如果 footer 信息还没读取，则先完成 footer 信息加载
+	if s.indexOffset == 0 {
+		if err := s.ReadFooter(); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.propsSize == 0 {
+		return nil, nil
+	}
+
+	// 读取属性块的内容并解析
+	propsBlock, err := s.ReadBlock(s.propsOffset, s.propsSize)
+	if err != nil {
+		return nil, err
+	}
+	kvs, err := s.ReadBlockData(propsBlock)
+	if err != nil {
+		return nil, err
+	}
+	return decodeProperties(kvs)
+}
+
 // 读取 sstable 下的全量 kv 数据
 func (s *SSTReader) ReadData() ([]*KV, error) {
 	// 如果 footer 信息还没读取，则先完成 footer 信息加载
@@ -142,23 +240,23 @@ func (s *SSTReader) ReadData() ([]*KV, error) {
 	return s.ReadBlockData(dataBlock)
 }
 
-// 读取一个 block 块的内容
+// 读取一个 block 块的内容. 基于 ReadAt 实现，不依赖文件的 offset，支持并发读取
 func (s *SSTReader) ReadBlock(offset, size uint64) ([]byte, error) {
-	// 根据起始偏移量，设置文件的 offset
-	if _, err := s.src.Seek(int64(offset), io.SeekStart); err != nil {
-		return nil, err
-	}
-	s.reader.Reset(s.src)
-
-	// 读取指定 size 的内容
+	// 从起始偏移量开始读取指定 size 的内容
 	buf := make([]byte, size)
-	_, err := io.ReadFull(s.reader, buf)
-	return buf, err
+	n, err := s.src.ReadAt(buf, int64(offset))
+	if n == len(buf) {
+		return buf, nil
+	}
+	if err == nil || errors.Is(err, io.EOF) {
+		err = io.ErrUnexpectedEOF
+	}
+	return nil, err
 }
 
 // 解析 filter block 块的内容
-func (s *SSTReader) readFilter(block []byte) (map[uint64][]byte, error) {
-	blockToFilter := make(map[uint64][]byte)
+func (s *SSTReader) readFilter(block []byte) (*SSTFilter, error) {
+	sstFilter := SSTFilter{BlockToFilter: make(map[uint64][]byte)}
 	// 将 filter block 块内容封装成一个 buffer
 	buf := bytes.NewBuffer(block)
 	var prevKey []byte
@@ -172,12 +270,31 @@ func (s *SSTReader) readFilter(block []byte) (map[uint64][]byte, error) {
 			return nil, err
 		}
 
-		blockOffset, _ := binary.Uvarint(key)
-		blockToFilter[blockOffset] = value
 		prevKey = key
+
+		// key 为空的记录为元信息，未知种类的元信息直接忽略
+		if len(key) == 0 {
+			if len(value) == 0 {
+				continue
+			}
+			switch value[0] {
+			case filterMetaPrefixExtractor:
+				sstFilter.PrefixExtractor = string(value[1:])
+			case filterMetaPolicy:
+				sstFilter.Policy = filter.ParsePolicy(string(value[1:]))
+			}
+			continue
+		}
+		blockOffset, _ := binary.Uvarint(key)
+		// 以数据区末尾的 offset 作为 key 的记录为全文件过滤器
+		if blockOffset == s.filterOffset {
+			sstFilter.Full = value
+			continue
+		}
+		sstFilter.BlockToFilter[blockOffset] = value
 	}
 
-	return blockToFilter, nil
+	return &sstFilter, nil
 }
 
 // 解析 index block 块的内容
@@ -4,6 +4,9 @@ import (
 	"bytes"
 	"fmt"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xiaoxuxiansheng/golsm/filter"
 )
 
 func Test_SSTReader(t *testing.T) {
@@ -48,7 +51,7 @@ func Test_SSTReader(t *testing.T) {
 		sstWriter.Append(kv.Key, kv.Value)
 	}
 
-	_, expectBlockToFilter, expectIndex := sstWriter.Finish()
+	_, expectFilter, expectIndex, _ := sstWriter.Finish()
 
 	// 构造一个 sst reader 读取数据
 	sstReader, err := NewSSTReader("test_write_read.sst", conf)
@@ -58,7 +61,7 @@ func Test_SSTReader(t *testing.T) {
 	}
 	defer sstReader.Close()
 
-	gotBlockToFilter, err := sstReader.ReadFilter()
+	gotFilter, err := sstReader.ReadFilter()
 	if err != nil {
 		t.Error(err)
 		return
@@ -70,7 +73,7 @@ func Test_SSTReader(t *testing.T) {
 		return
 	}
 
-	if err = assertFilterEqual(expectBlockToFilter, gotBlockToFilter); err != nil {
+	if err = assertFilterEqual(expectFilter.BlockToFilter, gotFilter.BlockToFilter); err != nil {
 		t.Error(err)
 		return
 	}
@@ -144,3 +147,370 @@ func assertDataEqual(expect, got []*KV) error {
 	}
 	return nil
 }
+
+func Test_SSTReader_ReadRangeTombstones(t *testing.T) {
+	conf, err := NewConfig(t.TempDir(), WithSSTDataBlockSize(16))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// 包含数据的 sst 文件以及只包含范围删除标记的 sst 文件
+	for _, withData := range []bool{true, false} {
+		sstWriter, err := NewSSTWriter("test_range_del.sst", conf)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if withData {
+			sstWriter.Append([]byte("a"), []byte("b"))
+			sstWriter.Append([]byte("c"), []byte("d"))
+		}
+		sstWriter.AddRangeTombstone([]byte("x"), []byte("z"))
+		sstWriter.AddRangeTombstone([]byte("b"), []byte("e"))
+		size, filter, index, _ := sstWriter.Finish()
+		sstWriter.Close()
+
+		sstReader, err := NewSSTReader("test_range_del.sst", conf)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		gotRangeDels, err := sstReader.ReadRangeTombstones()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if err = assertDataEqual([]*KV{
+			{Key: []byte("b"), Value: []byte("e")},
+			{Key: []byte("x"), Value: []byte("z")},
+		}, rangeTombstonesToKVs(gotRangeDels)); err != nil {
+			t.Error(err)
+			return
+		}
+
+		gotSize, err := sstReader.Size()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if gotSize != size {
+			t.Errorf("expect size: %d, got: %d", size, gotSize)
+			return
+		}
+
+		node := NewNode(conf, "test_range_del.sst", sstReader, 0, 0, size, filter, index, gotRangeDels)
+		if withData {
+			v, ok, err := node.Get([]byte("c"))
+			if err != nil || !ok || !bytes.Equal(v, []byte("d")) {
+				t.Errorf("expect c -> d, got: %s, %t, %v", v, ok, err)
+			}
+			if !bytes.Equal(node.Start(), []byte("a")) {
+				t.Errorf("expect start: a, got: %s", node.Start())
+			}
+		} else {
+			if _, ok, _ := node.Get([]byte("c")); ok {
+				t.Error("expect no data in node")
+			}
+			if !bytes.Equal(node.Start(), []byte("b")) {
+				t.Errorf("expect start: b, got: %s", node.Start())
+			}
+		}
+		if !bytes.Equal(node.End(), []byte("z")) {
+			t.Errorf("expect end: z, got: %s", node.End())
+		}
+		if !node.rangeDeleted([]byte("y")) || node.rangeDeleted([]byte("z")) {
+			t.Error("unexpected range tombstone coverage")
+		}
+		node.Destroy()
+	}
+}
+
+func rangeTombstonesToKVs(rangeDels []*RangeTombstone) []*KV {
+	kvs := make([]*KV, 0, len(rangeDels))
+	for _, r := range rangeDels {
+		kvs = append(kvs, &KV{Key: r.Start, Value: r.End})
+	}
+	return kvs
+}
+
+func Test_SSTReader_ReadFilter_PrefixExtractor(t *testing.T) {
+	conf, err := NewConfig(t.TempDir(), WithPrefixExtractor(NewFixedPrefixExtractor(2)))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	sstWriter, err := NewSSTWriter("test_prefix.sst", conf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	sstWriter.Append([]byte("aa1"), []byte("v"))
+	sstWriter.Append([]byte("aa2"), []byte("v"))
+	sstWriter.Append([]byte("b"), []byte("v"))
+	_, expectFilter, _, _ := sstWriter.Finish()
+	sstWriter.Close()
+
+	sstReader, err := NewSSTReader("test_prefix.sst", conf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer sstReader.Close()
+
+	gotFilter, err := sstReader.ReadFilter()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if err = assertFilterEqual(expectFilter.BlockToFilter, gotFilter.BlockToFilter); err != nil {
+		t.Error(err)
+		return
+	}
+	if gotFilter.PrefixExtractor != "fixed:2" {
+		t.Errorf("expect prefix extractor: fixed:2, got: %s", gotFilter.PrefixExtractor)
+		return
+	}
+	if policy := gotFilter.Policy.String(); policy != "bloom:m=1024" {
+		t.Errorf("expect filter policy: bloom:m=1024, got: %s", policy)
+		return
+	}
+	// 过滤器中同时包含完整的 key 以及 key 的前缀
+	bitmap := gotFilter.BlockToFilter[0]
+	for _, key := range []string{"aa1", "aa2", "b", "aa"} {
+		if !conf.Filter.Exist(bitmap, []byte(key)) {
+			t.Errorf("expect key: %s exist in filter", key)
+		}
+	}
+}
+
+func Test_Node_Get_FilterPolicyChanged(t *testing.T) {
+	dir := t.TempDir()
+	writeConf, err := NewConfig(dir, WithSSTDataBlockSize(64), WithFilter(filter.NewXorFilter()))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	sstWriter, err := NewSSTWriter("test_filter_type.sst", writeConf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for i := 0; i < 100; i++ {
+		sstWriter.Append([]byte(fmt.Sprintf("key_%03d", i)), []byte("v"))
+	}
+	size, _, index, _ := sstWriter.Finish()
+	sstWriter.Close()
+
+	// 使用布隆过滤器的配置读取 xor 过滤器写入的 sstable，按照 sstable 中记录的策略解析
+	readConf, err := NewConfig(dir, WithSSTDataBlockSize(64))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	sstReader, err := NewSSTReader("test_filter_type.sst", readConf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	gotFilter, err := sstReader.ReadFilter()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if policy := gotFilter.Policy.String(); policy != "xor" {
+		t.Errorf("expect filter policy: xor, got: %s", policy)
+		return
+	}
+
+	node := NewNode(readConf, "test_filter_type.sst", sstReader, 0, 0, size, gotFilter, index, nil)
+	defer node.Close()
+	for i := 0; i < 100; i++ {
+		if _, ok, err := node.Get([]byte(fmt.Sprintf("key_%03d", i))); err != nil || !ok {
+			t.Errorf("key: key_%03d, expect: true, got: %v, err: %v", i, ok, err)
+		}
+	}
+	if _, ok, err := node.Get([]byte("key_000_absent")); err != nil || ok {
+		t.Errorf("key: key_000_absent, expect: false, got: %v, err: %v", ok, err)
+	}
+}
+
+// 未在注册表中注册的自定义过滤器
+type unregisteredFilter struct {
+	*filter.BloomFilter
+}
+
+func (f unregisteredFilter) Policy() filter.Policy {
+	return filter.Policy{Name: "unregistered"}
+}
+
+func Test_Node_Get_UnknownFilterPolicy(t *testing.T) {
+	dir := t.TempDir()
+	bf, _ := filter.NewBloomFilter(1024)
+	writeConf, err := NewConfig(dir, WithSSTDataBlockSize(64), WithFilter(unregisteredFilter{bf}))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	sstWriter, err := NewSSTWriter("test_unknown_policy.sst", writeConf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for i := 0; i < 100; i++ {
+		sstWriter.Append([]byte(fmt.Sprintf("key_%03d", i)), []byte("v"))
+	}
+	size, _, index, _ := sstWriter.Finish()
+	sstWriter.Close()
+
+	readConf, err := NewConfig(dir, WithSSTDataBlockSize(64))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	sstReader, err := NewSSTReader("test_unknown_policy.sst", readConf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	gotFilter, err := sstReader.ReadFilter()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// 无法识别的策略不借助过滤器，直接读取 block
+	var stats filterStats
+	node := NewNode(readConf, "test_unknown_policy.sst", sstReader, 0, 0, size, gotFilter, index, nil)
+	node.stats = &stats
+	defer node.Close()
+	for i := 0; i < 100; i++ {
+		if _, ok, err := node.Get([]byte(fmt.Sprintf("key_%03d", i))); err != nil || !ok {
+			t.Errorf("key: key_%03d, expect: true, got: %v, err: %v", i, ok, err)
+		}
+	}
+	if checks := stats.checks.Load(); checks != 0 {
+		t.Errorf("expect no filter checks, got: %d", checks)
+	}
+
+	// 与配置的过滤器策略一致时使用配置的过滤器
+	if decoder := filterDecoder(writeConf, gotFilter); decoder == nil || decoder.Policy() != gotFilter.Policy {
+		t.Errorf("expect decoder with policy: %s", gotFilter.Policy)
+	}
+}
+
+func Test_Node_Get_LegacyBloomFilter(t *testing.T) {
+	dir := t.TempDir()
+	legacy, _ := filter.NewLegacyBloomFilter(1024)
+	writeConf, err := NewConfig(dir, WithSSTDataBlockSize(64), WithFilter(legacy))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	sstWriter, err := NewSSTWriter("test_legacy_bloom.sst", writeConf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for i := 0; i < 100; i++ {
+		sstWriter.Append([]byte(fmt.Sprintf("key_%03d", i)), []byte("v"))
+	}
+	size, _, index, _ := sstWriter.Finish()
+	sstWriter.Close()
+
+	readConf, err := NewConfig(dir, WithSSTDataBlockSize(64))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	sstReader, err := NewSSTReader("test_legacy_bloom.sst", readConf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	gotFilter, err := sstReader.ReadFilter()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	// 模拟早期版本写入的 sstable，其中没有记录过滤器策略
+	gotFilter.Policy = filter.Policy{}
+
+	var stats filterStats
+	node := NewNode(readConf, "test_legacy_bloom.sst", sstReader, 0, 0, size, gotFilter, index, nil)
+	node.stats = &stats
+	defer node.Close()
+	for i := 0; i < 100; i++ {
+		if _, ok, err := node.Get([]byte(fmt.Sprintf("key_%03d", i))); err != nil || !ok {
+			t.Errorf("key: key_%03d, expect: true, got: %v, err: %v", i, ok, err)
+		}
+	}
+	if checks := stats.checks.Load(); checks == 0 {
+		t.Error("expect filter checks with legacy bloom filter")
+	}
+}
+
+func Test_SSTReader_ReadProperties(t *testing.T) {
+	clock := newFakeClock()
+	conf, err := NewConfig(t.TempDir(), WithSSTDataBlockSize(64), WithClock(clock))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	sstWriter, err := NewSSTWriter("test_props.sst", conf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	var rawKeySize, rawValueSize uint64
+	for i := 0; i < 50; i++ {
+		key, value := []byte(fmt.Sprintf("key_%02d", i)), encodeEntry(newValueEntry([]byte("value")))
+		if i%5 == 0 {
+			value = encodeEntry(newDeleteEntry())
+		}
+		rawKeySize, rawValueSize = rawKeySize+uint64(len(key)), rawValueSize+uint64(len(value))
+		sstWriter.Append(key, value)
+	}
+	sstWriter.AddRangeTombstone([]byte("key_10"), []byte("key_20"))
+	sstWriter.setSeqRange(3, 97)
+	size, _, _, _ := sstWriter.Finish()
+	sstWriter.Close()
+
+	sstReader, err := NewSSTReader("test_props.sst", conf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer sstReader.Close()
+
+	props, err := sstReader.ReadProperties()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	assert.Equal(t, uint64(50), props.NumEntries)
+	assert.Equal(t, uint64(10), props.NumDeletions)
+	assert.Equal(t, uint64(1), props.NumRangeDeletions)
+	assert.Equal(t, rawKeySize, props.RawKeySize)
+	assert.Equal(t, rawValueSize, props.RawValueSize)
+	assert.Equal(t, sstReader.filterOffset, props.DataSize)
+	assert.Equal(t, sstReader.filterSize, props.FilterSize)
+	assert.Equal(t, sstReader.indexSize, props.IndexSize)
+	assert.Equal(t, "key_00", string(props.SmallestKey))
+	assert.Equal(t, "key_49", string(props.LargestKey))
+	assert.Equal(t, clock.Now().UnixNano(), props.CreationTime.UnixNano())
+	assert.Equal(t, "bytewise", props.Comparator)
+	assert.Equal(t, "bloom:m=1024", props.FilterPolicy)
+	assert.Equal(t, "none", props.Compression)
+	assert.Equal(t, uint64(3), props.SmallestSeq)
+	assert.Equal(t, uint64(97), props.LargestSeq)
+
+	// 文件大小的计算涵盖属性块
+	gotSize, err := sstReader.Size()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	assert.Equal(t, size, gotSize)
+}
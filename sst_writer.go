@@ -3,10 +3,11 @@ package golsm
 import (
 	"bytes"
 	"encoding/binary"
-	"os"
 	"path"
 
+	"github.com/xiaoxuxiansheng/golsm/filter"
 	"github.com/xiaoxuxiansheng/golsm/util"
+	"github.com/xiaoxuxiansheng/golsm/vfs"
 )
 
 // sstable 中用于快速检索 block 的索引
@@ -16,29 +17,49 @@ type Index struct {
 	PrevBlockSize   uint64 // 索引前一个 block 的大小，单位 byte
 }
 
+// sstable 中的过滤器信息
+type SSTFilter struct {
+	BlockToFilter   map[uint64][]byte // 各 block 对应的 filter bitmap. key 为 block 的 offset
+	Full            []byte            // 全文件过滤器的 bitmap. 不为空时代替各 block 的过滤器
+	PrefixExtractor string            // 写入时使用的前缀提取器名称. 为空表示过滤器中只包含完整的 key
+	Policy          filter.Policy     // 写入时使用的过滤器策略. 名称为空表示未记录策略，此时沿用配置的过滤器解析
+}
+
+// 过滤器块中的元信息记录. 元信息记录的 key 为空，value 的首个 byte 标识元信息的种类
+const (
+	filterMetaPrefixExtractor byte = 1 // 前缀提取器名称
+	filterMetaPolicy          byte = 2 // 过滤器策略
+)
+
 // 对应于 lsm tree 中的一个 sstable. 这是写入流程的视角
 type SSTWriter struct {
 	conf          *Config           // 配置文件
-	dest          *os.File          // sstable 对应的磁盘文件
+	dest          vfs.File          // sstable 对应的磁盘文件
 	dataBuf       *bytes.Buffer     // 数据块缓冲区 key -> val
 	filterBuf     *bytes.Buffer     // 过滤器块缓冲区 prev block offset -> filter bit map
 	indexBuf      *bytes.Buffer     // 索引块缓冲区 index key -> prev block offset, prev block size
+	rangeDelBuf   *bytes.Buffer     // 范围删除块缓冲区 range start -> range end
+	propsBuf      *bytes.Buffer     // 属性块缓冲区 property name -> property value
 	blockToFilter map[uint64][]byte // prev block offset -> filter bit map
 	index         []*Index          // index key -> prev block offset, prev block size
 
-	dataBlock     *Block   // 数据块
-	filterBlock   *Block   // 过滤器块
-	indexBlock    *Block   // 索引块
-	assistScratch [20]byte // 用于在写索引块时临时使用的辅助缓冲区
+	dataBlock     *Block          // 数据块
+	filterBlock   *Block          // 过滤器块
+	indexBlock    *Block          // 索引块
+	rangeDels     rangeTombstones // 范围删除标记
+	assistScratch [20]byte        // 用于在写索引块时临时使用的辅助缓冲区
 
 	prevKey         []byte // 前一笔数据的 key
+	prevPrefix      []byte // 当前数据块中前一笔数据的 key 前缀. 为 nil 表示尚未添加前缀
 	prevBlockOffset uint64 // 前一个数据块的起始偏移位置
 	prevBlockSize   uint64 // 前一个数据块的大小
+
+	props Properties // sstable 的属性信息，随数据的写入逐步累计
 }
 
 // sstWriter 构造器
 func NewSSTWriter(file string, conf *Config) (*SSTWriter, error) {
-	dest, err := os.OpenFile(path.Join(conf.Dir, file), os.O_CREATE|os.O_WRONLY, 0644)
+	dest, err := conf.FS.Create(path.Join(conf.Dir, file))
 	if err != nil {
 		return nil, err
 	}
@@ -49,6 +70,8 @@ func NewSSTWriter(file string, conf *Config) (*SSTWriter, error) {
 		dataBuf:       bytes.NewBuffer([]byte{}),
 		filterBuf:     bytes.NewBuffer([]byte{}),
 		indexBuf:      bytes.NewBuffer([]byte{}),
+		rangeDelBuf:   bytes.NewBuffer([]byte{}),
+		propsBuf:      bytes.NewBuffer([]byte{}),
 		blockToFilter: make(map[uint64][]byte),
 		dataBlock:     NewBlock(conf),
 		filterBlock:   NewBlock(conf),
@@ -58,18 +81,40 @@ func NewSSTWriter(file string, conf *Config) (*SSTWriter, error) {
 }
 
 // 完成 sstable 的全部处理流程，包括将其中的数据溢写到磁盘，并返回信息供上层的 lsm 获取缓存
-func (s *SSTWriter) Finish() (size uint64, blockToFilter map[uint64][]byte, index []*Index) {
+func (s *SSTWriter) Finish() (size uint64, filter *SSTFilter, index []*Index, err error) {
 	// 完成最后一个块的处理
 	s.refreshBlock()
-	// 补齐最后一个 index
-	s.insertIndex(s.prevKey)
+	// 补齐最后一个 index. 只包含范围删除标记的 sstable 没有数据块，也就无需索引
+	if len(s.index) > 0 {
+		s.insertIndex(s.prevKey)
+	}
 
-	// 将布隆过滤器块写入缓冲区
+	// 将布隆过滤器块写入缓冲区. 过滤器策略以及前缀提取器名称以 key 为空的元信息记录存放
+	filter = &SSTFilter{BlockToFilter: s.blockToFilter, Policy: s.conf.Filter.Policy()}
+	// 全文件过滤器以数据区末尾的 offset 作为 key，不会与任何 block 的起始 offset 冲突
+	if s.conf.FullFilter && s.conf.Filter.KeyLen() > 0 {
+		filter.Full = s.conf.Filter.Hash()
+		s.conf.Filter.Reset()
+		n := binary.PutUvarint(s.assistScratch[0:], uint64(s.dataBuf.Len()))
+		s.filterBlock.Append(s.assistScratch[:n], filter.Full)
+	}
+	s.filterBlock.Append([]byte{}, append([]byte{filterMetaPolicy}, filter.Policy.String()...))
+	if s.conf.PrefixExtractor != nil {
+		filter.PrefixExtractor = s.conf.PrefixExtractor.Name()
+		s.filterBlock.Append([]byte{}, append([]byte{filterMetaPrefixExtractor}, filter.PrefixExtractor...))
+	}
 	_, _ = s.filterBlock.FlushTo(s.filterBuf)
 	// 将索引块写入缓冲区
 	_, _ = s.indexBlock.FlushTo(s.indexBuf)
+	// 将范围删除块写入缓冲区
+	s.rangeDels.sort()
+	rangeDelBlock := NewBlock(s.conf)
+	for _, r := range s.rangeDels {
+		rangeDelBlock.Append(r.Start, r.End)
+	}
+	_, _ = rangeDelBlock.FlushTo(s.rangeDelBuf)
 
-	// 处理 footer，记录布隆过滤器块起始、大小、索引块起始、大小
+	// 处理 footer，记录布隆过滤器块起始、大小、索引块起始、大小、范围删除块起始、大小
 	footer := make([]byte, s.conf.SSTFooterSize)
 	size = uint64(s.dataBuf.Len())
 	n := binary.PutUvarint(footer[0:], size)
@@ -80,14 +125,34 @@ func (s *SSTWriter) Finish() (size uint64, blockToFilter map[uint64][]byte, inde
 	indexBufLen := uint64(s.indexBuf.Len())
 	n += binary.PutUvarint(footer[n:], indexBufLen)
 	size += indexBufLen
+	n += binary.PutUvarint(footer[n:], size)
+	rangeDelBufLen := uint64(s.rangeDelBuf.Len())
+	n += binary.PutUvarint(footer[n:], rangeDelBufLen)
+	size += rangeDelBufLen
+	// footer 的最后一个 byte 记录格式版本
+	footer[len(footer)-1] = sstFormatVersion
 
-	// 依次写入文件
-	_, _ = s.dest.Write(s.dataBuf.Bytes())
-	_, _ = s.dest.Write(s.filterBuf.Bytes())
-	_, _ = s.dest.Write(s.indexBuf.Bytes())
-	_, _ = s.dest.Write(footer)
+	// 属性块紧随范围删除块之后，其大小由文件大小推算，无需记录在 footer 中
+	s.props.NumRangeDeletions = uint64(len(s.rangeDels))
+	s.props.DataSize, s.props.FilterSize, s.props.IndexSize = uint64(s.dataBuf.Len()), filterBufLen, indexBufLen
+	s.props.CreationTime = s.conf.Clock.Now()
+	s.props.Comparator, s.props.Compression = bytewiseComparatorName, noCompressionName
+	s.props.FilterPolicy = filter.Policy.String()
+	propsBlock := NewBlock(s.conf)
+	s.props.appendTo(propsBlock)
+	_, _ = propsBlock.FlushTo(s.propsBuf)
+	size += uint64(s.propsBuf.Len())
+
+	// 依次写入文件，并在返回之前完成持久化. 溢写以及 compact 流程会在此之后删除预写日志或者老的 sst 文件
+	for _, buf := range [][]byte{s.dataBuf.Bytes(), s.filterBuf.Bytes(), s.indexBuf.Bytes(), s.rangeDelBuf.Bytes(), s.propsBuf.Bytes(), footer} {
+		if _, err = s.dest.Write(buf); err != nil {
+			return 0, nil, nil, err
+		}
+	}
+	if err = s.dest.Sync(); err != nil {
+		return 0, nil, nil, err
+	}
 
-	blockToFilter = s.blockToFilter
 	index = s.index
 	return
 }
@@ -101,17 +166,53 @@ func (s *SSTWriter) Append(key, value []byte) {
 
 	// 将数据写入到数据块中
 	s.dataBlock.Append(key, value)
-	// 将 key 添加到块的布隆过滤器中
+	// 将 key 添加到块的布隆过滤器中. 设置了前缀提取器时，key 的前缀也需要添加到过滤器中，同一个块中相同的前缀只需添加一次
 	s.conf.Filter.Add(key)
+	if extractor := s.conf.PrefixExtractor; extractor != nil && extractor.InDomain(key) {
+		if prefix := extractor.Transform(key); s.prevPrefix == nil || !bytes.Equal(prefix, s.prevPrefix) {
+			s.conf.Filter.Add(prefix)
+			s.prevPrefix = append([]byte{}, prefix...)
+		}
+	}
 	// 记录一下最新的 key
 	s.prevKey = key
 
+	// 累计属性信息. sstable 中的 key 有序，第一笔数据的 key 最小，最后一笔数据的 key 最大
+	if s.props.NumEntries == 0 {
+		s.props.SmallestKey = append([]byte{}, key...)
+	}
+	s.props.LargestKey = append(s.props.LargestKey[:0], key...)
+	s.props.NumEntries++
+	if len(value) > 0 && entryKind(value[0]&entryKindMask) == entryKindDelete {
+		s.props.NumDeletions++
+	}
+	s.props.RawKeySize += uint64(len(key))
+	s.props.RawValueSize += uint64(len(value))
+	if len(value) > 0 && value[0]&entryFlagBlob != 0 {
+		if e, err := decodeEntry(value); err == nil && e.blob != nil {
+			if s.props.BlobFiles == nil {
+				s.props.BlobFiles = make(map[uint64]uint64)
+			}
+			s.props.BlobFiles[e.blob.file] += e.blob.size
+		}
+	}
+
 	// 倘若数据块大小超限，则需要将其添加到 dataBuffer，并重置块
 	if s.dataBlock.Size() >= s.conf.SSTDataBlockSize {
 		s.refreshBlock()
 	}
 }
 
+// 追加一个范围删除标记到 sstable 中
+func (s *SSTWriter) AddRangeTombstone(start, end []byte) {
+	s.rangeDels = append(s.rangeDels, &RangeTombstone{Start: start, End: end})
+}
+
+// 设置 sstable 中数据的序列号范围. 数据落盘时已经清除了序列号，由调用方根据数据来源给出
+func (s *SSTWriter) setSeqRange(smallest, largest uint64) {
+	s.props.SmallestSeq, s.props.LargestSeq = smallest, largest
+}
+
 func (s *SSTWriter) Size() uint64 {
 	return uint64(s.dataBuf.Len())
 }
@@ -121,6 +222,8 @@ func (s *SSTWriter) Close() {
 	s.dataBuf.Reset()
 	s.indexBuf.Reset()
 	s.filterBuf.Reset()
+	s.rangeDelBuf.Reset()
+	s.propsBuf.Reset()
 }
 
 func (s *SSTWriter) insertIndex(key []byte) {
@@ -138,18 +241,21 @@ func (s *SSTWriter) insertIndex(key []byte) {
 }
 
 func (s *SSTWriter) refreshBlock() {
-	if s.conf.Filter.KeyLen() == 0 {
+	if s.dataBlock.entriesCnt == 0 {
 		return
 	}
 
 	s.prevBlockOffset = uint64(s.dataBuf.Len())
-	// 添加布隆过滤器 bitmap
-	filterBitmap := s.conf.Filter.Hash()
-	s.blockToFilter[s.prevBlockOffset] = filterBitmap
-	n := binary.PutUvarint(s.assistScratch[0:], s.prevBlockOffset)
-	s.filterBlock.Append(s.assistScratch[:n], filterBitmap)
-	// 重置布隆过滤器
-	s.conf.Filter.Reset()
+	// 添加布隆过滤器 bitmap. 全文件过滤器模式下，全部 block 的 key 累积在同一个过滤器中，在 Finish 时统一生成
+	if !s.conf.FullFilter {
+		filterBitmap := s.conf.Filter.Hash()
+		s.blockToFilter[s.prevBlockOffset] = filterBitmap
+		n := binary.PutUvarint(s.assistScratch[0:], s.prevBlockOffset)
+		s.filterBlock.Append(s.assistScratch[:n], filterBitmap)
+		// 重置布隆过滤器
+		s.conf.Filter.Reset()
+		s.prevPrefix = nil
+	}
 
 	// 将 block 的数据添加到缓冲区
 	s.prevBlockSize, _ = s.dataBlock.FlushTo(s.dataBuf)
@@ -27,16 +27,16 @@ func Test_SSTWriter(t *testing.T) {
 	// filter: 0 -> bitmap1  19 -> bitmap2
 	// index: [` 0 19] [d 19 19]
 	// footer: ...
-	_, blockToFilter, index := sstWriter.Finish()
-	if len(blockToFilter) != 2 {
-		t.Errorf("unexpect filter len: %d", len(blockToFilter))
+	_, filter, index, _ := sstWriter.Finish()
+	if len(filter.BlockToFilter) != 2 {
+		t.Errorf("unexpect filter len: %d", len(filter.BlockToFilter))
 	}
 
-	if _, ok := blockToFilter[0]; !ok {
+	if _, ok := filter.BlockToFilter[0]; !ok {
 		t.Error("miss filter key: 0")
 	}
 
-	if _, ok := blockToFilter[16]; !ok {
+	if _, ok := filter.BlockToFilter[16]; !ok {
 		t.Error("miss filter key: 19")
 	}
 
@@ -44,7 +44,7 @@ func Test_SSTWriter(t *testing.T) {
 		t.Errorf("unexpect index len: %d", len(index))
 	}
 
-	if string(index[0].Key) != "`" || index[0].PrevBlockOffset != 0 || index[0].PrevBlockSize != 0 {
+	if string(index[0].Key) != "" || index[0].PrevBlockOffset != 0 || index[0].PrevBlockSize != 0 {
 		t.Errorf("invalid index0: %+v, key: %s", index[0], index[0].Key)
 	}
 
@@ -0,0 +1,62 @@
+package golsm
+
+import "sync/atomic"
+
+// lsm tree 的运行统计信息
+type Stats struct {
+	FilterChecks            uint64  // 点查时借助过滤器判断 key 是否存在的次数
+	FilterNegatives         uint64  // 过滤器判定 key 不存在，从而省去 block 读取的次数
+	FilterFalsePositives    uint64  // 过滤器判定 key 可能存在，读取 block 后却发现 key 并不存在的次数
+	FilterFalsePositiveRate float64 // 实测的过滤器假阳性率，即实际不存在的 key 中被过滤器误判为可能存在的比例
+}
+
+// 列族内部的过滤器统计计数. 由列族下的各个节点共享
+type filterStats struct {
+	checks         atomic.Uint64
+	negatives      atomic.Uint64
+	falsePositives atomic.Uint64
+}
+
+// 记录一次过滤器判定. 未挂载到列族的节点 stats 为 nil，无需统计
+func (s *filterStats) recordCheck(mayExist bool) {
+	if s == nil {
+		return
+	}
+	s.checks.Add(1)
+	if !mayExist {
+		s.negatives.Add(1)
+	}
+}
+
+// 记录一次过滤器误判
+func (s *filterStats) recordFalsePositive() {
+	if s == nil {
+		return
+	}
+	s.falsePositives.Add(1)
+}
+
+func (s *Stats) add(fs *filterStats) {
+	s.FilterChecks += fs.checks.Load()
+	s.FilterNegatives += fs.negatives.Load()
+	s.FilterFalsePositives += fs.falsePositives.Load()
+	if total := s.FilterNegatives + s.FilterFalsePositives; total > 0 {
+		s.FilterFalsePositiveRate = float64(s.FilterFalsePositives) / float64(total)
+	}
+}
+
+// 列族的运行统计信息
+func (cf *ColumnFamily) Stats() Stats {
+	var stats Stats
+	stats.add(&cf.filterStats)
+	return stats
+}
+
+// lsm tree 的运行统计信息，汇总全部列族
+func (t *Tree) Stats() Stats {
+	var stats Stats
+	for _, cf := range t.cfs {
+		stats.add(&cf.filterStats)
+	}
+	return stats
+}
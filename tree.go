@@ -2,13 +2,27 @@ package golsm
 
 import (
 	"bytes"
+	"errors"
+	"os"
+	"path"
+	"sort"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/xiaoxuxiansheng/golsm/memtable"
+	"github.com/xiaoxuxiansheng/golsm/vfs"
 	"github.com/xiaoxuxiansheng/golsm/wal"
 )
 
+var (
+	ErrInvalidTTL = errors.New("ttl must be positive")
+	ErrReadOnly   = errors.New("lsm tree is opened in read-only mode")
+
+	ErrClosed       = errors.New("lsm tree is closed")
+	ErrCloseTimeout = errors.New("timeout waiting for background jobs to finish on close")
+)
+
 // 1 构造一棵树，基于 config 与磁盘文件映射
 // 2 写入一笔数据
 // 3 查询一笔数据
@@ -18,157 +32,606 @@ type Tree struct {
 	// 读写数据时使用的锁
 	dataLock sync.RWMutex
 
-	// 每层 node 节点使用的读写锁
-	levelLocks []sync.RWMutex
-
-	// 读写 memtable
-	memTable memtable.MemTable
+	// 各个列族. 下标 0 为默认列族
+	cfs []*ColumnFamily
 
-	// 只读 memtable
+	// 只读 memtable. 各列族的 memtable 共享同一份 wal 文件，因此总是一同切换
 	rOnlyMemTable []*memTableCompactItem
 
 	// 预写日志写入口
 	walWriter *wal.WALWriter
 
-	// lsm树状数据结构
-	nodes [][]*Node
-
 	// memtable 达到阈值时，通过该 chan 传递信号，进行溢写工作
 	memCompactC chan *memTableCompactItem
 
-	// 某层 sst 文件大小达到阈值时，通过该 chan 传递信号，进行溢写工作
-	levelCompactC chan int
+	// 某个列族某层 sst 文件大小达到阈值时，通过该 chan 传递信号，进行溢写工作
+	levelCompactC chan *levelCompactItem
+
+	// 摄入外部 sst 文件时，通过该 chan 将指令交由 compact 协程执行
+	ingestC chan *ingestItem
+
+	// 摄入外部 sst 文件使用的锁，同一时刻只执行一次摄入
+	ingestLock sync.Mutex
 
 	// lsm tree 停止时通过该 chan 传递信号
 	stopc chan struct{}
 
+	// lsm tree 是否已经关闭. 在 dataLock 写锁的保护下修改
+	closed atomic.Bool
+
+	// 关闭流程的状态，在 closeLock 的保护下访问. closeDone 在后台流程全部结束时关闭，closeFinished 标识文件以及目录锁是否已经释放
+	closeLock     sync.Mutex
+	closeDone     chan struct{}
+	closeFinished bool
+
+	// compact 协程以及向其发送指令的后台协程. 关闭时需要等待其全部退出
+	wg sync.WaitGroup
+
 	// memtable index，需要与 wal 文件一一对应
 	memTableIndex int
 
-	// 各层 sstable 文件 seq. sstable 文件命名为 level_seq.sst
-	levelToSeq []atomic.Int32
+	// 最近一次写入分配的序列号. 同一笔批量写入中的操作共享一个序列号
+	seq uint64
+
+	// 正在执行的摄入. 摄入的数据在节点发布之前对读流程不可见，事务提交时需要据此校验冲突. 在 dataLock 的保护下修改
+	ingesting *ingestItem
+
+	// 是否以只读模式打开. 只读模式下不运行 compact 协程，不创建、修改或删除任何文件
+	readOnly bool
+
+	// 编号小于该值的预写日志由早期版本写入，其中的 value 为原始值，没有类型标识. 仅在打开时确定
+	legacyWALs int
+
+	// 各列族 merge 操作符的名称，key 为列族名称. 仅在打开时确定，记录在文件版本中
+	mergeOperators map[string]string
+
+	// 是否作为从实例打开. 从实例以只读模式运行，可以通过 TryCatchUpWithPrimary 追赶主实例的最新状态
+	secondary bool
+
+	// 从实例追赶主实例使用的锁，同一时刻只执行一次追赶
+	catchUpLock sync.Mutex
+
+	// 写入文件版本使用的锁
+	versionLock sync.Mutex
+
+	// lsm tree 目录的排他锁. 只读模式下为 nil
+	dirLock *dirLock
+
+	// 后台流程出现的错误. 不为 nil 时 lsm tree 拒绝写入，并暂停溢写以及 compact
+	bgErr     *BackgroundError
+	bgErrLock sync.Mutex
+}
+
+// 构建出一棵 lsm tree. conf 为默认列族的配置，cfDescs 为默认列族之外的其他列族.
+// 预写日志中出现的列族都需要在 cfDescs 中声明
+func NewTree(conf *Config, cfDescs ...ColumnFamilyDescriptor) (*Tree, error) {
+	return openTree(conf, false, cfDescs)
+}
+
+// 以只读模式打开一棵 lsm tree，用于在其他进程正在读写的情况下查看其中的数据.
+// 加载 sst 文件并将预写日志回放到内存中，但不运行 compact 协程，也不会创建预写日志、清理残留文件.
+// 写入、摄入外部文件以及生成检查点均返回 ErrReadOnly. 打开之后其他进程写入的数据不可见
+func OpenReadOnly(conf *Config, cfDescs ...ColumnFamilyDescriptor) (*Tree, error) {
+	return openTree(conf, true, cfDescs)
+}
+
+func openTree(conf *Config, readOnly bool, cfDescs []ColumnFamilyDescriptor) (*Tree, error) {
+	// 1 以读写模式打开时锁定目录，避免多个进程同时读写. 只读模式不会修改任何文件，无需加锁
+	var lock *dirLock
+	if !readOnly {
+		if err := conf.mkdirs(); err != nil {
+			return nil, err
+		}
+		var err error
+		if lock, err = lockDir(conf.FS, conf.Dir); err != nil {
+			return nil, err
+		}
+	}
+	fail := func(err error) (*Tree, error) {
+		if lock != nil {
+			lock.release()
+		}
+		return nil, err
+	}
+
+	// 2 构造 lsm tree 实例
+	t, err := newTree(conf, readOnly, cfDescs)
+	if err != nil {
+		return fail(err)
+	}
+	t.dirLock = lock
+
+	// 3 读取各列族的 sst 文件，还原出整棵树. 以读写模式打开时，只加载上一次记录的文件版本中的 sst 文件.
+	// 早期版本没有记录文件版本，以此识别早期版本写入的目录
+	_, v, err := t.readVersion()
+	if err != nil && !os.IsNotExist(err) {
+		return fail(err)
+	}
+	if v != nil && v.Format > dirFormatVersion {
+		return fail(ErrUnsupportedFormat)
+	}
+	if v != nil {
+		t.legacyWALs = v.LegacyWALs
+	}
+	if err := t.checkMergeOperators(v); err != nil {
+		return fail(err)
+	}
+	for _, cf := range t.cfs {
+		if err := cf.constructTree(v); err != nil {
+			return fail(err)
+		}
+	}
+	// 预写日志全部溢写之后无法通过回放还原序列号，需要从已落盘数据的最大序列号开始分配，保证事务的冲突校验不会误判
+	for _, cf := range t.cfs {
+		for _, nodes := range cf.nodes {
+			if _, largest := seqRangeOf(nodes); largest > t.seq {
+				t.seq = largest
+			}
+		}
+	}
+
+	// 4 运行 lsm tree 压缩调整协程. 只读模式下不进行溢写以及 compact
+	if !readOnly {
+		t.wg.Add(1)
+		go func() {
+			defer t.wg.Done()
+			t.compact()
+		}()
+	}
+
+	// 5 读取 wal 还原出 memtable. 预写日志创建失败时记录为后台错误，此时同样无法打开
+	if err := t.constructMemtable(v); err != nil {
+		close(t.stopc)
+		return fail(err)
+	}
+	if err := t.BackgroundError(); err != nil {
+		close(t.stopc)
+		return fail(err)
+	}
+
+	// 6 记录当前的文件版本，供从实例追赶
+	if !readOnly {
+		if err := t.writeVersion(); err != nil {
+			close(t.stopc)
+			return fail(err)
+		}
+	}
+
+	// 7 返回 lsm tree 实例
+	return t, nil
 }
 
-// 构建出一棵 lsm tree
-func NewTree(conf *Config) (*Tree, error) {
-	// 1 构造 lsm tree 实例
+// 构造 lsm tree 实例以及各个列族，不加载任何数据
+func newTree(conf *Config, readOnly bool, cfDescs []ColumnFamilyDescriptor) (*Tree, error) {
 	t := Tree{
 		conf:          conf,
 		memCompactC:   make(chan *memTableCompactItem),
-		levelCompactC: make(chan int),
+		levelCompactC: make(chan *levelCompactItem),
+		ingestC:       make(chan *ingestItem),
 		stopc:         make(chan struct{}),
-		levelToSeq:    make([]atomic.Int32, conf.MaxLevel),
-		nodes:         make([][]*Node, conf.MaxLevel),
-		levelLocks:    make([]sync.RWMutex, conf.MaxLevel),
+		readOnly:      readOnly,
 	}
+	t.cfs = append(t.cfs, newColumnFamily(&t, 0, DefaultColumnFamilyName, conf))
+	for _, desc := range cfDescs {
+		if _, ok := t.ColumnFamily(desc.Name); ok {
+			return nil, ErrInvalidColumnFamilyName
+		}
+		cfConf, err := newColumnFamilyConfig(conf, desc)
+		if err != nil {
+			return nil, err
+		}
+		// 只读模式下不创建列族目录，目录不存在时视为空列族
+		if !readOnly {
+			if err = conf.FS.MkdirAll(cfConf.Dir); err != nil {
+				return nil, err
+			}
+			if err = vfs.SyncDir(conf.FS, conf.Dir); err != nil {
+				return nil, err
+			}
+		}
+		t.cfs = append(t.cfs, newColumnFamily(&t, len(t.cfs), desc.Name, cfConf))
+	}
+	return &t, nil
+}
 
-	// 2 读取 sst 文件，还原出整棵树
-	if err := t.constructTree(); err != nil {
-		return nil, err
+// 关闭 lsm tree. 此后的读写均返回 ErrClosed. 关闭时会等待执行中的溢写、compact 等后台流程结束，再关闭全部文件并释放目录锁.
+// 配置了 FlushOnClose 时，会先将全部 memtable 溢写落盘；否则 memtable 中的数据保留在预写日志中，重启时回放.
+// 等待超过 CloseTimeout 时返回 ErrCloseTimeout，此时文件以及目录锁均未释放，可以再次调用 Close 继续等待. 关闭完成后重复关闭返回 ErrClosed
+func (t *Tree) Close() error {
+	t.closeLock.Lock()
+	defer t.closeLock.Unlock()
+	if t.closeFinished {
+		return ErrClosed
 	}
 
-	// 3 运行 lsm tree 压缩调整协程
-	go t.compact()
+	// 1 首次关闭时标记为已关闭. 写流程在 dataLock 的保护下检查关闭状态，因此此后不会再有数据写入预写日志和 memtable.
+	// 随后通知后台协程退出，并等待执行中的流程结束
+	if t.closeDone == nil {
+		t.dataLock.Lock()
+		t.closed.Store(true)
+		t.dataLock.Unlock()
+
+		close(t.stopc)
+		done := make(chan struct{})
+		go func() {
+			t.wg.Wait()
+			close(done)
+		}()
+		t.closeDone = done
+	}
 
-	// 4 读取 wal 还原出 memtable
-	if err := t.constructMemtable(); err != nil {
-		return nil, err
+	// 2 等待超时时保留全部文件以及目录锁，由之后的 Close 继续等待
+	select {
+	case <-t.closeDone:
+	case <-time.After(t.conf.CloseTimeout):
+		return ErrCloseTimeout
 	}
+	t.closeFinished = true
 
-	// 5 返回 lsm tree 实例
-	return &t, nil
+	// 3 compact 协程已经退出，由当前协程将全部 memtable 溢写落盘
+	var err error
+	if t.conf.FlushOnClose && !t.readOnly {
+		err = t.flushAllMemTables()
+	}
+
+	// 4 关闭全部文件，释放目录锁. 预写日志在关闭之前完成持久化
+	if t.walWriter != nil {
+		walErr := t.walWriter.Sync()
+		if closeErr := t.walWriter.Close(); walErr == nil {
+			walErr = closeErr
+		}
+		if err == nil {
+			err = walErr
+		}
+	}
+	for _, cf := range t.cfs {
+		for i := 0; i < len(cf.nodes); i++ {
+			for j := 0; j < len(cf.nodes[i]); j++ {
+				cf.nodes[i][j].Close()
+			}
+		}
+		cf.blobs.close()
+	}
+	if t.dirLock != nil {
+		t.dirLock.release()
+	}
+	return err
 }
 
-func (t *Tree) Close() {
-	close(t.stopc)
-	for i := 0; i < len(t.nodes); i++ {
-		for j := 0; j < len(t.nodes[i]); j++ {
-			t.nodes[i][j].Close()
+// 将此前写入的数据在预写日志中持久化. 返回 nil 之后，即使进程或者机器崩溃，此前成功写入的数据在重启后也不会丢失.
+// 持久化失败时无法确定哪些数据已经落盘，记录为后台错误
+func (t *Tree) SyncWAL() error {
+	if t.readOnly {
+		return ErrReadOnly
+	}
+	// 持有读锁，期间不会写入数据，也不会切换预写日志
+	t.dataLock.RLock()
+	defer t.dataLock.RUnlock()
+	if err := t.checkWritable(); err != nil {
+		return err
+	}
+	if err := t.walWriter.Sync(); err != nil {
+		return t.setBackgroundError(BackgroundErrorWAL, err)
+	}
+	return nil
+}
+
+// 将读写 memtable 以及全部只读 memtable 依次溢写落盘，对应的预写日志随之删除. 只能在 compact 协程退出后执行.
+// 溢写失败时未落盘的数据保留在预写日志中
+func (t *Tree) flushAllMemTables() error {
+	t.dataLock.Lock()
+	active := memTableCompactItem{
+		walFile: t.walFile(),
+		lastSeq: t.seq,
+	}
+	for _, cf := range t.cfs {
+		active.memTables = append(active.memTables, &cfMemTable{
+			memTable:  cf.memTable,
+			rangeDels: cf.memRangeDels,
+		})
+	}
+	t.rOnlyMemTable = append(t.rOnlyMemTable, &active)
+	t.dataLock.Unlock()
+
+	for item := t.oldestROnlyMemTable(); item != nil; item = t.oldestROnlyMemTable() {
+		if err := t.compactMemTable(item); err != nil {
+			return err
 		}
 	}
+	return nil
+}
+
+// 校验 lsm tree 尚未关闭
+func (t *Tree) checkOpen() error {
+	if t.closed.Load() {
+		return ErrClosed
+	}
+	return nil
+}
+
+// 校验 lsm tree 可以写入: 尚未关闭，并且不存在后台错误
+func (t *Tree) checkWritable() error {
+	if err := t.checkOpen(); err != nil {
+		return err
+	}
+	return t.BackgroundError()
 }
 
 // 写入一组 kv 对到 lsm tree. 会直接写入到读写 memtable 中.
 func (t *Tree) Put(key, value []byte) error {
-	// 1 加写锁
+	return t.PutCF(t.DefaultColumnFamily(), key, value)
+}
+
+// 写入一组 kv 对到指定列族
+func (t *Tree) PutCF(cf *ColumnFamily, key, value []byte) error {
+	batch := NewWriteBatch()
+	batch.Put(cf, key, value)
+	return t.Write(batch)
+}
+
+// 写入一组带有存活时间的 kv 对. 超过 ttl 后，读流程视其为不存在，compact 流程会将其物理删除
+func (t *Tree) PutWithTTL(key, value []byte, ttl time.Duration) error {
+	return t.PutWithTTLCF(t.DefaultColumnFamily(), key, value, ttl)
+}
+
+// 写入一组带有存活时间的 kv 对到指定列族
+func (t *Tree) PutWithTTLCF(cf *ColumnFamily, key, value []byte, ttl time.Duration) error {
+	batch := NewWriteBatch()
+	batch.PutWithTTL(cf, key, value, ttl)
+	return t.Write(batch)
+}
+
+// 删除一个 key
+func (t *Tree) Delete(key []byte) error {
+	return t.DeleteCF(t.DefaultColumnFamily(), key)
+}
+
+// 删除指定列族中的一个 key
+func (t *Tree) DeleteCF(cf *ColumnFamily, key []byte) error {
+	batch := NewWriteBatch()
+	batch.Delete(cf, key)
+	return t.Write(batch)
+}
+
+// 删除 [start, end) 范围内的所有 key. 以范围删除标记的形式写入，读流程和 compact 流程会据此过滤掉被覆盖的老数据
+func (t *Tree) DeleteRange(start, end []byte) error {
+	return t.DeleteRangeCF(t.DefaultColumnFamily(), start, end)
+}
+
+// 删除指定列族中 [start, end) 范围内的所有 key
+func (t *Tree) DeleteRangeCF(cf *ColumnFamily, start, end []byte) error {
+	batch := NewWriteBatch()
+	batch.DeleteRange(cf, start, end)
+	return t.Write(batch)
+}
+
+// 写入一笔 merge 操作数. 读取时再通过 MergeOperator 将其与 key 原有的值进行合并
+func (t *Tree) Merge(key, operand []byte) error {
+	return t.MergeCF(t.DefaultColumnFamily(), key, operand)
+}
+
+// 写入一笔 merge 操作数到指定列族
+func (t *Tree) MergeCF(cf *ColumnFamily, key, operand []byte) error {
+	batch := NewWriteBatch()
+	batch.Merge(cf, key, operand)
+	return t.Write(batch)
+}
+
+// 原子性地执行一次批量写入. 批量写入中的全部操作作为一笔预写日志记录落盘，重启后要么全部生效，要么全部不生效
+func (t *Tree) Write(batch *WriteBatch) error {
+	if err := t.checkBatch(batch); err != nil {
+		return err
+	}
+	if len(batch.records) == 0 {
+		return nil
+	}
+
+	// 加写锁
 	t.dataLock.Lock()
 	defer t.dataLock.Unlock()
+	return t.writeLocked(batch)
+}
 
-	// 2 数据预写入预写日志中，防止因宕机引起 memtable 数据丢失.
-	if err := t.walWriter.Write(key, value); err != nil {
+// 校验批量写入中的操作是否合法
+func (t *Tree) checkBatch(batch *WriteBatch) error {
+	if t.readOnly {
+		return ErrReadOnly
+	}
+	if batch.err != nil {
+		return batch.err
+	}
+	for _, record := range batch.records {
+		if err := t.checkColumnFamily(record.cf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 执行一次批量写入. 调用方需要持有 dataLock 写锁
+func (t *Tree) writeLocked(batch *WriteBatch) error {
+	if err := t.checkWritable(); err != nil {
 		return err
 	}
 
-	// 3 数据写入读写跳表
-	t.memTable.Put(key, value)
+	// 1 分配序列号，并确定带有存活时间的数据的过期时间
+	t.seq++
+	for _, record := range batch.records {
+		record.e.seq = t.seq
+		if record.ttl > 0 {
+			record.e.expireAt = record.cf.conf.Clock.Now().Add(record.ttl).UnixNano()
+		}
+	}
 
-	// 4 倘若读写跳表的大小未达到 level0 层 sstable 的大小阈值，则直接返回.
-	// 考虑到溢写成 sstable 后，需要有一些辅助的元数据，预估容量放大为 5/4 倍
-	if uint64(t.memTable.Size()*5/4) <= t.conf.SSTSize {
-		return nil
+	// 2 数据预写入预写日志中，防止因宕机引起 memtable 数据丢失. 写入失败时预写日志末尾可能残留不完整的记录，
+	// 之后追加的记录在重启后无法被读取，需要记录为后台错误
+	if err := t.walWriter.Write(nil, encodeBatch(batch.records)); err != nil {
+		return t.setBackgroundError(BackgroundErrorWAL, err)
+	}
+
+	// 3 数据写入各列族的读写跳表. 对于 merge 操作数，需要与跳表中已有的记录进行叠加；对于范围删除，需要覆盖跳表中已有的数据.
+	// 写入失败时批量写入已经记录在预写日志中，而 memtable 中只应用了一部分，需要记录为后台错误
+	for _, record := range batch.records {
+		cf := record.cf
+		if err := applyRecord(cf.memTable, &cf.memRangeDels, record.key, record.e); err != nil {
+			return t.setBackgroundError(BackgroundErrorMemTable, err)
+		}
 	}
 
-	// 5 倘若读写跳表数据量达到上限，则需要切换跳表
-	t.refreshMemTableLocked()
+	// 4 倘若各列族读写跳表的大小均未达到 level0 层 sstable 的大小阈值，则直接返回.
+	// 考虑到溢写成 sstable 后，需要有一些辅助的元数据，预估容量放大为 5/4 倍
+	for _, cf := range t.cfs {
+		if uint64(cf.memTable.Size()*5/4) > cf.conf.SSTSize {
+			// 5 倘若读写跳表数据量达到上限，则需要切换跳表. 各列族共享 wal 文件，因此一同切换
+			t.refreshMemTableLocked()
+			break
+		}
+	}
 	return nil
 }
 
 // 根据 key 读取数据
 func (t *Tree) Get(key []byte) ([]byte, bool, error) {
+	return t.GetCF(t.DefaultColumnFamily(), key)
+}
+
+// 根据 key 读取指定列族中的数据
+func (t *Tree) GetCF(cf *ColumnFamily, key []byte) ([]byte, bool, error) {
+	if err := t.checkOpen(); err != nil {
+		return nil, false, err
+	}
+	if err := t.checkColumnFamily(cf); err != nil {
+		return nil, false, err
+	}
+
+	// 由新到旧收集 key 对应的数据记录，直到遇到一笔完整的记录为止
+	var entries []*entry
+	collect := func(e *entry) (bool, error) {
+		entries = append(entries, e)
+		return e.complete(), nil
+	}
+
+	// 1 读 memtable，同时获取各层节点的快照.
+	// 两个动作在同一把锁的保护下完成，保证不会因为并发的溢写流程而漏读或者重复读取数据
 	t.dataLock.RLock()
-	// 1 首先读 active memtable.
-	value, ok := t.memTable.Get(key)
-	if ok {
-		t.dataLock.RUnlock()
-		return value, true, nil
+	done, err := t.getFromMemTables(cf, key, collect)
+	v := cf.refVersion()
+	t.dataLock.RUnlock()
+	defer v.unref()
+	if err != nil {
+		return nil, false, err
 	}
 
-	// 2 读 readOnly memtable.  按照 index 倒序遍历，因为 index 越大，数据越晚写入，实时性越强
-	for i := len(t.rOnlyMemTable) - 1; i >= 0; i-- {
-		value, ok = t.rOnlyMemTable[i].memTable.Get(key)
-		if ok {
+	// 2 读 sstable
+	if !done {
+		if _, err = v.get(key, collect); err != nil {
+			return nil, false, err
+		}
+	}
+
+	// 3 基于收集到的数据记录得出最终结果. 没有任何记录或者数据已过期则说明 key 不存在
+	return cf.resolveEntries(key, entries, cf.conf.Clock.Now())
+}
+
+// 批量读取一组 key 对应的数据，返回与 keys 一一对应的结果
+func (t *Tree) MultiGet(keys [][]byte) ([][]byte, []bool, error) {
+	return t.MultiGetCF(t.DefaultColumnFamily(), keys)
+}
+
+// 批量读取指定列族中一组 key 对应的数据. 相比逐个调用 GetCF，只需要加一次锁、获取一次节点快照，
+// 并且同一个 block 中的 key 只需要读取并解析一次 block
+func (t *Tree) MultiGetCF(cf *ColumnFamily, keys [][]byte) ([][]byte, []bool, error) {
+	if err := t.checkOpen(); err != nil {
+		return nil, nil, err
+	}
+	if err := t.checkColumnFamily(cf); err != nil {
+		return nil, nil, err
+	}
+
+	// 1 key 排序去重
+	sorted := make([][]byte, len(keys))
+	copy(sorted, keys)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i], sorted[j]) < 0
+	})
+	lookups := make([]*multiGetLookup, 0, len(sorted))
+	for i, key := range sorted {
+		if i > 0 && bytes.Equal(key, sorted[i-1]) {
+			continue
+		}
+		lookups = append(lookups, &multiGetLookup{key: key})
+	}
+
+	// 2 读 memtable，同时获取各层节点的快照
+	t.dataLock.RLock()
+	for _, lookup := range lookups {
+		if _, err := t.getFromMemTables(cf, lookup.key, lookup.collect); err != nil {
 			t.dataLock.RUnlock()
-			return value, true, nil
+			return nil, nil, err
 		}
 	}
+	v := cf.refVersion()
 	t.dataLock.RUnlock()
+	defer v.unref()
 
-	// 3 读 sstable level0 层. 按照 index 倒序遍历，因为 index 越大，数据越晚写入，实时性越强
-	var err error
-	t.levelLocks[0].RLock()
-	for i := len(t.nodes[0]) - 1; i >= 0; i-- {
-		if value, ok, err = t.nodes[0][i].Get(key); err != nil {
-			t.levelLocks[0].RUnlock()
-			return nil, false, err
-		}
-		if ok {
-			t.levelLocks[0].RUnlock()
-			return value, true, nil
+	// 3 读 sstable
+	if err := v.multiGet(lookups); err != nil {
+		return nil, nil, err
+	}
+
+	// 4 基于收集到的数据记录得出各个 key 的最终结果
+	now := cf.conf.Clock.Now()
+	values, oks := make([][]byte, len(keys)), make([]bool, len(keys))
+	for i, key := range keys {
+		lookup := lookups[sort.Search(len(lookups), func(j int) bool {
+			return bytes.Compare(lookups[j].key, key) >= 0
+		})]
+		value, ok, err := cf.resolveEntries(key, lookup.entries, now)
+		if err != nil {
+			return nil, nil, err
 		}
+		values[i], oks[i] = value, ok
 	}
-	t.levelLocks[0].RUnlock()
+	return values, oks, nil
+}
 
-	// 4 依次读 sstable level 1 ~ i 层，每层至多只需要和一个 sstable 交互. 因为这些 level 层中的 sstable 都是无重复数据且全局有序的
-	for level := 1; level < len(t.nodes); level++ {
-		t.levelLocks[level].RLock()
-		node, ok := t.levelBinarySearch(level, key, 0, len(t.nodes[level])-1)
-		if !ok {
-			t.levelLocks[level].RUnlock()
-			continue
+// 由新到旧读取列族 memtable 中 key 对应的记录，交由 collect 处理. collect 返回 true 时终止流程
+// 调用方需要持有 dataLock 读锁
+func (t *Tree) getFromMemTables(cf *ColumnFamily, key []byte, collect func(e *entry) (bool, error)) (bool, error) {
+	// 1 首先读 active memtable.
+	if done, err := getFromMemTable(cf.memTable, cf.memRangeDels, key, collect); done || err != nil {
+		return done, err
+	}
+
+	// 2 读 readOnly memtable.  按照 index 倒序遍历，因为 index 越大，数据越晚写入，实时性越强
+	for i := len(t.rOnlyMemTable) - 1; i >= 0; i-- {
+		item := t.rOnlyMemTable[i].memTables[cf.index]
+		if done, err := getFromMemTable(item.memTable, item.rangeDels, key, collect); done || err != nil {
+			return done, err
 		}
-		if value, ok, err = node.Get(key); err != nil {
-			t.levelLocks[level].RUnlock()
-			return nil, false, err
+	}
+
+	return false, nil
+}
+
+// 读取 memtable 中 key 对应的记录，交由 collect 处理. key 被范围删除标记覆盖时，视为读到一笔删除标记
+func getFromMemTable(memTable memtable.MemTable, rangeDels rangeTombstones, key []byte, collect func(e *entry) (bool, error)) (bool, error) {
+	if raw, ok := memTable.Get(key); ok {
+		e, err := decodeEntry(raw)
+		if err != nil {
+			return false, err
 		}
-		if ok {
-			t.levelLocks[level].RUnlock()
-			return value, true, nil
+		if done, err := collect(e); done || err != nil {
+			return done, err
 		}
-		t.levelLocks[level].RUnlock()
 	}
 
-	// 5 至此都没有读到数据，则返回 key 不存在.
-	return nil, false, nil
+	if seq, ok := rangeDels.coveredSeq(key); ok {
+		deleted := newDeleteEntry()
+		deleted.seq = seq
+		return collect(deleted)
+	}
+	return false, nil
 }
 
 // 切换读写跳表为只读跳表，并构建新的读写跳表
@@ -176,14 +639,22 @@ func (t *Tree) refreshMemTableLocked() {
 	// 辞旧
 	// 将读写跳表切换为只读跳表，追加到 slice 中，并通过 chan 发送给 compact 协程，由其负责进行溢写成为 level0 层 sst 文件的操作.
 	oldItem := memTableCompactItem{
-		walFile:  t.walFile(),
-		memTable: t.memTable,
+		walFile: t.walFile(),
+		lastSeq: t.seq,
+	}
+	for _, cf := range t.cfs {
+		oldItem.memTables = append(oldItem.memTables, &cfMemTable{
+			memTable:  cf.memTable,
+			rangeDels: cf.memRangeDels,
+		})
 	}
 	t.rOnlyMemTable = append(t.rOnlyMemTable, &oldItem)
-	t.walWriter.Close()
-	go func() {
-		t.memCompactC <- &oldItem
-	}()
+	// 老的预写日志不再追加写入，关闭之前完成持久化，此后通过 SyncWAL 只需要持久化新的预写日志
+	if err := t.walWriter.Sync(); err != nil {
+		_ = t.setBackgroundError(BackgroundErrorWAL, err)
+	}
+	_ = t.walWriter.Close()
+	t.notifyMemCompact(&oldItem)
 
 	// 迎新
 	// 构造一个新的读写 memtable，并构造与之相应的 wal 文件.
@@ -191,24 +662,46 @@ func (t *Tree) refreshMemTableLocked() {
 	t.newMemTable()
 }
 
-func (t *Tree) levelBinarySearch(level int, key []byte, start, end int) (*Node, bool) {
-	if start > end {
-		return nil, false
-	}
-
-	mid := start + (end-start)>>1
-	if bytes.Compare(t.nodes[level][start].endKey, key) < 0 {
-		return t.levelBinarySearch(level, key, mid+1, end)
-	}
+// 在后台协程中将只读 memtable 发送给 compact 协程. lsm tree 关闭后放弃发送，只读 memtable 中的数据保留在预写日志中
+func (t *Tree) notifyMemCompact(item *memTableCompactItem) {
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		select {
+		case t.memCompactC <- item:
+		case <-t.stopc:
+		}
+	}()
+}
 
-	if bytes.Compare(t.nodes[level][start].startKey, key) > 0 {
-		return t.levelBinarySearch(level, key, start, mid-1)
+// 在 level1~levelk 层有序且互不重叠的节点中，二分查找 key 范围覆盖了 key 的节点
+// 节点的最大 key 可能是不包含在范围内的范围删除标记终点，此时相邻两个节点的 key 范围首尾相接，因此至多返回两个节点
+func levelBinarySearch(nodes []*Node, key []byte) []*Node {
+	// 找到首个最大 key 不小于 key 的节点
+	i := sort.Search(len(nodes), func(i int) bool {
+		return bytes.Compare(nodes[i].End(), key) >= 0
+	})
+	j := i
+	for j < len(nodes) && bytes.Compare(nodes[j].Start(), key) <= 0 {
+		j++
 	}
-
-	return t.nodes[level][mid], true
+	return nodes[i:j]
 }
 
 func (t *Tree) newMemTable() {
-	t.walWriter, _ = wal.NewWALWriter(t.walFile())
-	t.memTable = t.conf.MemTableConstructor()
+	// 只读模式下不创建预写日志. 新建的预写日志需要持久化目录项，否则崩溃后通过 SyncWAL 持久化的数据会随文件一起丢失.
+	// 创建失败时记录为后台错误，此后拒绝写入
+	if !t.readOnly {
+		var err error
+		if t.walWriter, err = wal.NewWALWriter(t.conf.FS, t.walFile()); err == nil {
+			err = vfs.SyncDir(t.conf.FS, path.Dir(t.walFile()))
+		}
+		if err != nil {
+			_ = t.setBackgroundError(BackgroundErrorWAL, err)
+		}
+	}
+	for _, cf := range t.cfs {
+		cf.memTable = cf.conf.MemTableConstructor()
+		cf.memRangeDels = nil
+	}
 }
@@ -6,15 +6,30 @@ import (
 	"math"
 	"os"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
 
 	"github.com/xiaoxuxiansheng/golsm/memtable"
 )
 
+// 一组共享同一份 wal 文件的只读 memtable
 type memTableCompactItem struct {
-	walFile  string
-	memTable memtable.MemTable
+	walFile   string
+	memTables []*cfMemTable // 各列族的只读 memtable，按照列族下标排列
+	lastSeq   uint64        // memtable 中最大的序列号
+}
+
+// 某个列族的 memtable 以及对应的范围删除标记
+type cfMemTable struct {
+	memTable  memtable.MemTable
+	rangeDels rangeTombstones
+}
+
+// level 层 compact 指令
+type levelCompactItem struct {
+	cf    *ColumnFamily
+	level int
 }
 
 // 运行 compact 协程.
@@ -26,248 +41,694 @@ func (t *Tree) compact() {
 			// log
 			return
 			// 接收到 read-only memtable，需要将其溢写到磁盘成为 level0 层 sstable 文件.
-		case memCompactItem := <-t.memCompactC:
-			t.compactMemTable(memCompactItem)
+			// 发送信号的协程之间没有先后顺序保证，因此总是溢写最早的只读 memtable，保证 level0 层 sst 文件的 seq 顺序与数据写入顺序一致
+		case <-t.memCompactC:
+			// 存在后台错误时暂停溢写，只读 memtable 保留在内存以及预写日志中，待 Resume 之后重新溢写
+			if t.BackgroundError() != nil {
+				continue
+			}
+			// 摄入外部文件时可能已经提前溢写了只读 memtable
+			if item := t.oldestROnlyMemTable(); item != nil {
+				if err := t.compactMemTable(item); err != nil {
+					_ = t.setBackgroundError(BackgroundErrorFlush, err)
+				}
+			}
 			// 接收到 level 层 compact 指令，需要执行 level~level+1 之间的 level sorted merge 流程.
-		case level := <-t.levelCompactC:
-			t.compactLevel(level)
+		case item := <-t.levelCompactC:
+			// 存在后台错误时暂停 compact，待 Resume 之后重新检查各层
+			if t.BackgroundError() != nil {
+				continue
+			}
+			// 同一层可能被多次触发 compact，此前的 compact 流程可能已经使得该层的数据量回落到阈值以内
+			if !item.cf.needCompact(item.level) {
+				continue
+			}
+			if err := item.cf.runCompaction(item.level); err != nil {
+				_ = t.setBackgroundError(BackgroundErrorCompaction, err)
+			}
+			// 接收到外部 sst 文件的摄入指令，将其放置到 lsm tree 中
+		case item := <-t.ingestC:
+			if err := t.BackgroundError(); err != nil {
+				rollbackIngest(item.cf.conf.FS, item.cf.conf.Dir, item.files)
+				item.errc <- err
+				continue
+			}
+			item.errc <- t.ingest(item)
+		}
+	}
+}
+
+// 按照列族的 compact 策略处理数据量超过阈值的 level 层
+func (cf *ColumnFamily) runCompaction(level int) error {
+	if cf.conf.CompactionStyle == CompactionStyleFIFO {
+		cf.compactFIFO()
+		return nil
+	}
+	return cf.compactLevel(level)
+}
+
+// 先进先出策略下，由旧到新删除 level0 层的节点，直到数据量回落到阈值以内
+func (cf *ColumnFamily) compactFIFO() {
+	limit := cf.conf.SSTSize * uint64(cf.conf.SSTNumPerLevel)
+	cf.levelLocks[0].RLock()
+	var size uint64
+	for _, node := range cf.nodes[0] {
+		size += node.size
+	}
+	var expired []*Node
+	for _, node := range cf.nodes[0] {
+		if size <= limit {
+			break
 		}
+		expired = append(expired, node)
+		size -= node.size
+	}
+	cf.levelLocks[0].RUnlock()
+
+	if len(expired) > 0 {
+		cf.replaceNodes(0, expired, nil)
 	}
 }
 
-// 针对 level 层进行排序归并操作
-func (t *Tree) compactLevel(level int) {
+// 针对 level 层进行排序归并操作. 任何一步失败时，已经生成的新文件均会被删除，lsm tree 保持原状
+func (cf *ColumnFamily) compactLevel(level int) error {
 	// 获取到 level 和 level + 1 层内需要进行本次归并的节点
-	pickedNodes := t.pickCompactNodes(level)
+	pickedNodes := cf.pickCompactNodes(level)
 
-	// 插入到 level + 1 层对应的目标 sstWriter
-	seq := t.levelToSeq[level+1].Load() + 1
-	sstWriter, _ := NewSSTWriter(t.sstFile(level+1, seq), t.conf)
-	defer sstWriter.Close()
+	// 倘若 level + 1 层没有与之重叠的节点，则无需读写数据，直接将文件平移到 level + 1 层即可
+	if cf.isTrivialMove(level, pickedNodes) {
+		err := cf.moveNodes(level, pickedNodes)
+		cf.tryTriggerCompact(level + 1)
+		return err
+	}
 
+	// 获取本次排序归并的节点涉及到的所有 kv 数据以及范围删除标记
+	pickedKVs, rangeDels, err := cf.pickedNodesToKVs(level+1, pickedNodes)
+	if err != nil {
+		return err
+	}
+
+	// 数据均已被清理，直接移除老节点即可
+	if len(pickedKVs) == 0 && len(rangeDels) == 0 {
+		cf.replaceNodes(level, pickedNodes, nil)
+		return nil
+	}
+
+	// 较大的 value 分离到 blob 文件中. 垃圾占比达到阈值的 blob 文件中仍然有效的 value 会被重新写入新的 blob 文件，
+	// 待不再有节点引用老的 blob 文件后，将其删除
+	separator := cf.newBlobSeparator(cf.blobs.garbageFiles(cf.liveBlobBytes(), cf.conf.BlobGCRatio))
+	defer separator.close()
+
+	// 本次归并生成的新节点，待全部归并完成后再统一插入到 lsm tree 内存结构中
+	var (
+		newNodes  []*Node
+		sstWriter *SSTWriter
+		seq       int32
+	)
+	// 失败时删除正在写入的 sst 文件以及已经生成的新节点
+	abort := func(err error) error {
+		if sstWriter != nil {
+			sstWriter.Close()
+			_ = cf.conf.FS.Remove(path.Join(cf.conf.Dir, cf.sstFile(level+1, seq)))
+		}
+		for _, node := range newNodes {
+			node.Destroy()
+		}
+		return err
+	}
+	// 构造一个新的 level + 1 层 sstWriter. 归并生成的 sst 文件继承全部老节点的序列号范围
+	smallestSeq, largestSeq := seqRangeOf(pickedNodes)
+	newWriter := func() error {
+		seq = cf.levelToSeq[level+1].Load() + 1
+		w, err := NewSSTWriter(cf.sstFile(level+1, seq), cf.conf)
+		if err != nil {
+			return err
+		}
+		w.setSeqRange(smallestSeq, largestSeq)
+		sstWriter = w
+		return nil
+	}
+	// 将 sst 文件溢写落盘，并构造为 node
+	finishWriter := func(rangeDels rangeTombstones) error {
+		size, filter, index, err := sstWriter.Finish()
+		if err != nil {
+			return err
+		}
+		node, err := cf.newNode(level+1, seq, size, filter, index, rangeDels)
+		if err != nil {
+			return err
+		}
+		sstWriter.Close()
+		sstWriter = nil
+		newNodes = append(newNodes, node)
+		return nil
+	}
+
+	if err = newWriter(); err != nil {
+		return abort(err)
+	}
 	// 获取 level + 1 层每个 sst 文件的大小阈值
-	sstLimit := t.conf.SSTSize * uint64(math.Pow10(level+1))
-	// 获取本次排序归并的节点涉及到的所有 kv 数据
-	pickedKVs := t.pickedNodesToKVs(pickedNodes)
+	sstLimit := cf.conf.SSTSize * uint64(math.Pow10(level+1))
 	// 遍历每笔需要归并的 kv 数据
 	for i := 0; i < len(pickedKVs); i++ {
 		// 倘若新生成的 level + 1 层 sst 文件大小已经超限
 		if sstWriter.Size() > sstLimit {
-			// 将 sst 文件溢写落盘
-			size, blockToFilter, index := sstWriter.Finish()
-			// 将 sst 文件对应 node 插入到 lsm tree 内存结构中
-			t.insertNode(level+1, seq, size, blockToFilter, index)
-			// 构造一个新的 level + 1 层 sstWriter
-			seq = t.levelToSeq[level+1].Load() + 1
-			sstWriter, _ = NewSSTWriter(t.sstFile(level+1, seq), t.conf)
-			defer sstWriter.Close()
+			// 范围删除标记按照下一个 sst 文件的最小 key 进行切分，之前的部分写入当前 sst 文件，保证同层 sst 文件的 key 范围互不重叠.
+			// 切分点即为下一个 sst 文件属性中记录的最小 key
+			var finished rangeTombstones
+			finished, rangeDels = rangeDels.split(pickedKVs[i].Key)
+			for _, r := range finished {
+				sstWriter.AddRangeTombstone(r.Start, r.End)
+			}
+			// 将 sst 文件溢写落盘，并构造一个新的 level + 1 层 sstWriter
+			if err = finishWriter(finished); err != nil {
+				return abort(err)
+			}
+			if err = newWriter(); err != nil {
+				return abort(err)
+			}
 		}
 
 		// 将 kv 数据追加到 sstWriter
-		sstWriter.Append(pickedKVs[i].Key, pickedKVs[i].Value)
-		// 倘若这是最后一笔 kv 数据，需要负责把 sstWriter 溢写落盘并把对应 node 插入到 lsm tree 内存结构中
-		if i == len(pickedKVs)-1 {
-			size, blockToFilter, index := sstWriter.Finish()
-			t.insertNode(level+1, seq, size, blockToFilter, index)
-		}
+		sstWriter.Append(pickedKVs[i].Key, separator.separate(pickedKVs[i].Value))
 	}
 
-	// 移除这部分被合并的节点
-	t.removeNodes(level, pickedNodes)
+	// 剩余的范围删除标记写入最后一个 sst 文件，将其溢写落盘并构造对应 node
+	for _, r := range rangeDels {
+		sstWriter.AddRangeTombstone(r.Start, r.End)
+	}
+	if err = finishWriter(rangeDels); err != nil {
+		return abort(err)
+	}
+	// 新节点引用的 blob 文件需要在老节点被删除之前完成持久化
+	if err = separator.sync(); err != nil {
+		return abort(err)
+	}
+
+	// 使用新节点替换这部分被合并的老节点
+	cf.replaceNodes(level, pickedNodes, newNodes)
 
 	// 尝试触发下一层的 compact 操作
-	t.tryTriggerCompact(level + 1)
+	cf.tryTriggerCompact(level + 1)
+	return nil
 }
 
 // 获取本轮 compact 流程涉及到的所有节点，范围涵盖 level 和 level+1 层
-func (t *Tree) pickCompactNodes(level int) []*Node {
+func (cf *ColumnFamily) pickCompactNodes(level int) []*Node {
 	// 每次合并范围为当前层前一半节点
-	startKey := t.nodes[level][0].Start()
-	endKey := t.nodes[level][0].End()
+	startKey := cf.nodes[level][0].Start()
+	endKey := cf.nodes[level][0].End()
 
-	mid := len(t.nodes[level]) >> 1
-	if bytes.Compare(t.nodes[level][mid].Start(), startKey) < 0 {
-		startKey = t.nodes[level][mid].Start()
+	mid := len(cf.nodes[level]) >> 1
+	if bytes.Compare(cf.nodes[level][mid].Start(), startKey) < 0 {
+		startKey = cf.nodes[level][mid].Start()
 	}
 
-	if bytes.Compare(t.nodes[level][mid].End(), endKey) > 0 {
-		endKey = t.nodes[level][mid].End()
+	if bytes.Compare(cf.nodes[level][mid].End(), endKey) > 0 {
+		endKey = cf.nodes[level][mid].End()
 	}
 
-	var pickedNodes []*Node
-	// 将 level 层和 level + 1 层 和 [start,end] 范围有重叠的节点进行合并
-	for i := level + 1; i >= level; i-- {
-		for j := 0; j < len(t.nodes[i]); j++ {
-			if bytes.Compare(endKey, t.nodes[i][j].Start()) < 0 || bytes.Compare(startKey, t.nodes[i][j].End()) > 0 {
+	// level 层中与 [start,end] 范围有重叠的节点都需要参与归并. level0 层节点之间可能存在重叠，
+	// 因此需要根据选中的节点不断扩大范围，直到不再有新的节点加入. 否则新数据被归并到 level + 1 层后，会被遗留在 level0 层的老数据遮蔽
+	var levelNodes []*Node
+	for {
+		levelNodes = levelNodes[:0]
+		expanded := false
+		for _, node := range cf.nodes[level] {
+			if bytes.Compare(endKey, node.Start()) < 0 || bytes.Compare(startKey, node.End()) > 0 {
 				continue
 			}
+			levelNodes = append(levelNodes, node)
+			if bytes.Compare(node.Start(), startKey) < 0 {
+				startKey, expanded = node.Start(), true
+			}
+			if bytes.Compare(node.End(), endKey) > 0 {
+				endKey, expanded = node.End(), true
+			}
+		}
+		if !expanded {
+			break
+		}
+	}
 
-			// 所有范围有重叠的节点都追加到 list
-			pickedNodes = append(pickedNodes, t.nodes[i][j])
+	var pickedNodes []*Node
+	// 将 level + 1 层中和 [start,end] 范围有重叠的节点一并进行合并. level + 1 层的数据更老，排在前面
+	for _, node := range cf.nodes[level+1] {
+		if bytes.Compare(endKey, node.Start()) < 0 || bytes.Compare(startKey, node.End()) > 0 {
+			continue
 		}
+		pickedNodes = append(pickedNodes, node)
 	}
 
-	return pickedNodes
+	return append(pickedNodes, levelNodes...)
 }
 
-// 获取本轮 compact 流程涉及到的所有 kv 对. 这个过程中可能存在重复 k，保证只保留最新的 v
-func (t *Tree) pickedNodesToKVs(pickedNodes []*Node) []*KV {
+// 判断本轮 compact 能否通过平移文件的方式完成.
+// 要求所有节点均位于 level 层，且节点之间 key 范围互不重叠（level0 层的节点之间可能存在重叠）
+func (cf *ColumnFamily) isTrivialMove(level int, pickedNodes []*Node) bool {
+	if len(pickedNodes) == 0 {
+		return false
+	}
+
+	for _, node := range pickedNodes {
+		if node.level != level {
+			return false
+		}
+	}
+
+	if level > 0 {
+		return true
+	}
+
+	sorted := make([]*Node, len(pickedNodes))
+	copy(sorted, pickedNodes)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i].Start(), sorted[j].Start()) < 0
+	})
+	for i := 1; i < len(sorted); i++ {
+		if bytes.Compare(sorted[i-1].End(), sorted[i].Start()) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// 将 level 层的节点平移到 level + 1 层. 只为 sst 文件更换文件名，不涉及数据的读写.
+// 某个节点平移失败时，此前已经完成平移的节点照常生效，其余节点保留在 level 层
+func (cf *ColumnFamily) moveNodes(level int, nodes []*Node) error {
+	movedNodes := make([]*Node, 0, len(nodes))
+	oldNodes := make([]*Node, 0, len(nodes))
+	var err error
+	for _, node := range nodes {
+		seq := cf.levelToSeq[level+1].Load() + 1
+		src, dest := path.Join(cf.conf.Dir, node.file), path.Join(cf.conf.Dir, cf.sstFile(level+1, seq))
+		// 优先通过硬链接平移，记录新的文件版本之后再删除老的文件名，崩溃时总有一个文件名与文件版本一致. 不支持硬链接时退化为重命名
+		linked := true
+		if err = cf.conf.FS.Link(src, dest); err != nil {
+			linked = false
+			if err = cf.conf.FS.Rename(src, dest); err != nil {
+				break
+			}
+		}
+
+		// 索引和过滤器信息保持不变，直接复用
+		var moved *Node
+		if moved, err = cf.newNode(level+1, seq, node.size, node.filter, node.index, node.rangeDels); err != nil {
+			if linked {
+				_ = cf.conf.FS.Remove(dest)
+			} else {
+				_ = cf.conf.FS.Rename(dest, src)
+			}
+			break
+		}
+		movedNodes = append(movedNodes, moved)
+		oldNodes = append(oldNodes, node)
+	}
+
+	// 老节点的文件名在记录新的文件版本之后删除. 文件已经被重命名时，销毁老节点只会关闭其 sst reader
+	cf.replaceNodes(level, oldNodes, movedNodes)
+	return err
+}
+
+// 获取本轮 compact 流程涉及到的所有 kv 对以及范围删除标记. 这个过程中可能存在重复 k，保证只保留最新的 v
+// merge 操作数会与老数据叠加，并尽可能收敛为更少的操作数或者最终结果；已过期以及被删除的数据会被尽可能清理
+func (cf *ColumnFamily) pickedNodesToKVs(targetLevel int, pickedNodes []*Node) ([]*KV, rangeTombstones, error) {
+	// level 层节点中的范围删除标记，晚于 level + 1 层的全部数据写入
+	var newerRangeDels rangeTombstones
+	for _, node := range pickedNodes {
+		if node.level != targetLevel {
+			newerRangeDels = append(newerRangeDels, node.rangeDels...)
+		}
+	}
+
 	// index 越小，数据越老. index 越大，数据越新
 	// 所以使用大 index 的数据覆盖小 index 数据，以久覆新
-	memtable := t.conf.MemTableConstructor()
+	memtable := cf.conf.MemTableConstructor()
+	var rangeDels rangeTombstones
 	for _, node := range pickedNodes {
-		kvs, _ := node.GetAll()
+		// level + 1 层的节点被更新的范围删除标记完整覆盖，其中的数据和范围删除标记均已失效，整个文件都无需读取
+		if node.level == targetLevel && newerRangeDels.coversRange(node.Start(), node.End()) {
+			continue
+		}
+
+		// 节点中的范围删除标记晚于此前节点中的数据写入，需要将其覆盖
+		for _, r := range node.rangeDels {
+			deleteRangeInMemTable(memtable, r)
+		}
+		rangeDels = append(rangeDels, node.rangeDels...)
+
+		kvs, err := node.GetAll()
+		if err != nil {
+			return nil, nil, err
+		}
 		for _, kv := range kvs {
-			memtable.Put(kv.Key, kv.Value)
+			e, err := decodeEntry(kv.Value)
+			if err != nil {
+				return nil, nil, err
+			}
+			// merge 操作数需要与更早写入的 value 叠加
+			if !e.complete() {
+				if err = cf.inlineBlob(memtable, kv.Key); err != nil {
+					return nil, nil, err
+				}
+			}
+			if err = applyToMemTable(memtable, kv.Key, e); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	// 倘若更深的 level 层中不存在与之重叠的节点，范围删除标记已经没有需要覆盖的数据，可以直接清理
+	var keptRangeDels rangeTombstones
+	for _, r := range rangeDels {
+		if cf.overlapInDeeperLevels(targetLevel, r.Start, r.End) {
+			keptRangeDels = append(keptRangeDels, r)
 		}
 	}
 
 	// 借助 memtable 实现有序排列
 	_kvs := memtable.All()
 	kvs := make([]*KV, 0, len(_kvs))
+	now := cf.conf.Clock.Now()
 	for _, kv := range _kvs {
+		e, err := decodeEntry(kv.Value)
+		if err != nil {
+			return nil, nil, err
+		}
+		// 倘若更深的 level 层中不存在该 key，merge 操作数可以直接合并出最终结果，已过期以及被删除的数据可以直接清理
+		if e, err = cf.collapseEntry(kv.Key, e, !cf.existInDeeperLevels(targetLevel, kv.Key), now); err != nil {
+			return nil, nil, err
+		}
+		if e == nil {
+			continue
+		}
+		// 被保留的范围删除标记覆盖的删除标记是多余的
+		if e.kind == entryKindDelete && keptRangeDels.covers(kv.Key) {
+			continue
+		}
 		kvs = append(kvs, &KV{
 			Key:   kv.Key,
-			Value: kv.Value,
+			Value: encodeEntry(e),
 		})
 	}
 
-	return kvs
+	return kvs, keptRangeDels, nil
 }
 
-// 移除所有完成 compact 流程的老节点
-func (t *Tree) removeNodes(level int, nodes []*Node) {
-	// 从 lsm tree 的 nodes 中移除老节点
-outer:
-	for k := 0; k < len(nodes); k++ {
-		node := nodes[k]
-		for i := level + 1; i >= level; i-- {
-			for j := 0; j < len(t.nodes[i]); j++ {
-				if node != t.nodes[i][j] {
-					continue
-				}
+// 判断 level 层之下的更深 level 层中，是否存在 key 范围覆盖了 key 的节点
+// 节点的增删只会在 compact 协程中执行，因此 compact 协程内读取 nodes 无需加锁
+func (cf *ColumnFamily) existInDeeperLevels(level int, key []byte) bool {
+	for i := level + 1; i < len(cf.nodes); i++ {
+		if len(levelBinarySearch(cf.nodes[i], key)) > 0 {
+			return true
+		}
+	}
+	return false
+}
 
-				t.levelLocks[i].Lock()
-				t.nodes[i] = append(t.nodes[i][:j], t.nodes[i][j+1:]...)
-				t.levelLocks[i].Unlock()
-				continue outer
+// 判断 level 层之下的更深 level 层中，是否存在 key 范围与 [start, end) 重叠的节点
+func (cf *ColumnFamily) overlapInDeeperLevels(level int, start, end []byte) bool {
+	for i := level + 1; i < len(cf.nodes); i++ {
+		for _, node := range cf.nodes[i] {
+			if bytes.Compare(node.Start(), end) < 0 && bytes.Compare(start, node.End()) <= 0 {
+				return true
 			}
 		}
 	}
+	return false
+}
 
-	go func() {
-		// 销毁老节点，包括关闭 sst reader，并且删除节点对应 sst 磁盘文件
-		for _, node := range nodes {
-			node.Destroy()
+// 使用新节点替换 level 和 level + 1 层中完成 compact 流程的老节点.
+// 替换过程在 level 和 level + 1 层的写锁保护下完成，保证读流程不会同时看到新老两份数据
+func (cf *ColumnFamily) replaceNodes(level int, oldNodes, newNodes []*Node) {
+	cf.levelLocks[level].Lock()
+	cf.levelLocks[level+1].Lock()
+	// 从 lsm tree 的 nodes 中移除老节点
+	cf.detachNodesLocked(level, oldNodes)
+	cf.detachNodesLocked(level+1, oldNodes)
+	// 插入新节点
+	for _, node := range newNodes {
+		cf.insertNodeLocked(node)
+	}
+	cf.levelLocks[level+1].Unlock()
+	cf.levelLocks[level].Unlock()
+
+	// 在删除老节点的文件之前记录新的文件版本，从实例不会读到已经被删除的文件，重启时也只会加载新节点.
+	// 记录失败时保留老节点的文件，重启后仍然基于上一个文件版本加载
+	if err := cf.tree.writeVersion(); err != nil {
+		_ = cf.tree.setBackgroundError(BackgroundErrorVersion, err)
+		for _, node := range oldNodes {
+			node.keepFile = true
 		}
-	}()
+	}
+
+	// 释放 lsm tree 对老节点的引用. 引用计数归零时会关闭 sst reader，并且删除节点对应 sst 磁盘文件
+	for _, node := range oldNodes {
+		node.Unref()
+	}
+}
+
+// 从 lsm tree 的 level 层中摘除节点. 调用方需要持有 level 层的写锁
+func (cf *ColumnFamily) detachNodesLocked(level int, nodes []*Node) {
+	for _, node := range nodes {
+		for j := 0; j < len(cf.nodes[level]); j++ {
+			if node != cf.nodes[level][j] {
+				continue
+			}
+			cf.nodes[level] = append(cf.nodes[level][:j], cf.nodes[level][j+1:]...)
+			break
+		}
+	}
 }
 
-// 将只读 memtable 溢写落盘成为 level0 层 sstable 文件
-func (t *Tree) compactMemTable(memCompactItem *memTableCompactItem) {
+// 获取最早生成的只读 memtable. 不存在只读 memtable 时返回 nil
+func (t *Tree) oldestROnlyMemTable() *memTableCompactItem {
+	t.dataLock.RLock()
+	defer t.dataLock.RUnlock()
+	if len(t.rOnlyMemTable) == 0 {
+		return nil
+	}
+	return t.rOnlyMemTable[0]
+}
+
+// 将只读 memtable 溢写落盘成为 level0 层 sstable 文件. 溢写失败时只读 memtable 保持原状，可以重新溢写
+func (t *Tree) compactMemTable(memCompactItem *memTableCompactItem) error {
 	// 处理 memtable 溢写工作:
-	// 1 memtable 溢写到 0 层 sstable 中
-	t.flushMemTable(memCompactItem.memTable)
+	// 1 各列族的 memtable 分别溢写到各自的 0 层 sstable 中. 没有任何数据的 memtable 无需溢写
+	newNodes := make([]*Node, len(t.cfs))
+	for i, cf := range t.cfs {
+		item := memCompactItem.memTables[i]
+		if item.memTable.EntriesCnt() == 0 && len(item.rangeDels) == 0 {
+			continue
+		}
+		node, err := cf.flushMemTable(item.memTable, item.rangeDels)
+		if err != nil {
+			// 其他列族已经生成的节点尚未发布，直接销毁
+			for _, node := range newNodes {
+				if node != nil {
+					node.Destroy()
+				}
+			}
+			return err
+		}
+		newNodes[i] = node
+	}
 
-	// 2 从 rOnly slice 中回收对应的 table
+	// 2 将新节点添加到 level0 层，同时从 rOnly slice 中回收对应的 table
+	// 两个动作需要在同一把锁的保护下完成，保证读流程不会同时看到新老两份数据
 	t.dataLock.Lock()
+	for i, cf := range t.cfs {
+		if newNodes[i] == nil {
+			continue
+		}
+		cf.levelLocks[0].Lock()
+		cf.insertNodeLocked(newNodes[i])
+		cf.levelLocks[0].Unlock()
+	}
 	for i := 0; i < len(t.rOnlyMemTable); i++ {
-		if t.rOnlyMemTable[i].memTable != memCompactItem.memTable {
+		if t.rOnlyMemTable[i] != memCompactItem {
 			continue
 		}
 		t.rOnlyMemTable = t.rOnlyMemTable[i+1:]
 	}
 	t.dataLock.Unlock()
 
-	// 3 删除相应的预写日志. 因为 memtable 落盘后数据已经安全，不存在丢失风险
-	_ = os.Remove(memCompactItem.walFile)
+	// 3 记录新的文件版本，之后删除相应的预写日志. 因为 memtable 落盘后数据已经安全，不存在丢失风险.
+	// 记录失败时保留预写日志，重启后基于上一个文件版本加载并回放；预写日志删除失败时，重启后会重复回放已经落盘的数据，同样需要记录为后台错误
+	if err := t.writeVersion(); err != nil {
+		_ = t.setBackgroundError(BackgroundErrorVersion, err)
+	} else if err = t.conf.FS.Remove(memCompactItem.walFile); err != nil && !os.IsNotExist(err) {
+		_ = t.setBackgroundError(BackgroundErrorRemoveFile, err)
+	}
+
+	// 4 尝试引发一轮 compact 操作
+	for _, cf := range t.cfs {
+		cf.tryTriggerCompact(0)
+	}
+	return nil
 }
 
-// 将 memtable 的数据溢写落盘到 level0 层成为一个新的 sst 文件
-func (t *Tree) flushMemTable(memTable memtable.MemTable) {
+// 将 memtable 的数据以及范围删除标记溢写落盘到 level0 层成为一个新的 sst 文件，返回对应的节点
+func (cf *ColumnFamily) flushMemTable(memTable memtable.MemTable, rangeDels rangeTombstones) (*Node, error) {
 	// memtable 写到 level 0 层 sstable 中
-	seq := t.levelToSeq[0].Load() + 1
+	seq := cf.levelToSeq[0].Load() + 1
 
 	// 创建 sst writer
-	sstWriter, _ := NewSSTWriter(t.sstFile(0, seq), t.conf)
+	file := cf.sstFile(0, seq)
+	sstWriter, err := NewSSTWriter(file, cf.conf)
+	if err != nil {
+		return nil, err
+	}
 	defer sstWriter.Close()
 
-	// 遍历 memtable 写入数据到 sst writer
+	// 较大的 value 分离到 blob 文件中
+	separator := cf.newBlobSeparator(nil)
+	defer separator.close()
+
+	// 遍历 memtable 写入数据到 sst writer. 落盘前清除序列号，只在属性中记录序列号范围
+	var smallestSeq, largestSeq uint64
+	observeSeq := func(seq uint64) {
+		if seq == 0 {
+			return
+		}
+		if smallestSeq == 0 || seq < smallestSeq {
+			smallestSeq = seq
+		}
+		if seq > largestSeq {
+			largestSeq = seq
+		}
+	}
 	for _, kv := range memTable.All() {
-		sstWriter.Append(kv.Key, kv.Value)
+		observeSeq(entrySeq(kv.Value))
+		sstWriter.Append(kv.Key, separator.separate(stripEntrySeq(kv.Value)))
 	}
+	for _, r := range rangeDels {
+		observeSeq(r.seq)
+		sstWriter.AddRangeTombstone(r.Start, r.End)
+	}
+	sstWriter.setSeqRange(smallestSeq, largestSeq)
 
-	// sstable 落盘
-	size, blockToFilter, index := sstWriter.Finish()
-
-	// 构造节点添加到 tree 的 node 中
-	t.insertNode(0, seq, size, blockToFilter, index)
-	// 尝试引发一轮 compact 操作
-	t.tryTriggerCompact(0)
+	// sstable 落盘，并构造 sst 文件对应的节点. 失败时删除不完整的 sst 文件
+	if err = separator.sync(); err != nil {
+		_ = cf.conf.FS.Remove(path.Join(cf.conf.Dir, file))
+		return nil, err
+	}
+	size, filter, index, err := sstWriter.Finish()
+	if err != nil {
+		_ = cf.conf.FS.Remove(path.Join(cf.conf.Dir, file))
+		return nil, err
+	}
+	node, err := cf.newNode(0, seq, size, filter, index, rangeDels)
+	if err != nil {
+		_ = cf.conf.FS.Remove(path.Join(cf.conf.Dir, file))
+		return nil, err
+	}
+	return node, nil
 }
 
-func (t *Tree) tryTriggerCompact(level int) {
-	// 最后一层不执行 compact 操作
-	if level == len(t.nodes)-1 {
-		return
+// level 层的数据量是否超过阈值，需要向 level + 1 层执行 compact. 最后一层不执行 compact 操作
+func (cf *ColumnFamily) needCompact(level int) bool {
+	if level == len(cf.nodes)-1 {
+		return false
+	}
+	// 先进先出策略下只有 level0 层存在数据
+	if cf.conf.CompactionStyle == CompactionStyleFIFO && level > 0 {
+		return false
 	}
 
 	var size uint64
-	for _, node := range t.nodes[level] {
+	cf.levelLocks[level].RLock()
+	for _, node := range cf.nodes[level] {
 		size += node.size
 	}
+	cf.levelLocks[level].RUnlock()
+
+	return size > cf.conf.SSTSize*uint64(math.Pow10(level))*uint64(cf.conf.SSTNumPerLevel)
+}
 
-	if size <= t.conf.SSTSize*uint64(math.Pow10(level))*uint64(t.conf.SSTNumPerLevel) {
+func (cf *ColumnFamily) tryTriggerCompact(level int) {
+	if !cf.needCompact(level) {
 		return
 	}
 
+	t := cf.tree
+	t.wg.Add(1)
 	go func() {
-		t.levelCompactC <- level
+		defer t.wg.Done()
+		select {
+		case t.levelCompactC <- &levelCompactItem{cf: cf, level: level}:
+		case <-t.stopc:
+		}
 	}()
 }
 
-// 插入一个 node 到指定 level 层
-func (t *Tree) insertNodeWithReader(sstReader *SSTReader, level int, seq int32, size uint64, blockToFilter map[uint64][]byte, index []*Index) {
-	file := t.sstFile(level, seq)
+// 插入一个 node 到其所在 level 层
+func (cf *ColumnFamily) insertNode(newNode *Node) {
 	// 记录当前 level 层对应的 seq 号（单调递增）
-	t.levelToSeq[level].Store(seq)
+	cf.levelToSeq[newNode.level].Store(newNode.seq)
+	cf.levelLocks[newNode.level].Lock()
+	cf.insertNodeLocked(newNode)
+	cf.levelLocks[newNode.level].Unlock()
+}
 
-	// 创建一个 lsm node
-	newNode := NewNode(t.conf, file, sstReader, level, seq, size, blockToFilter, index)
+// 将 node 插入到其所在 level 层. 调用方需要持有对应 level 层的写锁
+func (cf *ColumnFamily) insertNodeLocked(newNode *Node) {
+	level := newNode.level
 	// 对于 level0 而言，只需要 append 插入 node 即可
 	if level == 0 {
-		t.levelLocks[0].Lock()
-		t.nodes[level] = append(t.nodes[level], newNode)
-		t.levelLocks[0].Unlock()
+		cf.nodes[level] = append(cf.nodes[level], newNode)
 		return
 	}
 
 	// 对于 level1~levelk 层，需要根据 node 中 key 的大小，遵循顺序插入
-	for i := 0; i < len(t.nodes[level])-1; i++ {
-		// 遵循从小到大的遍历顺序，找到首个最小 key 比 newNode 最大 key 还大的 node，将 newNode 插入在其之前
-		if bytes.Compare(newNode.End(), t.nodes[level][i+1].Start()) < 0 {
-			t.levelLocks[level].Lock()
-			t.nodes[level] = append(t.nodes[level][:i+1], t.nodes[level][i:]...)
-			t.nodes[level][i+1] = newNode
-			t.levelLocks[level].Unlock()
+	for i := 0; i < len(cf.nodes[level]); i++ {
+		// 遵循从小到大的遍历顺序，找到首个最小 key 不小于 newNode 最大 key 的 node，将 newNode 插入在其之前.
+		// 两者相等时，newNode 的最大 key 来自不包含在范围内的范围删除标记终点
+		if bytes.Compare(newNode.End(), cf.nodes[level][i].Start()) <= 0 {
+			cf.nodes[level] = append(cf.nodes[level][:i+1], cf.nodes[level][i:]...)
+			cf.nodes[level][i] = newNode
 			return
 		}
 	}
 
 	// 遍历完 level 层所有节点都还没插入 newNode，说明 newNode 是该层 key 值最大的节点，则 append 到最后即可
-	t.levelLocks[level].Lock()
-	t.nodes[level] = append(t.nodes[level], newNode)
-	t.levelLocks[level].Unlock()
+	cf.nodes[level] = append(cf.nodes[level], newNode)
 }
 
-func (t *Tree) insertNode(level int, seq int32, size uint64, blockToFilter map[uint64][]byte, index []*Index) {
-	file := t.sstFile(level, seq)
-	sstReader, _ := NewSSTReader(file, t.conf)
+// 基于 sst 文件构造一个 node，但不插入到 lsm tree 中
+func (cf *ColumnFamily) newNode(level int, seq int32, size uint64, filter *SSTFilter, index []*Index, rangeDels []*RangeTombstone) (*Node, error) {
+	file := cf.sstFile(level, seq)
+	sstReader, err := NewSSTReader(file, cf.conf)
+	if err != nil {
+		return nil, err
+	}
+	// 提前加载 footer，避免节点发布后被并发地懒加载
+	if err = sstReader.ReadFooter(); err != nil {
+		sstReader.Close()
+		return nil, err
+	}
+	// 记录当前 level 层对应的 seq 号（单调递增）
+	cf.levelToSeq[level].Store(seq)
+	node := NewNode(cf.conf, file, sstReader, level, seq, size, filter, index, rangeDels)
+	cf.attachNode(node)
+	return node, nil
+}
 
-	t.insertNodeWithReader(sstReader, level, seq, size, blockToFilter, index)
+// 为节点挂载所属列族的过滤器统计，并登记节点对 blob 文件的引用
+func (cf *ColumnFamily) attachNode(node *Node) {
+	node.stats = &cf.filterStats
+	node.keepFile = cf.tree.readOnly
+	// 失效的 sst 文件删除失败时，重启后会被重新加载，需要记录为后台错误
+	node.onRemoveError = func(err error) {
+		_ = cf.tree.setBackgroundError(BackgroundErrorRemoveFile, err)
+	}
+	if props, err := node.Properties(); err == nil && props != nil && len(props.BlobFiles) > 0 {
+		node.blobs, node.blobRefs = cf.blobs, props.BlobFiles
+		cf.blobs.ref(props.BlobFiles)
+	}
 }
 
-func (t *Tree) sstFile(level int, seq int32) string {
+func (cf *ColumnFamily) sstFile(level int, seq int32) string {
 	return fmt.Sprintf("%d_%d.sst", level, seq)
 }
 
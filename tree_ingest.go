@@ -0,0 +1,461 @@
+package golsm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/xiaoxuxiansheng/golsm/filter"
+	"github.com/xiaoxuxiansheng/golsm/memtable"
+	"github.com/xiaoxuxiansheng/golsm/vfs"
+)
+
+var (
+	ErrExternalFileKeyOrder = errors.New("keys of external sst file are not in strictly increasing order")
+	ErrExternalFileEmpty    = errors.New("external sst file is empty")
+	ErrExternalFileInvalid  = errors.New("invalid external sst file")
+	ErrIngestFilesOverlap   = errors.New("key ranges of ingested files overlap")
+)
+
+// 摄入外部 sst 文件暂存时使用的文件名后缀. 重启时残留的暂存文件会被清理
+const ingestFileSuffix = ".ingest"
+
+// 基于有序输入构造可供 Tree.IngestExternalFiles 摄入的外部 sst 文件.
+// 写入的 key 必须严格递增，文件中不包含序列号，摄入时统一分配
+type ExternalSSTWriter struct {
+	conf      *Config
+	sstWriter *SSTWriter
+	prevKey   []byte
+	cnt       int // 写入的数据条数，范围删除标记也计算在内
+	finished  bool
+}
+
+// 外部 sst 文件写入器的构造器. file 为文件的完整路径，已经存在的文件会被覆盖.
+// conf 需要与摄入的目标列族保持一致的 sstable 配置，过滤器会按照相同的策略重新构造一份，不与 lsm tree 共享
+func NewExternalSSTWriter(file string, conf *Config) (*ExternalSSTWriter, error) {
+	c := *conf
+	c.Dir = path.Dir(file)
+	if f, ok := filter.Lookup(conf.Filter.Policy()); ok {
+		c.Filter = f
+	} else {
+		c.Filter = nil
+		repaire(&c)
+	}
+
+	if err := c.FS.Remove(file); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	sstWriter, err := NewSSTWriter(path.Base(file), &c)
+	if err != nil {
+		return nil, err
+	}
+	return &ExternalSSTWriter{
+		conf:      &c,
+		sstWriter: sstWriter,
+	}, nil
+}
+
+// 写入一组 kv 对
+func (w *ExternalSSTWriter) Put(key, value []byte) error {
+	return w.append(key, newValueEntry(value))
+}
+
+// 写入 key 的删除标记，摄入后遮蔽 lsm tree 中更早写入的数据
+func (w *ExternalSSTWriter) Delete(key []byte) error {
+	return w.append(key, newDeleteEntry())
+}
+
+// 写入 [start, end) 的范围删除标记，摄入后遮蔽 lsm tree 中更早写入的数据. 范围删除标记不受 key 顺序的限制
+func (w *ExternalSSTWriter) DeleteRange(start, end []byte) error {
+	if w.finished {
+		return ErrExternalFileInvalid
+	}
+	if bytes.Compare(start, end) >= 0 {
+		return ErrInvalidRange
+	}
+	w.sstWriter.AddRangeTombstone(append([]byte{}, start...), append([]byte{}, end...))
+	w.cnt++
+	return nil
+}
+
+func (w *ExternalSSTWriter) append(key []byte, e *entry) error {
+	if w.finished {
+		return ErrExternalFileInvalid
+	}
+	if w.prevKey != nil && bytes.Compare(key, w.prevKey) <= 0 {
+		return ErrExternalFileKeyOrder
+	}
+	w.prevKey = append([]byte{}, key...)
+	w.sstWriter.Append(w.prevKey, encodeEntry(e))
+	w.cnt++
+	return nil
+}
+
+// 将 sst 文件溢写落盘. 没有写入任何数据时返回 ErrExternalFileEmpty
+func (w *ExternalSSTWriter) Finish() error {
+	if w.finished {
+		return ErrExternalFileInvalid
+	}
+	w.finished = true
+	defer w.sstWriter.Close()
+	if w.cnt == 0 {
+		return ErrExternalFileEmpty
+	}
+	_, _, _, err := w.sstWriter.Finish()
+	return err
+}
+
+// 摄入外部 sst 文件的选项
+type IngestOptions struct {
+	Move bool // 通过重命名将文件移入 lsm tree，源文件不再保留. 重命名失败时（例如跨文件系统）退化为复制
+}
+
+// 一个待摄入的外部 sst 文件
+type externalFile struct {
+	path      string // 源文件路径
+	staged    string // 暂存在列族目录下的文件名
+	moved     bool   // 是否通过重命名暂存
+	start     []byte // 最小 key，范围删除标记的起点也计算在内
+	end       []byte // 最大 key，范围删除标记的终点也计算在内
+	size      uint64
+	filter    *SSTFilter
+	index     []*Index
+	rangeDels rangeTombstones
+}
+
+// 摄入外部 sst 文件的指令，交由 compact 协程执行
+type ingestItem struct {
+	cf      *ColumnFamily
+	files   []*externalFile
+	seq     uint64                 // 分配给摄入数据的全局序列号
+	barrier []*memTableCompactItem // 摄入之前的只读 memtable，需要先于外部文件落盘
+	errc    chan error
+}
+
+// 将一组外部 sst 文件摄入到默认列族
+func (t *Tree) IngestExternalFiles(paths []string, opts IngestOptions) error {
+	return t.IngestExternalFilesCF(t.DefaultColumnFamily(), paths, opts)
+}
+
+// 将一组外部 sst 文件摄入到指定列族. 各个文件内部的 key 需要严格递增，文件之间的 key 范围互不重叠.
+// 摄入的数据视为晚于此前的全部写入，共享一个全局序列号. 每个文件放置在不与已有数据重叠的最深 level 层，
+// 无法满足时放置在 level0 层. 全部文件校验通过后才会一次性生效，任何一个文件不合法时均不生效
+func (t *Tree) IngestExternalFilesCF(cf *ColumnFamily, paths []string, opts IngestOptions) error {
+	if t.readOnly {
+		return ErrReadOnly
+	}
+	if err := t.checkColumnFamily(cf); err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+
+	// 同一时刻只执行一次摄入，避免暂存文件重名
+	t.ingestLock.Lock()
+	defer t.ingestLock.Unlock()
+
+	// 1 校验外部文件，并按照 key 范围排序
+	files := make([]*externalFile, 0, len(paths))
+	for _, p := range paths {
+		f, err := readExternalFile(cf.conf, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return bytes.Compare(files[i].start, files[j].start) < 0
+	})
+	for i := 1; i < len(files); i++ {
+		if bytes.Compare(files[i-1].end, files[i].start) >= 0 {
+			return ErrIngestFilesOverlap
+		}
+	}
+
+	// 2 将文件移动或复制到列族目录下暂存
+	for i, f := range files {
+		f.staged = fmt.Sprintf("%d%s", i, ingestFileSuffix)
+		if err := f.stage(cf.conf.FS, cf.conf.Dir, opts.Move); err != nil {
+			rollbackIngest(cf.conf.FS, cf.conf.Dir, files[:i+1])
+			return err
+		}
+	}
+
+	// 3 分配全局序列号. 读写 memtable 中与外部文件重叠的数据更早写入，却会在读流程中遮蔽外部文件，因此需要将其切换为只读 memtable 并先行溢写
+	t.dataLock.Lock()
+	if err := t.checkWritable(); err != nil {
+		t.dataLock.Unlock()
+		rollbackIngest(cf.conf.FS, cf.conf.Dir, files)
+		return err
+	}
+	t.seq++
+	item := ingestItem{cf: cf, files: files, seq: t.seq, errc: make(chan error, 1)}
+	for _, f := range files {
+		if memTableOverlaps(cf.memTable, cf.memRangeDels, f.start, f.end) {
+			t.refreshMemTableLocked()
+			break
+		}
+	}
+	item.barrier = append(item.barrier, t.rOnlyMemTable...)
+	// 节点发布之前，事务通过 ingesting 校验与摄入数据之间的冲突
+	t.ingesting = &item
+	t.dataLock.Unlock()
+	defer func() {
+		t.dataLock.Lock()
+		t.ingesting = nil
+		t.dataLock.Unlock()
+	}()
+
+	// 4 在属性中记录全局序列号
+	for _, f := range files {
+		size, err := rewriteProperties(f.staged, cf.conf, func(p *Properties) {
+			p.SmallestSeq, p.LargestSeq = item.seq, item.seq
+		})
+		if err != nil {
+			rollbackIngest(cf.conf.FS, cf.conf.Dir, files)
+			return err
+		}
+		f.size = size
+	}
+
+	// 5 交由 compact 协程放置文件，保证与溢写以及 compact 流程互斥
+	select {
+	case t.ingestC <- &item:
+	case <-t.stopc:
+		rollbackIngest(cf.conf.FS, cf.conf.Dir, files)
+		return ErrClosed
+	}
+	return <-item.errc
+}
+
+// 校验外部 sst 文件，读取其索引、过滤器以及范围删除标记
+func readExternalFile(conf *Config, file string) (*externalFile, error) {
+	c := *conf
+	c.Dir = path.Dir(file)
+	sstReader, err := NewSSTReader(path.Base(file), &c)
+	if err != nil {
+		return nil, err
+	}
+	defer sstReader.Close()
+
+	if err = sstReader.ReadFooter(); err != nil {
+		return nil, err
+	}
+	// 早期版本的 sstable 中 value 没有类型标识，无法直接摄入
+	if sstReader.formatVersion != sstFormatVersion {
+		return nil, ErrExternalFileInvalid
+	}
+	f := externalFile{path: file}
+	if f.filter, err = sstReader.ReadFilter(); err != nil {
+		return nil, err
+	}
+	if f.index, err = sstReader.ReadIndex(); err != nil {
+		return nil, err
+	}
+	if f.rangeDels, err = sstReader.ReadRangeTombstones(); err != nil {
+		return nil, err
+	}
+	if len(f.index) == 0 && len(f.rangeDels) == 0 {
+		return nil, ErrExternalFileEmpty
+	}
+
+	// 逐个 block 校验 key 严格递增，并且记录中不包含序列号以及 blob 引用. index[0] 之前不存在 block
+	var firstKey, prevKey []byte
+	for i := 1; i < len(f.index); i++ {
+		block, err := sstReader.ReadBlock(f.index[i].PrevBlockOffset, f.index[i].PrevBlockSize)
+		if err != nil {
+			return nil, err
+		}
+		kvs, err := sstReader.ReadBlockData(block)
+		if err != nil {
+			return nil, err
+		}
+		for _, kv := range kvs {
+			if prevKey != nil && bytes.Compare(kv.Key, prevKey) <= 0 {
+				return nil, ErrExternalFileKeyOrder
+			}
+			if prevKey == nil {
+				firstKey = kv.Key
+			}
+			prevKey = kv.Key
+			if len(kv.Value) == 0 || kv.Value[0]&(entryFlagSeq|entryFlagBlob) != 0 {
+				return nil, ErrExternalFileInvalid
+			}
+			if _, err = decodeEntry(kv.Value); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, r := range f.rangeDels {
+		if bytes.Compare(r.Start, r.End) >= 0 {
+			return nil, ErrExternalFileInvalid
+		}
+	}
+
+	// key 范围需要涵盖范围删除标记. 数据的 key 范围即为校验时读到的第一个以及最后一个 key
+	if len(f.index) > 0 {
+		f.start, f.end = firstKey, prevKey
+	}
+	if len(f.rangeDels) > 0 {
+		start, end := f.rangeDels.bounds()
+		if len(f.index) == 0 || bytes.Compare(start, f.start) < 0 {
+			f.start = start
+		}
+		if len(f.index) == 0 || bytes.Compare(end, f.end) > 0 {
+			f.end = end
+		}
+	}
+	return &f, nil
+}
+
+// 将外部文件暂存到列族目录下
+func (f *externalFile) stage(fs vfs.FS, dir string, move bool) error {
+	dest := path.Join(dir, f.staged)
+	if move {
+		if err := fs.Rename(f.path, dest); err == nil {
+			f.moved = true
+			return nil
+		}
+	}
+	return copyFile(fs, f.path, dest)
+}
+
+// 摄入失败时撤销暂存. 通过重命名暂存的文件移回原处，复制的文件直接删除
+func rollbackIngest(fs vfs.FS, dir string, files []*externalFile) {
+	for _, f := range files {
+		staged := path.Join(dir, f.staged)
+		if f.moved {
+			_ = fs.Rename(staged, f.path)
+			continue
+		}
+		_ = fs.Remove(staged)
+	}
+}
+
+// memtable 中是否存在 key 位于 [start, end] 范围内的数据，或者与之重叠的范围删除标记
+func memTableOverlaps(memTable memtable.MemTable, rangeDels rangeTombstones, start, end []byte) bool {
+	kvs := memTable.All()
+	i := sort.Search(len(kvs), func(i int) bool {
+		return bytes.Compare(kvs[i].Key, start) >= 0
+	})
+	if i < len(kvs) && bytes.Compare(kvs[i].Key, end) <= 0 {
+		return true
+	}
+	for _, r := range rangeDels {
+		if bytes.Compare(r.Start, end) <= 0 && bytes.Compare(start, r.End) < 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// 在 compact 协程中放置外部文件
+func (t *Tree) ingest(item *ingestItem) error {
+	cf := item.cf
+	// 1 摄入之前的只读 memtable 中的数据更早写入，需要先行溢写，保证外部文件位于其上层
+	for _, memCompactItem := range item.barrier {
+		if !t.isROnlyMemTable(memCompactItem) {
+			continue
+		}
+		if err := t.compactMemTable(memCompactItem); err != nil {
+			rollbackIngest(cf.conf.FS, cf.conf.Dir, item.files)
+			return t.setBackgroundError(BackgroundErrorFlush, err)
+		}
+	}
+
+	// 2 逐个文件确定目标 level 层，并重命名为正式的 sst 文件
+	nodes := make([]*Node, 0, len(item.files))
+	for i, f := range item.files {
+		level := cf.ingestLevel(f.start, f.end)
+		seq := cf.levelToSeq[level].Load() + 1
+		file := cf.sstFile(level, seq)
+		err := cf.conf.FS.Rename(path.Join(cf.conf.Dir, f.staged), path.Join(cf.conf.Dir, file))
+		var node *Node
+		if err == nil {
+			if node, err = cf.newNode(level, seq, f.size, f.filter, f.index, f.rangeDels); err != nil {
+				_ = cf.conf.FS.Rename(path.Join(cf.conf.Dir, file), path.Join(cf.conf.Dir, f.staged))
+			}
+		}
+		if err != nil {
+			// 已经重命名的文件恢复暂存状态，一并撤销
+			for j := 0; j < i; j++ {
+				_ = cf.conf.FS.Rename(path.Join(cf.conf.Dir, nodes[j].file), path.Join(cf.conf.Dir, item.files[j].staged))
+				nodes[j].Close()
+			}
+			rollbackIngest(cf.conf.FS, cf.conf.Dir, item.files)
+			return err
+		}
+		nodes = append(nodes, node)
+	}
+
+	// 3 同时持有全部 level 层的写锁，一次性发布全部节点，读流程要么看到全部外部文件，要么一个都看不到
+	for level := 0; level < len(cf.nodes); level++ {
+		cf.levelLocks[level].Lock()
+	}
+	for _, node := range nodes {
+		cf.insertNodeLocked(node)
+	}
+	for level := len(cf.nodes) - 1; level >= 0; level-- {
+		cf.levelLocks[level].Unlock()
+	}
+	// 文件版本记录失败时，重启后不会加载摄入的文件，需要告知调用方
+	if err := t.writeVersion(); err != nil {
+		return t.setBackgroundError(BackgroundErrorVersion, err)
+	}
+
+	// 4 尝试触发 compact 操作
+	for _, node := range nodes {
+		cf.tryTriggerCompact(node.level)
+	}
+	return nil
+}
+
+// 外部文件放置的 level 层. 摄入的数据晚于已有的全部数据，因此需要位于与之重叠的节点之上.
+// 在此前提下尽可能放置到更深的 level 层，减少后续 compact 的开销. 先进先出策略下总是放置在 level0 层.
+// 节点的增删只会在 compact 协程中执行，因此无需加锁
+func (cf *ColumnFamily) ingestLevel(start, end []byte) int {
+	if cf.conf.CompactionStyle == CompactionStyleFIFO {
+		return 0
+	}
+	var target int
+	for level := 0; level < len(cf.nodes); level++ {
+		for _, node := range cf.nodes[level] {
+			if bytes.Compare(end, node.Start()) >= 0 && bytes.Compare(start, node.End()) <= 0 {
+				return target
+			}
+		}
+		target = level
+	}
+	return target
+}
+
+// memtable 是否仍处于只读状态，尚未溢写落盘
+func (t *Tree) isROnlyMemTable(item *memTableCompactItem) bool {
+	t.dataLock.RLock()
+	defer t.dataLock.RUnlock()
+	for _, rOnly := range t.rOnlyMemTable {
+		if rOnly == item {
+			return true
+		}
+	}
+	return false
+}
+
+// 清理摄入流程中途退出残留的暂存文件
+func (cf *ColumnFamily) removeIngestLeftovers() error {
+	entries, err := cf.conf.FS.List(cf.conf.Dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry, ingestFileSuffix) {
+			_ = cf.conf.FS.Remove(path.Join(cf.conf.Dir, entry))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+package golsm
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 基于 kvs 构造一个外部 sst 文件. value 为 nil 时写入删除标记
+func writeExternalFile(t *testing.T, file string, conf *Config, keys []string, values map[string]string) {
+	writer, err := NewExternalSSTWriter(file, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		value, ok := values[key]
+		if !ok {
+			err = writer.Delete([]byte(key))
+		} else {
+			err = writer.Put([]byte(key), []byte(value))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = writer.Finish(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_ExternalSSTWriter(t *testing.T) {
+	conf, err := NewConfig(t.TempDir())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	file := path.Join(t.TempDir(), "external.sst")
+	writer, err := NewExternalSSTWriter(file, conf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	assert.Nil(t, writer.Put([]byte("b"), []byte("1")))
+	assert.Equal(t, ErrExternalFileKeyOrder, writer.Put([]byte("b"), []byte("2")))
+	assert.Equal(t, ErrExternalFileKeyOrder, writer.Put([]byte("a"), []byte("2")))
+	assert.Nil(t, writer.Delete([]byte("c")))
+	assert.Equal(t, ErrInvalidRange, writer.DeleteRange([]byte("z"), []byte("x")))
+	assert.Nil(t, writer.Finish())
+	assert.Equal(t, ErrExternalFileInvalid, writer.Put([]byte("d"), []byte("3")))
+
+	f, err := readExternalFile(conf, file)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	assert.Equal(t, "b", string(f.start))
+	assert.Equal(t, "c", string(f.end))
+
+	// 没有写入任何数据
+	writer, err = NewExternalSSTWriter(path.Join(t.TempDir(), "empty.sst"), conf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	assert.Equal(t, ErrExternalFileEmpty, writer.Finish())
+}
+
+func Test_Tree_IngestExternalFiles(t *testing.T) {
+	conf, err := NewConfig(t.TempDir(),
+		WithSSTSize(4*1024),
+		WithSSTDataBlockSize(512),
+		WithSSTNumPerLevel(1000), // 避免后台自动触发 compact
+	)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	lsmTree, err := NewTree(conf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	cf := lsmTree.DefaultColumnFamily()
+
+	// 1 lsm tree 中已有 key_0000 ~ key_0199，并落盘到 level1 层
+	for i := 0; i < 200; i++ {
+		if err = lsmTree.Put([]byte(fmt.Sprintf("key_%04d", i)), []byte("old")); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	flushMemTable(lsmTree)
+	cf.compactLevel(0)
+
+	// 2 与已有数据不重叠的文件放置到最深的 level 层
+	externalDir := t.TempDir()
+	var keys []string
+	values := make(map[string]string)
+	for i := 500; i < 600; i++ {
+		key := fmt.Sprintf("key_%04d", i)
+		keys = append(keys, key)
+		values[key] = "ingested"
+	}
+	writeExternalFile(t, path.Join(externalDir, "1.sst"), conf, keys, values)
+	if err = lsmTree.IngestExternalFiles([]string{path.Join(externalDir, "1.sst")}, IngestOptions{Move: true}); err != nil {
+		t.Error(err)
+		return
+	}
+	assert.Equal(t, 1, len(cf.nodes[conf.MaxLevel-1]))
+	_, err = os.Stat(path.Join(externalDir, "1.sst"))
+	assert.True(t, os.IsNotExist(err))
+
+	// 摄入的数据共享同一个全局序列号，记录在属性中
+	props, err := cf.nodes[conf.MaxLevel-1][0].Properties()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	assert.NotZero(t, props.LargestSeq)
+	assert.Equal(t, props.SmallestSeq, props.LargestSeq)
+
+	// 3 与已有数据以及读写 memtable 重叠的文件放置到 level0 层，并且遮蔽更早写入的数据. 以复制的方式摄入，源文件保留
+	if err = lsmTree.Put([]byte("key_0010"), []byte("memtable")); err != nil {
+		t.Error(err)
+		return
+	}
+	keys, values = nil, make(map[string]string)
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key_%04d", i)
+		keys = append(keys, key)
+		if i%5 != 0 {
+			values[key] = "ingested"
+		}
+	}
+	writeExternalFile(t, path.Join(externalDir, "2.sst"), conf, keys, values)
+	if err = lsmTree.IngestExternalFiles([]string{path.Join(externalDir, "2.sst")}, IngestOptions{}); err != nil {
+		t.Error(err)
+		return
+	}
+	_, err = os.Stat(path.Join(externalDir, "2.sst"))
+	assert.Nil(t, err)
+	level0 := cf.nodes[0]
+	assert.Equal(t, 2, len(level0))
+	assert.Equal(t, "key_0000", string(level0[len(level0)-1].Start()))
+
+	// 摄入之后的写入晚于摄入的数据
+	if err = lsmTree.Put([]byte("key_0001"), []byte("new")); err != nil {
+		t.Error(err)
+		return
+	}
+
+	check := func(lsmTree *Tree) {
+		for i := 0; i < 600; i++ {
+			key := fmt.Sprintf("key_%04d", i)
+			value, ok, err := lsmTree.Get([]byte(key))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			switch {
+			case i == 1:
+				assert.Equal(t, "new", string(value))
+			case i < 20 && i%5 == 0:
+				assert.False(t, ok, key)
+			case i < 20:
+				assert.Equal(t, "ingested", string(value), key)
+			case i < 200:
+				assert.Equal(t, "old", string(value), key)
+			case i < 500:
+				assert.False(t, ok, key)
+			default:
+				assert.Equal(t, "ingested", string(value), key)
+			}
+		}
+	}
+	check(lsmTree)
+
+	// 4 重启后数据保持不变
+	waitMemTableFlushed(lsmTree)
+	lsmTree.Close()
+	if lsmTree, err = NewTree(conf); err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		waitMemTableFlushed(lsmTree)
+		lsmTree.Close()
+	}()
+	check(lsmTree)
+}
+
+func Test_Tree_IngestExternalFiles_Invalid(t *testing.T) {
+	conf, err := NewConfig(t.TempDir())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	lsmTree, err := NewTree(conf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		waitMemTableFlushed(lsmTree)
+		lsmTree.Close()
+	}()
+
+	externalDir := t.TempDir()
+	writeExternalFile(t, path.Join(externalDir, "1.sst"), conf, []string{"a", "c"}, map[string]string{"a": "1", "c": "1"})
+	writeExternalFile(t, path.Join(externalDir, "2.sst"), conf, []string{"b", "d"}, map[string]string{"b": "2", "d": "2"})
+
+	// 文件之间的 key 范围重叠时，全部文件均不生效
+	err = lsmTree.IngestExternalFiles([]string{path.Join(externalDir, "1.sst"), path.Join(externalDir, "2.sst")}, IngestOptions{Move: true})
+	assert.Equal(t, ErrIngestFilesOverlap, err)
+	for _, file := range []string{"1.sst", "2.sst"} {
+		_, err = os.Stat(path.Join(externalDir, file))
+		assert.Nil(t, err)
+	}
+	_, ok, err := lsmTree.Get([]byte("a"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	// 不是 sst 格式的文件
+	if err = os.WriteFile(path.Join(externalDir, "3.sst"), []byte("not an sst file"), 0644); err != nil {
+		t.Error(err)
+		return
+	}
+	assert.NotNil(t, lsmTree.IngestExternalFiles([]string{path.Join(externalDir, "3.sst")}, IngestOptions{}))
+
+	// lsm tree 目录下没有残留的文件
+	entries, err := os.ReadDir(conf.Dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for _, entry := range entries {
+		assert.False(t, strings.HasSuffix(entry.Name(), ".sst") || strings.HasSuffix(entry.Name(), ingestFileSuffix), entry.Name())
+	}
+}
@@ -1,47 +1,111 @@
 package golsm
 
 import (
-	"io/fs"
+	"errors"
+	"fmt"
 	"os"
 	"path"
 	"sort"
 	"strconv"
 	"strings"
 
+	"github.com/xiaoxuxiansheng/golsm/memtable"
+	"github.com/xiaoxuxiansheng/golsm/vfs"
 	"github.com/xiaoxuxiansheng/golsm/wal"
 )
 
-// 读取 sst 文件，还原出整棵树
-func (t *Tree) constructTree() error {
-	// 读取 sst 文件目录下的 sst 文件列表
-	sstEntries, err := t.getSortedSSTEntries()
+var ErrMissingSSTFile = errors.New("sst file recorded in version file is missing")
+
+// 读取 sst 文件，还原出整棵树. v 为上一次记录的文件版本，为 nil 表示没有记录
+func (cf *ColumnFamily) constructTree(v *liveVersion) error {
+	readOnly := cf.tree.readOnly
+
+	// 读取 sst 文件目录下的 sst 文件列表. 只读模式下列族目录不存在时视为空列族
+	sstEntries, err := cf.getSortedSSTEntries()
+	if readOnly && os.IsNotExist(err) {
+		return nil
+	}
 	if err != nil {
 		return err
 	}
 
+	// 清理摄入外部文件时残留的暂存文件，以及不在文件版本中的 sst 文件. 只读模式下不删除任何文件
+	if !readOnly {
+		if err = cf.removeIngestLeftovers(); err != nil {
+			return err
+		}
+		if sstEntries, err = cf.removeStaleSSTFiles(v, sstEntries); err != nil {
+			return err
+		}
+	}
+
+	// 加载 blob 文件，节点加载时会登记对 blob 文件的引用
+	if err = cf.blobs.load(); err != nil {
+		return err
+	}
+
 	// 遍历每个 sst 文件，将其加载为 node 添加 lsm tree 的 nodes 内存切片中
 	for _, sstEntry := range sstEntries {
-		if err = t.loadNode(sstEntry); err != nil {
+		if err = cf.loadNode(sstEntry); err != nil {
 			return err
 		}
 	}
 
+	// 没有被任何节点引用的 blob 文件中不存在有效数据
+	if !readOnly {
+		cf.blobs.removeUnreferenced()
+	}
 	return nil
 }
 
-func (t *Tree) getSortedSSTEntries() ([]fs.DirEntry, error) {
-	allEntries, err := os.ReadDir(t.conf.Dir)
+// 文件版本记录了列族当前的全部 sst 文件. 不在其中的 sst 文件来自中途崩溃的溢写、compact 流程，或者已经被合并但尚未删除，
+// 直接删除；记录在其中的 sst 文件缺失时返回 ErrMissingSSTFile. 文件版本中没有该列族时，列族在上一次打开时没有被声明，保留全部文件
+func (cf *ColumnFamily) removeStaleSSTFiles(v *liveVersion, sstEntries []string) ([]string, error) {
+	if v == nil {
+		return sstEntries, nil
+	}
+	files, ok := v.Files[cf.name]
+	if !ok {
+		return sstEntries, nil
+	}
+
+	live := make(map[string]bool, len(files))
+	for _, file := range files {
+		live[file] = false
+	}
+	liveEntries := make([]string, 0, len(files))
+	for _, entry := range sstEntries {
+		if _, ok := live[entry]; !ok {
+			if err := cf.conf.FS.Remove(path.Join(cf.conf.Dir, entry)); err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+			continue
+		}
+		live[entry] = true
+		liveEntries = append(liveEntries, entry)
+	}
+	for file, found := range live {
+		if !found {
+			return nil, fmt.Errorf("%w: %s", ErrMissingSSTFile, path.Join(cf.conf.Dir, file))
+		}
+	}
+	return liveEntries, nil
+}
+
+func (cf *ColumnFamily) getSortedSSTEntries() ([]string, error) {
+	allEntries, err := cf.conf.FS.List(cf.conf.Dir)
 	if err != nil {
 		return nil, err
 	}
 
-	sstEntries := make([]fs.DirEntry, 0, len(allEntries))
+	sstEntries := make([]string, 0, len(allEntries))
 	for _, entry := range allEntries {
-		if entry.IsDir() {
+		if !strings.HasSuffix(entry, ".sst") {
 			continue
 		}
 
-		if !strings.HasSuffix(entry.Name(), ".sst") {
+		// 忽略不符合 level_seq.sst 命名规则的文件
+		if _, _, ok := parseSSTFile(entry); !ok {
 			continue
 		}
 
@@ -49,8 +113,8 @@ func (t *Tree) getSortedSSTEntries() ([]fs.DirEntry, error) {
 	}
 
 	sort.Slice(sstEntries, func(i, j int) bool {
-		levelI, seqI := getLevelSeqFromSSTFile(sstEntries[i].Name())
-		levelJ, seqJ := getLevelSeqFromSSTFile(sstEntries[j].Name())
+		levelI, seqI := getLevelSeqFromSSTFile(sstEntries[i])
+		levelJ, seqJ := getLevelSeqFromSSTFile(sstEntries[j])
 		if levelI == levelJ {
 			return seqI < seqJ
 		}
@@ -60,117 +124,288 @@ func (t *Tree) getSortedSSTEntries() ([]fs.DirEntry, error) {
 }
 
 // 将一个 sst 文件作为一个 node 加载进入 lsm tree 的拓扑结构中
-func (t *Tree) loadNode(sstEntry fs.DirEntry) error {
-	// 创建 sst 文件对应的 reader
-	sstReader, err := NewSSTReader(sstEntry.Name(), t.conf)
+func (cf *ColumnFamily) loadNode(sstEntry string) error {
+	node, err := cf.openNode(sstEntry)
 	if err != nil {
 		return err
 	}
+	// 将 sst 文件作为一个 node 插入到 lsm tree 中
+	cf.insertNode(node)
+	return nil
+}
+
+// 打开一个 sst 文件，构造对应的 node，但不插入到 lsm tree 中
+func (cf *ColumnFamily) openNode(file string) (*Node, error) {
+	// 创建 sst 文件对应的 reader
+	sstReader, err := NewSSTReader(file, cf.conf)
+	if err != nil {
+		return nil, err
+	}
 
 	// 读取各 block 块对应的 filter 信息
-	blockToFilter, err := sstReader.ReadFilter()
+	filter, err := sstReader.ReadFilter()
 	if err != nil {
-		return err
+		sstReader.Close()
+		return nil, err
 	}
 
 	// 读取 index 信息
 	index, err := sstReader.ReadIndex()
 	if err != nil {
-		return err
+		sstReader.Close()
+		return nil, err
+	}
+
+	// 读取范围删除标记
+	rangeDels, err := sstReader.ReadRangeTombstones()
+	if err != nil {
+		sstReader.Close()
+		return nil, err
 	}
 
 	// 获取 sst 文件的大小，单位 byte
 	size, err := sstReader.Size()
 	if err != nil {
-		return err
+		sstReader.Close()
+		return nil, err
 	}
 
 	// 解析 sst 文件名，得知 sst 文件对应的 level 以及 seq 号
-	level, seq := getLevelSeqFromSSTFile(sstEntry.Name())
-	// 将 sst 文件作为一个 node 插入到 lsm tree 中
-	t.insertNodeWithReader(sstReader, level, seq, size, blockToFilter, index)
-	return nil
+	level, seq := getLevelSeqFromSSTFile(file)
+	node := NewNode(cf.conf, file, sstReader, level, seq, size, filter, index, rangeDels)
+	cf.attachNode(node)
+	return node, nil
 }
 
 func getLevelSeqFromSSTFile(file string) (level int, seq int32) {
+	level, seq, _ = parseSSTFile(file)
+	return
+}
+
+// 解析 level_seq.sst 格式的文件名. 格式不合法时返回 false
+func parseSSTFile(file string) (level int, seq int32, ok bool) {
 	file = strings.Replace(file, ".sst", "", -1)
 	splitted := strings.Split(file, "_")
-	level, _ = strconv.Atoi(splitted[0])
-	_seq, _ := strconv.Atoi(splitted[1])
-	return level, int32(_seq)
+	if len(splitted) != 2 {
+		return 0, 0, false
+	}
+	level, err := strconv.Atoi(splitted[0])
+	if err != nil {
+		return 0, 0, false
+	}
+	_seq, err := strconv.Atoi(splitted[1])
+	if err != nil {
+		return 0, 0, false
+	}
+	return level, int32(_seq), true
 }
 
-// 读取 wal 还原出 memtable
-func (t *Tree) constructMemtable() error {
+// 读取 wal 还原出 memtable. v 为上一次记录的文件版本，为 nil 时说明目录由早期版本写入，此时已有的 wal 文件均为早期版本的格式
+func (t *Tree) constructMemtable(v *liveVersion) error {
 	// 1 读 wal 目录，获取所有的 wal 文件
-	raw, _ := os.ReadDir(path.Join(t.conf.Dir, "walfile"))
+	walDir := path.Join(t.conf.Dir, "walfile")
+	raw, _ := t.conf.FS.List(walDir)
 
 	// 2 wal 文件除杂
-	var wals []fs.DirEntry
+	var wals []string
 	for _, entry := range raw {
-		if entry.IsDir() {
+		// 要求文件必须为 .wal 类型
+		if !strings.HasSuffix(entry, ".wal") {
 			continue
 		}
 
-		// 要求文件必须为 .wal 类型
-		if !strings.HasSuffix(entry.Name(), ".wal") {
+		// 编号早于文件版本的 wal 文件已经溢写落盘，只是删除操作在崩溃前尚未持久化. 回放其中的老数据会覆盖 sst 文件中更新的数据，需要跳过
+		if v != nil && walFileToMemTableIndex(entry) < v.WAL {
+			if !t.readOnly {
+				if err := t.conf.FS.Remove(path.Join(walDir, entry)); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+			}
 			continue
 		}
 
 		wals = append(wals, entry)
 	}
+	// 上一个进程创建的 wal 文件会被继续追加写入，其目录项可能尚未持久化
+	if !t.readOnly {
+		if err := vfs.SyncDir(t.conf.FS, walDir); err != nil {
+			return err
+		}
+	}
 
-	// 3 倘若 wal 目录不存在或者 wal 文件不存在，则构造一个新的 memtable
+	// 3 倘若 wal 目录不存在或者 wal 文件不存在，则构造一个新的 memtable. 新的 wal 编号不早于文件版本，避免被当作已经落盘的 wal
 	if len(wals) == 0 {
+		if v != nil {
+			t.memTableIndex = v.WAL
+		}
 		t.newMemTable()
 		return nil
 	}
 
 	// 4 依次还原 memtable. 最晚一个 memtable 作为读写 memtable
 	// 前置 memtable 作为只读 memtable，分别添加到内存 slice 和 channel 中.
-	return t.restoreMemTable(wals)
+	return t.restoreMemTable(wals, v == nil)
 }
 
 // 基于 wal 文件还原出一系列只读 memtable 和唯一一个读写 memtable
-func (t *Tree) restoreMemTable(wals []fs.DirEntry) error {
+func (t *Tree) restoreMemTable(wals []string, legacy bool) error {
 	// 1 wal 排序，index 单调递增，数据实时性也随之单调递增
 	sort.Slice(wals, func(i, j int) bool {
-		indexI := walFileToMemTableIndex(wals[i].Name())
-		indexJ := walFileToMemTableIndex(wals[j].Name())
+		indexI := walFileToMemTableIndex(wals[i])
+		indexJ := walFileToMemTableIndex(wals[j])
 		return indexI < indexJ
 	})
+	if legacy {
+		t.legacyWALs = walFileToMemTableIndex(wals[len(wals)-1]) + 1
+	}
 
-	// 2 依次还原 memtable，添加到内存和 channel
+	// 2 依次还原 memtable. 在全部 wal 文件都还原成功之后才推进溢写流程，
+	// 避免 wal 中出现未声明的列族时，前置 wal 已经被溢写并删除
+	files := make([]string, 0, len(wals))
+	restored := make([][]*cfMemTable, 0, len(wals))
+	lastSeqs := make([]uint64, 0, len(wals))
 	for i := 0; i < len(wals); i++ {
-		name := wals[i].Name()
-		file := path.Join(t.conf.Dir, "walfile", name)
+		file := path.Join(t.conf.Dir, "walfile", wals[i])
 
 		// 构建与 wal 文件对应的 walReader
-		walReader, err := wal.NewWALReader(file)
+		walReader, err := wal.NewWALReader(t.conf.FS, file)
 		if err != nil {
 			return err
 		}
 		defer walReader.Close()
 
-		// 通过 reader 读取 wal 文件内容，将数据注入到 memtable 中
-		memtable := t.conf.MemTableConstructor()
-		if err = walReader.RestoreToMemtable(memtable); err != nil {
+		// 通过 reader 读取 wal 文件内容，将数据按照写入顺序注入到 memtable 中. 崩溃时末尾尚未写完的记录会被忽略
+		kvs, size, err := walReader.ReadAllComplete()
+		if err != nil {
 			return err
 		}
-
-		if i == len(wals)-1 { // 倘若是最后一个 wal 文件，则 memtable 作为读写 memtable
-			t.memTable = memtable
-			t.memTableIndex = walFileToMemTableIndex(name)
-			t.walWriter, _ = wal.NewWALWriter(file)
-		} else { // memtable 作为只读 memtable，需要追加到只读 slice 以及 channel 中，继续推进完成溢写落盘流程
-			memTableCompactItem := memTableCompactItem{
-				walFile:  file,
-				memTable: memtable,
+		// 最后一个 wal 文件会被继续追加写入，需要截断末尾不完整的记录
+		if i == len(wals)-1 && !t.readOnly {
+			if err = t.truncateWAL(file, size); err != nil {
+				return err
 			}
+		}
+		memTables, lastSeq, err := t.restoreWAL(kvs, walFileToMemTableIndex(wals[i]) < t.legacyWALs)
+		if err != nil {
+			return err
+		}
+		// 序列号在 wal 之间单调递增
+		if lastSeq > t.seq {
+			t.seq = lastSeq
+		}
+		lastSeqs = append(lastSeqs, t.seq)
+		files = append(files, file)
+		restored = append(restored, memTables)
+	}
 
-			t.rOnlyMemTable = append(t.rOnlyMemTable, &memTableCompactItem)
-			t.memCompactC <- &memTableCompactItem
+	// 3 将 memtable 添加到内存. 最后一个 wal 文件对应的 memtable 作为读写 memtable，其余作为只读 memtable.
+	// compact 协程已经在运行，需要在 dataLock 的保护下修改
+	t.dataLock.Lock()
+	last := len(restored) - 1
+	for j, cf := range t.cfs {
+		cf.memTable, cf.memRangeDels = restored[last][j].memTable, restored[last][j].rangeDels
+	}
+	t.memTableIndex = walFileToMemTableIndex(wals[last])
+	// 只读模式下不追加写入预写日志
+	if !t.readOnly {
+		var err error
+		if t.walWriter, err = wal.NewWALWriter(t.conf.FS, files[last]); err != nil {
+			t.dataLock.Unlock()
+			return err
+		}
+	}
+	items := make([]*memTableCompactItem, 0, last)
+	for i := 0; i < last; i++ {
+		item := memTableCompactItem{
+			walFile:   files[i],
+			memTables: restored[i],
+			lastSeq:   lastSeqs[i],
+		}
+		t.rOnlyMemTable = append(t.rOnlyMemTable, &item)
+		items = append(items, &item)
+	}
+	// 早期版本的预写日志不再追加写入，避免同一个 wal 文件中混杂两种格式的记录. 切换到新的预写日志，老的 memtable 随之溢写
+	if t.memTableIndex < t.legacyWALs && !t.readOnly {
+		t.refreshMemTableLocked()
+	}
+	t.dataLock.Unlock()
+
+	// 4 只读 memtable 通过 channel 交由 compact 协程，继续推进完成溢写落盘流程. 只读模式下没有 compact 协程，只读 memtable 常驻内存
+	if !t.readOnly {
+		for _, item := range items {
+			t.memCompactC <- item
 		}
 	}
 	return nil
 }
+
+// 将 wal 文件截断到 size 大小
+func (t *Tree) truncateWAL(file string, size int64) error {
+	info, err := t.conf.FS.Stat(file)
+	if err != nil || info.Size() <= size {
+		return err
+	}
+	f, err := t.conf.FS.OpenReadWrite(file)
+	if err != nil {
+		return err
+	}
+	if err = f.Truncate(size); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// 基于 wal 文件中的全部记录，按照写入顺序还原出各列族的 memtable 以及对应的范围删除标记，同时返回其中最大的序列号.
+// legacy 标识 wal 文件是否由早期版本写入，其中的记录为默认列族的原始 value
+func (t *Tree) restoreWAL(kvs []*memtable.KV, legacy bool) ([]*cfMemTable, uint64, error) {
+	var err error
+	memTables := make([]*cfMemTable, 0, len(t.cfs))
+	for _, cf := range t.cfs {
+		memTables = append(memTables, &cfMemTable{memTable: cf.conf.MemTableConstructor()})
+	}
+
+	// merge 操作数需要与 memtable 中已有的记录进行叠加，范围删除需要覆盖 memtable 中已有的数据，因此不能直接写入
+	var lastSeq uint64
+	apply := func(cfName string, key []byte, e *entry) error {
+		cf, ok := t.ColumnFamily(cfName)
+		if !ok {
+			return ErrUnknownColumnFamily
+		}
+		if e.seq > lastSeq {
+			lastSeq = e.seq
+		}
+		item := memTables[cf.index]
+		return applyRecord(item.memTable, &item.rangeDels, key, e)
+	}
+
+	for _, kv := range kvs {
+		// 早期版本的预写日志中只有默认列族的原始值，其首个 byte 可能与批量写入的类型标识相同，不能按照类型解析
+		if legacy {
+			if err = apply(DefaultColumnFamilyName, kv.Key, newValueEntry(kv.Value)); err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+
+		// 批量写入记录中包含了一组跨列族的操作
+		if len(kv.Value) > 0 && entryKind(kv.Value[0]) == entryKindBatch {
+			if err = decodeBatch(kv.Value, apply); err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+
+		// 引入列族之前写入的单条记录，属于默认列族
+		e, err := decodeEntry(kv.Value)
+		if err != nil {
+			return nil, 0, err
+		}
+		if err = apply(DefaultColumnFamilyName, kv.Key, e); err != nil {
+			return nil, 0, err
+		}
+	}
+	return memTables, lastSeq, nil
+}
@@ -0,0 +1,277 @@
+package golsm
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xiaoxuxiansheng/golsm/vfs"
+	"github.com/xiaoxuxiansheng/golsm/wal"
+)
+
+func Test_Tree_CrashRecovery(t *testing.T) {
+	seed := time.Now().UnixNano()
+	t.Logf("seed: %d", seed)
+	r := rand.New(rand.NewSource(seed))
+	// 故障注入磁盘会在后台协程中使用随机数，因此使用独立的随机数源
+	disk := newFaultDisk(rand.New(rand.NewSource(r.Int63())), true)
+	fs := disk.fs()
+
+	const keys = 500
+	// durable 为已经持久化的数据，key 不存在表示已经被删除. pending 为最近一次持久化之后的写入，
+	// 其中的 key 在崩溃后既可能是持久化的值，也可能是之后写入的任意一个值，空串表示删除
+	durable := make(map[string]string)
+	pending := make(map[string][]string)
+	check := func(lsmTree *Tree) bool {
+		for i := 0; i < keys; i++ {
+			key := fmt.Sprintf("key_%03d", i)
+			value, ok, err := lsmTree.Get([]byte(key))
+			if !assert.Nil(t, err) {
+				return false
+			}
+			got := ""
+			if ok {
+				got = string(value)
+			}
+			expect, accepted := durable[key], false
+			for _, v := range append(pending[key], expect) {
+				accepted = accepted || v == got
+			}
+			if !assert.True(t, accepted, "key: %s, got: %q, expect: %q, pending: %q", key, got, expect, pending[key]) {
+				return false
+			}
+			// 重启后回放的数据已经持久化
+			if got == "" {
+				delete(durable, key)
+			} else {
+				durable[key] = got
+			}
+		}
+		pending = make(map[string][]string)
+		return true
+	}
+
+	for round := 0; round < 30; round++ {
+		conf, err := NewConfig("db",
+			WithFS(fs),
+			WithSSTSize(4*1024),
+			WithSSTDataBlockSize(512),
+			WithMinBlobSize(64),
+		)
+		if !assert.Nil(t, err) {
+			return
+		}
+		lsmTree, err := NewTree(conf)
+		if !assert.Nil(t, err, "round: %d", round) {
+			return
+		}
+		if !check(lsmTree) {
+			t.Logf("round: %d", round)
+			return
+		}
+
+		// 一半的轮次在随机的一次操作上注入错误
+		if r.Intn(2) == 0 {
+			errs := []error{syscall.EIO, syscall.ENOSPC}
+			fs.injectAfter(1+r.Intn(500), errs[r.Intn(len(errs))])
+		}
+
+		for i, n := 0, 200+r.Intn(400); i < n; i++ {
+			key := fmt.Sprintf("key_%03d", r.Intn(keys))
+			switch p := r.Intn(20); {
+			case p == 0:
+				if lsmTree.SyncWAL() == nil {
+					for key, values := range pending {
+						if v := values[len(values)-1]; v == "" {
+							delete(durable, key)
+						} else {
+							durable[key] = v
+						}
+					}
+					pending = make(map[string][]string)
+				}
+			case p < 3:
+				// 写入失败的数据同样可能残留在预写日志中
+				_ = lsmTree.Delete([]byte(key))
+				pending[key] = append(pending[key], "")
+			default:
+				value := fmt.Sprintf("%d_%d", round, i)
+				// 部分 value 超过 MinBlobSize，会被分离到 blob 文件中
+				if r.Intn(4) == 0 {
+					value += string(bytes.Repeat([]byte{'v'}, 64))
+				}
+				_ = lsmTree.Put([]byte(key), []byte(value))
+				pending[key] = append(pending[key], value)
+			}
+		}
+
+		// 随机等待一段时间，使得崩溃可能发生在溢写以及 compact 流程的任意阶段
+		time.Sleep(time.Duration(r.Intn(5)) * time.Millisecond)
+		fs = disk.crash()
+		// 崩溃前的文件系统实例已经不可用，关闭只是为了回收后台协程
+		_ = lsmTree.Close()
+	}
+
+	conf, err := NewConfig("db", WithFS(fs), WithSSTSize(4*1024), WithSSTDataBlockSize(512), WithMinBlobSize(64))
+	if !assert.Nil(t, err) {
+		return
+	}
+	lsmTree, err := NewTree(conf)
+	if !assert.Nil(t, err) {
+		return
+	}
+	check(lsmTree)
+	assert.Nil(t, lsmTree.Close())
+}
+
+func Test_Tree_LegacyFormat(t *testing.T) {
+	disk := newFaultDisk(rand.New(rand.NewSource(time.Now().UnixNano())), false)
+	fs := disk.fs()
+	newConf := func() *Config {
+		conf, err := NewConfig("db", WithFS(fs), WithSSTSize(4*1024), WithSSTDataBlockSize(512))
+		assert.Nil(t, err)
+		return conf
+	}
+	conf := newConf()
+
+	// 模拟早期版本写入的目录: sst 文件与预写日志中的 value 均为原始值，footer 中没有格式版本，也没有文件版本记录
+	sstWriter, err := NewSSTWriter("0_1.sst", conf)
+	if !assert.Nil(t, err) {
+		return
+	}
+	for i := 0; i < 100; i++ {
+		sstWriter.Append([]byte(fmt.Sprintf("key_%03d", i)), []byte(fmt.Sprintf("value_sst_%03d", i)))
+	}
+	_, _, _, err = sstWriter.Finish()
+	sstWriter.Close()
+	if !assert.Nil(t, err) {
+		return
+	}
+	sstFile := path.Join(conf.Dir, "0_1.sst")
+	raw, err := vfs.ReadFile(fs, sstFile)
+	if !assert.Nil(t, err) {
+		return
+	}
+	raw[len(raw)-1] = sstFormatLegacy
+	if !assert.Nil(t, vfs.WriteFile(fs, sstFile, raw)) {
+		return
+	}
+
+	walWriter, err := wal.NewWALWriter(fs, path.Join(conf.Dir, "walfile", "0.wal"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	for i := 50; i < 150; i++ {
+		assert.Nil(t, walWriter.Write([]byte(fmt.Sprintf("key_%03d", i)), []byte(fmt.Sprintf("value_wal_%03d", i))))
+	}
+	// 原始值的首个 byte 与批量写入的类型标识相同时，仍按原始值回放
+	rawValue := append([]byte{byte(entryKindBatch)}, "raw"...)
+	assert.Nil(t, walWriter.Write([]byte("key_raw"), rawValue))
+	assert.Nil(t, walWriter.Sync())
+	assert.Nil(t, walWriter.Close())
+
+	expect := func(i int) string {
+		if i < 50 {
+			return fmt.Sprintf("value_sst_%03d", i)
+		}
+		if i < 150 {
+			return fmt.Sprintf("value_wal_%03d", i)
+		}
+		return fmt.Sprintf("value_new_%03d", i)
+	}
+	check := func(lsmTree *Tree, n int) {
+		for i := 0; i < n; i++ {
+			key := fmt.Sprintf("key_%03d", i)
+			v, ok, err := lsmTree.Get([]byte(key))
+			assert.Nil(t, err)
+			assert.True(t, ok, key)
+			assert.Equal(t, expect(i), string(v), key)
+		}
+		v, ok, err := lsmTree.Get([]byte("key_raw"))
+		assert.Nil(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, rawValue, v)
+	}
+
+	lsmTree, err := NewTree(conf)
+	if !assert.Nil(t, err) {
+		return
+	}
+	check(lsmTree, 150)
+	for i := 150; i < 200; i++ {
+		assert.Nil(t, lsmTree.Put([]byte(fmt.Sprintf("key_%03d", i)), []byte(expect(i))))
+	}
+	assert.Nil(t, lsmTree.SyncWAL())
+	check(lsmTree, 200)
+
+	// 早期版本的预写日志不再追加写入. 崩溃后重新打开，两种格式的预写日志均能正确回放
+	fs = disk.crash()
+	_ = lsmTree.Close()
+	lsmTree, err = NewTree(newConf())
+	if !assert.Nil(t, err) {
+		return
+	}
+	check(lsmTree, 200)
+	assert.Nil(t, lsmTree.Close())
+
+	lsmTree, err = NewTree(newConf())
+	if !assert.Nil(t, err) {
+		return
+	}
+	check(lsmTree, 200)
+	assert.Nil(t, lsmTree.Close())
+}
+
+func Test_Tree_FlushedWAL(t *testing.T) {
+	conf, err := NewConfig("db", WithFS(vfs.NewMem()))
+	if !assert.Nil(t, err) {
+		return
+	}
+	lsmTree, err := NewTree(conf)
+	if !assert.Nil(t, err) {
+		return
+	}
+	flush := func() {
+		walFile := lsmTree.walFile()
+		lsmTree.dataLock.Lock()
+		lsmTree.refreshMemTableLocked()
+		lsmTree.dataLock.Unlock()
+		for {
+			if _, err := conf.FS.Stat(walFile); err != nil {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// 1 老数据所在的预写日志溢写之后被删除，之后新数据同样溢写落盘
+	assert.Nil(t, lsmTree.Put([]byte("key"), []byte("old")))
+	walFile := lsmTree.walFile()
+	raw, err := vfs.ReadFile(conf.FS, walFile)
+	if !assert.Nil(t, err) {
+		return
+	}
+	flush()
+	assert.Nil(t, lsmTree.Put([]byte("key"), []byte("new")))
+	flush()
+	assert.Nil(t, lsmTree.Close())
+
+	// 2 模拟预写日志的删除在崩溃前没有持久化. 重启时跳过并删除早于文件版本的预写日志，老数据不会覆盖新数据
+	assert.Nil(t, vfs.WriteFile(conf.FS, walFile, raw))
+	if lsmTree, err = NewTree(conf); !assert.Nil(t, err) {
+		return
+	}
+	value, ok, err := lsmTree.Get([]byte("key"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "new", string(value))
+	_, err = conf.FS.Stat(walFile)
+	assert.True(t, os.IsNotExist(err))
+	assert.Nil(t, lsmTree.Close())
+}
@@ -0,0 +1,411 @@
+package golsm
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/xiaoxuxiansheng/golsm/memtable"
+	"github.com/xiaoxuxiansheng/golsm/vfs"
+	"github.com/xiaoxuxiansheng/golsm/wal"
+)
+
+var (
+	ErrNotSecondary    = errors.New("lsm tree is not opened as secondary")
+	ErrCatchUpConflict = errors.New("primary kept changing files during catch up")
+
+	ErrUnsupportedFormat = errors.New("lsm tree directory is written by a newer format version")
+
+	errInvalidVersionFile = errors.New("invalid version file")
+	errCatchUpRetry       = errors.New("files changed during catch up")
+)
+
+// 主实例记录当前文件版本的文件名，位于 lsm tree 根目录下
+const versionFileName = "VERSION"
+
+// 目录的格式版本，记录在文件版本中. 早期版本没有文件版本记录，其预写日志中的 value 为原始值，没有类型标识
+const dirFormatVersion = 1
+
+// 从实例追赶主实例时的最大尝试次数
+const maxCatchUpAttempts = 10
+
+// 主实例当前的文件版本. 主实例的节点每次发生变化后，都会在删除老文件之前重写版本文件
+type liveVersion struct {
+	Format         int                 `json:"format"`                    // 目录的格式版本
+	WAL            int                 `json:"wal"`                       // 尚未溢写落盘的最早的预写日志编号. 更早的预写日志中的数据均已落盘到 sst 文件中
+	LegacyWALs     int                 `json:"legacy_wals,omitempty"`     // 编号小于该值的预写日志由早期版本写入. 早期版本的预写日志全部溢写之后不再记录
+	Files          map[string][]string `json:"files"`                     // 各列族当前的 sst 文件，key 为列族名称
+	MergeOperators map[string]string   `json:"merge_operators,omitempty"` // 各列族 merge 操作符的名称，key 为列族名称
+}
+
+// 记录当前的文件版本. 先写入临时文件再重命名，从实例不会读到写了一半的版本文件.
+// 文件版本中的 sst 文件以及它们引用的 blob 文件需要在此之前持久化目录项，重命名之后同样需要持久化目录，
+// 返回 nil 之后才能删除已经落盘的预写日志以及被替换的 sst 文件
+func (t *Tree) writeVersion() error {
+	if t.readOnly {
+		return nil
+	}
+	t.versionLock.Lock()
+	defer t.versionLock.Unlock()
+
+	t.dataLock.RLock()
+	snapshots := make([]*version, 0, len(t.cfs))
+	for _, cf := range t.cfs {
+		snapshots = append(snapshots, cf.refVersion())
+	}
+	v := t.newLiveVersion(snapshots)
+	t.dataLock.RUnlock()
+	for _, snapshot := range snapshots {
+		snapshot.unref()
+	}
+
+	for _, cf := range t.cfs {
+		if err := vfs.SyncDir(t.conf.FS, cf.conf.Dir); err != nil {
+			return err
+		}
+	}
+	return writeVersionFile(t.conf.FS, t.conf.Dir, v)
+}
+
+// 根据各列族的节点快照生成文件版本，snapshots 与 t.cfs 一一对应. 调用方需要持有 dataLock，保证预写日志编号与节点快照衔接
+func (t *Tree) newLiveVersion(snapshots []*version) *liveVersion {
+	v := liveVersion{Format: dirFormatVersion, Files: make(map[string][]string, len(t.cfs))}
+	v.WAL = t.memTableIndex
+	if len(t.rOnlyMemTable) > 0 {
+		v.WAL = walFileToMemTableIndex(path.Base(t.rOnlyMemTable[0].walFile))
+	}
+	if v.WAL < t.legacyWALs {
+		v.LegacyWALs = t.legacyWALs
+	}
+	if len(t.mergeOperators) > 0 {
+		v.MergeOperators = t.mergeOperators
+	}
+	for i, cf := range t.cfs {
+		files := make([]string, 0)
+		for _, nodes := range snapshots[i].nodes {
+			for _, node := range nodes {
+				files = append(files, node.file)
+			}
+		}
+		sort.Strings(files)
+		v.Files[cf.name] = files
+	}
+	return &v
+}
+
+// 将文件版本写入 dir 目录. 先写入临时文件再重命名，之后持久化目录
+func writeVersionFile(fs vfs.FS, dir string, v *liveVersion) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	file := path.Join(dir, versionFileName)
+	if err = vfs.WriteFile(fs, file+".tmp", raw); err != nil {
+		return err
+	}
+	if err = fs.Rename(file+".tmp", file); err != nil {
+		return err
+	}
+	return vfs.SyncDir(fs, dir)
+}
+
+// 读取主实例记录的文件版本
+func (t *Tree) readVersion() ([]byte, *liveVersion, error) {
+	raw, err := vfs.ReadFile(t.conf.FS, path.Join(t.conf.Dir, versionFileName))
+	if err != nil {
+		return nil, nil, err
+	}
+	var v liveVersion
+	if err = json.Unmarshal(raw, &v); err != nil {
+		return nil, nil, errInvalidVersionFile
+	}
+	return raw, &v, nil
+}
+
+// 作为从实例打开另一个进程正在读写的 lsm tree. 从实例以只读模式运行，基于主实例记录的文件版本加载 sst 文件，并回放尚未落盘的预写日志.
+// 之后可以通过 TryCatchUpWithPrimary 追赶主实例的最新状态. 写入、摄入外部文件以及生成检查点均返回 ErrReadOnly
+func OpenAsSecondary(conf *Config, cfDescs ...ColumnFamilyDescriptor) (*Tree, error) {
+	t, err := newTree(conf, true, cfDescs)
+	if err != nil {
+		return nil, err
+	}
+	t.secondary = true
+	t.newMemTable()
+	if err = t.TryCatchUpWithPrimary(); err != nil {
+		t.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// 追赶主实例的最新状态: 重新读取主实例记录的文件版本，加载新增的 sst 文件、释放已经被移除的 sst 文件，并重新回放尚未落盘的预写日志.
+// 读取期间主实例变更了文件时会重新尝试，多次尝试均失败时返回 ErrCatchUpConflict，此时从实例保持原有状态
+func (t *Tree) TryCatchUpWithPrimary() error {
+	if err := t.checkOpen(); err != nil {
+		return err
+	}
+	if !t.secondary {
+		return ErrNotSecondary
+	}
+
+	// 同一时刻只执行一次追赶. 从实例的节点只会在追赶流程中变更
+	t.catchUpLock.Lock()
+	defer t.catchUpLock.Unlock()
+
+	for i := 0; i < maxCatchUpAttempts; i++ {
+		if i > 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err := t.catchUp(); !errors.Is(err, errCatchUpRetry) {
+			return err
+		}
+	}
+	return ErrCatchUpConflict
+}
+
+// 执行一次追赶. 读取期间主实例变更了文件时返回 errCatchUpRetry
+func (t *Tree) catchUp() error {
+	// 1 读取主实例的文件版本
+	raw, v, err := t.readVersion()
+	if err != nil {
+		return err
+	}
+	if err = t.checkMergeOperators(v); err != nil {
+		return err
+	}
+
+	// 2 基于文件版本加载各列族的节点
+	levels := make([][][]*Node, 0, len(t.cfs))
+	release := func() {
+		for _, nodes := range levels {
+			unrefLevels(nodes)
+		}
+	}
+	for _, cf := range t.cfs {
+		nodes, err := cf.loadVersionNodes(v.Files[cf.name])
+		if err != nil {
+			release()
+			return err
+		}
+		levels = append(levels, nodes)
+	}
+
+	// 3 回放尚未溢写落盘的预写日志
+	restored, err := t.restoreLiveWALs(v.WAL, v.LegacyWALs)
+	if err != nil {
+		release()
+		return err
+	}
+
+	// 4 读取期间文件版本发生变化时，加载的 sst 文件与预写日志可能无法衔接，需要重新尝试
+	again, err := vfs.ReadFile(t.conf.FS, path.Join(t.conf.Dir, versionFileName))
+	if err != nil || !bytes.Equal(raw, again) {
+		release()
+		return errCatchUpRetry
+	}
+
+	// 5 在 dataLock 以及全部 level 层写锁的保护下一次性发布，读流程不会看到新老两份数据
+	var oldLevels [][][]*Node
+	t.dataLock.Lock()
+	for i, cf := range t.cfs {
+		for level := 0; level < len(cf.nodes); level++ {
+			cf.levelLocks[level].Lock()
+		}
+		oldLevels = append(oldLevels, cf.nodes)
+		cf.nodes = levels[i]
+		for level := len(cf.nodes) - 1; level >= 0; level-- {
+			cf.levelLocks[level].Unlock()
+		}
+	}
+	t.installMemTablesLocked(restored)
+	t.dataLock.Unlock()
+
+	// 6 释放老节点. 只读模式下销毁节点时不会删除文件
+	for _, nodes := range oldLevels {
+		unrefLevels(nodes)
+	}
+	return nil
+}
+
+// 基于文件版本中的 sst 文件构造列族的各层节点. 已经加载过的文件直接复用对应的节点
+func (cf *ColumnFamily) loadVersionNodes(files []string) ([][]*Node, error) {
+	// 加载新增的 blob 文件，节点加载时会登记对 blob 文件的引用. 主实例没有声明该列族时目录可能不存在
+	if err := cf.blobs.load(); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// 从实例的节点只会在追赶流程中变更，因此无需加锁
+	loaded := make(map[string]*Node)
+	for _, nodes := range cf.nodes {
+		for _, node := range nodes {
+			loaded[node.file] = node
+		}
+	}
+
+	levels := make([][]*Node, cf.conf.MaxLevel)
+	for _, file := range files {
+		level, _, ok := parseSSTFile(file)
+		if !ok || !strings.HasSuffix(file, ".sst") || level < 0 || level >= len(levels) {
+			unrefLevels(levels)
+			return nil, errInvalidVersionFile
+		}
+
+		// 主实例重启后可能复用已经被删除的文件名，需要确认是同一个文件
+		node, ok := loaded[file]
+		if ok && cf.isOpenedFile(node) {
+			node.Ref()
+		} else {
+			var err error
+			if node, err = cf.openNode(file); err != nil {
+				unrefLevels(levels)
+				// 文件在读取版本之后被主实例删除
+				if os.IsNotExist(err) {
+					return nil, errCatchUpRetry
+				}
+				return nil, err
+			}
+		}
+		levels[level] = append(levels[level], node)
+	}
+
+	// level0 层按照 seq 由老到新排列，其余各层按照 key 由小到大排列
+	sort.Slice(levels[0], func(i, j int) bool {
+		return levels[0][i].seq < levels[0][j].seq
+	})
+	for level := 1; level < len(levels); level++ {
+		nodes := levels[level]
+		sort.Slice(nodes, func(i, j int) bool {
+			return bytes.Compare(nodes[i].Start(), nodes[j].Start()) < 0
+		})
+	}
+	return levels, nil
+}
+
+// 节点打开的 sst 文件是否仍然是列族目录下的同名文件
+func (cf *ColumnFamily) isOpenedFile(node *Node) bool {
+	info, err := cf.conf.FS.Stat(path.Join(cf.conf.Dir, node.file))
+	if err != nil {
+		return false
+	}
+	opened, err := node.sstReader.src.Stat()
+	if err != nil {
+		return false
+	}
+	return cf.conf.FS.SameFile(info, opened)
+}
+
+func unrefLevels(levels [][]*Node) {
+	for _, nodes := range levels {
+		for _, node := range nodes {
+			node.Unref()
+		}
+	}
+}
+
+// 由预写日志还原出的一个 memtable
+type liveWAL struct {
+	file      string
+	index     int
+	memTables []*cfMemTable
+	lastSeq   uint64
+}
+
+// 依次回放编号不小于 from 的全部预写日志. 编号小于 legacyWALs 的预写日志由早期版本写入
+func (t *Tree) restoreLiveWALs(from, legacyWALs int) ([]*liveWAL, error) {
+	walDir := path.Join(t.conf.Dir, "walfile")
+	// 目录中没有 wal 文件目录时，数据均已落盘到 sst 文件中，没有需要回放的预写日志
+	entries, err := t.conf.FS.List(walDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var indexes []int
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry, ".wal") {
+			continue
+		}
+		if index := walFileToMemTableIndex(entry); index >= from {
+			indexes = append(indexes, index)
+		}
+	}
+	sort.Ints(indexes)
+
+	// 主实例总是持有读写 memtable 对应的预写日志，并且按照编号顺序删除预写日志. 编号不连续说明预写日志在读取版本之后被溢写删除
+	if len(indexes) == 0 {
+		return nil, errCatchUpRetry
+	}
+	for i, index := range indexes {
+		if index != from+i {
+			return nil, errCatchUpRetry
+		}
+	}
+
+	restored := make([]*liveWAL, 0, len(indexes))
+	for i, index := range indexes {
+		file := path.Join(walDir, fmt.Sprintf("%d.wal", index))
+		walReader, err := wal.NewWALReader(t.conf.FS, file)
+		if os.IsNotExist(err) {
+			return nil, errCatchUpRetry
+		}
+		if err != nil {
+			return nil, err
+		}
+		// 主实例正在追加写入最后一个预写日志，末尾的记录可能尚不完整，只回放其中完整的记录.
+		// 更早的预写日志已经不再写入，出现不完整的记录说明读取期间发生了变化
+		var kvs []*memtable.KV
+		if i == len(indexes)-1 {
+			kvs, _, err = walReader.ReadAllComplete()
+		} else {
+			kvs, err = walReader.ReadAll()
+		}
+		walReader.Close()
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, errCatchUpRetry
+		}
+		if err != nil {
+			return nil, err
+		}
+		memTables, lastSeq, err := t.restoreWAL(kvs, index < legacyWALs)
+		if err != nil {
+			return nil, err
+		}
+		restored = append(restored, &liveWAL{file: file, index: index, memTables: memTables, lastSeq: lastSeq})
+	}
+	return restored, nil
+}
+
+// 使用回放得到的 memtable 替换原有的 memtable. 最晚一个作为读写 memtable，其余作为只读 memtable. 调用方需要持有 dataLock 写锁
+func (t *Tree) installMemTablesLocked(restored []*liveWAL) {
+	t.rOnlyMemTable = nil
+	// 没有需要回放的预写日志时，数据均已落盘，清空原有的 memtable
+	if len(restored) == 0 {
+		t.newMemTable()
+	}
+	for i, item := range restored {
+		// 序列号在 wal 之间单调递增
+		if item.lastSeq > t.seq {
+			t.seq = item.lastSeq
+		}
+		if i == len(restored)-1 {
+			for j, cf := range t.cfs {
+				cf.memTable, cf.memRangeDels = item.memTables[j].memTable, item.memTables[j].rangeDels
+			}
+			t.memTableIndex = item.index
+			continue
+		}
+		t.rOnlyMemTable = append(t.rOnlyMemTable, &memTableCompactItem{
+			walFile:   item.file,
+			memTables: item.memTables,
+			lastSeq:   t.seq,
+		})
+	}
+}
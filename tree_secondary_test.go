@@ -0,0 +1,253 @@
+package golsm
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xiaoxuxiansheng/golsm/vfs"
+)
+
+func Test_Tree_Secondary(t *testing.T) {
+	opts := []ConfigOption{
+		WithSSTSize(4 * 1024),
+		WithSSTDataBlockSize(512),
+		WithSSTNumPerLevel(1000), // 避免后台自动触发 compact
+		WithMinBlobSize(64),
+	}
+	conf, err := NewConfig(t.TempDir(), opts...)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	cfDesc := ColumnFamilyDescriptor{Name: "meta"}
+
+	primary, err := NewTree(conf, cfDesc)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		waitMemTableFlushed(primary)
+		primary.Close()
+	}()
+	meta, _ := primary.ColumnFamily("meta")
+	assert.Equal(t, ErrNotSecondary, primary.TryCatchUpWithPrimary())
+
+	// 1 一部分数据落盘到 sstable 中，value 较大的部分存放在 blob 文件中；其余数据保留在 memtable 以及预写日志中
+	value := func(i, version int) []byte {
+		if i%2 == 0 {
+			return []byte(fmt.Sprintf("%0128d", i*10+version))
+		}
+		return []byte(strconv.Itoa(i*10 + version))
+	}
+	put := func(start, end, version int) {
+		for i := start; i < end; i++ {
+			if err := primary.Put([]byte(fmt.Sprintf("key_%04d", i)), value(i, version)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	put(0, 300, 1)
+	flushMemTable(primary)
+	primary.DefaultColumnFamily().compactLevel(0)
+	put(300, 310, 1)
+	if err = primary.PutCF(meta, []byte("version"), []byte("1")); err != nil {
+		t.Error(err)
+		return
+	}
+
+	secondaryConf, err := NewConfig(conf.Dir, opts...)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	secondary, err := OpenAsSecondary(secondaryConf, cfDesc)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer secondary.Close()
+	secondaryMeta, _ := secondary.ColumnFamily("meta")
+
+	check := func(expect func(i int) ([]byte, bool), version string) {
+		for i := 0; i < 400; i++ {
+			key := fmt.Sprintf("key_%04d", i)
+			want, wantOK := expect(i)
+			got, ok, err := secondary.Get([]byte(key))
+			assert.Nil(t, err, key)
+			assert.Equal(t, wantOK, ok, key)
+			assert.Equal(t, want, got, key)
+		}
+		got, ok, err := secondary.GetCF(secondaryMeta, []byte("version"))
+		assert.Nil(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, version, string(got))
+	}
+	expect1 := func(i int) ([]byte, bool) {
+		if i < 310 {
+			return value(i, 1), true
+		}
+		return nil, false
+	}
+	check(expect1, "1")
+	assert.Equal(t, ErrReadOnly, secondary.Put([]byte("key_0000"), []byte("new")))
+
+	// 2 主实例继续写入，并通过溢写以及 compact 删除、重命名部分文件
+	for i := 0; i < 310; i += 3 {
+		if err = primary.Delete([]byte(fmt.Sprintf("key_%04d", i))); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	put(100, 200, 2)
+	flushMemTable(primary)
+	primary.DefaultColumnFamily().compactLevel(0)
+	primary.DefaultColumnFamily().compactLevel(1)
+	put(310, 320, 2)
+	if err = primary.PutCF(meta, []byte("version"), []byte("2")); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// 追赶之前，从实例仍然读到原有的数据
+	check(expect1, "1")
+
+	// 3 追赶之后，从实例读到主实例的最新状态
+	if err = secondary.TryCatchUpWithPrimary(); err != nil {
+		t.Error(err)
+		return
+	}
+	check(func(i int) ([]byte, bool) {
+		switch {
+		case i >= 100 && i < 200, i >= 310 && i < 320:
+			return value(i, 2), true
+		case i%3 == 0 && i < 310:
+			return nil, false
+		case i < 310:
+			return value(i, 1), true
+		}
+		return nil, false
+	}, "2")
+
+	// 从实例没有删除主实例的任何文件
+	raw, v, err := secondary.readVersion()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	assert.NotEmpty(t, raw)
+	for _, file := range v.Files[DefaultColumnFamilyName] {
+		_, err = os.Stat(path.Join(conf.Dir, file))
+		assert.Nil(t, err, file)
+	}
+	assert.NotEmpty(t, listBlobFiles(t, conf.Dir))
+
+	// 4 只读模式打开的实例不支持追赶
+	readOnly, err := OpenReadOnly(secondaryConf, cfDesc)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	assert.Equal(t, ErrNotSecondary, readOnly.TryCatchUpWithPrimary())
+	readOnly.Close()
+}
+
+// 将每次写入拆分为两次，两次写入之间短暂停顿，使得并发的读取者能够观察到写了一半的记录
+type splitWriteFS struct {
+	vfs.FS
+}
+
+func (fs splitWriteFS) OpenAppend(name string) (vfs.File, error) {
+	f, err := fs.FS.OpenAppend(name)
+	if err != nil {
+		return nil, err
+	}
+	return &splitWriteFile{File: f}, nil
+}
+
+type splitWriteFile struct {
+	vfs.File
+}
+
+func (f *splitWriteFile) Write(p []byte) (int, error) {
+	n, err := f.File.Write(p[:len(p)/2])
+	if err != nil {
+		return n, err
+	}
+	time.Sleep(100 * time.Microsecond)
+	m, err := f.File.Write(p[len(p)/2:])
+	return n + m, err
+}
+
+func Test_Tree_Secondary_ConcurrentCatchUp(t *testing.T) {
+	fs := vfs.NewMem()
+	conf, err := NewConfig("db", WithFS(splitWriteFS{FS: fs}))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	primary, err := NewTree(conf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer primary.Close()
+	secondaryConf, err := NewConfig("db", WithFS(fs))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	secondary, err := OpenAsSecondary(secondaryConf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer secondary.Close()
+
+	// 主实例持续写入. 追赶时主实例的预写日志末尾可能是写了一半的记录，从实例只回放其中完整的记录
+	const keys = 300
+	var written atomic.Int64
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < keys; i++ {
+			if err := primary.Put([]byte(fmt.Sprintf("key_%04d", i)), []byte(strconv.Itoa(i))); err != nil {
+				t.Error(err)
+				return
+			}
+			written.Store(int64(i + 1))
+		}
+	}()
+
+	for finished := false; !finished; {
+		select {
+		case <-done:
+			finished = true
+		case <-time.After(time.Millisecond):
+		}
+		n := int(written.Load())
+		if !assert.Nil(t, secondary.TryCatchUpWithPrimary()) {
+			<-done
+			return
+		}
+		// 追赶之前已经写入完成的数据可见
+		if n > 0 {
+			v, ok, err := secondary.Get([]byte(fmt.Sprintf("key_%04d", n-1)))
+			assert.Nil(t, err)
+			assert.True(t, ok)
+			assert.Equal(t, strconv.Itoa(n-1), string(v))
+		}
+	}
+	for i := 0; i < keys; i++ {
+		v, ok, err := secondary.Get([]byte(fmt.Sprintf("key_%04d", i)))
+		assert.Nil(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, strconv.Itoa(i), string(v))
+	}
+}
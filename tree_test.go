@@ -2,12 +2,22 @@ package golsm
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 	"os"
 	"path"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/xiaoxuxiansheng/golsm/vfs"
 )
 
 func Test_LSM_UseCase(t *testing.T) {
@@ -125,9 +135,10 @@ func Test_Tree_getSortedSSTEntries(t *testing.T) {
 		}()
 	}
 
-	tree := Tree{
+	cf := ColumnFamily{
 		conf: &Config{
 			Dir: "./test",
+			FS:  vfs.Default,
 		},
 	}
 
@@ -135,7 +146,7 @@ func Test_Tree_getSortedSSTEntries(t *testing.T) {
 		"1_1.sst", "1_5.sst", "2_3.sst", "10_0.sst", "10_5.sst", "10_10.sst",
 	}
 
-	gotEntries, err := tree.getSortedSSTEntries()
+	gotEntries, err := cf.getSortedSSTEntries()
 	if err != nil {
 		t.Error(err)
 		return
@@ -147,8 +158,8 @@ func Test_Tree_getSortedSSTEntries(t *testing.T) {
 	}
 
 	for i := 0; i < len(gotEntries); i++ {
-		if gotEntries[i].Name() != expectEntries[i] {
-			t.Errorf("index: %d, got entries: %s, expect: %s", i, gotEntries[i].Name(), expectEntries[i])
+		if gotEntries[i] != expectEntries[i] {
+			t.Errorf("index: %d, got entries: %s, expect: %s", i, gotEntries[i], expectEntries[i])
 		}
 	}
 }
@@ -159,3 +170,1771 @@ func Test_pathJoin(t *testing.T) {
 	assert.Equal(t, path.Join("/root", "/wal", "1.sst"), "/root/wal/1.sst")
 	assert.Equal(t, path.Join("/root", "wal", "1.sst"), "/root/wal/1.sst")
 }
+
+func Test_Tree_compactLevel_TrivialMove(t *testing.T) {
+	conf, err := NewConfig(t.TempDir(),
+		WithSSTSize(4*1024),
+		WithSSTDataBlockSize(1024),
+		WithSSTNumPerLevel(1000), // 避免后台自动触发 compact
+	)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	lsmTree, err := NewTree(conf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer lsmTree.Close()
+
+	// 顺序写入的 key，溢写生成的 level0 层 sst 文件之间互不重叠
+	for i := 0; i < 2000; i++ {
+		key := []byte(fmt.Sprintf("key_%08d5", i))
+		if err = lsmTree.Put(key, key); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	waitMemTableFlushed(lsmTree)
+
+	level0Files := make(map[string]os.FileInfo)
+	for _, node := range lsmTree.DefaultColumnFamily().nodes[0] {
+		info, err := os.Stat(path.Join(conf.Dir, node.file))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		level0Files[node.file] = info
+	}
+	if len(level0Files) < 2 {
+		t.Errorf("expect multiple level0 sst files, got: %d", len(level0Files))
+		return
+	}
+
+	lsmTree.DefaultColumnFamily().compactLevel(0)
+
+	if len(lsmTree.DefaultColumnFamily().nodes[1]) == 0 {
+		t.Error("expect nodes moved to level1")
+		return
+	}
+
+	// level1 层的文件都应当是 level0 层文件重命名而来，而非重新写入
+	for _, node := range lsmTree.DefaultColumnFamily().nodes[1] {
+		info, err := os.Stat(path.Join(conf.Dir, node.file))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		var moved bool
+		for _, level0Info := range level0Files {
+			if os.SameFile(info, level0Info) {
+				moved = true
+				break
+			}
+		}
+		if !moved {
+			t.Errorf("level1 file: %s is not moved from level0", node.file)
+		}
+	}
+
+	for i := 0; i < len(lsmTree.DefaultColumnFamily().nodes[1])-1; i++ {
+		if bytes.Compare(lsmTree.DefaultColumnFamily().nodes[1][i].End(), lsmTree.DefaultColumnFamily().nodes[1][i+1].Start()) >= 0 {
+			t.Errorf("level1 nodes overlap, index: %d", i)
+		}
+	}
+
+	for i := 0; i < 2000; i++ {
+		key := []byte(fmt.Sprintf("key_%08d5", i))
+		v, ok, err := lsmTree.Get(key)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if !ok || !bytes.Equal(v, key) {
+			t.Errorf("key: %s, expect v: %s, got: %s, ok: %t", key, key, v, ok)
+			return
+		}
+	}
+}
+
+// 等待所有只读 memtable 溢写落盘
+func waitMemTableFlushed(t *Tree) {
+	for {
+		t.dataLock.RLock()
+		n := len(t.rOnlyMemTable)
+		t.dataLock.RUnlock()
+		if n == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func Test_Tree_Merge(t *testing.T) {
+	conf, err := NewConfig(t.TempDir(),
+		WithSSTSize(4*1024),
+		WithSSTDataBlockSize(512),
+		WithSSTNumPerLevel(1000), // 避免后台自动触发 compact
+		WithMergeOperator(NewUInt64AddOperator()),
+	)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	lsmTree, err := NewTree(conf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// 计数器的操作数分散在 memtable、level0 以及更深的 level 层中
+	counters := make(map[string]uint64)
+	for round := 0; round < 20; round++ {
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("counter_%03d", i)
+			if err = lsmTree.Merge([]byte(key), EncodeUInt64(uint64(round))); err != nil {
+				t.Error(err)
+				return
+			}
+			counters[key] += uint64(round)
+		}
+		// 部分计数器被直接覆盖写
+		key := fmt.Sprintf("counter_%03d", round)
+		if err = lsmTree.Put([]byte(key), EncodeUInt64(1000)); err != nil {
+			t.Error(err)
+			return
+		}
+		counters[key] = 1000
+
+		// 手动将 level0 层的数据归并到 level1 层
+		if round == 9 {
+			waitMemTableFlushed(lsmTree)
+			lsmTree.DefaultColumnFamily().compactLevel(0)
+		}
+	}
+	if len(lsmTree.DefaultColumnFamily().nodes[1]) == 0 {
+		t.Error("expect nodes in level1")
+		return
+	}
+
+	assertCounters := func(lsmTree *Tree) {
+		for key, expect := range counters {
+			v, ok, err := lsmTree.Get([]byte(key))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if !ok || binary.LittleEndian.Uint64(v) != expect {
+				t.Errorf("key: %s, expect: %d, got: %v, ok: %t", key, expect, v, ok)
+				return
+			}
+		}
+
+		iter, err := lsmTree.NewIterator()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer iter.Close()
+		var cnt int
+		for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+			if expect := counters[string(iter.Key())]; binary.LittleEndian.Uint64(iter.Value()) != expect {
+				t.Errorf("iterator key: %s, expect: %d, got: %v", iter.Key(), expect, iter.Value())
+				return
+			}
+			cnt++
+		}
+		if cnt != len(counters) {
+			t.Errorf("iterator expect cnt: %d, got: %d", len(counters), cnt)
+		}
+	}
+	assertCounters(lsmTree)
+
+	// 重启后基于 sst 文件和 wal 文件还原，结果保持一致
+	waitMemTableFlushed(lsmTree)
+	lsmTree.Close()
+	if lsmTree, err = NewTree(conf); err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		waitMemTableFlushed(lsmTree)
+		lsmTree.Close()
+	}()
+	assertCounters(lsmTree)
+}
+
+func Test_Tree_Merge_NoOperator(t *testing.T) {
+	conf, err := NewConfig(t.TempDir())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	lsmTree, err := NewTree(conf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer lsmTree.Close()
+
+	assert.Equal(t, ErrMergeOperatorNotSet, lsmTree.Merge([]byte("a"), []byte("b")))
+}
+
+// 可控的时钟，用于测试数据过期
+type fakeClock struct {
+	now atomic.Int64
+}
+
+func newFakeClock() *fakeClock {
+	var c fakeClock
+	c.now.Store(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano())
+	return &c
+}
+
+func (c *fakeClock) Now() time.Time {
+	return time.Unix(0, c.now.Load())
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now.Add(int64(d))
+}
+
+func Test_Tree_PutWithTTL(t *testing.T) {
+	clock := newFakeClock()
+	conf, err := NewConfig(t.TempDir(),
+		WithSSTSize(4*1024),
+		WithSSTDataBlockSize(512),
+		WithSSTNumPerLevel(1000), // 避免后台自动触发 compact
+		WithClock(clock),
+		WithMergeOperator(NewStringAppendOperator([]byte(","))),
+	)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	lsmTree, err := NewTree(conf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		waitMemTableFlushed(lsmTree)
+		lsmTree.Close()
+	}()
+
+	assert.Equal(t, ErrInvalidTTL, lsmTree.PutWithTTL([]byte("a"), []byte("b"), 0))
+
+	// 先写入永久数据并归并到 level1 层，再使用带 ttl 的数据覆盖其中的一部分
+	forever, session := bytes.Repeat([]byte("f"), 64), bytes.Repeat([]byte("s"), 64)
+	for i := 0; i < 1000; i++ {
+		if err = lsmTree.Put([]byte(fmt.Sprintf("key_%04d", i)), forever); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	waitMemTableFlushed(lsmTree)
+	lsmTree.DefaultColumnFamily().compactLevel(0)
+	for i := 0; i < 1000; i += 3 {
+		if err = lsmTree.PutWithTTL([]byte(fmt.Sprintf("key_%04d", i)), session, time.Minute); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	// 在即将过期的数据之上追加 merge 操作数
+	if err = lsmTree.Merge([]byte("key_0000"), []byte("op")); err != nil {
+		t.Error(err)
+		return
+	}
+
+	expect := func(i int, expired bool) ([]byte, bool) {
+		switch {
+		case i == 0 && expired:
+			return []byte("op"), true
+		case i == 0:
+			return append(append([]byte{}, session...), ",op"...), true
+		case i%3 == 0 && expired:
+			return nil, false
+		case i%3 == 0:
+			return session, true
+		default:
+			return forever, true
+		}
+	}
+
+	assertData := func(expired bool) {
+		for i := 0; i < 1000; i++ {
+			key := []byte(fmt.Sprintf("key_%04d", i))
+			expectV, expectOK := expect(i, expired)
+			v, ok, err := lsmTree.Get(key)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if ok != expectOK || !bytes.Equal(v, expectV) {
+				t.Errorf("key: %s, expect: %s, %t, got: %s, %t", key, expectV, expectOK, v, ok)
+				return
+			}
+		}
+
+		iter, err := lsmTree.NewIterator()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer iter.Close()
+		var cnt int
+		for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+			cnt++
+		}
+		expectCnt := 1000
+		if expired {
+			expectCnt = 667
+		}
+		if cnt != expectCnt {
+			t.Errorf("iterator expect cnt: %d, got: %d", expectCnt, cnt)
+		}
+	}
+
+	assertData(false)
+	clock.Advance(time.Minute)
+	assertData(true)
+
+	// 将带 ttl 的数据归并到 level1 层. 更深的 level 层中不存在数据，过期数据会被物理删除
+	waitMemTableFlushed(lsmTree)
+	if len(lsmTree.DefaultColumnFamily().nodes[0]) == 0 {
+		t.Error("expect nodes in level0")
+		return
+	}
+	lsmTree.DefaultColumnFamily().compactLevel(0)
+	assertData(true)
+	for _, node := range lsmTree.DefaultColumnFamily().nodes[1] {
+		kvs, err := node.GetAll()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		for _, kv := range kvs {
+			e, err := decodeEntry(kv.Value)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if e.expireAt > 0 {
+				t.Errorf("expect expired key dropped, key: %s", kv.Key)
+				return
+			}
+		}
+	}
+}
+
+func Test_Tree_PutWithTTL_Merge(t *testing.T) {
+	clock := newFakeClock()
+	conf, err := NewConfig(t.TempDir(),
+		WithSSTNumPerLevel(1000), // 避免后台自动触发 compact
+		WithClock(clock),
+		WithMergeOperator(NewStringAppendOperator([]byte(","))),
+	)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	lsmTree, err := NewTree(conf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		waitMemTableFlushed(lsmTree)
+		lsmTree.Close()
+	}()
+
+	// level1 层中已有该 key 的老数据，之后的归并需要重写节点
+	assert.Nil(t, lsmTree.Put([]byte("key"), []byte("old")))
+	flushMemTable(lsmTree)
+	lsmTree.DefaultColumnFamily().compactLevel(0)
+
+	// 带 ttl 的 base 与 merge 操作数在过期之前被归并到 level1 层
+	assert.Nil(t, lsmTree.PutWithTTL([]byte("key"), []byte("base"), time.Minute))
+	assert.Nil(t, lsmTree.Merge([]byte("key"), []byte("op1")))
+	assert.Nil(t, lsmTree.Merge([]byte("key"), []byte("op2")))
+	flushMemTable(lsmTree)
+	lsmTree.DefaultColumnFamily().compactLevel(0)
+	if !assert.Len(t, lsmTree.DefaultColumnFamily().nodes[1], 1) {
+		return
+	}
+	kvs, err := lsmTree.DefaultColumnFamily().nodes[1][0].GetAll()
+	if !assert.Nil(t, err) || !assert.Len(t, kvs, 1) {
+		return
+	}
+	e, err := decodeEntry(kvs[0].Value)
+	assert.Nil(t, err)
+	assert.NotZero(t, e.expireAt)
+
+	v, ok, err := lsmTree.Get([]byte("key"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "base,op1,op2", string(v))
+
+	// base 过期之后，操作数作用于空的 base，与未经 compact 时的结果一致
+	clock.Advance(time.Minute)
+	v, ok, err = lsmTree.Get([]byte("key"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "op1,op2", string(v))
+
+	// 过期之后追加操作数并再次归并，得出不再过期的最终结果
+	assert.Nil(t, lsmTree.Merge([]byte("key"), []byte("op3")))
+	flushMemTable(lsmTree)
+	lsmTree.DefaultColumnFamily().compactLevel(0)
+	kvs, err = lsmTree.DefaultColumnFamily().nodes[1][0].GetAll()
+	if !assert.Nil(t, err) || !assert.Len(t, kvs, 1) {
+		return
+	}
+	e, err = decodeEntry(kvs[0].Value)
+	assert.Nil(t, err)
+	assert.Equal(t, entryKindValue, e.kind)
+	assert.Zero(t, e.expireAt)
+	assert.Equal(t, "op1,op2,op3", string(e.value))
+}
+
+func Test_Tree_DeleteRange(t *testing.T) {
+	conf, err := NewConfig(t.TempDir(),
+		WithSSTSize(4*1024),
+		WithSSTDataBlockSize(512),
+		WithSSTNumPerLevel(1000), // 避免后台自动触发 compact
+		WithMergeOperator(NewStringAppendOperator([]byte(","))),
+	)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	lsmTree, err := NewTree(conf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		waitMemTableFlushed(lsmTree)
+		lsmTree.Close()
+	}()
+
+	assert.Equal(t, ErrInvalidRange, lsmTree.DeleteRange([]byte("b"), []byte("a")))
+
+	// 老数据分布在 level0 和 level2 层
+	expect := make(map[string][]byte)
+	value := bytes.Repeat([]byte("v"), 64)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key_%04d", i)
+		if err = lsmTree.Put([]byte(key), value); err != nil {
+			t.Error(err)
+			return
+		}
+		expect[key] = value
+	}
+	waitMemTableFlushed(lsmTree)
+	lsmTree.DefaultColumnFamily().compactLevel(0)
+	for len(lsmTree.DefaultColumnFamily().nodes[1]) > 0 {
+		lsmTree.DefaultColumnFamily().compactLevel(1)
+	}
+
+	// 范围删除之后再次写入的数据不受影响
+	if err = lsmTree.DeleteRange([]byte("key_0100"), []byte("key_0300")); err != nil {
+		t.Error(err)
+		return
+	}
+	for i := 100; i < 300; i++ {
+		delete(expect, fmt.Sprintf("key_%04d", i))
+	}
+	if err = lsmTree.Delete([]byte("key_0500")); err != nil {
+		t.Error(err)
+		return
+	}
+	delete(expect, "key_0500")
+	if err = lsmTree.Put([]byte("key_0150"), []byte("again")); err != nil {
+		t.Error(err)
+		return
+	}
+	expect["key_0150"] = []byte("again")
+	if err = lsmTree.Merge([]byte("key_0200"), []byte("op")); err != nil {
+		t.Error(err)
+		return
+	}
+	expect["key_0200"] = []byte("op")
+
+	assertData := func(lsmTree *Tree) {
+		for i := 0; i < 1000; i++ {
+			key := fmt.Sprintf("key_%04d", i)
+			expectV, expectOK := expect[key]
+			v, ok, err := lsmTree.Get([]byte(key))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if ok != expectOK || !bytes.Equal(v, expectV) {
+				t.Errorf("key: %s, expect: %s, %t, got: %s, %t", key, expectV, expectOK, v, ok)
+				return
+			}
+		}
+
+		iter, err := lsmTree.NewIterator()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer iter.Close()
+		var cnt int
+		for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+			if expectV, ok := expect[string(iter.Key())]; !ok || !bytes.Equal(iter.Value(), expectV) {
+				t.Errorf("iterator key: %s, expect: %s, %t, got: %s", iter.Key(), expectV, ok, iter.Value())
+				return
+			}
+			cnt++
+		}
+		if cnt != len(expect) {
+			t.Errorf("iterator expect cnt: %d, got: %d", len(expect), cnt)
+		}
+	}
+	assertData(lsmTree)
+
+	// 重启后基于 wal 文件还原范围删除标记
+	reopen := func() bool {
+		waitMemTableFlushed(lsmTree)
+		lsmTree.Close()
+		if lsmTree, err = NewTree(conf); err != nil {
+			t.Error(err)
+			return false
+		}
+		return true
+	}
+	if !reopen() {
+		return
+	}
+	assertData(lsmTree)
+
+	// 写入更多数据，使得范围删除标记溢写到 level0 层的 sst 文件中
+	for i := 0; i < 300; i++ {
+		key := fmt.Sprintf("other_%04d", i)
+		if err = lsmTree.Put([]byte(key), value); err != nil {
+			t.Error(err)
+			return
+		}
+		expect[key] = value
+	}
+	waitMemTableFlushed(lsmTree)
+	assertData(lsmTree)
+
+	// 将 level0 层全部归并到 level1 层. level2 层中仍有被覆盖的老数据，范围删除标记需要保留
+	for len(lsmTree.DefaultColumnFamily().nodes[0]) > 0 {
+		lsmTree.DefaultColumnFamily().compactLevel(0)
+	}
+	assertData(lsmTree)
+	var rangeDelCnt int
+	for _, node := range lsmTree.DefaultColumnFamily().nodes[1] {
+		rangeDelCnt += len(node.RangeTombstones())
+	}
+	if rangeDelCnt == 0 {
+		t.Error("expect range tombstones in level1")
+		return
+	}
+
+	// 继续归并到 level2 层. 更深的 level 层中不存在数据，被删除的数据以及范围删除标记都会被物理清理
+	for len(lsmTree.DefaultColumnFamily().nodes[1]) > 0 {
+		lsmTree.DefaultColumnFamily().compactLevel(1)
+	}
+	assertData(lsmTree)
+	var cnt int
+	for _, node := range lsmTree.DefaultColumnFamily().nodes[2] {
+		if len(node.RangeTombstones()) > 0 {
+			t.Errorf("expect range tombstones dropped, node: %s", node.file)
+			return
+		}
+		kvs, err := node.GetAll()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		cnt += len(kvs)
+	}
+	if memCnt := lsmTree.DefaultColumnFamily().memTable.EntriesCnt(); cnt+memCnt != len(expect) {
+		t.Errorf("expect deleted data dropped, expect cnt: %d, got: %d", len(expect), cnt+memCnt)
+		return
+	}
+
+	// 重启后基于 sst 文件还原
+	if !reopen() {
+		return
+	}
+	assertData(lsmTree)
+}
+
+func Test_Tree_ColumnFamilies(t *testing.T) {
+	conf, err := NewConfig(t.TempDir(),
+		WithSSTSize(4*1024),
+		WithSSTDataBlockSize(512),
+		WithSSTNumPerLevel(1000), // 避免后台自动触发 compact
+	)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = NewTree(conf, ColumnFamilyDescriptor{Name: DefaultColumnFamilyName})
+	assert.Equal(t, ErrInvalidColumnFamilyName, err)
+
+	// 各列族使用独立的配置
+	cfDescs := []ColumnFamilyDescriptor{
+		{Name: "counters", Opts: []ConfigOption{
+			WithSSTDataBlockSize(256),
+			WithSSTNumPerLevel(1000),
+			WithMergeOperator(NewUInt64AddOperator()),
+		}},
+		{Name: "meta"},
+	}
+	lsmTree, err := NewTree(conf, cfDescs...)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		waitMemTableFlushed(lsmTree)
+		lsmTree.Close()
+	}()
+
+	counters, ok := lsmTree.ColumnFamily("counters")
+	if !ok {
+		t.Error("expect column family counters")
+		return
+	}
+	assert.Equal(t, "counters", counters.Name())
+	assert.Equal(t, ErrMergeOperatorNotSet, lsmTree.Merge([]byte("a"), EncodeUInt64(1)))
+
+	// 跨列族的批量写入
+	value := bytes.Repeat([]byte("v"), 64)
+	write := func(round int) bool {
+		meta, _ := lsmTree.ColumnFamily("meta")
+		counters, _ := lsmTree.ColumnFamily("counters")
+		batch := NewWriteBatch()
+		for i := 0; i < 50; i++ {
+			key := []byte(fmt.Sprintf("key_%03d", i))
+			batch.Put(lsmTree.DefaultColumnFamily(), key, value)
+			batch.Merge(counters, key, EncodeUInt64(uint64(round)))
+		}
+		batch.Put(meta, []byte("round"), []byte(strconv.Itoa(round)))
+		if err := lsmTree.Write(batch); err != nil {
+			t.Error(err)
+			return false
+		}
+		return true
+	}
+
+	assertData := func(lsmTree *Tree, rounds int) {
+		meta, _ := lsmTree.ColumnFamily("meta")
+		counters, _ := lsmTree.ColumnFamily("counters")
+		var sum uint64
+		for round := 0; round < rounds; round++ {
+			sum += uint64(round)
+		}
+		for i := 0; i < 50; i++ {
+			key := []byte(fmt.Sprintf("key_%03d", i))
+			v, ok, err := lsmTree.Get(key)
+			if err != nil || !ok || !bytes.Equal(v, value) {
+				t.Errorf("key: %s, got: %s, ok: %t, err: %v", key, v, ok, err)
+				return
+			}
+			v, ok, err = lsmTree.GetCF(counters, key)
+			if err != nil || !ok || binary.LittleEndian.Uint64(v) != sum {
+				t.Errorf("key: %s, expect: %d, got: %v, ok: %t, err: %v", key, sum, v, ok, err)
+				return
+			}
+		}
+		v, ok, err := lsmTree.GetCF(meta, []byte("round"))
+		if err != nil || !ok || string(v) != strconv.Itoa(rounds-1) {
+			t.Errorf("expect round: %d, got: %s, ok: %t, err: %v", rounds-1, v, ok, err)
+			return
+		}
+
+		// 列族之间的数据互相隔离
+		_, ok, _ = lsmTree.Get([]byte("round"))
+		assert.False(t, ok)
+		iter, err := lsmTree.NewIteratorCF(meta)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer iter.Close()
+		var cnt int
+		for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+			cnt++
+		}
+		assert.Equal(t, 1, cnt)
+	}
+
+	for round := 0; round < 30; round++ {
+		if !write(round) {
+			return
+		}
+	}
+	assertData(lsmTree, 30)
+
+	// 各列族的 sst 文件存放在各自的目录下
+	waitMemTableFlushed(lsmTree)
+	counters.compactLevel(0)
+	if len(counters.nodes[1]) == 0 {
+		t.Error("expect nodes in level1 of counters")
+		return
+	}
+	for _, node := range counters.nodes[1] {
+		if _, err = os.Stat(path.Join(conf.Dir, "counters", node.file)); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	assertData(lsmTree, 30)
+
+	// 重启后基于 sst 文件以及 wal 还原
+	waitMemTableFlushed(lsmTree)
+	lsmTree.Close()
+	if lsmTree, err = NewTree(conf, cfDescs...); err != nil {
+		t.Error(err)
+		return
+	}
+	assertData(lsmTree, 30)
+
+	// wal 中包含未声明的列族时无法还原
+	if !write(30) {
+		return
+	}
+	meta, _ := lsmTree.ColumnFamily("meta")
+	if err = lsmTree.PutCF(meta, []byte("round"), []byte("30")); err != nil {
+		t.Error(err)
+		return
+	}
+	waitMemTableFlushed(lsmTree)
+	lsmTree.Close()
+	_, err = NewTree(conf)
+	assert.Equal(t, ErrUnknownColumnFamily, err)
+
+	if lsmTree, err = NewTree(conf, cfDescs...); err != nil {
+		t.Error(err)
+		return
+	}
+	assertData(lsmTree, 31)
+}
+
+func Test_Tree_ColumnFamilies_CompactionStyle(t *testing.T) {
+	conf, err := NewConfig(t.TempDir(),
+		WithSSTSize(4*1024),
+		WithSSTDataBlockSize(512),
+		WithSSTNumPerLevel(2),
+	)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// events 列族使用先进先出策略，默认列族使用分层归并
+	lsmTree, err := NewTree(conf, ColumnFamilyDescriptor{Name: "events", Opts: []ConfigOption{
+		WithSSTSize(4 * 1024),
+		WithSSTNumPerLevel(2),
+		WithCompactionStyle(CompactionStyleFIFO),
+	}})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		waitMemTableFlushed(lsmTree)
+		lsmTree.Close()
+	}()
+	events, _ := lsmTree.ColumnFamily("events")
+
+	value := bytes.Repeat([]byte("v"), 64)
+	for round := 0; round < 10; round++ {
+		batch := NewWriteBatch()
+		for i := 0; i < 100; i++ {
+			key := []byte(fmt.Sprintf("key_%04d", round*100+i))
+			batch.Put(lsmTree.DefaultColumnFamily(), key, value)
+			batch.Put(events, key, value)
+		}
+		if err = lsmTree.Write(batch); err != nil {
+			t.Error(err)
+			return
+		}
+		flushMemTable(lsmTree)
+	}
+
+	// 等待后台 compact 完成
+	limit := conf.SSTSize * uint64(conf.SSTNumPerLevel)
+	levelSize := func(cf *ColumnFamily, level int) uint64 {
+		cf.levelLocks[level].RLock()
+		defer cf.levelLocks[level].RUnlock()
+		var size uint64
+		for _, node := range cf.nodes[level] {
+			size += node.size
+		}
+		return size
+	}
+	for deadline := time.Now().Add(5 * time.Second); levelSize(events, 0) > limit || levelSize(lsmTree.DefaultColumnFamily(), 0) > limit; {
+		if time.Now().After(deadline) {
+			t.Error("wait compaction timeout")
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// 默认列族的数据被归并到更深的 level 层，全部保留
+	if levelSize(lsmTree.DefaultColumnFamily(), 1) == 0 {
+		t.Error("expect nodes in level1 of default column family")
+	}
+	for i := 0; i < 1000; i++ {
+		_, ok, err := lsmTree.Get([]byte(fmt.Sprintf("key_%04d", i)))
+		assert.Nil(t, err)
+		assert.True(t, ok)
+	}
+
+	// events 列族只有 level0 层的数据，最早写入的数据被删除，最新写入的数据保留
+	for level := 1; level < len(events.nodes); level++ {
+		assert.Zero(t, levelSize(events, level))
+	}
+	_, ok, err := lsmTree.GetCF(events, []byte("key_0000"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	_, ok, err = lsmTree.GetCF(events, []byte("key_0999"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+}
+func Test_Tree_MultiGet(t *testing.T) {
+	conf, err := NewConfig(t.TempDir(),
+		WithSSTSize(4*1024),
+		WithSSTDataBlockSize(512),
+		WithSSTNumPerLevel(1000), // 避免后台自动触发 compact
+		WithMergeOperator(NewUInt64AddOperator()),
+	)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	lsmTree, err := NewTree(conf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		waitMemTableFlushed(lsmTree)
+		lsmTree.Close()
+	}()
+
+	// 数据分散在 level1、level0 以及 memtable 中，其中包含删除标记、范围删除标记以及 merge 操作数
+	for i := 0; i < 500; i++ {
+		if err = lsmTree.Put([]byte(fmt.Sprintf("key_%04d", i)), EncodeUInt64(uint64(i))); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	waitMemTableFlushed(lsmTree)
+	lsmTree.DefaultColumnFamily().compactLevel(0)
+	for i := 0; i < 500; i += 3 {
+		if err = lsmTree.Merge([]byte(fmt.Sprintf("key_%04d", i)), EncodeUInt64(1000)); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	if err = lsmTree.DeleteRange([]byte("key_0100"), []byte("key_0150")); err != nil {
+		t.Error(err)
+		return
+	}
+	for i := 0; i < 500; i += 7 {
+		if err = lsmTree.Delete([]byte(fmt.Sprintf("key_%04d", i))); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	// key 乱序且存在重复，结果需要与逐个读取的结果一致
+	var keys [][]byte
+	for i := 0; i < 600; i += 2 {
+		keys = append(keys, []byte(fmt.Sprintf("key_%04d", (i*37)%600)))
+	}
+	keys = append(keys, keys[0], keys[1])
+
+	values, oks, err := lsmTree.MultiGet(keys)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(values) != len(keys) || len(oks) != len(keys) {
+		t.Errorf("expect %d results, got: %d, %d", len(keys), len(values), len(oks))
+		return
+	}
+	var found int
+	for i, key := range keys {
+		expect, ok, err := lsmTree.Get(key)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if ok != oks[i] || !bytes.Equal(expect, values[i]) {
+			t.Errorf("key: %s, expect: %v, %t, got: %v, %t", key, expect, ok, values[i], oks[i])
+			return
+		}
+		if ok {
+			found++
+		}
+	}
+	if found == 0 || found == len(keys) {
+		t.Errorf("expect both existing and missing keys, found: %d", found)
+	}
+}
+
+func Test_Tree_FullFilter(t *testing.T) {
+	conf, err := NewConfig(t.TempDir(),
+		WithSSTSize(4*1024),
+		WithSSTDataBlockSize(512),
+		WithSSTNumPerLevel(1000), // 避免后台自动触发 compact
+		WithBloomBitsPerKey(10),
+		WithFullFilter(),
+	)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	lsmTree, err := NewTree(conf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for i := 0; i < 500; i++ {
+		if err = lsmTree.Put([]byte(fmt.Sprintf("key_%04d", i)), []byte(strconv.Itoa(i))); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	waitMemTableFlushed(lsmTree)
+	lsmTree.DefaultColumnFamily().compactLevel(0)
+
+	assertFullFilter := func(lsmTree *Tree) {
+		// 每个 sstable 只包含一个全文件过滤器
+		nodes := lsmTree.DefaultColumnFamily().nodes[1]
+		if len(nodes) == 0 {
+			t.Error("expect nodes in level1")
+			return
+		}
+		for _, node := range nodes {
+			if len(node.filter.Full) == 0 || len(node.filter.BlockToFilter) != 0 {
+				t.Errorf("node: %s, expect full filter only, got: %d block filters", node.file, len(node.filter.BlockToFilter))
+			}
+		}
+
+		before := lsmTree.Stats()
+		for i := 0; i < 500; i++ {
+			value, ok, err := lsmTree.Get([]byte(fmt.Sprintf("key_%04d", i)))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			assert.Equal(t, true, ok)
+			assert.Equal(t, strconv.Itoa(i), string(value))
+		}
+		// 不存在的 key 大多落在 sstable 的 key 范围内，需要经过过滤器判定
+		for i := 0; i < 2000; i++ {
+			_, ok, err := lsmTree.Get([]byte(fmt.Sprintf("key_%04d_%d", i%500, i)))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			assert.Equal(t, false, ok)
+		}
+
+		// 落在两个 sstable 之间的 key 无需经过过滤器判定
+		stats := lsmTree.Stats()
+		absentChecks := stats.FilterNegatives + stats.FilterFalsePositives - before.FilterNegatives - before.FilterFalsePositives
+		// 仍在 memtable 中的 key 无需读取 sstable
+		inSST := uint64(500 - lsmTree.DefaultColumnFamily().memTable.EntriesCnt())
+		assert.Equal(t, inSST, stats.FilterChecks-before.FilterChecks-absentChecks)
+		if absentChecks < 1500 || absentChecks > 2000 {
+			t.Errorf("absent key filter checks: %d", absentChecks)
+		}
+		if stats.FilterFalsePositiveRate > 0.05 {
+			t.Errorf("false positive rate: %v", stats.FilterFalsePositiveRate)
+		}
+	}
+	assertFullFilter(lsmTree)
+
+	// 重启后从 sst 文件中还原全文件过滤器
+	lsmTree.Close()
+	if lsmTree, err = NewTree(conf); err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		waitMemTableFlushed(lsmTree)
+		lsmTree.Close()
+	}()
+	assertFullFilter(lsmTree)
+}
+
+func Test_Tree_NodeProperties(t *testing.T) {
+	conf, err := NewConfig(t.TempDir(),
+		WithSSTSize(4*1024),
+		WithSSTDataBlockSize(512),
+		WithSSTNumPerLevel(1000), // 避免后台自动触发 compact
+	)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	lsmTree, err := NewTree(conf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		waitMemTableFlushed(lsmTree)
+		lsmTree.Close()
+	}()
+
+	for i := 0; i < 500; i++ {
+		if err = lsmTree.Put([]byte(fmt.Sprintf("key_%04d", i)), []byte(strconv.Itoa(i))); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	waitMemTableFlushed(lsmTree)
+
+	// level0 层的节点记录了 memtable 中数据的序列号范围
+	cf := lsmTree.DefaultColumnFamily()
+	level0 := append([]*Node{}, cf.nodes[0]...)
+	if len(level0) == 0 {
+		t.Error("expect nodes in level0")
+		return
+	}
+	var entries uint64
+	for _, node := range level0 {
+		props, err := node.Properties()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if props.SmallestSeq == 0 || props.SmallestSeq > props.LargestSeq {
+			t.Errorf("node: %s, invalid seq range: [%d, %d]", node.file, props.SmallestSeq, props.LargestSeq)
+		}
+		entries += props.NumEntries
+	}
+	smallestSeq, largestSeq := seqRangeOf(level0)
+
+	// 归并生成的节点继承老节点的序列号范围，平移的节点保留原有的属性，数据条数保持一致
+	cf.compactLevel(0)
+	var compacted uint64
+	for _, node := range cf.nodes[1] {
+		props, err := node.Properties()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if props.SmallestSeq < smallestSeq || props.LargestSeq > largestSeq || props.SmallestSeq > props.LargestSeq {
+			t.Errorf("node: %s, seq range: [%d, %d] out of [%d, %d]", node.file, props.SmallestSeq, props.LargestSeq, smallestSeq, largestSeq)
+		}
+		compacted += props.NumEntries
+	}
+	assert.Equal(t, entries, compacted)
+}
+
+func Test_Tree_EdgeKeys(t *testing.T) {
+	conf, err := NewConfig(t.TempDir(),
+		WithSSTSize(4*1024),
+		WithSSTDataBlockSize(512),
+		WithSSTNumPerLevel(1000), // 避免后台自动触发 compact
+	)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	lsmTree, err := NewTree(conf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// 空 key 以及末位为 0x00、0xff 的 key 分布在 sstable 的边界上
+	expect := map[string]string{
+		"":                 "empty",
+		"\x00":             "zero",
+		"\x00\x00":         "zero_zero",
+		"\x00\x01":         "zero_one",
+		"a\x00":            "a_zero",
+		"\xff":             "ff",
+		"\xff\xff":         "ff_ff",
+		"\xff\xff\xff\x00": "ff_ff_ff_zero",
+	}
+	for i := 0; i < 500; i++ {
+		expect[fmt.Sprintf("key_%04d", i)] = strconv.Itoa(i)
+	}
+	for key, value := range expect {
+		if err = lsmTree.Put([]byte(key), []byte(value)); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	waitMemTableFlushed(lsmTree)
+	lsmTree.DefaultColumnFamily().compactLevel(0)
+
+	assertEdgeKeys := func(lsmTree *Tree) {
+		for key, value := range expect {
+			got, ok, err := lsmTree.Get([]byte(key))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if !ok || string(got) != value {
+				t.Errorf("key: %q, expect: %s, got: %s, %t", key, value, got, ok)
+			}
+		}
+
+		// 节点的 key 范围恰好为其中真实的最小 key 与最大 key
+		cf := lsmTree.DefaultColumnFamily()
+		for level := range cf.nodes {
+			for _, node := range cf.nodes[level] {
+				kvs, err := node.GetAll()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				assert.Equal(t, kvs[0].Key, node.Start())
+				assert.Equal(t, kvs[len(kvs)-1].Key, node.End())
+				for _, kv := range kvs {
+					if nodes := levelBinarySearch(cf.nodes[level], kv.Key); level > 0 && (len(nodes) != 1 || nodes[0] != node) {
+						t.Errorf("key: %q, expect found in node: %s", kv.Key, node.file)
+					}
+				}
+			}
+		}
+
+		iter, err := lsmTree.NewIterator()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer iter.Close()
+		var cnt int
+		var prev []byte
+		for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+			if cnt > 0 && bytes.Compare(prev, iter.Key()) >= 0 {
+				t.Errorf("iterator out of order: %q, %q", prev, iter.Key())
+			}
+			prev = append(prev[:0], iter.Key()...)
+			cnt++
+		}
+		assert.Equal(t, len(expect), cnt)
+	}
+	assertEdgeKeys(lsmTree)
+
+	// 重启后基于 sst 文件和 wal 文件还原，结果保持一致
+	waitMemTableFlushed(lsmTree)
+	lsmTree.Close()
+	if lsmTree, err = NewTree(conf); err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		waitMemTableFlushed(lsmTree)
+		lsmTree.Close()
+	}()
+	assertEdgeKeys(lsmTree)
+}
+
+// 列出目录下的全部文件以及文件大小
+func listFiles(t *testing.T, dir string) map[string]int64 {
+	files := make(map[string]int64)
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		files[p] = info.Size()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func Test_Tree_OpenReadOnly(t *testing.T) {
+	conf, err := NewConfig(t.TempDir(),
+		WithSSTSize(4*1024),
+		WithSSTDataBlockSize(512),
+		WithSSTNumPerLevel(1000), // 避免后台自动触发 compact
+	)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	cfDesc := ColumnFamilyDescriptor{Name: "meta"}
+
+	lsmTree, err := NewTree(conf, cfDesc)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	meta, _ := lsmTree.ColumnFamily("meta")
+
+	// 1 一部分数据落盘到 sstable 中，其余数据保留在 memtable 以及预写日志中
+	for i := 0; i < 300; i++ {
+		if err = lsmTree.Put([]byte(fmt.Sprintf("key_%04d", i)), []byte(strconv.Itoa(i))); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	flushMemTable(lsmTree)
+	lsmTree.DefaultColumnFamily().compactLevel(0)
+	for i := 300; i < 310; i++ {
+		if err = lsmTree.Put([]byte(fmt.Sprintf("key_%04d", i)), []byte(strconv.Itoa(i))); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	if err = lsmTree.PutCF(meta, []byte("version"), []byte("1")); err != nil {
+		t.Error(err)
+		return
+	}
+
+	check := func(readOnly *Tree) {
+		iter, err := readOnly.NewIterator()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer iter.Close()
+		var cnt int
+		for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+			assert.Equal(t, fmt.Sprintf("key_%04d", cnt), string(iter.Key()))
+			assert.Equal(t, strconv.Itoa(cnt), string(iter.Value()))
+			cnt++
+		}
+		assert.Equal(t, 310, cnt)
+
+		readOnlyMeta, _ := readOnly.ColumnFamily("meta")
+		got, ok, err := readOnly.GetCF(readOnlyMeta, []byte("version"))
+		assert.Nil(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, "1", string(got))
+	}
+
+	// 2 在读写实例运行期间以只读模式打开. 未在目录中出现过的列族视为空列族
+	before := listFiles(t, conf.Dir)
+	readOnly, err := OpenReadOnly(conf, cfDesc, ColumnFamilyDescriptor{Name: "absent"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	check(readOnly)
+	absent, _ := readOnly.ColumnFamily("absent")
+	_, ok, err := readOnly.GetCF(absent, []byte("version"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	// 3 写入类操作均返回 ErrReadOnly
+	assert.Equal(t, ErrReadOnly, readOnly.Put([]byte("key_0000"), []byte("new")))
+	assert.Equal(t, ErrReadOnly, readOnly.Delete([]byte("key_0000")))
+	tx := readOnly.BeginTx()
+	assert.Nil(t, tx.Put([]byte("key_0000"), []byte("new")))
+	assert.Equal(t, ErrReadOnly, tx.Commit())
+	assert.Equal(t, ErrReadOnly, readOnly.IngestExternalFiles([]string{path.Join(t.TempDir(), "1.sst")}, IngestOptions{}))
+	assert.Equal(t, ErrReadOnly, readOnly.Checkpoint(path.Join(t.TempDir(), "checkpoint")))
+	readOnly.Close()
+
+	// 只读实例没有创建、修改或删除任何文件
+	assert.Equal(t, before, listFiles(t, conf.Dir))
+
+	// 4 读写实例关闭时残留了只读 memtable 对应的预写日志. 只读实例不会溢写，也不会删除预写日志
+	waitMemTableFlushed(lsmTree)
+	walFile := lsmTree.walFile()
+	nextWALFile := path.Join(path.Dir(walFile), fmt.Sprintf("%d.wal", lsmTree.memTableIndex+1))
+	lsmTree.Close()
+	if err = os.WriteFile(nextWALFile, nil, 0644); err != nil {
+		t.Error(err)
+		return
+	}
+
+	before = listFiles(t, conf.Dir)
+	if readOnly, err = OpenReadOnly(conf, cfDesc); err != nil {
+		t.Error(err)
+		return
+	}
+	assert.Equal(t, 1, len(readOnly.rOnlyMemTable))
+	check(readOnly)
+	readOnly.Close()
+	assert.Equal(t, before, listFiles(t, conf.Dir))
+}
+
+// 只读挂载的文件系统，任何修改操作都返回 EROFS
+type readOnlyFS struct {
+	vfs.FS
+}
+
+func (readOnlyFS) Create(name string) (vfs.File, error) {
+	return nil, &os.PathError{Op: "create", Path: name, Err: syscall.EROFS}
+}
+
+func (readOnlyFS) OpenReadWrite(name string) (vfs.File, error) {
+	return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EROFS}
+}
+
+func (readOnlyFS) OpenAppend(name string) (vfs.File, error) {
+	return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EROFS}
+}
+
+func (readOnlyFS) Rename(oldname, newname string) error {
+	return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: syscall.EROFS}
+}
+
+func (readOnlyFS) Link(oldname, newname string) error {
+	return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: syscall.EROFS}
+}
+
+func (readOnlyFS) Remove(name string) error {
+	return &os.PathError{Op: "remove", Path: name, Err: syscall.EROFS}
+}
+
+func (readOnlyFS) RemoveAll(name string) error {
+	return &os.PathError{Op: "remove", Path: name, Err: syscall.EROFS}
+}
+
+func (readOnlyFS) MkdirAll(dir string) error {
+	return &os.PathError{Op: "mkdir", Path: dir, Err: syscall.EROFS}
+}
+
+func (readOnlyFS) Lock(name string) (io.Closer, error) {
+	return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EROFS}
+}
+
+func Test_Tree_OpenReadOnly_ReadOnlyDir(t *testing.T) {
+	fs := vfs.NewMem()
+	conf, err := NewConfig("db", WithFS(fs), WithSSTSize(4*1024), WithSSTDataBlockSize(512))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	lsmTree, err := NewTree(conf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for i := 0; i < 300; i++ {
+		assert.Nil(t, lsmTree.Put([]byte(fmt.Sprintf("key_%04d", i)), []byte(strconv.Itoa(i))))
+	}
+	flushMemTable(lsmTree)
+	assert.Nil(t, lsmTree.Close())
+	// 数据均已落盘到 sstable 中，目录中没有 wal 文件目录
+	assert.Nil(t, fs.RemoveAll(path.Join(conf.Dir, "walfile")))
+
+	check := func(readOnly *Tree) {
+		for i := 0; i < 300; i++ {
+			v, ok, err := readOnly.Get([]byte(fmt.Sprintf("key_%04d", i)))
+			assert.Nil(t, err)
+			assert.True(t, ok)
+			assert.Equal(t, strconv.Itoa(i), string(v))
+		}
+	}
+
+	// 只读挂载的目录可以以只读模式或者从实例的方式打开，不会创建缺失的目录
+	conf, err = NewConfig("db", WithFS(readOnlyFS{FS: fs}), WithSSTSize(4*1024), WithSSTDataBlockSize(512))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	readOnly, err := OpenReadOnly(conf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	check(readOnly)
+	assert.Nil(t, readOnly.Close())
+
+	secondary, err := OpenAsSecondary(conf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	check(secondary)
+	assert.Nil(t, secondary.Close())
+
+	_, err = NewTree(conf)
+	assert.True(t, errors.Is(err, syscall.EROFS))
+}
+
+func Test_Tree_Close(t *testing.T) {
+	conf, err := NewConfig(t.TempDir(),
+		WithSSTSize(4*1024),
+		WithSSTDataBlockSize(512),
+		WithFlushOnClose(),
+	)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	lsmTree, err := NewTree(conf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	// 写入的数据量足以触发多次 memtable 切换以及 compact
+	for i := 0; i < 2000; i++ {
+		if err = lsmTree.Put([]byte(fmt.Sprintf("key_%04d", i)), []byte(strconv.Itoa(i))); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	// 1 关闭时等待后台流程结束，并将全部 memtable 溢写落盘，预写日志随之删除
+	assert.Nil(t, lsmTree.Close())
+	assert.Equal(t, ErrClosed, lsmTree.Close())
+	entries, err := os.ReadDir(path.Join(conf.Dir, "walfile"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	assert.Empty(t, entries)
+
+	// 2 关闭之后的读写均返回 ErrClosed
+	assert.Equal(t, ErrClosed, lsmTree.Put([]byte("key_0000"), []byte("new")))
+	_, _, err = lsmTree.Get([]byte("key_0000"))
+	assert.Equal(t, ErrClosed, err)
+	_, _, err = lsmTree.MultiGet([][]byte{[]byte("key_0000")})
+	assert.Equal(t, ErrClosed, err)
+	_, err = lsmTree.NewIterator()
+	assert.Equal(t, ErrClosed, err)
+	_, err = lsmTree.NewIteratorCF(lsmTree.DefaultColumnFamily())
+	assert.Equal(t, ErrClosed, err)
+	_, err = lsmTree.NewPrefixIterator([]byte("key_"))
+	assert.Equal(t, ErrClosed, err)
+	tx := lsmTree.BeginTx()
+	assert.Nil(t, tx.Put([]byte("key_0000"), []byte("new")))
+	assert.Equal(t, ErrClosed, tx.Commit())
+	assert.Equal(t, ErrClosed, lsmTree.Checkpoint(path.Join(t.TempDir(), "checkpoint")))
+
+	// 3 重启后数据完整
+	if lsmTree, err = NewTree(conf); err != nil {
+		t.Error(err)
+		return
+	}
+	for i := 0; i < 2000; i++ {
+		value, ok, err := lsmTree.Get([]byte(fmt.Sprintf("key_%04d", i)))
+		assert.Nil(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, strconv.Itoa(i), string(value))
+	}
+
+	// 4 后台流程超时未结束时返回 ErrCloseTimeout，此时目录锁仍被持有
+	conf.CloseTimeout = 50 * time.Millisecond
+	lsmTree.wg.Add(1)
+	assert.Equal(t, ErrCloseTimeout, lsmTree.Close())
+	assert.Equal(t, ErrClosed, lsmTree.Put([]byte("key_0000"), []byte("new")))
+	_, err = NewTree(conf)
+	assert.True(t, errors.Is(err, ErrLocked))
+
+	// 后台流程结束后再次关闭，释放全部文件以及目录锁，之后即可重新打开
+	lsmTree.wg.Done()
+	assert.Nil(t, lsmTree.Close())
+	assert.Equal(t, ErrClosed, lsmTree.Close())
+	if lsmTree, err = NewTree(conf); err != nil {
+		t.Error(err)
+		return
+	}
+	for i := 0; i < 2000; i++ {
+		value, ok, err := lsmTree.Get([]byte(fmt.Sprintf("key_%04d", i)))
+		assert.Nil(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, strconv.Itoa(i), string(value))
+	}
+	assert.Nil(t, lsmTree.Close())
+}
+
+func Test_Tree_MemFS(t *testing.T) {
+	fs := vfs.NewMem()
+	dir := path.Join(t.TempDir(), "db")
+	conf, err := NewConfig(dir,
+		WithFS(fs),
+		WithSSTSize(4*1024),
+		WithSSTDataBlockSize(512),
+	)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	lsmTree, err := NewTree(conf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	// 写入的数据量足以触发多次 memtable 切换以及 compact
+	for i := 0; i < 2000; i++ {
+		if err = lsmTree.Put([]byte(fmt.Sprintf("key_%04d", i)), []byte(strconv.Itoa(i))); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	waitMemTableFlushed(lsmTree)
+
+	// 1 同一个文件系统中的目录锁同样生效
+	_, err = NewTree(conf)
+	assert.True(t, errors.Is(err, ErrLocked))
+
+	// 2 检查点写入同一个文件系统
+	checkpointDir := path.Join(t.TempDir(), "checkpoint")
+	assert.Nil(t, lsmTree.Checkpoint(checkpointDir))
+	assert.Nil(t, lsmTree.Close())
+
+	// 3 全部文件都在内存中，不涉及磁盘读写
+	_, err = os.Stat(dir)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(checkpointDir)
+	assert.True(t, os.IsNotExist(err))
+	files, err := fs.List(dir)
+	assert.Nil(t, err)
+	assert.Contains(t, files, "walfile")
+
+	// 4 重启以及打开检查点后数据完整
+	for _, d := range []string{dir, checkpointDir} {
+		c, err := NewConfig(d, WithFS(fs), WithSSTSize(4*1024), WithSSTDataBlockSize(512))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if lsmTree, err = NewTree(c); err != nil {
+			t.Error(err)
+			return
+		}
+		for i := 0; i < 2000; i++ {
+			value, ok, err := lsmTree.Get([]byte(fmt.Sprintf("key_%04d", i)))
+			assert.Nil(t, err)
+			assert.True(t, ok)
+			assert.Equal(t, strconv.Itoa(i), string(value))
+		}
+		assert.Nil(t, lsmTree.Close())
+	}
+}
+
+func Test_Tree_SyncWAL(t *testing.T) {
+	var lock sync.Mutex
+	var ops []string
+	fs := &hookFS{FS: vfs.NewMem(), hook: func(op, name string) error {
+		lock.Lock()
+		defer lock.Unlock()
+		ops = append(ops, op+" "+path.Base(name))
+		return nil
+	}}
+	// 在第 from 个操作之后查找 op
+	indexAfter := func(op string, from int) int {
+		lock.Lock()
+		defer lock.Unlock()
+		for i := from + 1; i < len(ops); i++ {
+			if ops[i] == op {
+				return i
+			}
+		}
+		return -1
+	}
+	indexOf := func(op string) int {
+		return indexAfter(op, -1)
+	}
+
+	conf, err := NewConfig("db", WithFS(fs))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	lsmTree, err := NewTree(conf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, lsmTree.Put([]byte(fmt.Sprintf("key_%d", i)), []byte("value")))
+	}
+
+	// 1 SyncWAL 持久化当前的预写日志
+	walFile := lsmTree.walFile()
+	assert.Equal(t, -1, indexOf("sync "+path.Base(walFile)))
+	assert.Nil(t, lsmTree.SyncWAL())
+	assert.NotEqual(t, -1, indexOf("sync "+path.Base(walFile)))
+
+	// 2 新的预写日志创建之后持久化目录项
+	lsmTree.dataLock.Lock()
+	lsmTree.refreshMemTableLocked()
+	newWALFile := lsmTree.walFile()
+	lsmTree.dataLock.Unlock()
+	assert.NotEqual(t, -1, indexAfter("syncdir walfile", indexOf("create "+path.Base(newWALFile))))
+
+	// 3 溢写时 sst 文件、其目录项以及新的文件版本在预写日志被删除之前完成持久化
+	for {
+		if _, err = fs.Stat(walFile); os.IsNotExist(err) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	sstFile := lsmTree.DefaultColumnFamily().sstFile(0, 1)
+	removed := indexOf("remove " + path.Base(walFile))
+	assert.NotEqual(t, -1, indexOf("sync "+path.Base(sstFile)))
+	assert.Less(t, indexOf("sync "+path.Base(sstFile)), removed)
+	sstDirSynced := indexAfter("syncdir db", indexOf("sync "+path.Base(sstFile)))
+	versionRenamed := indexAfter("rename "+versionFileName, sstDirSynced)
+	versionDirSynced := indexAfter("syncdir db", versionRenamed)
+	assert.NotEqual(t, -1, sstDirSynced)
+	assert.NotEqual(t, -1, versionRenamed)
+	assert.NotEqual(t, -1, versionDirSynced)
+	assert.Less(t, versionDirSynced, removed)
+	assert.Nil(t, lsmTree.Close())
+
+	// 4 关闭之后以及只读模式下无法持久化预写日志
+	assert.Equal(t, ErrClosed, lsmTree.SyncWAL())
+	if lsmTree, err = OpenReadOnly(conf); err != nil {
+		t.Error(err)
+		return
+	}
+	assert.Equal(t, ErrReadOnly, lsmTree.SyncWAL())
+	assert.Nil(t, lsmTree.Close())
+}
+
+func Test_Tree_TornWALTail(t *testing.T) {
+	conf, err := NewConfig("db", WithFS(vfs.NewMem()))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	lsmTree, err := NewTree(conf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, lsmTree.Put([]byte(fmt.Sprintf("key_%d", i)), []byte("value")))
+	}
+	walFile := lsmTree.walFile()
+	assert.Nil(t, lsmTree.Close())
+
+	// 1 模拟崩溃时预写日志末尾残留了一条不完整的记录
+	f, err := conf.FS.OpenAppend(walFile)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	_, _ = f.Write([]byte{5, 32, 'k'})
+	_ = f.Close()
+
+	// 2 重启时忽略并截断不完整的记录，之后追加的记录在下一次重启时能够被读取
+	for round := 0; round < 2; round++ {
+		if lsmTree, err = NewTree(conf); err != nil {
+			t.Error(err)
+			return
+		}
+		for i := 0; i < 10+round*10; i++ {
+			value, ok, err := lsmTree.Get([]byte(fmt.Sprintf("key_%d", i)))
+			assert.Nil(t, err)
+			assert.True(t, ok)
+			assert.Equal(t, "value", string(value))
+		}
+		for i := 10; i < 20; i++ {
+			assert.Nil(t, lsmTree.Put([]byte(fmt.Sprintf("key_%d", i)), []byte("value")))
+		}
+		assert.Nil(t, lsmTree.Close())
+	}
+}
+
+func Test_Tree_StaleSSTFiles(t *testing.T) {
+	conf, err := NewConfig("db", WithFS(vfs.NewMem()))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	lsmTree, err := NewTree(conf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, lsmTree.Put([]byte(fmt.Sprintf("key_%d", i)), []byte("value")))
+	}
+	walFile := lsmTree.walFile()
+	lsmTree.dataLock.Lock()
+	lsmTree.refreshMemTableLocked()
+	lsmTree.dataLock.Unlock()
+	for {
+		if _, err = conf.FS.Stat(walFile); os.IsNotExist(err) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cf := lsmTree.DefaultColumnFamily()
+	liveFile, staleFile := path.Join(cf.conf.Dir, cf.sstFile(0, 1)), path.Join(cf.conf.Dir, cf.sstFile(0, 2))
+	assert.Nil(t, lsmTree.Close())
+
+	// 1 模拟溢写中途崩溃残留的 sst 文件，其内容不完整，并且没有记录在文件版本中
+	assert.Nil(t, vfs.WriteFile(conf.FS, staleFile, []byte("partial")))
+
+	// 2 重启时删除不在文件版本中的 sst 文件
+	if lsmTree, err = NewTree(conf); err != nil {
+		t.Error(err)
+		return
+	}
+	_, err = conf.FS.Stat(staleFile)
+	assert.True(t, os.IsNotExist(err))
+	for i := 0; i < 10; i++ {
+		value, ok, err := lsmTree.Get([]byte(fmt.Sprintf("key_%d", i)))
+		assert.Nil(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, "value", string(value))
+	}
+	assert.Nil(t, lsmTree.Close())
+
+	// 3 文件版本中记录的 sst 文件缺失时无法打开
+	assert.Nil(t, conf.FS.Remove(liveFile))
+	_, err = NewTree(conf)
+	assert.True(t, errors.Is(err, ErrMissingSSTFile))
+}
+
+func Test_Tree_compact_SkipSatisfiedLevel(t *testing.T) {
+	conf, err := NewConfig("db", WithFS(vfs.NewMem()))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	lsmTree, err := NewTree(conf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer lsmTree.Close()
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, lsmTree.Put([]byte(fmt.Sprintf("key_%d", i)), []byte("value")))
+	}
+	lsmTree.dataLock.Lock()
+	lsmTree.refreshMemTableLocked()
+	lsmTree.dataLock.Unlock()
+	waitMemTableFlushed(lsmTree)
+
+	// level0 层的数据量远低于阈值，重复触发的 compact 指令不会将节点平移到 level1 层.
+	// 通道没有缓冲，第二个指令发送成功时第一个指令已经处理完毕
+	cf := lsmTree.DefaultColumnFamily()
+	lsmTree.levelCompactC <- &levelCompactItem{cf: cf, level: 0}
+	lsmTree.memCompactC <- nil
+	cf.levelLocks[0].RLock()
+	assert.Len(t, cf.nodes[0], 1)
+	cf.levelLocks[0].RUnlock()
+	cf.levelLocks[1].RLock()
+	assert.Len(t, cf.nodes[1], 0)
+	cf.levelLocks[1].RUnlock()
+}
@@ -0,0 +1,321 @@
+package golsm
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+
+	"github.com/xiaoxuxiansheng/golsm/memtable"
+)
+
+var (
+	ErrConflict = errors.New("transaction conflict")
+	ErrTxDone   = errors.New("transaction has already been committed or rolled back")
+)
+
+// 事务. 写入先缓存在事务内部，读取时优先读取事务自身的写入. Tx 不是并发安全的
+// 乐观事务提交时校验事务读写过的 key 在开启事务之后是否被其他写入修改过，存在冲突则返回 ErrConflict，由调用方重试.
+// 事务中的读取读到已经提交的最新数据，只读的乐观事务提交时同样校验读过的 key. 提交成功时，事务读到的数据均为开启事务时刻的快照.
+// 悲观事务由 TxDB 开启，通过 GetForUpdate 以及写入操作对 key 加行锁，提交时无需校验冲突
+type Tx struct {
+	tree *Tree
+
+	// 开启事务时 lsm tree 最新的序列号. 序列号大于 snapshotSeq 的写入对于事务而言都是冲突的
+	snapshotSeq uint64
+
+	// 事务中的写入，提交时作为一笔批量写入落盘
+	batch *WriteBatch
+
+	// 各列族中事务写入的 key 对应的最新记录
+	writes map[*ColumnFamily]map[string]*entry
+
+	// 各列族中事务读写过的 key，提交时需要校验冲突
+	tracked map[*ColumnFamily]map[string]struct{}
+
+	// 悲观事务所属的 TxDB. 乐观事务为 nil
+	db   *TxDB
+	id   uint64
+	opts TxOptions
+
+	// 悲观事务持有的行锁
+	locked map[lockKey]struct{}
+
+	done bool
+}
+
+// 开启一个乐观事务
+func (t *Tree) BeginTx() *Tx {
+	t.dataLock.RLock()
+	snapshotSeq := t.seq
+	t.dataLock.RUnlock()
+
+	return &Tx{
+		tree:        t,
+		snapshotSeq: snapshotSeq,
+		batch:       NewWriteBatch(),
+		writes:      make(map[*ColumnFamily]map[string]*entry),
+		tracked:     make(map[*ColumnFamily]map[string]struct{}),
+	}
+}
+
+// 读取默认列族中 key 对应的数据
+func (tx *Tx) Get(key []byte) ([]byte, bool, error) {
+	return tx.GetCF(tx.tree.DefaultColumnFamily(), key)
+}
+
+// 读取指定列族中 key 对应的数据. 优先读取事务自身的写入
+func (tx *Tx) GetCF(cf *ColumnFamily, key []byte) ([]byte, bool, error) {
+	if tx.done {
+		return nil, false, ErrTxDone
+	}
+	if err := tx.tree.checkColumnFamily(cf); err != nil {
+		return nil, false, err
+	}
+
+	if e, ok := tx.writes[cf][string(key)]; ok {
+		return e.value, e.kind == entryKindValue, nil
+	}
+
+	tx.track(cf, key)
+	return tx.tree.GetCF(cf, key)
+}
+
+// 读取默认列族中 key 对应的数据，并声明事务将会修改该 key
+func (tx *Tx) GetForUpdate(key []byte) ([]byte, bool, error) {
+	return tx.GetForUpdateCF(tx.tree.DefaultColumnFamily(), key)
+}
+
+// 读取指定列族中 key 对应的数据，并声明事务将会修改该 key.
+// 悲观事务会先对 key 加行锁再读取，乐观事务与 GetCF 一致
+func (tx *Tx) GetForUpdateCF(cf *ColumnFamily, key []byte) ([]byte, bool, error) {
+	if tx.done {
+		return nil, false, ErrTxDone
+	}
+	if err := tx.tree.checkColumnFamily(cf); err != nil {
+		return nil, false, err
+	}
+	if err := tx.lock(cf, key); err != nil {
+		return nil, false, err
+	}
+	return tx.GetCF(cf, key)
+}
+
+// 在事务中写入一组 kv 对到默认列族
+func (tx *Tx) Put(key, value []byte) error {
+	return tx.PutCF(tx.tree.DefaultColumnFamily(), key, value)
+}
+
+// 在事务中写入一组 kv 对到指定列族
+func (tx *Tx) PutCF(cf *ColumnFamily, key, value []byte) error {
+	return tx.write(cf, key, newValueEntry(value))
+}
+
+// 在事务中删除默认列族的一个 key
+func (tx *Tx) Delete(key []byte) error {
+	return tx.DeleteCF(tx.tree.DefaultColumnFamily(), key)
+}
+
+// 在事务中删除指定列族的一个 key
+func (tx *Tx) DeleteCF(cf *ColumnFamily, key []byte) error {
+	return tx.write(cf, key, newDeleteEntry())
+}
+
+// 创建默认列族的迭代器. 遍历结果中包含事务自身的写入，遍历到的 key 在提交时都会校验冲突
+func (tx *Tx) NewIterator() (*Iterator, error) {
+	return tx.NewIteratorCF(tx.tree.DefaultColumnFamily())
+}
+
+// 创建指定列族的迭代器. 迭代器基于创建时刻事务中的写入，之后的写入对迭代器不可见
+func (tx *Tx) NewIteratorCF(cf *ColumnFamily) (*Iterator, error) {
+	if tx.done {
+		return nil, ErrTxDone
+	}
+	if err := tx.tree.checkColumnFamily(cf); err != nil {
+		return nil, err
+	}
+
+	// 事务中的写入作为最新的数据源
+	kvs := make([]*memtable.KV, 0, len(tx.writes[cf]))
+	for key, e := range tx.writes[cf] {
+		kvs = append(kvs, &memtable.KV{
+			Key:   []byte(key),
+			Value: encodeEntry(e),
+		})
+	}
+	sort.Slice(kvs, func(i, j int) bool {
+		return bytes.Compare(kvs[i].Key, kvs[j].Key) < 0
+	})
+
+	it := tx.tree.newIterator(cf, []internalIterator{newMemIterator(kvs, nil)}, nil)
+	it.observe = func(key []byte) {
+		tx.track(cf, key)
+	}
+	return it, nil
+}
+
+// 提交事务. 事务读写过的 key 在开启事务之后被修改过时返回 ErrConflict，事务中的写入全部不生效.
+// 只读事务同样需要提交，提交成功才能确认读到的数据来自同一个快照
+func (tx *Tx) Commit() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+
+	// 悲观事务持有行锁，无需校验冲突
+	t := tx.tree
+	if tx.db != nil {
+		defer tx.unlock()
+		return t.Write(tx.batch)
+	}
+
+	// 只读事务只需校验读过的 key
+	if len(tx.batch.records) == 0 && tx.batch.err == nil {
+		if err := t.checkOpen(); err != nil {
+			return err
+		}
+		t.dataLock.RLock()
+		defer t.dataLock.RUnlock()
+		return tx.validateLocked()
+	}
+
+	if err := t.checkBatch(tx.batch); err != nil {
+		return err
+	}
+
+	// 冲突校验与写入在同一把锁的保护下完成，保证校验通过后不会再有其他写入插入
+	t.dataLock.Lock()
+	defer t.dataLock.Unlock()
+	if err := t.checkWritable(); err != nil {
+		return err
+	}
+	if err := tx.validateLocked(); err != nil {
+		return err
+	}
+	return t.writeLocked(tx.batch)
+}
+
+// 校验事务读写过的 key 在开启事务之后是否被修改过. 调用方需要持有 dataLock
+func (tx *Tx) validateLocked() error {
+	for cf, keys := range tx.tracked {
+		for key := range keys {
+			changed, err := tx.tree.changedSinceLocked(cf, []byte(key), tx.snapshotSeq)
+			if err != nil {
+				return err
+			}
+			if changed {
+				return ErrConflict
+			}
+		}
+	}
+	return nil
+}
+
+// 回滚事务，丢弃事务中的全部写入
+func (tx *Tx) Rollback() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	tx.batch.Clear()
+	tx.unlock()
+	return nil
+}
+
+func (tx *Tx) write(cf *ColumnFamily, key []byte, e *entry) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	if err := tx.tree.checkColumnFamily(cf); err != nil {
+		return err
+	}
+	if err := tx.lock(cf, key); err != nil {
+		return err
+	}
+
+	tx.batch.append(cf, key, e)
+	if _, ok := tx.writes[cf]; !ok {
+		tx.writes[cf] = make(map[string]*entry)
+	}
+	tx.writes[cf][string(key)] = e
+	tx.track(cf, key)
+	return nil
+}
+
+// 悲观事务对 key 加行锁. 乐观事务无需加锁
+func (tx *Tx) lock(cf *ColumnFamily, key []byte) error {
+	if tx.db == nil {
+		return nil
+	}
+	lk := lockKey{cf: cf, key: string(key)}
+	if _, ok := tx.locked[lk]; ok {
+		return nil
+	}
+	if err := tx.db.locks.lock(tx.id, lk, tx.opts.LockTimeout, !tx.opts.DisableDeadlockDetect); err != nil {
+		return err
+	}
+	tx.locked[lk] = struct{}{}
+	return nil
+}
+
+// 悲观事务释放持有的全部行锁
+func (tx *Tx) unlock() {
+	if tx.db == nil {
+		return
+	}
+	keys := make([]lockKey, 0, len(tx.locked))
+	for lk := range tx.locked {
+		keys = append(keys, lk)
+	}
+	tx.db.locks.unlock(tx.id, keys)
+	tx.locked = nil
+}
+
+// 记录事务读写过的 key. 悲观事务通过行锁避免冲突，无需记录
+func (tx *Tx) track(cf *ColumnFamily, key []byte) {
+	if tx.db != nil {
+		return
+	}
+	if _, ok := tx.tracked[cf]; !ok {
+		tx.tracked[cf] = make(map[string]struct{})
+	}
+	tx.tracked[cf][string(key)] = struct{}{}
+}
+
+// key 在序列号 seq 之后是否被修改过. 调用方需要持有 dataLock
+func (t *Tree) changedSinceLocked(cf *ColumnFamily, key []byte, seq uint64) (bool, error) {
+	// 1 memtable 中 key 最新一笔记录的序列号即为 key 最近一次被修改的序列号
+	var latest uint64
+	found, err := t.getFromMemTables(cf, key, func(e *entry) (bool, error) {
+		latest = e.seq
+		return true, nil
+	})
+	if err != nil {
+		return false, err
+	}
+	if found {
+		return latest > seq, nil
+	}
+
+	// 2 正在摄入的外部文件尚未发布为节点，key 落在文件范围内时保守地视为已修改
+	if item := t.ingesting; item != nil && item.cf == cf && item.seq > seq {
+		for _, f := range item.files {
+			if bytes.Compare(key, f.start) >= 0 && bytes.Compare(key, f.end) <= 0 {
+				return true, nil
+			}
+		}
+	}
+
+	// 3 由新到旧查找包含 key 的首个节点，以节点属性中的最大序列号作为 key 最近一次被修改的序列号的上界
+	v := cf.refVersion()
+	defer v.unref()
+	node, err := v.latestNode(key)
+	if err != nil || node == nil {
+		return false, err
+	}
+	props, err := node.Properties()
+	if err != nil {
+		return false, err
+	}
+	// 没有记录序列号范围的节点由早期版本写入，其中的数据早于任何事务
+	return props != nil && props.LargestSeq > seq, nil
+}
@@ -0,0 +1,314 @@
+package golsm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"path"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Tx(t *testing.T) {
+	conf, err := NewConfig(t.TempDir(),
+		WithSSTSize(4*1024),
+		WithSSTDataBlockSize(512),
+		WithSSTNumPerLevel(1000), // 避免后台自动触发 compact
+	)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	lsmTree, err := NewTree(conf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		waitMemTableFlushed(lsmTree)
+		lsmTree.Close()
+	}()
+
+	if err = lsmTree.Put([]byte("a"), []byte("1")); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// 事务优先读取自身的写入，提交之前对其他读者不可见
+	tx := lsmTree.BeginTx()
+	v, ok, err := tx.Get([]byte("a"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("1"), v)
+	assert.Nil(t, tx.Put([]byte("b"), []byte("2")))
+	assert.Nil(t, tx.Delete([]byte("a")))
+	_, ok, _ = tx.Get([]byte("a"))
+	assert.False(t, ok)
+	_, ok, _ = lsmTree.Get([]byte("b"))
+	assert.False(t, ok)
+
+	iter, err := tx.NewIterator()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	var keys []string
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+		keys = append(keys, string(iter.Key()))
+	}
+	iter.Close()
+	assert.Equal(t, []string{"b"}, keys)
+
+	assert.Nil(t, tx.Commit())
+	assert.Equal(t, ErrTxDone, tx.Commit())
+	_, ok, _ = lsmTree.Get([]byte("a"))
+	assert.False(t, ok)
+	v, _, _ = lsmTree.Get([]byte("b"))
+	assert.Equal(t, []byte("2"), v)
+
+	// 读过的 key 在事务开启之后被修改，提交失败
+	tx = lsmTree.BeginTx()
+	_, _, _ = tx.Get([]byte("b"))
+	assert.Nil(t, tx.Put([]byte("c"), []byte("3")))
+	assert.Nil(t, lsmTree.Put([]byte("b"), []byte("4")))
+	assert.Equal(t, ErrConflict, tx.Commit())
+	_, ok, _ = lsmTree.Get([]byte("c"))
+	assert.False(t, ok)
+
+	// 迭代器遍历过的 key 被范围删除，提交失败
+	tx = lsmTree.BeginTx()
+	iter, _ = tx.NewIterator()
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+	}
+	iter.Close()
+	assert.Nil(t, tx.Put([]byte("c"), []byte("3")))
+	assert.Nil(t, lsmTree.DeleteRange([]byte("a"), []byte("z")))
+	assert.Equal(t, ErrConflict, tx.Commit())
+
+	// 只读事务两次读取之间其他 key 被修改，读到的数据不属于同一个快照，提交失败
+	assert.Nil(t, lsmTree.Put([]byte("b"), []byte("4")))
+	tx = lsmTree.BeginTx()
+	_, _, _ = tx.Get([]byte("b"))
+	assert.Nil(t, lsmTree.Put([]byte("d"), []byte("5")))
+	v, _, _ = tx.Get([]byte("d"))
+	assert.Equal(t, []byte("5"), v)
+	assert.Equal(t, ErrConflict, tx.Commit())
+
+	// 读过的 key 没有被修改的只读事务提交成功
+	tx = lsmTree.BeginTx()
+	_, _, _ = tx.Get([]byte("b"))
+	_, _, _ = tx.Get([]byte("d"))
+	assert.Nil(t, lsmTree.Put([]byte("e"), []byte("5")))
+	assert.Nil(t, tx.Commit())
+	assert.Nil(t, lsmTree.Delete([]byte("e")))
+
+	// 修改其他 key 不影响提交
+	tx = lsmTree.BeginTx()
+	_, _, _ = tx.Get([]byte("b"))
+	assert.Nil(t, tx.Put([]byte("c"), []byte("3")))
+	assert.Nil(t, lsmTree.Put([]byte("d"), []byte("5")))
+	assert.Nil(t, tx.Commit())
+
+	// 回滚的事务不生效
+	tx = lsmTree.BeginTx()
+	assert.Nil(t, tx.Put([]byte("e"), []byte("6")))
+	assert.Nil(t, tx.Rollback())
+	assert.Equal(t, ErrTxDone, tx.Put([]byte("e"), []byte("6")))
+	_, ok, _ = lsmTree.Get([]byte("e"))
+	assert.False(t, ok)
+}
+
+func Test_Tx_Concurrent(t *testing.T) {
+	conf, err := NewConfig(t.TempDir(),
+		WithSSTSize(4*1024),
+		WithSSTDataBlockSize(512),
+	)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	lsmTree, err := NewTree(conf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		waitMemTableFlushed(lsmTree)
+		lsmTree.Close()
+	}()
+
+	// 多个协程并发地在账户之间转账，冲突时重试. 转账结束后账户余额总和保持不变
+	const accounts, initial = 10, 1000
+	for i := 0; i < accounts; i++ {
+		if err = lsmTree.Put([]byte(fmt.Sprintf("account_%d", i)), EncodeUInt64(initial)); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	transfer := func(from, to string) error {
+		for {
+			tx := lsmTree.BeginTx()
+			fromV, _, err := tx.Get([]byte(from))
+			if err != nil {
+				return err
+			}
+			toV, _, err := tx.Get([]byte(to))
+			if err != nil {
+				return err
+			}
+			fromBalance, toBalance := binary.LittleEndian.Uint64(fromV), binary.LittleEndian.Uint64(toV)
+			if fromBalance == 0 {
+				return tx.Rollback()
+			}
+			_ = tx.Put([]byte(from), EncodeUInt64(fromBalance-1))
+			_ = tx.Put([]byte(to), EncodeUInt64(toBalance+1))
+			if err = tx.Commit(); err != ErrConflict {
+				return err
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				from := fmt.Sprintf("account_%d", (g+i)%accounts)
+				to := fmt.Sprintf("account_%d", (g+i*3+1)%accounts)
+				if from == to {
+					continue
+				}
+				assert.Nil(t, transfer(from, to))
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	var sum uint64
+	for i := 0; i < accounts; i++ {
+		v, ok, err := lsmTree.Get([]byte(fmt.Sprintf("account_%d", i)))
+		assert.Nil(t, err)
+		assert.True(t, ok)
+		sum += binary.LittleEndian.Uint64(v)
+	}
+	assert.Equal(t, uint64(accounts*initial), sum)
+}
+
+func Test_Tx_Flush(t *testing.T) {
+	conf, err := NewConfig(t.TempDir(),
+		WithSSTSize(4*1024),
+		WithSSTDataBlockSize(512),
+		WithSSTNumPerLevel(1000), // 避免后台自动触发 compact
+	)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	lsmTree, err := NewTree(conf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		waitMemTableFlushed(lsmTree)
+		lsmTree.Close()
+	}()
+
+	assert.Nil(t, lsmTree.Put([]byte("a"), []byte("1")))
+	assert.Nil(t, lsmTree.Put([]byte("b"), []byte("2")))
+	flushMemTable(lsmTree)
+
+	// 事务期间溢写了其他 key 的修改，提交成功
+	tx := lsmTree.BeginTx()
+	_, _, _ = tx.Get([]byte("a"))
+	assert.Nil(t, tx.Put([]byte("c"), []byte("3")))
+	assert.Nil(t, lsmTree.Put([]byte("d"), []byte("4")))
+	flushMemTable(lsmTree)
+	assert.Nil(t, tx.Commit())
+	v, _, _ := lsmTree.Get([]byte("c"))
+	assert.Equal(t, []byte("3"), v)
+
+	// 读过的 key 被修改并溢写到 sstable 中，提交失败
+	tx = lsmTree.BeginTx()
+	_, _, _ = tx.Get([]byte("a"))
+	assert.Nil(t, tx.Put([]byte("c"), []byte("5")))
+	assert.Nil(t, lsmTree.Put([]byte("a"), []byte("6")))
+	flushMemTable(lsmTree)
+	assert.Equal(t, ErrConflict, tx.Commit())
+
+	// 读过的 key 被范围删除并溢写到 sstable 中，提交失败
+	tx = lsmTree.BeginTx()
+	_, _, _ = tx.Get([]byte("b"))
+	assert.Nil(t, tx.Put([]byte("c"), []byte("5")))
+	assert.Nil(t, lsmTree.DeleteRange([]byte("b"), []byte("c")))
+	flushMemTable(lsmTree)
+	assert.Equal(t, ErrConflict, tx.Commit())
+	v, _, _ = lsmTree.Get([]byte("c"))
+	assert.Equal(t, []byte("3"), v)
+
+	// 事务期间摄入了与读过的 key 无关的外部文件，提交成功；摄入的文件包含读过的 key 时提交失败
+	externalDir := t.TempDir()
+	writeExternalFile(t, path.Join(externalDir, "1.sst"), conf, []string{"x", "y"}, map[string]string{"x": "7", "y": "7"})
+	writeExternalFile(t, path.Join(externalDir, "2.sst"), conf, []string{"a"}, map[string]string{"a": "8"})
+	tx = lsmTree.BeginTx()
+	_, _, _ = tx.Get([]byte("a"))
+	assert.Nil(t, tx.Put([]byte("c"), []byte("9")))
+	assert.Nil(t, lsmTree.IngestExternalFiles([]string{path.Join(externalDir, "1.sst")}, IngestOptions{}))
+	assert.Nil(t, tx.Commit())
+
+	tx = lsmTree.BeginTx()
+	_, _, _ = tx.Get([]byte("a"))
+	assert.Nil(t, tx.Put([]byte("c"), []byte("10")))
+	assert.Nil(t, lsmTree.IngestExternalFiles([]string{path.Join(externalDir, "2.sst")}, IngestOptions{}))
+	assert.Equal(t, ErrConflict, tx.Commit())
+	v, _, _ = lsmTree.Get([]byte("c"))
+	assert.Equal(t, []byte("9"), v)
+}
+
+func Test_Tx_Reopen(t *testing.T) {
+	conf, err := NewConfig(t.TempDir(),
+		WithSSTSize(4*1024),
+		WithSSTDataBlockSize(512),
+	)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	lsmTree, err := NewTree(conf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, lsmTree.Put([]byte(fmt.Sprintf("key_%d", i)), []byte("v")))
+	}
+	// 数据全部溢写落盘，对应的预写日志随之删除
+	flushMemTable(lsmTree)
+	assert.Nil(t, lsmTree.Close())
+
+	// 重新打开之后，序列号从已落盘数据的最大序列号开始分配，读取落盘数据的事务不会误判为冲突
+	lsmTree, err = NewTree(conf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer lsmTree.Close()
+	tx := lsmTree.BeginTx()
+	v, ok, err := tx.Get([]byte("key_0"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("v"), v)
+	assert.Nil(t, tx.Commit())
+
+	tx = lsmTree.BeginTx()
+	_, _, _ = tx.Get([]byte("key_1"))
+	assert.Nil(t, lsmTree.Put([]byte("key_1"), []byte("v2")))
+	assert.Equal(t, ErrConflict, tx.Commit())
+}
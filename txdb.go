@@ -0,0 +1,82 @@
+package golsm
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// 支持悲观事务的 lsm tree. 事务通过 GetForUpdate 以及写入操作对 key 加行锁，持有至提交或者回滚.
+// 直接通过 Tree 进行的写入不受行锁约束
+type TxDB struct {
+	tree  *Tree
+	locks *lockManager
+	conf  txDBConfig
+
+	// 事务 id 生成器
+	nextTxID atomic.Uint64
+}
+
+type txDBConfig struct {
+	lockStripes int           // 行锁分片数量
+	lockTimeout time.Duration // 事务未指定时使用的行锁等待超时时间
+}
+
+// TxDB 配置项
+type TxDBOption func(*txDBConfig)
+
+// 行锁分片数量. 默认为 64 个分片
+func WithLockStripes(lockStripes int) TxDBOption {
+	return func(c *txDBConfig) {
+		c.lockStripes = lockStripes
+	}
+}
+
+// 行锁等待超时时间. 默认为 1s
+func WithLockTimeout(lockTimeout time.Duration) TxDBOption {
+	return func(c *txDBConfig) {
+		c.lockTimeout = lockTimeout
+	}
+}
+
+// 悲观事务选项
+type TxOptions struct {
+	LockTimeout           time.Duration // 行锁等待超时时间. 为 0 时使用 TxDB 的配置
+	DisableDeadlockDetect bool          // 是否关闭死锁检测. 默认开启，等待行锁形成环路时直接返回 ErrDeadlock
+}
+
+// 基于 lsm tree 构造 TxDB
+func NewTxDB(tree *Tree, opts ...TxDBOption) *TxDB {
+	var conf txDBConfig
+	for _, opt := range opts {
+		opt(&conf)
+	}
+	if conf.lockStripes <= 0 {
+		conf.lockStripes = 64
+	}
+	if conf.lockTimeout <= 0 {
+		conf.lockTimeout = time.Second
+	}
+
+	return &TxDB{
+		tree:  tree,
+		locks: newLockManager(conf.lockStripes),
+		conf:  conf,
+	}
+}
+
+// 底层的 lsm tree
+func (db *TxDB) Tree() *Tree {
+	return db.tree
+}
+
+// 开启一个悲观事务
+func (db *TxDB) Begin(opts TxOptions) *Tx {
+	if opts.LockTimeout <= 0 {
+		opts.LockTimeout = db.conf.lockTimeout
+	}
+
+	tx := db.tree.BeginTx()
+	tx.db, tx.id, tx.opts = db, db.nextTxID.Add(1), opts
+	tx.locked = make(map[lockKey]struct{})
+	return tx
+}
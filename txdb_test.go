@@ -0,0 +1,110 @@
+package golsm
+
+import (
+	"encoding/binary"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_TxDB(t *testing.T) {
+	conf, err := NewConfig(t.TempDir(),
+		WithSSTSize(4*1024),
+		WithSSTDataBlockSize(512),
+	)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	lsmTree, err := NewTree(conf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		waitMemTableFlushed(lsmTree)
+		lsmTree.Close()
+	}()
+	db := NewTxDB(lsmTree, WithLockStripes(4), WithLockTimeout(5*time.Second))
+
+	// 行锁被持有时，等待超时
+	tx1 := db.Begin(TxOptions{})
+	_, _, err = tx1.GetForUpdate([]byte("a"))
+	assert.Nil(t, err)
+	assert.Nil(t, tx1.Put([]byte("a"), []byte("1")))
+	tx2 := db.Begin(TxOptions{LockTimeout: 50 * time.Millisecond})
+	_, _, err = tx2.GetForUpdate([]byte("a"))
+	assert.Equal(t, ErrLockTimeout, err)
+	assert.Equal(t, ErrLockTimeout, tx2.Put([]byte("a"), []byte("2")))
+
+	// 行锁释放后即可获取，并读到已提交的数据
+	assert.Nil(t, tx1.Commit())
+	v, ok, err := tx2.GetForUpdate([]byte("a"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("1"), v)
+	assert.Nil(t, tx2.Rollback())
+
+	// 两个事务互相等待对方持有的行锁，后发起等待的事务检测到死锁
+	tx1 = db.Begin(TxOptions{})
+	tx2 = db.Begin(TxOptions{})
+	assert.Nil(t, tx1.Put([]byte("a"), []byte("3")))
+	assert.Nil(t, tx2.Put([]byte("b"), []byte("4")))
+	errC := make(chan error)
+	go func() {
+		errC <- tx1.Put([]byte("b"), []byte("3"))
+	}()
+	for waiting := false; !waiting; {
+		db.locks.waitLock.Lock()
+		_, waiting = db.locks.waitFor[tx1.id]
+		db.locks.waitLock.Unlock()
+	}
+	assert.Equal(t, ErrDeadlock, tx2.Put([]byte("a"), []byte("4")))
+	assert.Nil(t, tx2.Rollback())
+	assert.Nil(t, <-errC)
+	assert.Nil(t, tx1.Commit())
+	v, _, _ = lsmTree.Get([]byte("a"))
+	assert.Equal(t, []byte("3"), v)
+	v, _, _ = lsmTree.Get([]byte("b"))
+	assert.Equal(t, []byte("3"), v)
+
+	// 持有者已经释放行锁而等待者尚未被唤醒时，等待图中残留的边不会被误判为死锁
+	tx1 = db.Begin(TxOptions{})
+	tx2 = db.Begin(TxOptions{LockTimeout: 50 * time.Millisecond})
+	assert.Nil(t, tx1.Put([]byte("a"), []byte("5")))
+	db.locks.waitLock.Lock()
+	db.locks.waitFor[tx1.id] = waitEdge{waiter: tx1.id, owner: tx2.id, key: lockKey{cf: lsmTree.DefaultColumnFamily(), key: "b"}}
+	db.locks.waitLock.Unlock()
+	assert.Equal(t, ErrLockTimeout, tx2.Put([]byte("a"), []byte("6")))
+	db.locks.stopWaiting(tx1.id)
+	assert.Nil(t, tx2.Rollback())
+	assert.Nil(t, tx1.Rollback())
+
+	// 多个事务并发地对同一个计数器执行读改写
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				tx := db.Begin(TxOptions{})
+				v, ok, err := tx.GetForUpdate([]byte("counter"))
+				if !assert.Nil(t, err) {
+					return
+				}
+				var cnt uint64
+				if ok {
+					cnt = binary.LittleEndian.Uint64(v)
+				}
+				assert.Nil(t, tx.Put([]byte("counter"), EncodeUInt64(cnt+1)))
+				assert.Nil(t, tx.Commit())
+			}
+		}()
+	}
+	wg.Wait()
+	v, _, _ = lsmTree.Get([]byte("counter"))
+	assert.Equal(t, uint64(800), binary.LittleEndian.Uint64(v))
+}
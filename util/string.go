@@ -12,11 +12,9 @@ func SharedPrefixLen(a, b []byte) int {
 
 // 返回结果 x，保证 a <= x < b. 使用方需要自行保证 a < b
 func GetSeparatorBetween(a, b []byte) []byte {
-	// 倘若 a 为空，则返回一个比 b 小的结果即可
+	// 倘若 a 为空，则返回空 key 即可. 空 key 小于任何非空的 b，且不存在末位 byte 下溢的问题
 	if len(a) == 0 {
-		sepatator := make([]byte, len(b))
-		copy(sepatator, b)
-		return append(sepatator[:len(b)-1], sepatator[len(b)-1]-1)
+		return []byte{}
 	}
 
 	// 返回 a 即可
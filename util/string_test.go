@@ -13,7 +13,9 @@ func Test_SharedPrefixLen(t *testing.T) {
 }
 
 func Test_GetSeparatorBetween(t *testing.T) {
-	assert.Equal(t, GetSeparatorBetween(nil, []byte("b")), []byte("a"))
+	assert.Equal(t, GetSeparatorBetween(nil, []byte("b")), []byte{})
+	assert.Equal(t, GetSeparatorBetween(nil, []byte{0}), []byte{})
+	assert.Equal(t, GetSeparatorBetween([]byte{}, []byte{0, 0}), []byte{})
 	assert.Equal(t, GetSeparatorBetween([]byte("abcd"), []byte("abcde")), []byte("abcd"))
 	assert.Equal(t, GetSeparatorBetween([]byte("abcd"), []byte("abce")), []byte("abcd"))
 }
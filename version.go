@@ -0,0 +1,223 @@
+package golsm
+
+import "sync"
+
+// lsm tree 某一时刻各层节点的快照. 持有快照期间，其中的节点不会被销毁
+type version struct {
+	nodes [][]*Node
+}
+
+// 获取当前各层节点的快照，并为其中的节点添加引用. 使用完毕后需要调用 unref 释放
+func (cf *ColumnFamily) refVersion() *version {
+	v := version{
+		nodes: make([][]*Node, len(cf.nodes)),
+	}
+
+	// 同时持有所有 level 层的读锁，保证快照不会落在一次 compact 流程的中间状态
+	for level := 0; level < len(cf.nodes); level++ {
+		cf.levelLocks[level].RLock()
+	}
+	for level := 0; level < len(cf.nodes); level++ {
+		v.nodes[level] = make([]*Node, len(cf.nodes[level]))
+		copy(v.nodes[level], cf.nodes[level])
+		for _, node := range v.nodes[level] {
+			node.Ref()
+		}
+	}
+	for level := len(cf.nodes) - 1; level >= 0; level-- {
+		cf.levelLocks[level].RUnlock()
+	}
+
+	return &v
+}
+
+// 释放快照对节点的引用
+func (v *version) unref() {
+	for _, nodes := range v.nodes {
+		for _, node := range nodes {
+			node.Unref()
+		}
+	}
+}
+
+// 由新到旧读取 sstable 中 key 对应的记录，交由 collect 处理. collect 返回 true 时终止流程
+func (v *version) get(key []byte, collect func(e *entry) (bool, error)) (bool, error) {
+	// 1 读 sstable level0 层. 按照 index 倒序遍历，因为 index 越大，数据越晚写入，实时性越强
+	for i := len(v.nodes[0]) - 1; i >= 0; i-- {
+		if done, err := getFromNode(v.nodes[0][i], key, collect); done || err != nil {
+			return done, err
+		}
+	}
+
+	// 2 依次读 sstable level 1 ~ i 层，每层只需要和 key 范围覆盖了 key 的 sstable 交互. 因为这些 level 层中的 sstable 都是无重复数据且全局有序的
+	for level := 1; level < len(v.nodes); level++ {
+		for _, node := range levelBinarySearch(v.nodes[level], key) {
+			if done, err := getFromNode(node, key, collect); done || err != nil {
+				return done, err
+			}
+		}
+	}
+
+	// 3 至此没有读到完整的数据记录
+	return false, nil
+}
+
+// 由新到旧查找包含 key 对应记录的首个节点，key 被节点中的范围删除标记覆盖也视为包含. 不存在时返回 nil
+func (v *version) latestNode(key []byte) (*Node, error) {
+	var nodes []*Node
+	for i := len(v.nodes[0]) - 1; i >= 0; i-- {
+		nodes = append(nodes, v.nodes[0][i])
+	}
+	for level := 1; level < len(v.nodes); level++ {
+		nodes = append(nodes, levelBinarySearch(v.nodes[level], key)...)
+	}
+
+	for _, node := range nodes {
+		_, ok, err := node.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		if ok || node.rangeDeleted(key) {
+			return node, nil
+		}
+	}
+	return nil, nil
+}
+
+// 读取 node 中 key 对应的记录，交由 collect 处理. key 被范围删除标记覆盖时，视为读到一笔删除标记
+func getFromNode(node *Node, key []byte, collect func(e *entry) (bool, error)) (bool, error) {
+	raw, ok, err := node.Get(key)
+	if err != nil {
+		return false, err
+	}
+	if ok {
+		e, err := decodeEntry(raw)
+		if err != nil {
+			return false, err
+		}
+		if done, err := collect(e); done || err != nil {
+			return done, err
+		}
+	}
+
+	if node.rangeDeleted(key) {
+		return collect(newDeleteEntry())
+	}
+	return false, nil
+}
+
+// 批量读取中单个 key 的查找状态
+type multiGetLookup struct {
+	key     []byte
+	entries []*entry // 由新到旧收集到的数据记录
+	done    bool     // 是否已经收集到完整的记录
+}
+
+func (l *multiGetLookup) collect(e *entry) (bool, error) {
+	l.entries = append(l.entries, e)
+	l.done = e.complete()
+	return l.done, nil
+}
+
+// 由新到旧批量读取 sstable 中一组由小到大排列的 key 对应的记录
+func (v *version) multiGet(lookups []*multiGetLookup) error {
+	// 1 读 sstable level0 层. 节点之间可能存在重叠，按照 index 倒序依次读取
+	for i := len(v.nodes[0]) - 1; i >= 0; i-- {
+		if lookups = pendingLookups(lookups); len(lookups) == 0 {
+			return nil
+		}
+		if err := multiGetFromNodes([]*Node{v.nodes[0][i]}, [][]*multiGetLookup{lookups}); err != nil {
+			return err
+		}
+	}
+
+	// 2 依次读 sstable level 1 ~ i 层. 同一层中的节点互不重叠，将 key 按照节点分组后并行读取
+	for level := 1; level < len(v.nodes); level++ {
+		if lookups = pendingLookups(lookups); len(lookups) == 0 {
+			return nil
+		}
+
+		var (
+			nodes  []*Node
+			groups [][]*multiGetLookup
+		)
+		nodeToGroup := make(map[*Node]int)
+		for _, lookup := range lookups {
+			for _, node := range levelBinarySearch(v.nodes[level], lookup.key) {
+				g, ok := nodeToGroup[node]
+				if !ok {
+					g = len(nodes)
+					nodeToGroup[node] = g
+					nodes, groups = append(nodes, node), append(groups, nil)
+				}
+				groups[g] = append(groups[g], lookup)
+			}
+		}
+		if err := multiGetFromNodes(nodes, groups); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// 并行地从各个节点中读取对应分组的 key，再按照节点顺序依次收集结果
+func multiGetFromNodes(nodes []*Node, groups [][]*multiGetLookup) error {
+	type result struct {
+		values [][]byte
+		oks    []bool
+		err    error
+	}
+	results := make([]result, len(nodes))
+
+	var wg sync.WaitGroup
+	for i, node := range nodes {
+		keys := make([][]byte, 0, len(groups[i]))
+		for _, lookup := range groups[i] {
+			keys = append(keys, lookup.key)
+		}
+		wg.Add(1)
+		go func(i int, node *Node) {
+			defer wg.Done()
+			r := &results[i]
+			r.values, r.oks, r.err = node.MultiGet(keys)
+		}(i, node)
+	}
+	wg.Wait()
+
+	for i, node := range nodes {
+		if results[i].err != nil {
+			return results[i].err
+		}
+		for j, lookup := range groups[i] {
+			if lookup.done {
+				continue
+			}
+			// key 被范围删除标记覆盖时，视为读到一笔删除标记
+			if results[i].oks[j] {
+				e, err := decodeEntry(results[i].values[j])
+				if err != nil {
+					return err
+				}
+				if done, _ := lookup.collect(e); done {
+					continue
+				}
+			}
+			if node.rangeDeleted(lookup.key) {
+				_, _ = lookup.collect(newDeleteEntry())
+			}
+		}
+	}
+	return nil
+}
+
+// 尚未收集到完整记录的 key
+func pendingLookups(lookups []*multiGetLookup) []*multiGetLookup {
+	pending := lookups[:0:0]
+	for _, lookup := range lookups {
+		if !lookup.done {
+			pending = append(pending, lookup)
+		}
+	}
+	return pending
+}
@@ -0,0 +1,93 @@
+// vfs 对 lsm tree 使用到的文件系统操作进行抽象. 默认基于操作系统的文件系统实现，
+// 也可以替换为内存文件系统，或者基于加密、远端存储等自定义的实现
+package vfs
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// 对文件加锁时，文件已经被其他持有者锁定
+var ErrLocked = errors.New("file is locked")
+
+// 打开的文件句柄
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.WriterAt
+	io.Seeker
+	io.Closer
+	// 将已经写入的内容持久化. 调用成功之前写入的数据在崩溃后可能丢失
+	Sync() error
+	Truncate(size int64) error
+	Stat() (os.FileInfo, error)
+}
+
+// 文件系统. 文件不存在时返回的错误需要能够被 os.IsNotExist 识别
+type FS interface {
+	// 以读写模式创建文件. 文件已经存在时将其清空
+	Create(name string) (File, error)
+	// 以只读模式打开已经存在的文件
+	Open(name string) (File, error)
+	// 以读写模式打开已经存在的文件
+	OpenReadWrite(name string) (File, error)
+	// 以追加写的模式打开文件，文件不存在时进行创建
+	OpenAppend(name string) (File, error)
+	// 重命名文件或者目录. newname 为已经存在的文件时将其替换
+	Rename(oldname, newname string) error
+	// 为文件创建硬链接
+	Link(oldname, newname string) error
+	// 删除文件或者空目录
+	Remove(name string) error
+	// 删除文件或者目录及其中的全部内容. 不存在时返回 nil
+	RemoveAll(name string) error
+	Stat(name string) (os.FileInfo, error)
+	// 获取目录下全部文件以及子目录的名称，由小到大排列
+	List(dir string) ([]string, error)
+	// 创建目录及其缺失的上级目录
+	MkdirAll(dir string) error
+	// 对文件加排他锁，文件不存在时进行创建. 已经被锁定时返回 ErrLocked. 通过返回值的 Close 方法释放锁
+	Lock(name string) (io.Closer, error)
+	// 两个文件信息是否对应同一个文件
+	SameFile(a, b os.FileInfo) bool
+}
+
+// 支持持久化目录的文件系统. 目录中文件的创建、删除以及重命名在持久化目录之后才能保证崩溃后不丢失
+type DirSyncer interface {
+	SyncDir(dir string) error
+}
+
+// 持久化目录. 文件系统没有实现 DirSyncer 时视为无需持久化目录
+func SyncDir(fs FS, dir string) error {
+	if s, ok := fs.(DirSyncer); ok {
+		return s.SyncDir(dir)
+	}
+	return nil
+}
+
+// 读取文件的全部内容
+func ReadFile(fs FS, name string) ([]byte, error) {
+	f, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// 将 data 写入文件，文件已经存在时将其覆盖. 返回之前完成持久化
+func WriteFile(fs FS, name string, data []byte) error {
+	f, err := fs.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
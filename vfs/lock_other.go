@@ -0,0 +1,14 @@
+//go:build !unix
+
+package vfs
+
+import "os"
+
+// 非 unix 平台不支持 flock，不提供跨进程的互斥保护
+func tryLockFile(f *os.File) (bool, error) {
+	return true, nil
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,446 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// 内存文件系统. 全部内容存放在内存中，不涉及磁盘读写，进程退出后丢失
+type memFS struct {
+	mu    sync.Mutex
+	files map[string]*memNode // 文件路径 -> 文件内容. 硬链接的多个路径指向同一个 memNode
+	dirs  map[string]struct{} // 全部目录
+	locks map[string]struct{} // 已经被锁定的文件
+}
+
+// 构造一个空的内存文件系统
+func NewMem() FS {
+	return &memFS{
+		files: make(map[string]*memNode),
+		dirs:  make(map[string]struct{}),
+		locks: make(map[string]struct{}),
+	}
+}
+
+// 一个文件的内容
+type memNode struct {
+	mu      sync.RWMutex
+	data    []byte
+	modTime time.Time
+}
+
+// 根目录以及当前目录总是存在. 调用方需要持有 mu
+func (fs *memFS) isDirLocked(dir string) bool {
+	if dir == "." || dir == "/" {
+		return true
+	}
+	_, ok := fs.dirs[dir]
+	return ok
+}
+
+func (fs *memFS) openFile(op, name string, create, trunc, read, write, append bool) (File, error) {
+	name = path.Clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	node, ok := fs.files[name]
+	switch {
+	case !ok && fs.isDirLocked(name):
+		return nil, &os.PathError{Op: op, Path: name, Err: syscall.EISDIR}
+	case !ok && (!create || !fs.isDirLocked(path.Dir(name))):
+		return nil, &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	case !ok:
+		node = &memNode{modTime: time.Now()}
+		fs.files[name] = node
+	case trunc:
+		node.mu.Lock()
+		node.data, node.modTime = nil, time.Now()
+		node.mu.Unlock()
+	}
+	return &memFile{name: name, node: node, read: read, write: write, append: append}, nil
+}
+
+func (fs *memFS) Create(name string) (File, error) {
+	return fs.openFile("create", name, true, true, true, true, false)
+}
+
+func (fs *memFS) Open(name string) (File, error) {
+	return fs.openFile("open", name, false, false, true, false, false)
+}
+
+func (fs *memFS) OpenReadWrite(name string) (File, error) {
+	return fs.openFile("open", name, false, false, true, true, false)
+}
+
+func (fs *memFS) OpenAppend(name string) (File, error) {
+	return fs.openFile("open", name, true, false, false, true, true)
+}
+
+func (fs *memFS) Rename(oldname, newname string) error {
+	oldname, newname = path.Clean(oldname), path.Clean(newname)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if !fs.isDirLocked(path.Dir(newname)) {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+	if node, ok := fs.files[oldname]; ok {
+		if fs.isDirLocked(newname) {
+			return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: syscall.EISDIR}
+		}
+		delete(fs.files, oldname)
+		fs.files[newname] = node
+		return nil
+	}
+	if _, ok := fs.dirs[oldname]; !ok {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+	if _, ok := fs.files[newname]; ok || fs.isDirLocked(newname) {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: os.ErrExist}
+	}
+
+	// 目录下的全部文件以及子目录随之移动
+	prefix := oldname + "/"
+	for name, node := range fs.files {
+		if strings.HasPrefix(name, prefix) {
+			delete(fs.files, name)
+			fs.files[newname+"/"+strings.TrimPrefix(name, prefix)] = node
+		}
+	}
+	for dir := range fs.dirs {
+		if strings.HasPrefix(dir, prefix) {
+			delete(fs.dirs, dir)
+			fs.dirs[newname+"/"+strings.TrimPrefix(dir, prefix)] = struct{}{}
+		}
+	}
+	delete(fs.dirs, oldname)
+	fs.dirs[newname] = struct{}{}
+	return nil
+}
+
+func (fs *memFS) Link(oldname, newname string) error {
+	oldname, newname = path.Clean(oldname), path.Clean(newname)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	node, ok := fs.files[oldname]
+	if !ok || !fs.isDirLocked(path.Dir(newname)) {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+	if _, ok = fs.files[newname]; ok || fs.isDirLocked(newname) {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: os.ErrExist}
+	}
+	fs.files[newname] = node
+	return nil
+}
+
+func (fs *memFS) Remove(name string) error {
+	name = path.Clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if _, ok := fs.files[name]; ok {
+		delete(fs.files, name)
+		return nil
+	}
+	if _, ok := fs.dirs[name]; !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	if len(fs.listLocked(name)) > 0 {
+		return &os.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+	}
+	delete(fs.dirs, name)
+	return nil
+}
+
+func (fs *memFS) RemoveAll(name string) error {
+	name = path.Clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	prefix := name + "/"
+	for file := range fs.files {
+		if file == name || strings.HasPrefix(file, prefix) {
+			delete(fs.files, file)
+		}
+	}
+	for dir := range fs.dirs {
+		if dir == name || strings.HasPrefix(dir, prefix) {
+			delete(fs.dirs, dir)
+		}
+	}
+	return nil
+}
+
+func (fs *memFS) Stat(name string) (os.FileInfo, error) {
+	name = path.Clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if node, ok := fs.files[name]; ok {
+		return node.stat(name), nil
+	}
+	if fs.isDirLocked(name) {
+		return &memFileInfo{name: path.Base(name), isDir: true}, nil
+	}
+	return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+}
+
+func (fs *memFS) List(dir string) ([]string, error) {
+	dir = path.Clean(dir)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if !fs.isDirLocked(dir) {
+		return nil, &os.PathError{Op: "open", Path: dir, Err: os.ErrNotExist}
+	}
+	return fs.listLocked(dir), nil
+}
+
+// 获取目录下直接包含的文件以及子目录. 调用方需要持有 mu
+func (fs *memFS) listLocked(dir string) []string {
+	var names []string
+	for name := range fs.files {
+		if path.Dir(name) == dir {
+			names = append(names, path.Base(name))
+		}
+	}
+	for name := range fs.dirs {
+		if name != dir && path.Dir(name) == dir {
+			names = append(names, path.Base(name))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (fs *memFS) MkdirAll(dir string) error {
+	dir = path.Clean(dir)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for d := dir; !fs.isDirLocked(d); d = path.Dir(d) {
+		if _, ok := fs.files[d]; ok {
+			return &os.PathError{Op: "mkdir", Path: d, Err: syscall.ENOTDIR}
+		}
+		fs.dirs[d] = struct{}{}
+	}
+	return nil
+}
+
+func (fs *memFS) Lock(name string) (io.Closer, error) {
+	f, err := fs.OpenAppend(name)
+	if err != nil {
+		return nil, err
+	}
+	_ = f.Close()
+
+	name = path.Clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if _, ok := fs.locks[name]; ok {
+		return nil, ErrLocked
+	}
+	fs.locks[name] = struct{}{}
+	return &memLock{fs: fs, name: name}, nil
+}
+
+func (fs *memFS) SameFile(a, b os.FileInfo) bool {
+	ia, ok := a.(*memFileInfo)
+	if !ok {
+		return false
+	}
+	ib, ok := b.(*memFileInfo)
+	return ok && ia.node != nil && ia.node == ib.node
+}
+
+type memLock struct {
+	fs   *memFS
+	name string
+}
+
+func (l *memLock) Close() error {
+	l.fs.mu.Lock()
+	defer l.fs.mu.Unlock()
+	delete(l.fs.locks, l.name)
+	return nil
+}
+
+func (n *memNode) stat(name string) *memFileInfo {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return &memFileInfo{name: path.Base(name), size: int64(len(n.data)), modTime: n.modTime, node: n}
+}
+
+// 内存文件的句柄. 文件偏移量不支持并发读写，ReadAt 以及 WriteAt 可以并发调用
+type memFile struct {
+	name   string
+	node   *memNode
+	pos    int64
+	read   bool
+	write  bool
+	append bool
+	closed atomic.Bool
+}
+
+func (f *memFile) check(op string, allowed bool) error {
+	if f.closed.Load() {
+		return &os.PathError{Op: op, Path: f.name, Err: os.ErrClosed}
+	}
+	if !allowed {
+		return &os.PathError{Op: op, Path: f.name, Err: syscall.EBADF}
+	}
+	return nil
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.pos)
+	f.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.check("read", f.read); err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: syscall.EINVAL}
+	}
+	f.node.mu.RLock()
+	defer f.node.mu.RUnlock()
+	if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	if err := f.check("write", f.write); err != nil {
+		return 0, err
+	}
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+	if f.append {
+		f.pos = int64(len(f.node.data))
+	}
+	f.node.writeAt(p, f.pos)
+	f.pos += int64(len(p))
+	return len(p), nil
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	if err := f.check("write", f.write); err != nil {
+		return 0, err
+	}
+	if f.append {
+		return 0, errors.New("vfs: invalid use of WriteAt on file opened for append")
+	}
+	if off < 0 {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: syscall.EINVAL}
+	}
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+	f.node.writeAt(p, off)
+	return len(p), nil
+}
+
+// 调用方需要持有 mu 写锁
+func (n *memNode) writeAt(p []byte, off int64) {
+	if end := off + int64(len(p)); end > int64(len(n.data)) {
+		n.data = append(n.data, make([]byte, end-int64(len(n.data)))...)
+	}
+	copy(n.data[off:], p)
+	n.modTime = time.Now()
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	if err := f.check("seek", true); err != nil {
+		return 0, err
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		f.node.mu.RLock()
+		offset += int64(len(f.node.data))
+		f.node.mu.RUnlock()
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: syscall.EINVAL}
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	if err := f.check("truncate", f.write); err != nil {
+		return err
+	}
+	if size < 0 {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: syscall.EINVAL}
+	}
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+	if size <= int64(len(f.node.data)) {
+		f.node.data = f.node.data[:size]
+	} else {
+		f.node.data = append(f.node.data, make([]byte, size-int64(len(f.node.data)))...)
+	}
+	f.node.modTime = time.Now()
+	return nil
+}
+
+// 内存文件无需持久化
+func (f *memFile) Sync() error {
+	return f.check("sync", true)
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	if err := f.check("stat", true); err != nil {
+		return nil, err
+	}
+	return f.node.stat(f.name), nil
+}
+
+func (f *memFile) Close() error {
+	if f.closed.Swap(true) {
+		return &os.PathError{Op: "close", Path: f.name, Err: os.ErrClosed}
+	}
+	return nil
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	isDir   bool
+	node    *memNode
+}
+
+func (i *memFileInfo) Name() string       { return i.name }
+func (i *memFileInfo) Size() int64        { return i.size }
+func (i *memFileInfo) ModTime() time.Time { return i.modTime }
+func (i *memFileInfo) IsDir() bool        { return i.isDir }
+func (i *memFileInfo) Sys() interface{}   { return i.node }
+
+func (i *memFileInfo) Mode() os.FileMode {
+	if i.isDir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
@@ -0,0 +1,87 @@
+package vfs
+
+import (
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_MemFS(t *testing.T) {
+	fs := NewMem()
+
+	// 1 上级目录不存在时无法创建文件
+	_, err := fs.Create("db/a")
+	assert.True(t, os.IsNotExist(err))
+	assert.Nil(t, fs.MkdirAll("db/sub"))
+
+	// 2 读写文件
+	assert.Nil(t, WriteFile(fs, "db/a", []byte("hello")))
+	f, err := fs.OpenAppend("db/a")
+	assert.Nil(t, err)
+	_, err = f.Write([]byte(" world"))
+	assert.Nil(t, err)
+	_, err = f.WriteAt([]byte("x"), 0)
+	assert.NotNil(t, err)
+	assert.Nil(t, f.Close())
+	raw, err := ReadFile(fs, "db/a")
+	assert.Nil(t, err)
+	assert.Equal(t, "hello world", string(raw))
+
+	f, err = fs.Open("db/a")
+	assert.Nil(t, err)
+	buf := make([]byte, 5)
+	_, err = f.ReadAt(buf, 6)
+	assert.Nil(t, err)
+	assert.Equal(t, "world", string(buf))
+	_, err = f.ReadAt(buf, 8)
+	assert.Equal(t, io.EOF, err)
+	_, err = f.Write([]byte("x"))
+	assert.NotNil(t, err)
+	pos, err := f.Seek(-5, io.SeekEnd)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(6), pos)
+	raw, err = io.ReadAll(f)
+	assert.Nil(t, err)
+	assert.Equal(t, "world", string(raw))
+
+	// 3 硬链接指向同一个文件，删除原文件后打开的句柄以及链接仍然可读
+	assert.Nil(t, fs.Link("db/a", "db/sub/b"))
+	info, err := f.Stat()
+	assert.Nil(t, err)
+	linked, err := fs.Stat("db/sub/b")
+	assert.Nil(t, err)
+	assert.True(t, fs.SameFile(info, linked))
+	assert.Nil(t, fs.Remove("db/a"))
+	_, err = f.ReadAt(buf, 0)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+	assert.NotNil(t, f.Close())
+	_, err = fs.Open("db/a")
+	assert.True(t, os.IsNotExist(err))
+
+	// 4 非空目录无法直接删除，重命名目录时其中的文件随之移动
+	assert.NotNil(t, fs.Remove("db/sub"))
+	assert.Nil(t, fs.Rename("db/sub", "db/moved"))
+	names, err := fs.List("db")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"moved"}, names)
+	raw, err = ReadFile(fs, "db/moved/b")
+	assert.Nil(t, err)
+	assert.Equal(t, "hello world", string(raw))
+	assert.Nil(t, fs.RemoveAll("db/moved"))
+	names, err = fs.List("db")
+	assert.Nil(t, err)
+	assert.Empty(t, names)
+
+	// 5 文件锁释放之前无法再次加锁
+	l, err := fs.Lock("db/LOCK")
+	assert.Nil(t, err)
+	_, err = fs.Lock("db/LOCK")
+	assert.Equal(t, ErrLocked, err)
+	assert.Nil(t, l.Close())
+	l, err = fs.Lock("db/LOCK")
+	assert.Nil(t, err)
+	assert.Nil(t, l.Close())
+}
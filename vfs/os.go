@@ -0,0 +1,108 @@
+package vfs
+
+import (
+	"io"
+	"os"
+)
+
+// 基于操作系统文件系统的实现
+var Default FS = osFS{}
+
+type osFS struct{}
+
+func (osFS) Create(name string) (File, error) {
+	return openOSFile(name, os.O_CREATE|os.O_TRUNC|os.O_RDWR)
+}
+
+func (osFS) Open(name string) (File, error) {
+	return openOSFile(name, os.O_RDONLY)
+}
+
+func (osFS) OpenReadWrite(name string) (File, error) {
+	return openOSFile(name, os.O_RDWR)
+}
+
+func (osFS) OpenAppend(name string) (File, error) {
+	return openOSFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND)
+}
+
+// 返回值为 nil 时不能直接转换为 File 接口，否则得到的接口不为 nil
+func openOSFile(name string, flag int) (File, error) {
+	f, err := os.OpenFile(name, flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFS) Rename(oldname, newname string) error {
+	return os.Rename(oldname, newname)
+}
+
+func (osFS) Link(oldname, newname string) error {
+	return os.Link(oldname, newname)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) RemoveAll(name string) error {
+	return os.RemoveAll(name)
+}
+
+func (osFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) List(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names, nil
+}
+
+func (osFS) MkdirAll(dir string) error {
+	return os.MkdirAll(dir, os.ModePerm)
+}
+
+func (osFS) Lock(name string) (io.Closer, error) {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	locked, err := tryLockFile(f)
+	if err != nil || !locked {
+		_ = f.Close()
+		if err == nil {
+			err = ErrLocked
+		}
+		return nil, err
+	}
+	return &osLock{f: f}, nil
+}
+
+func (osFS) SyncDir(dir string) error {
+	return syncDir(dir)
+}
+
+func (osFS) SameFile(a, b os.FileInfo) bool {
+	return os.SameFile(a, b)
+}
+
+type osLock struct {
+	f *os.File
+}
+
+func (l *osLock) Close() error {
+	err := unlockFile(l.f)
+	if closeErr := l.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
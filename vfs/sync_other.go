@@ -0,0 +1,8 @@
+//go:build !unix
+
+package vfs
+
+// 非 unix 平台无法对目录执行 fsync，目录项的变更由文件系统自行保证
+func syncDir(dir string) error {
+	return nil
+}
@@ -0,0 +1,18 @@
+//go:build unix
+
+package vfs
+
+import "os"
+
+// 持久化目录中文件的创建、删除以及重命名
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -6,22 +6,22 @@ import (
 	"encoding/binary"
 	"errors"
 	"io"
-	"os"
 
 	"github.com/xiaoxuxiansheng/golsm/memtable"
+	"github.com/xiaoxuxiansheng/golsm/vfs"
 )
 
 // wal 文件读取器
 type WALReader struct {
 	file   string        // 预写日志文件名，是包含了目录在内的绝对路径
-	src    *os.File      // 预写日志文件
+	src    vfs.File      // 预写日志文件
 	reader *bufio.Reader // 基于 bufio reader 对日志文件的封装
 }
 
 // 构造器函数.
-func NewWALReader(file string) (*WALReader, error) {
+func NewWALReader(fs vfs.FS, file string) (*WALReader, error) {
 	// 以只读模式打开 wal 文件，要求目标文件必须存在
-	src, err := os.OpenFile(file, os.O_RDONLY, 0644)
+	src, err := fs.Open(file)
 	if err != nil {
 		return nil, err
 	}
@@ -47,7 +47,7 @@ func (w *WALReader) RestoreToMemtable(memTable memtable.MemTable) error {
 	}()
 
 	// 将文件中读取到的内容解析成一系列 kv 对
-	kvs, err := w.readAll(bytes.NewReader(body))
+	kvs, _, err := w.readAll(bytes.NewReader(body))
 	if err != nil {
 		return err
 	}
@@ -60,46 +60,91 @@ func (w *WALReader) RestoreToMemtable(memTable memtable.MemTable) error {
 	return nil
 }
 
-// 将文件中读到的原始内容解析成一系列 kv 对数据
-func (w *WALReader) readAll(reader *bytes.Reader) ([]*memtable.KV, error) {
+// 读取 wal 文件中的全部 kv 对，按照写入顺序排列. 最后一条记录不完整时返回 io.ErrUnexpectedEOF
+func (w *WALReader) ReadAll() ([]*memtable.KV, error) {
+	kvs, _, err := w.read()
+	if err != nil {
+		return nil, err
+	}
+	return kvs, nil
+}
+
+// 读取 wal 文件中全部完整的 kv 对，同时返回这部分记录的总长度. 进程崩溃时最后一条记录可能只写入了一部分，
+// 此时忽略这条不完整的记录，调用方可以据此截断文件，避免之后追加的记录无法被读取
+func (w *WALReader) ReadAllComplete() ([]*memtable.KV, int64, error) {
+	kvs, size, err := w.read()
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		err = nil
+	}
+	return kvs, size, err
+}
+
+func (w *WALReader) read() ([]*memtable.KV, int64, error) {
+	// 读取 wal 文件全量内容
+	body, err := io.ReadAll(w.reader)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// 兜底保证文件偏移量被重置到起始位置
+	defer func() {
+		_, _ = w.src.Seek(0, io.SeekStart)
+		w.reader.Reset(w.src)
+	}()
+
+	return w.readAll(bytes.NewReader(body))
+}
+
+// 将文件中读到的原始内容解析成一系列 kv 对数据，同时返回完整记录的总长度
+func (w *WALReader) readAll(reader *bytes.Reader) ([]*memtable.KV, int64, error) {
 	var kvs []*memtable.KV
+	var size int64
 	// 循环读取每组 kv 对，直到遇到 eof 错误才终止流程
 	for {
 		// 从 reader 中读取首个 uint64 作为 key 长度
 		keyLen, err := binary.ReadUvarint(reader)
 		// 如果遇到 eof 错误说明文件内容已经读取完毕，终止流程
-		if errors.Is(err, io.EOF) {
+		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			return nil, err
+			return kvs, size, err
 		}
 
-		// 从 reader 中读取下一个 uint64 作为 val 长度
+		// 从 reader 中读取下一个 uint64 作为 val 长度. 记录中途遇到 eof 说明最后一条记录不完整
 		valLen, err := binary.ReadUvarint(reader)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
 		if err != nil {
-			return nil, err
+			return kvs, size, err
+		}
+
+		// 记录长度超过剩余内容时同样说明记录不完整，避免按照错误的长度分配内存
+		if remain := uint64(reader.Len()); keyLen > remain || valLen > remain-keyLen {
+			return kvs, size, io.ErrUnexpectedEOF
 		}
 
 		// 从 reader 中读取对应于 key 长度的字节数作为 key
 		keyBuf := make([]byte, keyLen)
 		if _, err = io.ReadFull(reader, keyBuf); err != nil {
-			return nil, err
+			return kvs, size, err
 		}
 
 		// 从 reader 中读取对应于 val 长度的字节数作为 val
 		valBuf := make([]byte, valLen)
 		if _, err = io.ReadFull(reader, valBuf); err != nil {
-			return nil, err
+			return kvs, size, err
 		}
 
 		kvs = append(kvs, &memtable.KV{
 			Key:   keyBuf,
 			Value: valBuf,
 		})
+		size = reader.Size() - int64(reader.Len())
 	}
 
-	return kvs, nil
+	return kvs, size, nil
 }
 
 func (w *WALReader) Close() {
@@ -2,13 +2,16 @@ package wal
 
 import (
 	"bytes"
+	"errors"
+	"io"
 	"testing"
 
 	"github.com/xiaoxuxiansheng/golsm/memtable"
+	"github.com/xiaoxuxiansheng/golsm/vfs"
 )
 
 func Test_WAL(t *testing.T) {
-	walWriter, err := NewWALWriter("./test.wal")
+	walWriter, err := NewWALWriter(vfs.Default, "./test.wal")
 	if err != nil {
 		t.Error(err)
 		return
@@ -33,7 +36,7 @@ func Test_WAL(t *testing.T) {
 		}
 	}
 
-	walReader, err := NewWALReader("./test.wal")
+	walReader, err := NewWALReader(vfs.Default, "./test.wal")
 	if err != nil {
 		t.Error(err)
 		return
@@ -60,3 +63,58 @@ func Test_WAL(t *testing.T) {
 		}
 	}
 }
+
+func Test_WAL_ReadAllComplete(t *testing.T) {
+	fs := vfs.NewMem()
+	walWriter, err := NewWALWriter(fs, "test.wal")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	var sizes []int64
+	for i := 0; i < 3; i++ {
+		if err = walWriter.Write([]byte{'a' + uint8(i)}, bytes.Repeat([]byte{'b'}, 10)); err != nil {
+			t.Error(err)
+			return
+		}
+		info, _ := fs.Stat("test.wal")
+		sizes = append(sizes, info.Size())
+	}
+	walWriter.Close()
+
+	// 模拟崩溃时最后一条记录只写入了一部分
+	f, err := fs.OpenReadWrite("test.wal")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	_ = f.Truncate(sizes[2] - 2)
+	f.Close()
+
+	walReader, err := NewWALReader(fs, "test.wal")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer walReader.Close()
+	if _, err = walReader.ReadAll(); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("expect: %v, got: %v", io.ErrUnexpectedEOF, err)
+		return
+	}
+
+	// 不完整的记录被忽略，返回的长度只包含完整的记录
+	kvs, size, err := walReader.ReadAllComplete()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(kvs) != 2 || size != sizes[1] {
+		t.Errorf("got: %d kvs, size %d, expect: 2 kvs, size %d", len(kvs), size, sizes[1])
+		return
+	}
+	for i, kv := range kvs {
+		if !bytes.Equal(kv.Key, []byte{'a' + uint8(i)}) {
+			t.Errorf("index: %d, got key: %s", i, kv.Key)
+		}
+	}
+}
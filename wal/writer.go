@@ -2,20 +2,21 @@ package wal
 
 import (
 	"encoding/binary"
-	"os"
+
+	"github.com/xiaoxuxiansheng/golsm/vfs"
 )
 
 // 预写日志写入口
 type WALWriter struct {
 	file         string   // 预写日志文件名，是包含了目录在内的绝对路径
-	dest         *os.File // 预写日志文件
+	dest         vfs.File // 预写日志文件
 	assistBuffer [30]byte // 辅助转移数据使用的临时缓冲区
 }
 
 // 构造器
-func NewWALWriter(file string) (*WALWriter, error) {
-	// 打开 wal 文件，如果文件不存在则进行创建
-	dest, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY, 0644)
+func NewWALWriter(fs vfs.FS, file string) (*WALWriter, error) {
+	// 打开 wal 文件，如果文件不存在则进行创建. 重启后会复用最后一个 wal 文件，需要以追加的方式写入，避免覆盖已有的记录
+	dest, err := fs.OpenAppend(file)
 	if err != nil {
 		return nil, err
 	}
@@ -42,6 +43,11 @@ func (w *WALWriter) Write(key, value []byte) error {
 	return err
 }
 
-func (w *WALWriter) Close() {
-	_ = w.dest.Close()
+// 将已经写入的记录持久化
+func (w *WALWriter) Sync() error {
+	return w.dest.Sync()
+}
+
+func (w *WALWriter) Close() error {
+	return w.dest.Close()
 }
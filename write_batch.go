@@ -0,0 +1,142 @@
+package golsm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+)
+
+// 批量写入中的一笔操作
+type batchRecord struct {
+	cf  *ColumnFamily
+	key []byte
+	e   *entry
+	ttl time.Duration // 存活时间. 过期时间在写入时基于列族的时钟确定
+}
+
+// 批量写入. 其中的操作可以跨越多个列族，写入时作为一笔预写日志记录整体落盘，保证原子性
+type WriteBatch struct {
+	records []*batchRecord
+	err     error // 构造过程中遇到的首个错误，在写入时返回
+}
+
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{}
+}
+
+// 向列族写入一组 kv 对
+func (b *WriteBatch) Put(cf *ColumnFamily, key, value []byte) {
+	b.append(cf, key, newValueEntry(value))
+}
+
+// 向列族写入一组带有存活时间的 kv 对
+func (b *WriteBatch) PutWithTTL(cf *ColumnFamily, key, value []byte, ttl time.Duration) {
+	if ttl <= 0 {
+		b.setErr(ErrInvalidTTL)
+		return
+	}
+	b.append(cf, key, newValueEntry(value))
+	b.records[len(b.records)-1].ttl = ttl
+}
+
+// 删除列族中的一个 key
+func (b *WriteBatch) Delete(cf *ColumnFamily, key []byte) {
+	b.append(cf, key, newDeleteEntry())
+}
+
+// 删除列族中 [start, end) 范围内的所有 key
+func (b *WriteBatch) DeleteRange(cf *ColumnFamily, start, end []byte) {
+	if bytes.Compare(start, end) >= 0 {
+		b.setErr(ErrInvalidRange)
+		return
+	}
+	b.append(cf, start, newRangeDeleteEntry(end))
+}
+
+// 向列族写入一笔 merge 操作数
+func (b *WriteBatch) Merge(cf *ColumnFamily, key, operand []byte) {
+	if cf != nil && cf.conf.MergeOperator == nil {
+		b.setErr(ErrMergeOperatorNotSet)
+		return
+	}
+	b.append(cf, key, newMergeEntry(operand))
+}
+
+// 批量写入中的操作数量
+func (b *WriteBatch) Count() int {
+	return len(b.records)
+}
+
+// 清空批量写入，以便复用
+func (b *WriteBatch) Clear() {
+	b.records, b.err = b.records[:0], nil
+}
+
+func (b *WriteBatch) append(cf *ColumnFamily, key []byte, e *entry) {
+	b.records = append(b.records, &batchRecord{
+		cf:  cf,
+		key: key,
+		e:   e,
+	})
+}
+
+func (b *WriteBatch) setErr(err error) {
+	if b.err == nil {
+		b.err = err
+	}
+}
+
+// 将批量写入编码为一笔预写日志记录的 value
+// kind | 操作数量 | 列族名称长度 | 列族名称 | key 长度 | key | 记录长度 | 记录 | ...
+func encodeBatch(records []*batchRecord) []byte {
+	var scratch [binary.MaxVarintLen64]byte
+	buf := []byte{byte(entryKindBatch)}
+	n := binary.PutUvarint(scratch[0:], uint64(len(records)))
+	buf = append(buf, scratch[:n]...)
+	for _, record := range records {
+		for _, field := range [][]byte{[]byte(record.cf.name), record.key, encodeEntry(record.e)} {
+			n = binary.PutUvarint(scratch[0:], uint64(len(field)))
+			buf = append(buf, scratch[:n]...)
+			buf = append(buf, field...)
+		}
+	}
+	return buf
+}
+
+// 解析预写日志中的批量写入记录，依次交由 apply 处理
+func decodeBatch(raw []byte, apply func(cfName string, key []byte, e *entry) error) error {
+	if len(raw) == 0 || entryKind(raw[0]) != entryKindBatch {
+		return errInvalidEntry
+	}
+	raw = raw[1:]
+
+	cnt, n := binary.Uvarint(raw)
+	if n <= 0 {
+		return errInvalidEntry
+	}
+	raw = raw[n:]
+
+	for i := uint64(0); i < cnt; i++ {
+		var (
+			cfName, key, rawEntry []byte
+			err                   error
+		)
+		if cfName, raw, err = readLengthPrefixed(raw); err != nil {
+			return err
+		}
+		if key, raw, err = readLengthPrefixed(raw); err != nil {
+			return err
+		}
+		if rawEntry, raw, err = readLengthPrefixed(raw); err != nil {
+			return err
+		}
+		e, err := decodeEntry(rawEntry)
+		if err != nil {
+			return err
+		}
+		if err = apply(string(cfName), key, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}